@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"song-recognition/shazam"
+	"song-recognition/utils"
+	"song-recognition/wav"
+	"strings"
+	"time"
+)
+
+// requireAdmin rejects requests that don't carry
+// "Authorization: Bearer $ADMIN_TOKEN". without a configured token the
+// wrapped endpoint is disabled entirely.
+func (s *apiServer) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken == "" {
+			writeError(w, http.StatusForbidden, "admin endpoints are disabled (set ADMIN_TOKEN)")
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "invalid or missing admin token")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// reindexEvent is one line of the /api/reindex-all NDJSON progress stream.
+type reindexEvent struct {
+	SongID uint32 `json:"songId,omitempty"`
+	Title  string `json:"title,omitempty"`
+	Index  int    `json:"index,omitempty"` // 1-based position in the library
+	Total  int    `json:"total"`
+	Status string `json:"status"` // ok, skipped, failed or done
+	Before int    `json:"fingerprintsBefore,omitempty"`
+	After  int    `json:"fingerprintsAfter,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	// set on the final "done" event
+	Reindexed int `json:"reindexed,omitempty"`
+	Skipped   int `json:"skipped,omitempty"`
+	Failed    int `json:"failed,omitempty"`
+}
+
+// handleReindexAll re-fingerprints every song from its stored source file
+// under the server's current config, streaming one JSON object per song. songs
+// without a readable source file are skipped and keep their fingerprints;
+// old fingerprints are only replaced once the new ones are computed.
+func (s *apiServer) handleReindexAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !s.reindexing.CompareAndSwap(false, true) {
+		writeError(w, http.StatusConflict, "a reindex is already running")
+		return
+	}
+	defer s.reindexing.Store(false)
+
+	songs, err := s.db.GetAllSongs()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list entries")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	emit := func(ev reindexEvent) {
+		enc.Encode(ev)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	start := time.Now()
+	cfg := s.config()
+	utils.Infof("[reindex] reindexing %d songs", len(songs))
+
+	done := reindexEvent{Total: len(songs), Status: "done"}
+	for i, entry := range songs {
+		if r.Context().Err() != nil {
+			utils.Warnf("[reindex] cancelled after %d of %d songs", i, len(songs))
+			return
+		}
+
+		ev := reindexEvent{SongID: entry.ID, Title: entry.Title, Index: i + 1, Total: len(songs)}
+		ev.Before, ev.After, err = s.reindexSong(r, entry.ID, cfg)
+		switch {
+		case errors.Is(err, errNoSource), errors.Is(err, errAppendedParts):
+			ev.Status = "skipped"
+			ev.Error = err.Error()
+			done.Skipped++
+		case err != nil:
+			ev.Status = "failed"
+			ev.Error = err.Error()
+			done.Failed++
+		default:
+			ev.Status = "ok"
+			done.Reindexed++
+		}
+
+		utils.Infof("[reindex] %d/%d '%s': %s %s", ev.Index, ev.Total, entry.Title, ev.Status, ev.Error)
+		emit(ev)
+	}
+
+	utils.Infof("[reindex] done in %s: %d reindexed, %d skipped, %d failed",
+		time.Since(start), done.Reindexed, done.Skipped, done.Failed)
+	emit(done)
+}
+
+var (
+	errNoSource      = errors.New("no source file on record")
+	errAppendedParts = errors.New("has parts appended after its source file, which reindexing would drop")
+)
+
+// reindexSong replaces a song's fingerprints with ones computed from its
+// source file under the current config, returning the counts before and after.
+func (s *apiServer) reindexSong(r *http.Request, songID uint32, cfg shazam.FingerprintConfig) (int, int, error) {
+	song, exists, err := s.db.GetSongByID(songID)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !exists {
+		return 0, 0, fmt.Errorf("song no longer exists")
+	}
+	// web uploads only record the client's file name; the audio is gone
+	if song.SourcePath == "" || !filepath.IsAbs(song.SourcePath) {
+		return 0, 0, errNoSource
+	}
+	if _, err := os.Stat(song.SourcePath); err != nil {
+		return 0, 0, fmt.Errorf("source file unavailable: %v", err)
+	}
+
+	duration, err := wav.GetAudioDuration(r.Context(), song.SourcePath)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read duration: %v", err)
+	}
+	// only the first part of an entry built with `save --append` is on record
+	if song.DurationSec > duration+0.5 {
+		return 0, 0, errAppendedParts
+	}
+
+	before, _ := s.db.CountFingerprintsForSong(songID)
+
+	fingerprint, _, err := shazam.FingerprintAudioChunked(r.Context(), song.SourcePath, songID, cfg)
+	if err != nil {
+		return before, 0, fmt.Errorf("failed to fingerprint: %w", err)
+	}
+
+	// once fingerprinting is done the swap goes ahead even if the client
+	// disconnects; the replace keeps the old set if it fails
+	ctx := context.WithoutCancel(r.Context())
+	err = retryWrite(ctx, func() error {
+		return s.db.ReplaceFingerprintsForSong(songID, fingerprint)
+	})
+	if err != nil {
+		return before, 0, fmt.Errorf("failed to replace fingerprints (the old ones are kept): %w", err)
+	}
+	if err := s.db.SetSongDuration(songID, duration); err != nil {
+		return before, len(fingerprint), err
+	}
+	return before, len(fingerprint), nil
+}
+
+// config returns a copy of the fingerprint config to serve a request with.
+// the slices in it are shared and must not be modified.
+func (s *apiServer) config() shazam.FingerprintConfig {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return s.cfg
+}
+
+// handleConfig returns the fingerprint config the server is using (GET)
+// or replaces it (POST). a POST body holds FingerprintConfig fields by
+// their Go names; fields it leaves out keep their current values. the new
+// config is validated as at startup and swapped in whole: requests already
+// running finish with the old one. it isn't saved, so a restart goes back
+// to the command-line config.
+//
+// songs indexed under one config don't reliably match clips fingerprinted
+// under another, since most fields change the addresses or times that are
+// stored. after changing anything but the search-side settings, run
+// /api/reindex-all so the library agrees with the new config again.
+func (s *apiServer) handleConfig(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.config())
+		return
+	case http.MethodPost:
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	// held for the whole update so two concurrent POSTs can't each start
+	// from the same old config and lose one another's changes
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+
+	// decoding reuses a slice's backing array, which requests holding the
+	// old config may still be reading
+	cfg := s.cfg
+	cfg.FreqBands = slices.Clone(cfg.FreqBands)
+	cfg.SpeedScales = slices.Clone(cfg.SpeedScales)
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	if clamped, err := cfg.ClampToNyquist(wav.DecodeSampleRate); err != nil {
+		utils.WarnfCtx(r.Context(), "[config] %v; using %g Hz", err, clamped.MaxFreqHz)
+		cfg = clamped
+	}
+	if err := cfg.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid config: %v", err))
+		return
+	}
+	if err := cfg.CheckResolution(wav.DecodeSampleRate); err != nil {
+		utils.WarnfCtx(r.Context(), "[config] %v", err)
+	}
+	if err := cfg.CheckBands(); err != nil {
+		utils.WarnfCtx(r.Context(), "[config] %v", err)
+	}
+
+	s.cfg = cfg
+	utils.InfofCtx(r.Context(), "[config] fingerprint config replaced; songs indexed under the old one may not match until reindexed")
+	writeJSON(w, http.StatusOK, cfg)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"song-recognition/db"
+	"song-recognition/models"
+	"song-recognition/shazam"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// postConfig sends body to POST /api/config.
+func postConfig(s *apiServer, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.handleConfig(rec, httptest.NewRequest(http.MethodPost, "/api/config", strings.NewReader(body)))
+	return rec
+}
+
+func TestHandleConfig(t *testing.T) {
+	s := newTestServer(t, shazam.DefaultAudiobookConfig(), 0)
+	before := s.config()
+
+	rec := httptest.NewRecorder()
+	s.handleConfig(rec, httptest.NewRequest(http.MethodGet, "/api/config", nil))
+	var got shazam.FingerprintConfig
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || !reflect.DeepEqual(got, before) {
+		t.Fatalf("GET returned %s (%v), want the current config", rec.Body, err)
+	}
+
+	// fields left out keep their values
+	if rec := postConfig(s, `{"TargetZoneSize": 5, "FreqBands": [[0, 200], [200, 1024]]}`); rec.Code != http.StatusOK {
+		t.Fatalf("POST: %d (%s)", rec.Code, rec.Body)
+	}
+	after := s.config()
+	if after.TargetZoneSize != 5 || len(after.FreqBands) != 2 || after.WindowSize != before.WindowSize {
+		t.Errorf("config after POST: %+v", after)
+	}
+	// the copy taken before is untouched, bands included
+	if before.TargetZoneSize != 3 || !reflect.DeepEqual(before.FreqBands, shazam.DefaultAudiobookConfig().FreqBands) {
+		t.Errorf("the old config changed under its holder: %+v", before)
+	}
+
+	for name, body := range map[string]string{
+		"unknown field": `{"WindowSise": 1024}`,
+		"invalid":       `{"WindowSize": 1000}`,
+		"not JSON":      `window=1024`,
+	} {
+		if rec := postConfig(s, body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", name, rec.Code)
+		}
+	}
+	if !reflect.DeepEqual(s.config(), after) {
+		t.Error("a rejected POST changed the config")
+	}
+}
+
+// blockingClient holds the first fingerprint lookup until released.
+type blockingClient struct {
+	db.DBClient
+	once             sync.Once
+	started, release chan struct{}
+}
+
+func (c *blockingClient) GetCouplesForSongs(addresses []uint32, songIDs []uint32) (map[uint32][]models.Couple, error) {
+	c.once.Do(func() {
+		close(c.started)
+		<-c.release
+	})
+	return c.DBClient.GetCouplesForSongs(addresses, songIDs)
+}
+
+func TestConfigSwapDuringMatch(t *testing.T) {
+	requireFFmpeg(t)
+	inTempDir(t)
+	client := &blockingClient{DBClient: db.NewMemoryClient(), started: make(chan struct{}), release: make(chan struct{})}
+	s := newTestServerWith(t, client, shazam.DefaultAudiobookConfig(), 2)
+	clip := clipWav(t, 2, 20, 8)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec := httptest.NewRecorder()
+		s.handleMatch(rec, uploadRequest(t, "/api/match", "clip.wav", clip, nil))
+		done <- rec
+	}()
+	<-client.started
+
+	// coarser address bins no longer agree with the indexed library
+	if rec := postConfig(s, `{"FreqBinHz": 40}`); rec.Code != http.StatusOK {
+		t.Fatalf("POST: %d (%s)", rec.Code, rec.Body)
+	}
+	close(client.release)
+
+	// the running request finishes with the config it started with, and
+	// the next one uses the new config, which the library no longer fits
+	score := func(rec *httptest.ResponseRecorder) float64 {
+		t.Helper()
+		if titles := matchTitles(t, rec); len(titles) == 0 || titles[0] != "song 1" {
+			return 0
+		}
+		return decodeJSON(t, rec)["matches"].([]any)[0].(map[string]any)["score"].(float64)
+	}
+	before := score(<-done)
+	if before < 10 {
+		t.Fatalf("in-flight match scored %g for song 1, want a clear match", before)
+	}
+	if after := score(postMatch(t, s, "", clip)); after > before/4 {
+		t.Errorf("match after the swap scored %g, against %g before it", after, before)
+	}
+}
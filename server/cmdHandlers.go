@@ -1,17 +1,30 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"song-recognition/db"
+	"song-recognition/metrics"
 	"song-recognition/shazam"
 	"song-recognition/utils"
 	"song-recognition/wav"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -19,25 +32,38 @@ const (
 	SONGS_DIR = "songs"
 )
 
-func find(filePath string) {
-	log.Printf("[find] fingerprinting %s with chunked processing...", filePath)
+// stdinPath is the find argument that reads the audio from stdin.
+const stdinPath = "-"
 
-	fingerprint, err := shazam.FingerprintAudioChunked(filePath, utils.GenerateUniqueID(), fpConfig)
+// find matches filePath against the library and prints the top matches
+// scoring at least minScore.
+func find(filePath string, top int, minScore float64) {
+	dbClient, err := db.NewDBClient()
 	if err != nil {
-		fmt.Println("error generating fingerprint:", err)
+		fmt.Println("error creating DB client:", err)
 		return
 	}
+	defer dbClient.Close()
 
-	sampleFingerprint := make(map[uint32]uint32, len(fingerprint))
-	for address, couple := range fingerprint {
-		sampleFingerprint[address] = couple.AnchorTimeMs
+	if filePath == stdinPath {
+		filePath, err = saveStdin()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer os.Remove(filePath)
 	}
 
-	log.Printf("[find] searching database with %d fingerprints...", len(sampleFingerprint))
-
-	matches, searchDuration, err := shazam.FindMatchesFGP(sampleFingerprint)
+	top = clampMatchLimit(top)
+	matches, searchDuration, err := runFind(dbClient, filePath, fpConfig, matchOpts, top, minScore)
+	var below *belowMinScoreError
+	if errors.As(err, &below) {
+		fmt.Printf("\nno match found: %v.\n", err)
+		fmt.Printf("\nsearch took: %s\n", searchDuration)
+		return
+	}
 	if err != nil {
-		fmt.Println("error finding matches:", err)
+		fmt.Println(err)
 		return
 	}
 
@@ -48,47 +74,361 @@ func find(filePath string) {
 	}
 
 	topMatches := matches
-	if len(matches) >= 20 {
-		fmt.Println("top 20 matches:")
-		topMatches = matches[:20]
+	if len(matches) >= top {
+		fmt.Printf("top %d matches:\n", top)
+		topMatches = matches[:top]
 	} else {
 		fmt.Println("matches:")
 	}
 
 	for _, match := range topMatches {
 		fmt.Printf("\t- %s by %s, score: %.2f\n",
-			match.SongTitle, match.SongArtist, match.Score)
+			match.Title, match.Author, match.Score)
 	}
 
 	fmt.Printf("\nsearch took: %s\n", searchDuration)
 	topMatch := topMatches[0]
 	fmt.Printf("\nfinal prediction: %s by %s, score: %.2f\n",
-		topMatch.SongTitle, topMatch.SongArtist, topMatch.Score)
+		topMatch.Title, topMatch.Author, topMatch.Score)
+}
+
+// belowMinScoreError is returned by runFind when the search found matches
+// but none scored minScore.
+type belowMinScoreError struct {
+	best     matchResult
+	minScore float64
+}
+
+func (e *belowMinScoreError) Error() string {
+	return fmt.Sprintf("the best score, %.2f (%s by %s), is below --min-score %g",
+		e.best.Score, e.best.Title, e.best.Author, e.minScore)
+}
+
+// runFind matches the audio file at filePath against the library in
+// dbClient under cfg and opts, for limit results (see matchFile). it returns the
+// matches scoring at least minScore, best first, as /api/match would
+// report them, and how long the search (not the fingerprinting) took. an
+// empty library is reported as errEmptyLibrary, and matches that all
+// fall below minScore as a *belowMinScoreError.
+func runFind(dbClient db.DBClient, filePath string, cfg shazam.FingerprintConfig, opts shazam.MatchOptions, limit int, minScore float64) ([]matchResult, time.Duration, error) {
+	matches, searchDuration, err := matchFile(dbClient, filePath, cfg, opts, limit)
+	if err != nil {
+		return nil, searchDuration, err
+	}
+
+	kept := aboveMinScore(matches, minScore)
+	if len(kept) == 0 && len(matches) > 0 {
+		return nil, searchDuration, &belowMinScoreError{best: newMatchResult(matches[0]), minScore: minScore}
+	}
+	results := make([]matchResult, len(kept))
+	for i, m := range kept {
+		results[i] = newMatchResult(m)
+	}
+	return results, searchDuration, nil
+}
+
+// verifyTopOffsets is how many offset buckets verify prints.
+const verifyTopOffsets = 5
+
+// verify fingerprints a clip and reports how it aligns with one song,
+// for working out why a clip matched (or didn't match) it. artist may be
+// empty when the title is unique.
+func verify(clipPath, title, artist string) {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		fmt.Println("error creating DB client:", err)
+		return
+	}
+	defer dbClient.Close()
+
+	song, err := findSongByTitle(dbClient, title, artist)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	fingerprint, _, err := shazam.FingerprintAudioChunked(context.Background(), clipPath, utils.GenerateUniqueID(), fpConfig)
+	if err != nil {
+		fmt.Println("error generating fingerprint:", err)
+		return
+	}
+	sampleFingerprint := shazam.SampleFingerprint(fingerprint, fpConfig)
+
+	report, err := shazam.ExplainMatch(dbClient, sampleFingerprint, song.ID, matchOpts)
+	if err != nil {
+		fmt.Println("error scoring song:", err)
+		return
+	}
+
+	fmt.Printf("'%s' by '%s' (id %d)\n", song.Title, song.Artist, song.ID)
+	fmt.Printf("clip fingerprints: %d, hits in song: %d\n", report.SampleFingerprints, report.Hits)
+	if len(report.Buckets) == 0 {
+		fmt.Println("score: 0 (the clip shares no fingerprints with this song)")
+		return
+	}
+
+	best := report.Buckets[0]
+	fmt.Printf("score: %.2f, clip starts at %s in the song (%d of %d hits aligned)\n",
+		report.Score, formatOffset(best.OffsetMs), best.Hits, report.Hits)
+
+	fmt.Printf("\ntop offsets (of %d):\n", len(report.Buckets))
+	for _, bucket := range report.Buckets[:min(verifyTopOffsets, len(report.Buckets))] {
+		fmt.Printf("\t%10s  %4d hits", formatOffset(bucket.OffsetMs), bucket.Hits)
+		if matchOpts.IDFWeighting {
+			fmt.Printf("  weight %.2f", bucket.Weight)
+		}
+		fmt.Println()
+	}
+}
+
+// findSongByTitle looks a song up by title and artist, or by title alone
+// (case-insensitively) when artist is empty and only one song has it.
+func findSongByTitle(dbClient db.DBClient, title, artist string) (db.Song, error) {
+	if artist != "" {
+		song, found, err := dbClient.GetSongByKey(utils.GenerateSongKey(title, artist))
+		if err != nil {
+			return db.Song{}, fmt.Errorf("error looking up song: %v", err)
+		}
+		if !found {
+			return db.Song{}, fmt.Errorf("no song '%s' by '%s'", title, artist)
+		}
+		return song, nil
+	}
+
+	songs, err := dbClient.GetAllSongs()
+	if err != nil {
+		return db.Song{}, fmt.Errorf("error listing songs: %v", err)
+	}
+	var candidates []db.SongWithID
+	for _, song := range songs {
+		if strings.EqualFold(song.Title, title) {
+			candidates = append(candidates, song)
+		}
+	}
+
+	switch len(candidates) {
+	case 0:
+		return db.Song{}, fmt.Errorf("no song titled '%s'", title)
+	case 1:
+		song, _, err := dbClient.GetSongByID(candidates[0].ID)
+		if err != nil {
+			return db.Song{}, fmt.Errorf("error looking up song: %v", err)
+		}
+		return song, nil
+	default:
+		var names []string
+		for _, song := range candidates {
+			names = append(names, fmt.Sprintf("'%s'", song.Artist))
+		}
+		return db.Song{}, fmt.Errorf("%d songs are titled '%s' (by %s); pass --artist", len(candidates), title, strings.Join(names, ", "))
+	}
+}
+
+// formatOffset renders a song-minus-clip offset in milliseconds as signed
+// seconds.
+func formatOffset(ms int32) string {
+	return fmt.Sprintf("%+.1fs", float64(ms)/1000)
+}
+
+// saveStdin copies stdin to a file under tmp, for `find -` in a pipeline.
+// ffmpeg sniffs the format, so the file has no extension.
+func saveStdin() (string, error) {
+	if err := utils.CreateFolder("tmp"); err != nil {
+		return "", fmt.Errorf("failed to create tmp dir: %v", err)
+	}
+
+	file, err := os.CreateTemp("tmp", "stdin_*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer file.Close()
+
+	written, err := io.Copy(file, os.Stdin)
+	if err == nil && written == 0 {
+		err = errors.New("no data")
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed to read audio from stdin: %v", err)
+	}
+
+	utils.Debugf("[find] read %s from stdin", formatBytes(written))
+	return file.Name(), nil
+}
+
+// matchFile fingerprints an audio file under cfg and searches the database
+// for it with opts, returning the matches and how long the search (not the
+// fingerprinting) took. limit is how many matches the caller uses, which
+// a search that runs out of time still resolves. an empty library is
+// reported as errEmptyLibrary.
+func matchFile(dbClient db.DBClient, filePath string, cfg shazam.FingerprintConfig, opts shazam.MatchOptions, limit int) ([]shazam.Match, time.Duration, error) {
+	if err := checkLibrary(dbClient); err != nil {
+		return nil, 0, err
+	}
+
+	clipSec, err := wav.GetAudioDuration(context.Background(), filePath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reading audio duration: %v", err)
+	}
+	if err := cfg.CheckClipLength(clipSec, wav.DecodeSampleRate); err != nil {
+		return nil, 0, err
+	}
+
+	utils.Infof("[find] fingerprinting %s with chunked processing...", filePath)
+
+	fingerprint, _, err := shazam.FingerprintAudioChunked(context.Background(), filePath, utils.GenerateUniqueID(), cfg)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error generating fingerprint: %v", err)
+	}
+
+	sampleFingerprint := shazam.SampleFingerprint(fingerprint, cfg)
+
+	utils.Infof("[find] searching database with %d fingerprints...", len(sampleFingerprint))
+
+	matches, searchDuration, err := shazam.FindMatchesFGP(dbClient, sampleFingerprint, nil, limit, opts)
+	if err != nil {
+		return nil, searchDuration, fmt.Errorf("error finding matches: %v", err)
+	}
+	return matches, searchDuration, nil
+}
+
+// serveOptions holds the flags of the serve command.
+type serveOptions struct {
+	protocol       string
+	port           string
+	maxIndexUpload int64 // bytes
+	maxMatchUpload int64 // bytes
+
+	// https only: certificate and key files, or a generated
+	// self-signed certificate when selfSigned is set and they're empty
+	certFile   string
+	keyFile    string
+	selfSigned bool
 }
 
-func serve(protocol, port string) {
-	protocol = strings.ToLower(protocol)
+func serve(opts serveOptions) {
+	protocol, port := strings.ToLower(opts.protocol), opts.port
+
+	// one client for the whole server; handlers share its connection pool
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		log.Fatalf("error creating DB client: %v", err)
+	}
+	defer dbClient.Close()
+
+	exposePaths, _ := strconv.ParseBool(utils.GetEnv("EXPOSE_SOURCE_PATHS", "false"))
+	s := &apiServer{
+		db:          db.NewVersionedClient(dbClient),
+		adminToken:  utils.GetEnv("ADMIN_TOKEN"),
+		exposePaths: exposePaths,
+		indexRoots:  indexRootsFromEnv(),
+		matchCache:  newMatchCacheFromEnv(),
+		matchOpts:   matchOpts,
+		cfg:         fpConfig,
+
+		maxIndexUpload: opts.maxIndexUpload,
+		maxMatchUpload: opts.maxMatchUpload,
+	}
+	if s.adminToken == "" {
+		utils.Infof("ADMIN_TOKEN not set, admin endpoints are disabled")
+	}
 
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/api/index", handleIndex)
-	mux.HandleFunc("/api/match", handleMatch)
-	mux.HandleFunc("/api/stats", handleStats)
-	mux.HandleFunc("/api/entries", handleEntries)
+	mux.HandleFunc("/api/index", s.handleIndex)
+	mux.HandleFunc("/api/index/bulk", s.handleIndexBulk)
+	mux.HandleFunc("/api/index/path", s.requireAdmin(s.handleIndexPath))
+	mux.HandleFunc("/api/match", s.handleMatch)
+	mux.HandleFunc("/api/analyze", s.handleAnalyze)
+	mux.HandleFunc("/api/stats", s.handleStats)
+	mux.HandleFunc("/api/composition", s.handleComposition)
+	mux.HandleFunc("/api/entries", s.handleEntries)
+	mux.HandleFunc("GET /api/entries/{id}/fingerprints", s.handleEntryFingerprints)
+	mux.HandleFunc("/api/stream", s.handleStream)
+	mux.HandleFunc("/api/reindex-all", s.requireAdmin(s.handleReindexAll))
+	mux.HandleFunc("/api/config", s.requireAdmin(s.handleConfig))
+	mux.Handle("/metrics", metrics.Handler())
 
 	mux.Handle("/", http.FileServer(http.Dir("static")))
 
 	handler := requestLogger(corsMiddleware(mux))
 
-	log.Printf("starting server on port %s (%s)\n", port, protocol)
-	if err := http.ListenAndServe(":"+port, handler); err != nil {
-		log.Fatalf("server error: %v", err)
+	metrics.RegisterLibraryGauges(dbCount(dbClient.TotalSongs), dbCount(dbClient.TotalFingerprints))
+
+	srv := &http.Server{Addr: ":" + port, Handler: handler}
+	if protocol == "https" && opts.certFile == "" {
+		cert, err := selfSignedCert()
+		if err != nil {
+			log.Fatalf("error creating self-signed certificate: %v", err)
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		utils.Warnf("using a self-signed certificate; clients will not trust it")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		utils.Infof("starting server on port %s (%s)", port, protocol)
+		if protocol == "https" {
+			// empty paths use srv.TLSConfig's certificate
+			serveErr <- srv.ListenAndServeTLS(opts.certFile, opts.keyFile)
+			return
+		}
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("server error: %v", err)
+		}
+	case <-ctx.Done():
+		utils.Infof("shutting down server...")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			utils.Warnf("server shutdown: %v", err)
+		}
+	}
+}
+
+// newMatchCacheFromEnv builds the /api/match result cache from
+// MATCH_CACHE_SIZE (entries, 0 or unset disables it) and MATCH_CACHE_TTL.
+func newMatchCacheFromEnv() *shazam.MatchCache {
+	size, err := strconv.Atoi(utils.GetEnv("MATCH_CACHE_SIZE", "0"))
+	if err != nil || size < 0 {
+		utils.Warnf("ignoring invalid MATCH_CACHE_SIZE, match cache disabled")
+		return nil
+	}
+	ttl, err := time.ParseDuration(utils.GetEnv("MATCH_CACHE_TTL", "5m"))
+	if err != nil || ttl < 0 {
+		utils.Warnf("ignoring invalid MATCH_CACHE_TTL, using 5m")
+		ttl = 5 * time.Minute
+	}
+	if size > 0 {
+		utils.Infof("match cache enabled: %d entries, ttl %s", size, ttl)
+	}
+	return shazam.NewMatchCache(size, ttl)
+}
+
+// dbCount adapts a DBClient counting method into a metrics gauge callback.
+// a failed query reports -1 so it is distinguishable from an empty library.
+func dbCount(count func() (int, error)) func() float64 {
+	return func() float64 {
+		n, err := count()
+		if err != nil {
+			return -1
+		}
+		return float64(n)
 	}
 }
 
 type statusRecorder struct {
 	http.ResponseWriter
-	status int
+	status    int
+	requestID string
 }
 
 func (r *statusRecorder) WriteHeader(code int) {
@@ -96,24 +436,59 @@ func (r *statusRecorder) WriteHeader(code int) {
 	r.ResponseWriter.WriteHeader(code)
 }
 
+// Flush lets streamed responses (NDJSON) reach the client as they are
+// written.
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets WebSocket upgrades (/api/stream) pass through the logger.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	r.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// requestLogger logs each API request with its status and gives it a
+// short ID, returned in the X-Request-ID header and prefixed to the log
+// lines written on its behalf, so concurrent requests can be told apart.
 func requestLogger(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		rec := &statusRecorder{ResponseWriter: w, status: 200}
+		id := utils.NewRequestID()
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(utils.WithRequestID(r.Context(), id))
+		rec := &statusRecorder{ResponseWriter: w, status: 200, requestID: id}
 		next.ServeHTTP(rec, r)
 
 		// skip noisy static file / stats polling logs
 		if strings.HasPrefix(r.URL.Path, "/api/") {
-			log.Printf("[http] %s %s -> %d (%s)", r.Method, r.URL.Path, rec.status, time.Since(start))
+			utils.InfofCtx(r.Context(), "[http] %s %s -> %d (%s)", r.Method, r.URL.Path, rec.status, time.Since(start))
 		}
 	})
 }
 
+// requestContext returns a context carrying the ID requestLogger gave
+// the request w answers, for logging where only w is at hand.
+func requestContext(w http.ResponseWriter) context.Context {
+	ctx := context.Background()
+	if rec, ok := w.(*statusRecorder); ok {
+		ctx = utils.WithRequestID(ctx, rec.requestID)
+	}
+	return ctx
+}
+
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
 			return
@@ -151,8 +526,7 @@ func erase(songsDir string, dbOnly bool, all bool) {
 		if info.IsDir() {
 			return nil
 		}
-		ext := filepath.Ext(path)
-		if ext == ".wav" || ext == ".m4a" || ext == ".mp3" || ext == ".flac" || ext == ".ogg" {
+		if erasedExtensions[filepath.Ext(path)] {
 			return os.Remove(path)
 		}
 		return nil
@@ -164,100 +538,566 @@ func erase(songsDir string, dbOnly bool, all bool) {
 	fmt.Println("erase complete")
 }
 
-func save(path string, force bool) {
+// audioExtensions are the file types `save` picks up from a directory.
+var audioExtensions = map[string]bool{
+	".wav": true, ".m4a": true, ".m4b": true, ".mp3": true,
+	".flac": true, ".ogg": true, ".opus": true, ".aac": true,
+}
+
+// erasedExtensions are the file types `erase all` deletes from the songs
+// directory. it is deliberately not audioExtensions: growing what save
+// reads shouldn't quietly grow what erase deletes.
+var erasedExtensions = map[string]bool{
+	".wav": true, ".m4a": true, ".mp3": true, ".flac": true, ".ogg": true,
+}
+
+// isAudioFile reports whether path has one of the audioExtensions.
+func isAudioFile(path string) bool {
+	return audioExtensions[strings.ToLower(filepath.Ext(path))]
+}
+
+// saveOptions carries the flags of the save command.
+type saveOptions struct {
+	force   bool
+	workers int      // files indexed in parallel; 0 picks a default from NumCPU
+	quiet   bool     // no progress bar
+	strict  bool     // reject files with too few fingerprints per second
+	exclude []string // glob patterns of files and directories a directory walk skips
+	resume  bool     // skip files whose title and author are already indexed
+
+	// appendTo is the ID of an entry to add a single file to, e.g. the
+	// next episode of a serialized audiobook; 0 creates a new entry
+	appendTo uint32
+
+	// per-file title/author from a directory's sidecar, keyed by path
+	overrides map[string]entryOverride
+}
+
+// compactOptions holds the flags of the compact command.
+type compactOptions struct {
+	pruneCommon bool
+	maxDF       float64 // fraction of songs above which an address is pruned
+	dryRun      bool
+}
+
+// compact shrinks the fingerprint store. with pruneCommon it deletes
+// addresses found in more than maxDF of all songs: they cost storage and
+// lookups but barely help tell songs apart.
+func compact(opts compactOptions) {
+	if !opts.pruneCommon {
+		fmt.Println("nothing to do; pass --prune-common")
+		return
+	}
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		fmt.Println("error creating DB client:", err)
+		return
+	}
+	defer dbClient.Close()
+
+	totalSongs, err := dbClient.TotalSongs()
+	if err != nil {
+		fmt.Println("error counting songs:", err)
+		return
+	}
+	counts, err := dbClient.AddressSongCounts()
+	if err != nil {
+		fmt.Println("error counting songs per address:", err)
+		return
+	}
+
+	common := commonAddresses(counts, totalSongs, opts.maxDF)
+	fmt.Printf("%d of %d addresses appear in more than %.0f%% of %d songs\n",
+		len(common), len(counts), opts.maxDF*100, totalSongs)
+	if len(common) == 0 || opts.dryRun {
+		return
+	}
+
+	start := time.Now()
+	if err := dbClient.DeleteAddresses(common); err != nil {
+		fmt.Println("error pruning addresses:", err)
+		return
+	}
+	fmt.Printf("pruned %d addresses in %s\n", len(common), time.Since(start).Round(time.Millisecond))
+}
+
+// commonAddresses returns the addresses whose song count exceeds maxDF of
+// totalSongs, sorted. an address used by a single song is never common.
+func commonAddresses(counts map[uint32]int, totalSongs int, maxDF float64) []uint32 {
+	limit := maxDF * float64(totalSongs)
+	var common []uint32
+	for address, n := range counts {
+		if n > 1 && float64(n) > limit {
+			common = append(common, address)
+		}
+	}
+	slices.Sort(common)
+	return common
+}
+
+func save(path string, opts saveOptions) {
 	fileInfo, err := os.Stat(path)
 	if err != nil {
 		fmt.Printf("error: %v\n", err)
 		return
 	}
 
+	if opts.appendTo != 0 && fileInfo.IsDir() {
+		fmt.Println("error: --append takes a single file, not a directory")
+		return
+	}
+
 	if !fileInfo.IsDir() {
-		if err := saveEntry(path, force); err != nil {
+		res, err := saveEntry(path, opts)
+		if err != nil {
 			fmt.Printf("error saving (%v): %v\n", path, err)
+			return
+		}
+		res.print()
+		return
+	}
+
+	listing, err := listAudioFiles(path, opts.exclude)
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		return
+	}
+
+	if listing.sidecarPath != "" {
+		utils.Infof("[save] using titles and authors from %s", listing.sidecarPath)
+		opts.overrides = listing.overrides
+		reportUnmatchedOverrides(listing.overrides, listing.files, listing.sidecarPath)
+	}
+	if len(listing.skipped) > 0 {
+		for _, fp := range listing.skipped {
+			utils.Debugf("[save] skipped %s", fp)
 		}
+		fmt.Printf("skipped %d files that aren't audio or are excluded\n", len(listing.skipped))
+	}
+	if len(listing.files) == 0 {
+		fmt.Printf("no audio files found in %s\n", path)
 		return
 	}
 
-	var filePaths []string
-	filepath.Walk(path, func(fp string, info os.FileInfo, err error) error {
+	processFilesConcurrently(listing.files, opts)
+}
+
+// audioListing is what listAudioFiles found in a directory.
+type audioListing struct {
+	files       []string                 // audio files to index, in walk order
+	skipped     []string                 // other files, and those matched by an exclude pattern
+	overrides   map[string]entryOverride // from the sidecar, if there is one
+	sidecarPath string                   // "" if there is none
+}
+
+// listAudioFiles walks dir for the files `save` indexes from it: every
+// file with one of the audioExtensions, except those whose name or path
+// relative to dir matches one of the exclude globs. a directory that
+// matches is skipped whole, and its files aren't listed as skipped.
+func listAudioFiles(dir string, exclude []string) (audioListing, error) {
+	var listing audioListing
+	var err error
+	listing.overrides, listing.sidecarPath, err = readSidecar(dir)
+	if err != nil {
+		return audioListing{}, err
+	}
+
+	err = filepath.Walk(dir, func(fp string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if !info.IsDir() {
-			filePaths = append(filePaths, fp)
+		if fp != dir && isExcluded(dir, fp, exclude) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			listing.skipped = append(listing.skipped, fp)
+			return nil
+		}
+		switch {
+		case info.IsDir(), fp == listing.sidecarPath:
+		case isAudioFile(fp):
+			listing.files = append(listing.files, fp)
+		default:
+			listing.skipped = append(listing.skipped, fp)
 		}
 		return nil
 	})
+	if err != nil {
+		return audioListing{}, err
+	}
+	return listing, nil
+}
 
-	processFilesConcurrently(filePaths, force)
+// isExcluded reports whether the file at fp, found under dir, matches one
+// of the globs by its base name or by its slash-separated path relative
+// to dir. patterns have been checked with filepath.Match already.
+func isExcluded(dir, fp string, patterns []string) bool {
+	rel, err := filepath.Rel(dir, fp)
+	if err != nil {
+		rel = fp
+	}
+	rel = filepath.ToSlash(rel)
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, filepath.Base(fp)); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, rel); ok {
+			return true
+		}
+	}
+	return false
 }
 
-func processFilesConcurrently(filePaths []string, force bool) {
-	maxWorkers := runtime.NumCPU() / 2
-	numFiles := len(filePaths)
+// reportUnmatchedOverrides warns about sidecar rows naming files that
+// weren't found, which are usually typos.
+func reportUnmatchedOverrides(overrides map[string]entryOverride, filePaths []string, sidecarPath string) {
+	found := make(map[string]bool, len(filePaths))
+	for _, fp := range filePaths {
+		found[fp] = true
+	}
+
+	var unmatched []string
+	for fp := range overrides {
+		if !found[fp] {
+			rel, err := filepath.Rel(filepath.Dir(sidecarPath), fp)
+			if err != nil {
+				rel = fp
+			}
+			unmatched = append(unmatched, filepath.ToSlash(rel))
+		}
+	}
+	if len(unmatched) == 0 {
+		return
+	}
 
+	slices.Sort(unmatched)
+	fmt.Printf("warning: %s lists %d file(s) that don't exist:\n", sidecarPath, len(unmatched))
+	for _, name := range unmatched {
+		fmt.Printf("  %s\n", name)
+	}
+}
+
+func processFilesConcurrently(filePaths []string, opts saveOptions) {
+	numFiles := len(filePaths)
 	if numFiles == 0 {
 		return
 	}
-	if numFiles < maxWorkers {
-		maxWorkers = numFiles
+	maxWorkers := indexWorkers(opts.workers, numFiles)
+
+	utils.Debugf("[save] indexing %d files with %d workers", numFiles, maxWorkers)
+
+	start := time.Now()
+	results := make(chan saveOutcome, numFiles)
+	go indexConcurrently(numFiles, maxWorkers, func(i int) saveOutcome {
+		res, err := saveEntry(filePaths[i], opts)
+		return saveOutcome{res, err}
+	}, func(_ int, out saveOutcome) {
+		results <- out
+	})
+
+	// results are printed here rather than by the workers so lines
+	// don't interleave with each other or with the progress bar
+	bar := newProgressBar(numFiles, opts.quiet)
+	bar.draw()
+
+	successCount, skipCount, errorCount := 0, 0, 0
+	var total saveResult
+	for i := 0; i < numFiles; i++ {
+		out := <-results
+		bar.clear()
+		switch {
+		case out.err != nil:
+			fmt.Printf("error: %v\n", out.err)
+			errorCount++
+		case out.existingID != 0:
+			out.print()
+			skipCount++
+		default:
+			out.print()
+			successCount++
+			total.fingerprints += out.fingerprints
+			total.durationSec += out.durationSec
+		}
+		bar.advance()
+	}
+	bar.clear()
+
+	elapsed := time.Since(start)
+	if opts.resume {
+		fmt.Printf("\nprocessed %d files: %d successful, %d already indexed, %d failed\n", numFiles, successCount, skipCount, errorCount)
+	} else {
+		fmt.Printf("\nprocessed %d files: %d successful, %d failed\n", numFiles, successCount, errorCount)
+	}
+	fmt.Printf("stored %d fingerprints from %s of audio in %s",
+		total.fingerprints, formatDuration(total.durationSec), elapsed.Round(time.Second))
+	if secs := elapsed.Seconds(); secs > 0 && total.durationSec > 0 {
+		fmt.Printf(" (%.1fx realtime)", total.durationSec/secs)
+	}
+	fmt.Println()
+}
+
+// indexWorkers returns how many files to index at once: requested, or
+// half the CPUs when it is 0, but never more than numFiles or less than 1.
+func indexWorkers(requested, numFiles int) int {
+	workers := requested
+	if workers == 0 {
+		workers = runtime.NumCPU() / 2
 	}
-	if maxWorkers < 1 {
-		maxWorkers = 1
+	return max(min(workers, numFiles), 1)
+}
+
+// indexConcurrently runs index for items 0..n-1 on the given number of
+// workers and hands each outcome to done, from the calling goroutine, as
+// it finishes. it returns once every item is done.
+func indexConcurrently(n, workers int, index func(i int) saveOutcome, done func(i int, out saveOutcome)) {
+	type indexed struct {
+		i   int
+		out saveOutcome
 	}
 
-	jobs := make(chan string, numFiles)
-	results := make(chan error, numFiles)
+	jobs := make(chan int, n)
+	results := make(chan indexed, n)
 
-	for w := 0; w < maxWorkers; w++ {
+	for w := 0; w < workers; w++ {
 		go func() {
-			for fp := range jobs {
-				results <- saveEntry(fp, force)
+			for i := range jobs {
+				results <- indexed{i, index(i)}
 			}
 		}()
 	}
 
-	for _, fp := range filePaths {
-		jobs <- fp
+	for i := 0; i < n; i++ {
+		jobs <- i
 	}
 	close(jobs)
 
-	successCount, errorCount := 0, 0
-	for i := 0; i < numFiles; i++ {
-		if err := <-results; err != nil {
-			fmt.Printf("error: %v\n", err)
-			errorCount++
-		} else {
-			successCount++
-		}
+	for range n {
+		res := <-results
+		done(res.i, res.out)
 	}
+}
 
-	fmt.Printf("\nprocessed %d files: %d successful, %d failed\n", numFiles, successCount, errorCount)
+// saveResult is what indexing a single file produced.
+type saveResult struct {
+	title        string
+	author       string
+	fingerprints int
+	durationSec  float64
+	appendedAt   float64 // where an appended file starts in its entry, in seconds; 0 for new entries
+	warnings     []string
+
+	// with --resume, the ID of the entry the file was already indexed
+	// as, in which case nothing was done; 0 otherwise
+	existingID uint32
 }
 
-func saveEntry(filePath string, force bool) error {
-	metadata, err := wav.GetMetadata(filePath)
+func (r saveResult) print() {
+	if r.existingID != 0 {
+		fmt.Printf("skipped '%s' by '%s', already indexed (ID %d)\n", r.title, r.author, r.existingID)
+		return
+	}
+	if r.appendedAt > 0 {
+		fmt.Printf("appended to '%s' by '%s' at %s (%d fingerprints)\n",
+			r.title, r.author, formatDuration(r.appendedAt), r.fingerprints)
+	} else {
+		fmt.Printf("indexed '%s' by '%s' (%d fingerprints)\n", r.title, r.author, r.fingerprints)
+	}
+	for _, w := range r.warnings {
+		fmt.Printf("  warning: %s\n", w)
+	}
+}
+
+type saveOutcome struct {
+	saveResult
+	err error
+}
 
-	title := ""
-	author := ""
+// formatDuration renders seconds as h:mm:ss (or m:ss under an hour).
+func formatDuration(sec float64) string {
+	total := int(math.Round(sec))
+	h, m, s := total/3600, total/60%60, total%60
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%d:%02d", m, s)
+}
 
+// entryTags returns the title and artist tags of filePath, falling back
+// to name without its extension and "unknown".
+func entryTags(filePath, name string) (title, author string) {
+	metadata, err := wav.GetMetadata(filePath)
 	if err == nil {
-		title = metadata.Format.Tags["title"]
-		author = metadata.Format.Tags["artist"]
+		title = metadata.Title()
+		author = metadata.Artist()
 	}
 
 	if title == "" {
-		title = strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
+		title = strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
 	}
 	if author == "" {
 		author = "unknown"
 	}
+	return title, author
+}
+
+// entryNames returns the title and author filePath is indexed under: its
+// tags or name, overridden by the sidecar.
+func entryNames(filePath string, opts saveOptions) (title, author string) {
+	title, author = entryTags(filePath, filePath)
+	if override, ok := opts.overrides[filePath]; ok {
+		if override.Title != "" {
+			title = override.Title
+		}
+		if override.Author != "" {
+			author = override.Author
+		}
+	}
+	return title, author
+}
+
+func saveEntry(filePath string, opts saveOptions) (saveResult, error) {
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		return saveResult{}, fmt.Errorf("failed to create DB client: %v", err)
+	}
+	defer dbClient.Close()
+
+	return saveEntryTo(context.Background(), dbClient, filePath, opts, fpConfig)
+}
+
+// saveEntryTo indexes filePath like saveEntry, using dbClient and cfg.
+func saveEntryTo(ctx context.Context, dbClient db.DBClient, filePath string, opts saveOptions, cfg shazam.FingerprintConfig) (saveResult, error) {
+	title, author := entryNames(filePath, opts)
+
+	// by key rather than content: a file whose tags were fixed since the
+	// last run is indexed again under its new names
+	if opts.resume && opts.appendTo == 0 {
+		existing, exists, err := dbClient.GetSongByKey(utils.GenerateSongKey(title, author))
+		if err != nil {
+			return saveResult{}, fmt.Errorf("failed to look up '%s': %v", filePath, err)
+		}
+		if exists {
+			return saveResult{title: title, author: author, existingID: existing.ID}, nil
+		}
+	}
+
+	duration, err := wav.GetAudioDuration(ctx, filePath)
+	if err != nil {
+		return saveResult{}, fmt.Errorf("failed to process '%s': %v", filePath, err)
+	}
+
+	sourcePath, err := filepath.Abs(filePath)
+	if err != nil {
+		sourcePath = filePath
+	}
 
-	_, fpCount, err := processAndSave(filePath, title, author)
+	if opts.appendTo != 0 {
+		if song, found, err := dbClient.GetSongByID(opts.appendTo); err == nil && found {
+			title, author = song.Title, song.Artist
+		}
+	}
+
+	result, err := processAndSave(ctx, dbClient, filePath, title, author,
+		indexOptions{durationSec: duration, strict: opts.strict, sourcePath: sourcePath, appendTo: opts.appendTo, cfg: cfg})
+	if err != nil {
+		return saveResult{}, fmt.Errorf("failed to process '%s': %v", filePath, err)
+	}
+
+	return saveResult{
+		title:        title,
+		author:       author,
+		fingerprints: result.fingerprints,
+		durationSec:  duration,
+		appendedAt:   result.offsetSec,
+		warnings:     result.warnings,
+	}, nil
+}
+
+// maxSpectrogramWidth caps the number of time columns in an exported
+// spectrogram; longer files are max-pooled down to fit.
+const maxSpectrogramWidth = 4000
+
+// spectrogram renders the spectrogram of filePath under the current
+// config as a PNG heatmap with the peaks fingerprinting uses overlaid.
+// the file is read chunk by chunk so memory stays bounded for long
+// recordings.
+func spectrogram(filePath, outputPath string) {
+	duration, err := wav.GetAudioDuration(context.Background(), filePath)
 	if err != nil {
-		return fmt.Errorf("failed to process '%s': %v", filePath, err)
+		fmt.Println("error reading audio duration:", err)
+		return
+	}
+
+	chunkDur := fpConfig.ChunkDurationSec
+	if chunkDur <= 0 {
+		chunkDur = duration
+	}
+
+	// chunks are extracted at 44.1 kHz
+	effectiveRate := shazam.EffectiveSampleRate(wav.DecodeSampleRate, fpConfig)
+	frameDuration := shazam.FrameDuration(wav.DecodeSampleRate, fpConfig)
+	freqResolution := effectiveRate / float64(fpConfig.WindowSize)
+
+	totalFrames := int(duration/frameDuration) + 1
+	framesPerColumn := (totalFrames + maxSpectrogramWidth - 1) / maxSpectrogramWidth
+
+	var columns, pending [][]float64
+	var peaks []shazam.Peak
+
+	for start := 0.0; start < duration; start += chunkDur {
+		dur := chunkDur
+		if start+dur > duration {
+			dur = duration - start
+		}
+
+		chunkPath, err := wav.ExtractChunkAsWAV(context.Background(), filePath, start, dur)
+		if err != nil {
+			fmt.Printf("error extracting chunk at %.0fs: %v\n", start, err)
+			return
+		}
+		wavInfo, err := wav.ReadWavInfo(chunkPath)
+		wav.RemoveTemp(chunkPath)
+		if err != nil {
+			fmt.Printf("error reading chunk at %.0fs: %v\n", start, err)
+			return
+		}
+
+		samples := wavInfo.MonoSamples()
+		spectro, err := shazam.Spectrogram(samples, wavInfo.SampleRate, fpConfig)
+		if err != nil {
+			fmt.Printf("error computing spectrogram at %.0fs: %v\n", start, err)
+			return
+		}
+
+		// the peaks fingerprinting keeps, after silence trimming, merging
+		// and the per-chunk cap, not everything ExtractPeaks finds
+		analysis, err := shazam.AnalyzeSamplesDetailed(samples, wavInfo.SampleRate, fpConfig)
+		if err != nil {
+			fmt.Printf("error picking peaks at %.0fs: %v\n", start, err)
+			return
+		}
+		for _, p := range analysis.Peaks {
+			p.Time += start
+			peaks = append(peaks, p)
+		}
+
+		pending = append(pending, spectro...)
+		for len(pending) >= framesPerColumn {
+			columns = append(columns, shazam.MaxPoolFrames(pending[:framesPerColumn]))
+			pending = pending[framesPerColumn:]
+		}
+	}
+	if len(pending) > 0 {
+		columns = append(columns, shazam.MaxPoolFrames(pending))
+	}
+
+	img := shazam.SpectrogramImage(columns, peaks, frameDuration*float64(framesPerColumn), freqResolution)
+	if err := shazam.SavePNG(img, outputPath); err != nil {
+		fmt.Println("error writing image:", err)
+		return
 	}
 
-	fmt.Printf("indexed '%s' by '%s' (%d fingerprints)\n", title, author, fpCount)
-	return nil
+	fmt.Printf("wrote %dx%d spectrogram (%d frames per column, %d peaks) to %s\n",
+		img.Bounds().Dx(), img.Bounds().Dy(), framesPerColumn, len(peaks), outputPath)
 }
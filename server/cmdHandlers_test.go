@@ -0,0 +1,565 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"song-recognition/db"
+	"song-recognition/models"
+	"song-recognition/shazam"
+	"song-recognition/utils"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// sqliteTestServer is newTestServer over an SQLite database in a temp
+// dir, the backend whose connection sharing matters most.
+func sqliteTestServer(t testing.TB, cfg shazam.FingerprintConfig, songs int) *apiServer {
+	t.Helper()
+	client, err := db.NewSQLiteClient(filepath.Join(t.TempDir(), "db.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return newTestServerWith(t, client, cfg, songs)
+}
+
+func TestConcurrentMatchesShareClient(t *testing.T) {
+	cfg := shazam.DefaultAudiobookConfig()
+	s := sqliteTestServer(t, cfg, 2)
+	opts := progressiveOptions{limit: 1, cfg: cfg}
+
+	var wg sync.WaitGroup
+	errs := make(chan string, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			song := i % 2
+			want := fmt.Sprintf("song %d", song)
+			clip := testTones(int64(song+1), 44100, 60)[20*44100 : 28*44100]
+			matches, _, err := s.matchWindow(clip, 44100, opts)
+			if err != nil {
+				errs <- err.Error()
+			} else if len(matches) == 0 || matches[0].SongTitle != want {
+				errs <- fmt.Sprintf("clip of %s matched %v", want, matches)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// BenchmarkParallelMatch compares the server's shared client with opening
+// one per request, as the handlers used to.
+func BenchmarkParallelMatch(b *testing.B) {
+	cfg := shazam.DefaultAudiobookConfig()
+	path := filepath.Join(b.TempDir(), "db.sqlite3")
+	client, err := db.NewSQLiteClient(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+	s := newTestServerWith(b, client, cfg, 5)
+	opts := progressiveOptions{limit: 1, cfg: cfg}
+	clip := testTones(3, 44100, 60)[20*44100 : 28*44100]
+
+	b.Run("shared", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if _, _, err := s.matchWindow(clip, 44100, opts); err != nil {
+					b.Error(err)
+				}
+			}
+		})
+	})
+	b.Run("per-request", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				client, err := db.NewSQLiteClient(path)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				req := &apiServer{db: db.NewVersionedClient(client), cfg: cfg}
+				if _, _, err := req.matchWindow(clip, 44100, opts); err != nil {
+					b.Error(err)
+				}
+				client.Close()
+			}
+		})
+	})
+}
+
+func TestIndexWorkers(t *testing.T) {
+	cpus := runtime.NumCPU()
+	for _, tc := range []struct{ requested, files, want int }{
+		{4, 10, 4},
+		{4, 2, 2},
+		{0, 1000, max(cpus/2, 1)},
+		{0, 1, 1},
+	} {
+		if got := indexWorkers(tc.requested, tc.files); got != tc.want {
+			t.Errorf("indexWorkers(%d, %d) = %d, want %d", tc.requested, tc.files, got, tc.want)
+		}
+	}
+}
+
+func TestIndexConcurrentlyBoundsWorkers(t *testing.T) {
+	const n, workers = 20, 3
+	var running, peak atomic.Int32
+	seen := make([]int, n)
+
+	indexConcurrently(n, workers, func(i int) saveOutcome {
+		now := running.Add(1)
+		for {
+			old := peak.Load()
+			if now <= old || peak.CompareAndSwap(old, now) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		running.Add(-1)
+		return saveOutcome{saveResult{fingerprints: i}, nil}
+	}, func(i int, out saveOutcome) {
+		// called from this goroutine, so no locking
+		seen[i]++
+		if out.fingerprints != i {
+			t.Errorf("item %d got item %d's outcome", i, out.fingerprints)
+		}
+	})
+
+	for i, count := range seen {
+		if count != 1 {
+			t.Errorf("item %d done %d times", i, count)
+		}
+	}
+	if p := peak.Load(); p > workers {
+		t.Errorf("%d items indexed at once, more than %d workers", p, workers)
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	for sec, want := range map[float64]string{0: "0:00", 59.6: "1:00", 754: "12:34", 3725: "1:02:05"} {
+		if got := formatDuration(sec); got != want {
+			t.Errorf("formatDuration(%g) = %q, want %q", sec, got, want)
+		}
+	}
+}
+
+func TestSaveDirectoryReportsTotals(t *testing.T) {
+	requireFFmpeg(t)
+	dir := cliTestDir(t)
+	songs := filepath.Join(dir, "in")
+	os.Mkdir(songs, 0o755)
+	writeTestWav(t, filepath.Join(songs, "a.wav"), 1, 8)
+	writeTestWav(t, filepath.Join(songs, "b.wav"), 2, 12)
+
+	out := captureStdout(t, func() { save(songs, saveOptions{workers: 2, quiet: true}) })
+	if !strings.Contains(out, "processed 2 files: 2 successful, 0 failed") {
+		t.Errorf("summary missing from:\n%s", out)
+	}
+	if !strings.Contains(out, "of audio in") || !strings.Contains(out, "from 0:20 of audio") {
+		t.Errorf("totals missing from:\n%s", out)
+	}
+
+	client := openCLIDB(t)
+	total, _ := client.TotalFingerprints()
+	if !strings.Contains(out, fmt.Sprintf("stored %d fingerprints", total)) {
+		t.Errorf("reported fingerprint count isn't the %d stored:\n%s", total, out)
+	}
+}
+
+func TestCommonAddresses(t *testing.T) {
+	counts := map[uint32]int{1: 10, 2: 5, 3: 4, 4: 1, 5: 6}
+	if got := commonAddresses(counts, 10, 0.5); !reflect.DeepEqual(got, []uint32{1, 5}) {
+		t.Errorf("above half of 10 songs: %v, want [1 5]", got)
+	}
+	// with a single song every address is in all of them, yet none is common
+	if got := commonAddresses(map[uint32]int{1: 1}, 1, 0.2); len(got) != 0 {
+		t.Errorf("single-song address pruned: %v", got)
+	}
+}
+
+func TestCompactPrunesCommonAddresses(t *testing.T) {
+	cliTestDir(t)
+	client := openCLIDB(t)
+	// address 100 is in all 5 songs, 200 in 3, 300 in 2 and the rest in one
+	for i := 0; i < 5; i++ {
+		id, err := client.RegisterSong(fmt.Sprintf("song %d", i), "artist", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fps := map[uint32]models.Couple{100: {SongID: id}, uint32(1000 + i): {SongID: id}}
+		if i < 3 {
+			fps[200] = models.Couple{SongID: id, AnchorTimeMs: 10}
+		}
+		if i < 2 {
+			fps[300] = models.Couple{SongID: id, AnchorTimeMs: 20}
+		}
+		if err := client.StoreFingerprints(fps); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addresses := []uint32{100, 200, 300, 1000, 1004}
+	left := func() []uint32 {
+		t.Helper()
+		couples, err := client.GetCouples(addresses)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found []uint32
+		for _, address := range addresses {
+			if len(couples[address]) > 0 {
+				found = append(found, address)
+			}
+		}
+		return found
+	}
+
+	out := captureStdout(t, func() { compact(compactOptions{pruneCommon: true, maxDF: 0.5, dryRun: true}) })
+	if !strings.Contains(out, "2 of 8 addresses") || !reflect.DeepEqual(left(), addresses) {
+		t.Errorf("dry run printed %q and left %v", out, left())
+	}
+
+	captureStdout(t, func() { compact(compactOptions{pruneCommon: true, maxDF: 0.5}) })
+	if got := left(); !reflect.DeepEqual(got, []uint32{300, 1000, 1004}) {
+		t.Errorf("addresses left after pruning: %v, want the rare ones", got)
+	}
+}
+
+// withStdin runs fn with stdin reading data.
+func withStdin(t *testing.T, data []byte, fn func()) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "stdin")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	stdin := os.Stdin
+	os.Stdin = f
+	defer func() { os.Stdin = stdin }()
+	fn()
+}
+
+func TestFindReadsStdin(t *testing.T) {
+	requireFFmpeg(t)
+	dir := cliTestDir(t)
+	songs := filepath.Join(dir, "in")
+	os.Mkdir(songs, 0o755)
+	writeTestWav(t, filepath.Join(songs, "first.wav"), 1, 20)
+	writeTestWav(t, filepath.Join(songs, "second.wav"), 2, 20)
+	captureStdout(t, func() { save(songs, saveOptions{workers: 1, quiet: true}) })
+
+	var out string
+	withStdin(t, clipWav(t, 2, 5, 8), func() {
+		out = captureStdout(t, func() { find(stdinPath, 1, 0) })
+	})
+	if !strings.Contains(out, "second") || strings.Contains(out, "first") {
+		t.Errorf("clip of second.wav piped to find -:\n%s", out)
+	}
+	if left, _ := filepath.Glob(filepath.Join("tmp", "stdin_*")); len(left) > 0 {
+		t.Errorf("stdin copy not removed: %v", left)
+	}
+
+	withStdin(t, nil, func() {
+		out = captureStdout(t, func() { find(stdinPath, 1, 0) })
+	})
+	if !strings.Contains(out, "failed to read audio from stdin: no data") {
+		t.Errorf("empty stdin:\n%s", out)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	requireFFmpeg(t)
+	dir := cliTestDir(t)
+	songs := filepath.Join(dir, "in")
+	os.Mkdir(songs, 0o755)
+	writeTestWav(t, filepath.Join(songs, "first.wav"), 1, 20)
+	writeTestWav(t, filepath.Join(songs, "second.wav"), 2, 20)
+	captureStdout(t, func() { save(songs, saveOptions{workers: 1, quiet: true}) })
+	clip := filepath.Join(dir, "clip.wav")
+	if err := os.WriteFile(clip, clipWav(t, 2, 6, 8), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := captureStdout(t, func() { verify(clip, "SECOND", "") })
+	if !strings.Contains(out, "'second' by 'unknown'") || !strings.Contains(out, "top offsets") {
+		t.Fatalf("verify against the clip's song:\n%s", out)
+	}
+	// the clip starts 6s in; offsets are floored to 100ms buckets
+	if !strings.Contains(out, "clip starts at +6.0s") && !strings.Contains(out, "clip starts at +5.9s") {
+		t.Errorf("offset isn't about 6s:\n%s", out)
+	}
+
+	out = captureStdout(t, func() { verify(clip, "first", "unknown") })
+	if strings.Contains(out, "clip starts at +6.0s") || strings.Contains(out, "clip starts at +5.9s") {
+		t.Errorf("clip aligns with a song it isn't from:\n%s", out)
+	}
+
+	out = captureStdout(t, func() { verify(clip, "third", "") })
+	if !strings.Contains(out, "no song titled 'third'") {
+		t.Errorf("unknown title:\n%s", out)
+	}
+}
+
+func TestFindEmptyLibrary(t *testing.T) {
+	dir := cliTestDir(t)
+	clip := filepath.Join(dir, "clip.wav")
+	writeTestWav(t, clip, 1, 5)
+	// the library is checked before the clip is decoded, so this runs
+	// without ffmpeg
+	out := captureStdout(t, func() { find(clip, 1, 0) })
+	if !strings.Contains(out, errEmptyLibrary.Error()) {
+		t.Errorf("find on an empty library:\n%s", out)
+	}
+}
+
+func TestSaveAppend(t *testing.T) {
+	requireFFmpeg(t)
+	dir := cliTestDir(t)
+	first, second := filepath.Join(dir, "part1.wav"), filepath.Join(dir, "part2.wav")
+	writeTestWav(t, first, 1, 20)
+	writeTestWav(t, second, 2, 20)
+	captureStdout(t, func() { save(first, saveOptions{quiet: true}) })
+
+	client := openCLIDB(t)
+	entry, _, err := client.GetSongByKey(utils.GenerateSongKey("part1", "unknown"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := captureStdout(t, func() { save(second, saveOptions{quiet: true, appendTo: entry.ID}) })
+	if !strings.Contains(out, "appended to 'part1' by 'unknown' at 0:20") {
+		t.Fatalf("append output:\n%s", out)
+	}
+	if total, _ := client.TotalSongs(); total != 1 {
+		t.Errorf("%d entries after appending, want 1", total)
+	}
+	if song, _, _ := client.GetSongByID(entry.ID); song.DurationSec != 40 {
+		t.Errorf("entry covers %gs, want 40", song.DurationSec)
+	}
+
+	// a clip from 5s into the second part is 25s into the entry
+	clip := filepath.Join(dir, "clip.wav")
+	if err := os.WriteFile(clip, clipWav(t, 2, 5, 8), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	matches, _, err := matchFile(client, clip, fpConfig, matchOpts, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) == 0 || matches[0].SongID != entry.ID || matches[0].OffsetMs < 24800 || matches[0].OffsetMs > 25100 {
+		t.Errorf("clip of the second part matched %+v, want entry %d at about 25s", matches, entry.ID)
+	}
+
+	out = captureStdout(t, func() { save(second, saveOptions{quiet: true, appendTo: entry.ID + 100}) })
+	if !strings.Contains(out, fmt.Sprintf("no entry with ID %d", entry.ID+100)) {
+		t.Errorf("append to a missing entry:\n%s", out)
+	}
+}
+
+func TestFindMinScore(t *testing.T) {
+	requireFFmpeg(t)
+	dir := cliTestDir(t)
+	song := filepath.Join(dir, "song.wav")
+	writeTestWav(t, song, 1, 20)
+	captureStdout(t, func() { save(song, saveOptions{quiet: true}) })
+	clip := filepath.Join(dir, "clip.wav")
+	if err := os.WriteFile(clip, clipWav(t, 1, 5, 8), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if out := captureStdout(t, func() { find(clip, 1, 1) }); !strings.Contains(out, "final prediction: song") {
+		t.Errorf("match above --min-score 1 hidden:\n%s", out)
+	}
+	out := captureStdout(t, func() { find(clip, 1, 1e6) })
+	if !strings.Contains(out, "no match found: the best score") || !strings.Contains(out, "(song by unknown), is below --min-score 1e+06") {
+		t.Errorf("match below --min-score shown:\n%s", out)
+	}
+}
+
+func TestListAudioFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"a.MP3", "b.flac", "cover.jpg", "notes.txt", "metadata.csv",
+		"sub/c.opus", "sub/old-c.opus", "sub/chapter.m4b",
+		"drafts/d.wav", "e.wav.bak",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		content := "data"
+		if name == "metadata.csv" {
+			content = "a.MP3,Title,Author\n"
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rel := func(paths []string) []string {
+		var out []string
+		for _, p := range paths {
+			r, _ := filepath.Rel(dir, p)
+			out = append(out, filepath.ToSlash(r))
+		}
+		return out
+	}
+
+	listing, err := listAudioFiles(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.MP3", "b.flac", "drafts/d.wav", "sub/c.opus", "sub/chapter.m4b", "sub/old-c.opus"}; !reflect.DeepEqual(rel(listing.files), want) {
+		t.Errorf("files = %v, want %v", rel(listing.files), want)
+	}
+	if want := []string{"cover.jpg", "e.wav.bak", "notes.txt"}; !reflect.DeepEqual(rel(listing.skipped), want) {
+		t.Errorf("skipped = %v, want %v", rel(listing.skipped), want)
+	}
+	if listing.sidecarPath != filepath.Join(dir, "metadata.csv") || len(listing.overrides) != 1 {
+		t.Errorf("sidecar %q with %d overrides", listing.sidecarPath, len(listing.overrides))
+	}
+
+	// by directory, by base name and by relative path; a skipped
+	// directory's files aren't listed
+	listing, err = listAudioFiles(dir, []string{"drafts", "*.m4b", "sub/old-*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.MP3", "b.flac", "sub/c.opus"}; !reflect.DeepEqual(rel(listing.files), want) {
+		t.Errorf("files with excludes = %v, want %v", rel(listing.files), want)
+	}
+	if want := []string{"cover.jpg", "e.wav.bak", "notes.txt", "sub/chapter.m4b", "sub/old-c.opus"}; !reflect.DeepEqual(rel(listing.skipped), want) {
+		t.Errorf("skipped with excludes = %v, want %v", rel(listing.skipped), want)
+	}
+
+	var exclude globList
+	if err := exclude.Set("[a-"); err == nil {
+		t.Error("malformed glob accepted")
+	}
+}
+
+func TestEraseOnlyDeletesErasedExtensions(t *testing.T) {
+	// erase must never delete something save wouldn't have read
+	for ext := range erasedExtensions {
+		if !audioExtensions[ext] {
+			t.Errorf("erase deletes %s files, which save doesn't index", ext)
+		}
+	}
+	if erasedExtensions[".m4b"] || erasedExtensions[".opus"] {
+		t.Error("extensions added to save's walk were added to erase too")
+	}
+}
+
+func TestSaveResume(t *testing.T) {
+	requireFFmpeg(t)
+	dir := cliTestDir(t)
+	songs := filepath.Join(dir, "in")
+	os.Mkdir(songs, 0o755)
+	writeTestWav(t, filepath.Join(songs, "a.wav"), 1, 8)
+	captureStdout(t, func() { save(songs, saveOptions{quiet: true}) })
+
+	client := openCLIDB(t)
+	first, _, err := client.GetSongByKey(utils.GenerateSongKey("a", "unknown"))
+	if err != nil || first.ID == 0 {
+		t.Fatalf("first run didn't index a.wav: %v", err)
+	}
+	before, _ := client.CountFingerprintsForSong(first.ID)
+
+	// the interrupted run is picked up where it left off
+	writeTestWav(t, filepath.Join(songs, "b.wav"), 2, 8)
+	out := captureStdout(t, func() { save(songs, saveOptions{quiet: true, resume: true}) })
+	if !strings.Contains(out, "processed 2 files: 1 successful, 1 already indexed, 0 failed") {
+		t.Errorf("summary missing from:\n%s", out)
+	}
+	if !strings.Contains(out, fmt.Sprintf("skipped 'a' by 'unknown', already indexed (ID %d)", first.ID)) {
+		t.Errorf("skipped file not reported:\n%s", out)
+	}
+	if total, _ := client.TotalSongs(); total != 2 {
+		t.Errorf("%d entries after resuming, want 2", total)
+	}
+	if after, _ := client.CountFingerprintsForSong(first.ID); after != before {
+		t.Errorf("the skipped entry went from %d to %d fingerprints", before, after)
+	}
+
+	// without --resume the file already indexed is a failure
+	out = captureStdout(t, func() { save(songs, saveOptions{quiet: true}) })
+	if !strings.Contains(out, "processed 2 files: 0 successful, 2 failed") {
+		t.Errorf("rerun without --resume:\n%s", out)
+	}
+}
+
+func TestRunFindMatchesAPI(t *testing.T) {
+	requireFFmpeg(t)
+	inTempDir(t)
+	s := newTestServer(t, shazam.DefaultMusicConfig(), 3)
+	clip := clipWav(t, 2, 20, 8)
+	clipPath := filepath.Join(t.TempDir(), "clip.wav")
+	if err := os.WriteFile(clipPath, clip, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	found, _, err := runFind(s.db, clipPath, s.config(), s.matchOpts, maxMatchLimit, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) == 0 || found[0].Title != "song 1" || found[0].Author != "artist" {
+		t.Fatalf("runFind = %+v, want song 1 first", found)
+	}
+
+	// the same results /api/match gives for the clip
+	rec := postMatch(t, s, fmt.Sprintf("?limit=%d", maxMatchLimit), clip)
+	var resp struct{ Matches []matchResult }
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("match: %d %s (%v)", rec.Code, rec.Body, err)
+	}
+	if !reflect.DeepEqual(resp.Matches, found) {
+		t.Errorf("/api/match returned %+v, runFind %+v", resp.Matches, found)
+	}
+
+	// a cut that keeps nothing reports the best match it dropped
+	var below *belowMinScoreError
+	if _, _, err := runFind(s.db, clipPath, s.config(), s.matchOpts, maxMatchLimit, found[0].Score+1); !errors.As(err, &below) || below.best != found[0] {
+		t.Errorf("min score above the best: err = %v, want the best match below it", err)
+	}
+
+	if _, _, err := runFind(db.NewMemoryClient(), clipPath, s.config(), s.matchOpts, maxMatchLimit, 0); !errors.Is(err, errEmptyLibrary) {
+		t.Errorf("empty library: err = %v, want errEmptyLibrary", err)
+	}
+}
+
+func TestSpectrogramDrawsFingerprintPeaks(t *testing.T) {
+	requireFFmpeg(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "song.wav")
+	writeTestWav(t, path, 1, 10)
+
+	defer func(cfg shazam.FingerprintConfig) { fpConfig = cfg }(fpConfig)
+	fpConfig = shazam.DefaultMusicConfig()
+	fpConfig.MaxPeaksPerChunk = 40
+
+	out := captureStdout(t, func() { spectrogram(path, filepath.Join(dir, "song.png")) })
+	var width, height, perColumn, peaks int
+	if _, err := fmt.Sscanf(out, "wrote %dx%d spectrogram (%d frames per column, %d peaks)", &width, &height, &perColumn, &peaks); err != nil {
+		t.Fatalf("output %q: %v", out, err)
+	}
+	// a single chunk, capped as fingerprinting caps it
+	if peaks == 0 || peaks > fpConfig.MaxPeaksPerChunk {
+		t.Errorf("%d peaks drawn, want 1 to %d", peaks, fpConfig.MaxPeaksPerChunk)
+	}
+}
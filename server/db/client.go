@@ -4,40 +4,176 @@ import (
 	"fmt"
 	"song-recognition/models"
 	"song-recognition/utils"
+	"sort"
+	"sync"
 )
 
 type DBClient interface {
 	Close() error
 	StoreFingerprints(fingerprints map[uint32]models.Couple) error
 	GetCouples(addresses []uint32) (map[uint32][]models.Couple, error)
+	GetCouplesForSongs(addresses []uint32, songIDs []uint32) (map[uint32][]models.Couple, error)
 	TotalSongs() (int, error)
 	TotalFingerprints() (int, error)
-	RegisterSong(songTitle, songArtist, ytID string) (uint32, error)
+	RegisterSong(songTitle, songArtist, ytID, sourcePath string) (uint32, error)
 	GetSong(filterKey string, value interface{}) (Song, bool, error)
 	GetSongByID(songID uint32) (Song, bool, error)
 	GetSongByYTID(ytID string) (Song, bool, error)
 	GetSongByKey(key string) (Song, bool, error)
 	GetAllSongs() ([]SongWithID, error)
 	CountFingerprintsForSong(songID uint32) (int, error)
+	// CountFingerprintsForSongs is CountFingerprintsForSong for many songs
+	// at once, without a query per song. songs with no fingerprints may
+	// be left out of the result.
+	CountFingerprintsForSongs(songIDs []uint32) (map[uint32]int, error)
+	GetFingerprintsBySong(songID uint32) ([]models.Fingerprint, error)
 	DeleteSongByID(songID uint32) error
+	// SetSongDuration records the length in seconds of the audio a song's
+	// fingerprints cover.
+	SetSongDuration(songID uint32, durationSec float64) error
+	DeleteFingerprintsForSong(songID uint32) error
+	// ReplaceFingerprintsForSong swaps a song's fingerprints for a new
+	// set, e.g. when reindexing. if it fails the song keeps its old set;
+	// it never ends up with neither.
+	ReplaceFingerprintsForSong(songID uint32, fingerprints map[uint32]models.Couple) error
 	DeleteCollection(collectionName string) error
+
+	// AddressSongCounts returns, for every stored address, how many
+	// distinct songs have a fingerprint with it.
+	AddressSongCounts() (map[uint32]int, error)
+	// DeleteAddresses removes every fingerprint with one of addresses.
+	DeleteAddresses(addresses []uint32) error
+	// LibraryComposition returns the number of songs per author, most
+	// indexed first.
+	LibraryComposition() ([]AuthorCount, error)
+}
+
+// sortFingerprints orders fingerprints by anchor time, then address, so
+// every backend returns them (and pages through them) the same way.
+func sortFingerprints(fps []models.Fingerprint) {
+	sort.Slice(fps, func(i, j int) bool {
+		if fps[i].AnchorTimeMs != fps[j].AnchorTimeMs {
+			return fps[i].AnchorTimeMs < fps[j].AnchorTimeMs
+		}
+		return fps[i].Address < fps[j].Address
+	})
+}
+
+// filterCouplesBySong keeps only couples belonging to songIDs, dropping
+// addresses left with none.
+func filterCouplesBySong(couples map[uint32][]models.Couple, songIDs []uint32) map[uint32][]models.Couple {
+	wanted := make(map[uint32]bool, len(songIDs))
+	for _, id := range songIDs {
+		wanted[id] = true
+	}
+
+	filtered := make(map[uint32][]models.Couple, len(couples))
+	for address, list := range couples {
+		var kept []models.Couple
+		for _, c := range list {
+			if wanted[c.SongID] {
+				kept = append(kept, c)
+			}
+		}
+		if len(kept) > 0 {
+			filtered[address] = kept
+		}
+	}
+	return filtered
 }
 
 type Song struct {
+	ID        uint32
 	Title     string
 	Artist    string
 	YouTubeID string
+	// SourcePath is the absolute path of the audio file the song was
+	// fingerprinted from, used to reindex it. for web uploads it is just
+	// the uploaded file's name; empty when unknown.
+	SourcePath string
+	// DurationSec is the length of the audio fingerprinted for the song,
+	// including parts appended later; 0 for songs indexed before it was
+	// recorded.
+	DurationSec float64
 }
 
 type SongWithID struct {
-	ID     uint32
-	Title  string
+	ID         uint32
+	Title      string
+	Artist     string
+	SourcePath string
+}
+
+// AuthorCount is how many songs of one author are indexed.
+type AuthorCount struct {
 	Artist string
+	Songs  int
+}
+
+// countAuthors aggregates songs into per-author counts, ordered by count
+// and then by name, for backends without a GROUP BY.
+func countAuthors(songs []SongWithID) []AuthorCount {
+	counts := make(map[string]int)
+	for _, song := range songs {
+		counts[song.Artist]++
+	}
+
+	authors := make([]AuthorCount, 0, len(counts))
+	for artist, n := range counts {
+		authors = append(authors, AuthorCount{Artist: artist, Songs: n})
+	}
+	sort.Slice(authors, func(i, j int) bool {
+		if authors[i].Songs != authors[j].Songs {
+			return authors[i].Songs > authors[j].Songs
+		}
+		return authors[i].Artist < authors[j].Artist
+	})
+	return authors
 }
 
-var DBtype = utils.GetEnv("DB_TYPE", "sqlite") // Can be "sqlite" or "mongo"
+var DBtype = utils.GetEnv("DB_TYPE", "sqlite") // Can be "sqlite", "sqlite-postings", "mongo" or "memory"
 
+// NewDBClient opens the database DBtype names. the first call in a
+// process also re-keys its songs under the current utils.SongKeys mode
+// (see songRekeyer).
 func NewDBClient() (DBClient, error) {
+	client, err := openDBClient()
+	if err != nil {
+		return nil, err
+	}
+	if rekeyer, ok := client.(songRekeyer); ok {
+		rekeyOnce.Do(func() {
+			changed, kept, err := rekeyer.rekeySongs()
+			switch {
+			case err != nil:
+				utils.Warnf("[db] failed to re-key songs: %v", err)
+			case kept > 0:
+				utils.Warnf("[db] re-keyed %d songs; %d kept their old keys, which another song already has", changed, kept)
+			case changed > 0:
+				utils.Infof("[db] re-keyed %d songs for the current -song-keys mode", changed)
+			}
+		})
+	}
+	return client, nil
+}
+
+// songRekeyer is implemented by backends that persist song keys. keys
+// are computed when a song is saved, with the -song-keys mode of that
+// run, and looked up by the mode of the current one, so rows saved under
+// another mode would never be found as duplicates (the 409 on upload,
+// `save --resume`, merge conflicts). rekeySongs recomputes every stored
+// key, returning how many changed and how many were left alone because
+// the new key belongs to another song.
+type songRekeyer interface {
+	rekeySongs() (changed, kept int, err error)
+}
+
+// rekeyOnce keeps the re-keying scan to one per process. the server opens
+// a single client, but CLI commands and the Spotify helpers each open
+// their own.
+var rekeyOnce sync.Once
+
+func openDBClient() (DBClient, error) {
 	switch DBtype {
 	case "mongo":
 		var (
@@ -57,6 +193,12 @@ func NewDBClient() (DBClient, error) {
 	case "sqlite":
 		return NewSQLiteClient("db/db.sqlite3")
 
+	case "sqlite-postings":
+		return NewSQLitePostingsClient("db/db.sqlite3")
+
+	case "memory":
+		return &MemoryClient{store: sharedMemoryStore}, nil
+
 	default:
 		return nil, fmt.Errorf("unsupported database type: %s", DBtype)
 	}
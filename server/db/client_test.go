@@ -0,0 +1,442 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"song-recognition/models"
+	"song-recognition/utils"
+	"testing"
+)
+
+// eachClient runs fn against a fresh client of every backend that needs
+// no server.
+func eachClient(t *testing.T, fn func(t *testing.T, client DBClient)) {
+	t.Helper()
+	backends := []struct {
+		name string
+		open func(path string) (DBClient, error)
+	}{
+		{"memory", func(string) (DBClient, error) { return NewMemoryClient(), nil }},
+		{"sqlite", func(path string) (DBClient, error) { return NewSQLiteClient(path) }},
+		{"sqlite-postings", func(path string) (DBClient, error) { return NewSQLitePostingsClient(path) }},
+	}
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			client, err := b.open(filepath.Join(t.TempDir(), "db.sqlite3"))
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			defer client.Close()
+			fn(t, client)
+		})
+	}
+}
+
+// songFingerprints returns n fingerprints for songID at addresses
+// base, base+1, ... so songs stored with overlapping bases share some.
+func songFingerprints(songID uint32, base uint32, n int) map[uint32]models.Couple {
+	fps := make(map[uint32]models.Couple, n)
+	for i := 0; i < n; i++ {
+		fps[base+uint32(i)] = models.Couple{SongID: songID, AnchorTimeMs: uint32(i * 10)}
+	}
+	return fps
+}
+
+func mustRegister(t *testing.T, client DBClient, title string) uint32 {
+	t.Helper()
+	id, err := client.RegisterSong(title, "artist", "", "")
+	if err != nil {
+		t.Fatalf("RegisterSong(%q): %v", title, err)
+	}
+	return id
+}
+
+func mustStore(t *testing.T, client DBClient, fps map[uint32]models.Couple) {
+	t.Helper()
+	if err := client.StoreFingerprints(fps); err != nil {
+		t.Fatalf("StoreFingerprints: %v", err)
+	}
+}
+
+func TestReplaceFingerprintsForSong(t *testing.T) {
+	eachClient(t, func(t *testing.T, client DBClient) {
+		a := mustRegister(t, client, "a")
+		b := mustRegister(t, client, "b")
+		mustStore(t, client, songFingerprints(a, 0, 50))
+		mustStore(t, client, songFingerprints(b, 25, 50))
+
+		replacement := songFingerprints(a, 1000, 20)
+		if err := client.ReplaceFingerprintsForSong(a, replacement); err != nil {
+			t.Fatalf("ReplaceFingerprintsForSong: %v", err)
+		}
+
+		fps, err := client.GetFingerprintsBySong(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fps) != len(replacement) {
+			t.Fatalf("song has %d fingerprints after replace, want %d", len(fps), len(replacement))
+		}
+		for _, fp := range fps {
+			if c, ok := replacement[fp.Address]; !ok || c.AnchorTimeMs != fp.AnchorTimeMs {
+				t.Fatalf("unexpected fingerprint %+v after replace", fp)
+			}
+		}
+
+		// the other song's couples, some at shared addresses, are untouched
+		if n, _ := client.CountFingerprintsForSong(b); n != 50 {
+			t.Errorf("other song has %d fingerprints, want 50", n)
+		}
+		if n, _ := client.CountFingerprintsForSong(a); n != len(replacement) {
+			t.Errorf("CountFingerprintsForSong = %d, want %d", n, len(replacement))
+		}
+	})
+}
+
+func TestPostingsIndexBuiltForOlderDatabases(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.sqlite3")
+	client, err := NewSQLitePostingsClient(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := mustRegister(t, client, "a")
+	mustStore(t, client, songFingerprints(a, 0, 30))
+	// as written before posting_songs existed
+	if _, err := client.db.Exec("DROP TABLE posting_songs"); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	client, err = NewSQLitePostingsClient(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	fps, err := client.GetFingerprintsBySong(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fps) != 30 {
+		t.Fatalf("found %d fingerprints after reopening, want 30", len(fps))
+	}
+	if err := client.DeleteFingerprintsForSong(a); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := client.TotalFingerprints(); n != 0 {
+		t.Errorf("%d fingerprints left after deleting the only song", n)
+	}
+}
+
+func TestCountFingerprintsForSongs(t *testing.T) {
+	eachClient(t, func(t *testing.T, client DBClient) {
+		a := mustRegister(t, client, "a")
+		b := mustRegister(t, client, "b")
+		c := mustRegister(t, client, "c")
+		mustStore(t, client, songFingerprints(a, 0, 40))
+		mustStore(t, client, songFingerprints(b, 20, 30))
+		// storing the same couples again must not count them twice
+		mustStore(t, client, songFingerprints(a, 0, 40))
+
+		counts, err := client.CountFingerprintsForSongs([]uint32{a, b, c})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if counts[a] != 40 || counts[b] != 30 || counts[c] != 0 {
+			t.Fatalf("counts = %v, want a=40 b=30 c=0", counts)
+		}
+
+		// addresses 20-29 hold couples of both songs
+		if err := client.DeleteAddresses([]uint32{20, 21, 22, 23, 24, 25, 26, 27, 28, 29}); err != nil {
+			t.Fatal(err)
+		}
+		counts, err = client.CountFingerprintsForSongs([]uint32{a, b})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if counts[a] != 30 || counts[b] != 20 {
+			t.Errorf("after deleting shared addresses counts = %v, want a=30 b=20", counts)
+		}
+
+		if err := client.DeleteFingerprintsForSong(a); err != nil {
+			t.Fatal(err)
+		}
+		if n, _ := client.CountFingerprintsForSong(a); n != 0 {
+			t.Errorf("CountFingerprintsForSong after delete = %d, want 0", n)
+		}
+	})
+}
+
+func TestSQLiteCountsRebuilt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.sqlite3")
+	client, err := NewSQLiteClient(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := mustRegister(t, client, "a")
+	mustStore(t, client, songFingerprints(a, 0, 25))
+	// as written before fingerprint_counts existed
+	if _, err := client.db.Exec("DROP TABLE fingerprint_counts"); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	client, err = NewSQLiteClient(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := client.CountFingerprintsForSong(a); n != 25 {
+		t.Errorf("reopened database counts %d fingerprints, want 25", n)
+	}
+	client.Close()
+
+	// through the posting layout and back again
+	postings, err := NewSQLitePostingsClient(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := postings.CountFingerprintsForSong(a); n != 25 {
+		t.Errorf("posting layout counts %d fingerprints, want 25", n)
+	}
+	postings.Close()
+
+	client, err = NewSQLiteClient(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if n, _ := client.CountFingerprintsForSong(a); n != 25 {
+		t.Errorf("row layout counts %d fingerprints, want 25", n)
+	}
+}
+
+func TestRekeySongs(t *testing.T) {
+	defer func(mode utils.SongKeyMode) { utils.SongKeys = mode }(utils.SongKeys)
+
+	client, err := NewSQLiteClient(filepath.Join(t.TempDir(), "db.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// saved by an older run with strict keys
+	utils.SongKeys = utils.SongKeysStrict
+	dune := mustRegister(t, client, "Dune ")
+	mustRegister(t, client, "The Hobbit ")
+	hobbit := mustRegister(t, client, "the hobbit")
+
+	utils.SongKeys = utils.SongKeysNormalized
+	changed, kept, err := client.rekeySongs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// "the hobbit" already has the normalized key "The Hobbit " would get
+	if changed != 1 || kept != 1 {
+		t.Errorf("rekeySongs() = %d changed, %d kept; want 1 and 1", changed, kept)
+	}
+
+	for title, want := range map[string]uint32{"DUNE": dune, "The  Hobbit": hobbit} {
+		song, found, err := client.GetSongByKey(utils.GenerateSongKey(title, "Artist"))
+		if err != nil || !found {
+			t.Fatalf("%q not found by its normalized key (err %v)", title, err)
+		}
+		if song.ID != want {
+			t.Errorf("%q found song %d, want %d", title, song.ID, want)
+		}
+	}
+}
+
+func TestGetSongByKeyReturnsID(t *testing.T) {
+	eachClient(t, func(t *testing.T, client DBClient) {
+		mustRegister(t, client, "a")
+		b := mustRegister(t, client, "b")
+		song, found, err := client.GetSongByKey(utils.GenerateSongKey("b", "artist"))
+		if err != nil || !found {
+			t.Fatalf("GetSongByKey: found=%v err=%v", found, err)
+		}
+		if song.ID != b || song.Title != "b" || song.Artist != "artist" {
+			t.Errorf("GetSongByKey = %+v, want song %d", song, b)
+		}
+	})
+}
+
+func TestClientSongs(t *testing.T) {
+	eachClient(t, func(t *testing.T, client DBClient) {
+		id, err := client.RegisterSong("Title", "Artist", "yt1", "/music/title.mp3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.RegisterSong("Title", "Artist", "", ""); err == nil {
+			t.Error("registering the same title and artist twice succeeded")
+		}
+		// only the key is unique; the YouTube ID is checked by callers
+		other, err := client.RegisterSong("Other", "Artist", "yt1", "")
+		if err != nil {
+			t.Fatalf("registering a second song with the same YouTube ID: %v", err)
+		}
+
+		want := Song{ID: id, Title: "Title", Artist: "Artist", YouTubeID: "yt1", SourcePath: "/music/title.mp3"}
+		for name, lookup := range map[string]func() (Song, bool, error){
+			"id":  func() (Song, bool, error) { return client.GetSongByID(id) },
+			"key": func() (Song, bool, error) { return client.GetSongByKey(utils.GenerateSongKey("Title", "Artist")) },
+		} {
+			song, found, err := lookup()
+			if err != nil || !found || song != want {
+				t.Errorf("by %s: %+v, found=%v, err=%v; want %+v", name, song, found, err, want)
+			}
+		}
+		if song, found, _ := client.GetSongByYTID("yt1"); !found || song.YouTubeID != "yt1" {
+			t.Errorf("by ytID: %+v, found=%v", song, found)
+		}
+		if _, found, err := client.GetSongByID(0); found || err != nil {
+			t.Errorf("unknown ID: found=%v err=%v", found, err)
+		}
+
+		if err := client.SetSongDuration(id, 12.5); err != nil {
+			t.Fatal(err)
+		}
+		if song, _, _ := client.GetSongByID(id); song.DurationSec != 12.5 {
+			t.Errorf("DurationSec = %g after SetSongDuration(12.5)", song.DurationSec)
+		}
+
+		if n, _ := client.TotalSongs(); n != 2 {
+			t.Errorf("TotalSongs = %d, want 2", n)
+		}
+		songs, err := client.GetAllSongs()
+		if err != nil || len(songs) != 2 {
+			t.Fatalf("GetAllSongs = %v, %v", songs, err)
+		}
+
+		if err := client.DeleteSongByID(other); err != nil {
+			t.Fatal(err)
+		}
+		if _, found, _ := client.GetSongByID(other); found {
+			t.Error("deleted song still found")
+		}
+		if err := client.DeleteCollection("songs"); err != nil {
+			t.Fatal(err)
+		}
+		if n, _ := client.TotalSongs(); n != 0 {
+			t.Errorf("TotalSongs = %d after deleting the collection", n)
+		}
+	})
+}
+
+func TestClientFingerprints(t *testing.T) {
+	eachClient(t, func(t *testing.T, client DBClient) {
+		a := mustRegister(t, client, "a")
+		b := mustRegister(t, client, "b")
+		mustStore(t, client, songFingerprints(a, 0, 10))
+		mustStore(t, client, songFingerprints(b, 5, 10))
+
+		if n, _ := client.TotalFingerprints(); n != 20 {
+			t.Errorf("TotalFingerprints = %d, want 20", n)
+		}
+
+		couples, err := client.GetCouples([]uint32{0, 7, 99})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(couples[0]) != 1 || len(couples[7]) != 2 || len(couples[99]) != 0 {
+			t.Errorf("GetCouples = %v, want 1 couple at 0, 2 at 7 and none at 99", couples)
+		}
+		couples, err = client.GetCouplesForSongs([]uint32{0, 7, 12}, []uint32{b})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(couples) != 2 || couples[7][0].SongID != b || couples[12][0].SongID != b {
+			t.Errorf("GetCouplesForSongs restricted to b = %v", couples)
+		}
+
+		fps, err := client.GetFingerprintsBySong(a)
+		if err != nil || len(fps) != 10 {
+			t.Fatalf("GetFingerprintsBySong = %d fingerprints, %v; want 10", len(fps), err)
+		}
+		for i := 1; i < len(fps); i++ {
+			if fps[i].AnchorTimeMs < fps[i-1].AnchorTimeMs {
+				t.Fatalf("fingerprints not in anchor time order: %v", fps)
+			}
+		}
+
+		if err := client.DeleteFingerprintsForSong(a); err != nil {
+			t.Fatal(err)
+		}
+		if n, _ := client.TotalFingerprints(); n != 10 {
+			t.Errorf("TotalFingerprints = %d after deleting a's, want 10", n)
+		}
+		if err := client.DeleteCollection("fingerprints"); err != nil {
+			t.Fatal(err)
+		}
+		if n, _ := client.TotalFingerprints(); n != 0 {
+			t.Errorf("TotalFingerprints = %d after deleting the collection", n)
+		}
+	})
+}
+
+func TestAddressSongCounts(t *testing.T) {
+	eachClient(t, func(t *testing.T, client DBClient) {
+		a := mustRegister(t, client, "a")
+		b := mustRegister(t, client, "b")
+		mustStore(t, client, songFingerprints(a, 0, 10))
+		mustStore(t, client, songFingerprints(b, 5, 10))
+
+		counts, err := client.AddressSongCounts()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(counts) != 15 {
+			t.Fatalf("%d addresses counted, want 15", len(counts))
+		}
+		for address, n := range counts {
+			want := 1
+			if address >= 5 && address < 10 {
+				want = 2
+			}
+			if n != want {
+				t.Errorf("address %d in %d songs, want %d", address, n, want)
+			}
+		}
+	})
+}
+
+func TestSetSongDuration(t *testing.T) {
+	eachClient(t, func(t *testing.T, client DBClient) {
+		id := mustRegister(t, client, "book")
+		if song, _, _ := client.GetSongByID(id); song.DurationSec != 0 {
+			t.Errorf("new song has duration %g, want 0", song.DurationSec)
+		}
+		if err := client.SetSongDuration(id, 1234.5); err != nil {
+			t.Fatal(err)
+		}
+		song, found, err := client.GetSongByID(id)
+		if err != nil || !found || song.DurationSec != 1234.5 {
+			t.Errorf("GetSongByID = %+v, %v, %v; want duration 1234.5", song, found, err)
+		}
+		if song, _, _ := client.GetSongByKey(utils.GenerateSongKey("book", "artist")); song.DurationSec != 1234.5 {
+			t.Errorf("GetSongByKey duration %g, want 1234.5", song.DurationSec)
+		}
+	})
+}
+
+func TestLibraryComposition(t *testing.T) {
+	eachClient(t, func(t *testing.T, client DBClient) {
+		if authors, err := client.LibraryComposition(); err != nil || len(authors) != 0 {
+			t.Fatalf("empty library: %v, %v", authors, err)
+		}
+		for i, artist := range []string{"Pratchett", "Austen", "Pratchett", "Brontë", "Austen", "Pratchett"} {
+			if _, err := client.RegisterSong(fmt.Sprintf("book %d", i), artist, "", ""); err != nil {
+				t.Fatal(err)
+			}
+		}
+		authors, err := client.LibraryComposition()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// most first, ties by name
+		want := []AuthorCount{{"Pratchett", 3}, {"Austen", 2}, {"Brontë", 1}}
+		if !reflect.DeepEqual(authors, want) {
+			t.Errorf("LibraryComposition = %v, want %v", authors, want)
+		}
+	})
+}
@@ -0,0 +1,364 @@
+package db
+
+import (
+	"fmt"
+	"song-recognition/models"
+	"song-recognition/utils"
+	"sort"
+	"sync"
+)
+
+// MemoryClient is a DBClient backed by maps. nothing is persisted; it is
+// meant for tests and throwaway `serve --db memory` sessions.
+type MemoryClient struct {
+	store *memoryStore
+}
+
+type memorySong struct {
+	Song
+	key string
+}
+
+type memoryStore struct {
+	mu           sync.RWMutex
+	songs        map[uint32]memorySong
+	fingerprints map[uint32][]models.Couple // address -> couples
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		songs:        make(map[uint32]memorySong),
+		fingerprints: make(map[uint32][]models.Couple),
+	}
+}
+
+// sharedMemoryStore backs every client returned by NewDBClient when
+// DBtype is "memory", so handlers that open a client per request still
+// see each other's writes for the lifetime of the process.
+var sharedMemoryStore = newMemoryStore()
+
+// NewMemoryClient returns a client with its own empty store.
+func NewMemoryClient() *MemoryClient {
+	return &MemoryClient{store: newMemoryStore()}
+}
+
+func (db *MemoryClient) Close() error {
+	return nil
+}
+
+func (db *MemoryClient) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
+	s := db.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.storeFingerprints(fingerprints)
+	return nil
+}
+
+// storeFingerprints adds couples not already stored. s.mu must be held.
+func (s *memoryStore) storeFingerprints(fingerprints map[uint32]models.Couple) {
+	for address, couple := range fingerprints {
+		existing := s.fingerprints[address]
+		duplicate := false
+		for _, c := range existing {
+			if c == couple {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			s.fingerprints[address] = append(existing, couple)
+		}
+	}
+}
+
+func (db *MemoryClient) GetCouples(addresses []uint32) (map[uint32][]models.Couple, error) {
+	s := db.store
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	couples := make(map[uint32][]models.Couple)
+	for _, address := range addresses {
+		if found, ok := s.fingerprints[address]; ok {
+			couples[address] = append([]models.Couple(nil), found...)
+		}
+	}
+	return couples, nil
+}
+
+func (db *MemoryClient) GetCouplesForSongs(addresses []uint32, songIDs []uint32) (map[uint32][]models.Couple, error) {
+	couples, err := db.GetCouples(addresses)
+	if err != nil || len(songIDs) == 0 {
+		return couples, err
+	}
+	return filterCouplesBySong(couples, songIDs), nil
+}
+
+func (db *MemoryClient) TotalSongs() (int, error) {
+	s := db.store
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.songs), nil
+}
+
+func (db *MemoryClient) TotalFingerprints() (int, error) {
+	s := db.store
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	total := 0
+	for _, couples := range s.fingerprints {
+		total += len(couples)
+	}
+	return total, nil
+}
+
+func (db *MemoryClient) RegisterSong(songTitle, songArtist, ytID, sourcePath string) (uint32, error) {
+	s := db.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// like the other backends, only the key has to be unique; callers
+	// check YouTube IDs with GetSongByYTID
+	key := utils.GenerateSongKey(songTitle, songArtist)
+	for _, song := range s.songs {
+		if song.key == key {
+			return 0, fmt.Errorf("song with ytID or key already exists: %s", key)
+		}
+	}
+
+	songID := utils.GenerateUniqueID()
+	for _, taken := s.songs[songID]; taken; _, taken = s.songs[songID] {
+		songID = utils.GenerateUniqueID()
+	}
+
+	s.songs[songID] = memorySong{
+		Song: Song{ID: songID, Title: songTitle, Artist: songArtist, YouTubeID: ytID, SourcePath: sourcePath},
+		key:  key,
+	}
+	return songID, nil
+}
+
+var memoryfilterKeys = "id | _id | ytID | key"
+
+func (db *MemoryClient) GetSong(filterKey string, value interface{}) (Song, bool, error) {
+	s := db.store
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	switch filterKey {
+	case "id", "_id":
+		id, ok := value.(uint32)
+		if !ok {
+			return Song{}, false, fmt.Errorf("invalid value for %s: %v", filterKey, value)
+		}
+		song, found := s.songs[id]
+		return song.Song, found, nil
+
+	case "ytID", "key":
+		str, ok := value.(string)
+		if !ok {
+			return Song{}, false, fmt.Errorf("invalid value for %s: %v", filterKey, value)
+		}
+		for _, song := range s.songs {
+			if (filterKey == "key" && song.key == str) || (filterKey == "ytID" && song.YouTubeID == str) {
+				return song.Song, true, nil
+			}
+		}
+		return Song{}, false, nil
+
+	default:
+		return Song{}, false, fmt.Errorf("invalid filter key (expected %s)", memoryfilterKeys)
+	}
+}
+
+func (db *MemoryClient) GetSongByID(songID uint32) (Song, bool, error) {
+	return db.GetSong("id", songID)
+}
+
+func (db *MemoryClient) GetSongByYTID(ytID string) (Song, bool, error) {
+	return db.GetSong("ytID", ytID)
+}
+
+func (db *MemoryClient) GetSongByKey(key string) (Song, bool, error) {
+	return db.GetSong("key", key)
+}
+
+func (db *MemoryClient) SetSongDuration(songID uint32, durationSec float64) error {
+	s := db.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	song, ok := s.songs[songID]
+	if !ok {
+		return fmt.Errorf("song %d not found", songID)
+	}
+	song.DurationSec = durationSec
+	s.songs[songID] = song
+	return nil
+}
+
+func (db *MemoryClient) GetAllSongs() ([]SongWithID, error) {
+	s := db.store
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	songs := make([]SongWithID, 0, len(s.songs))
+	for id, song := range s.songs {
+		songs = append(songs, SongWithID{ID: id, Title: song.Title, Artist: song.Artist, SourcePath: song.SourcePath})
+	}
+	sort.Slice(songs, func(i, j int) bool { return songs[i].ID < songs[j].ID })
+	return songs, nil
+}
+
+func (db *MemoryClient) CountFingerprintsForSong(songID uint32) (int, error) {
+	s := db.store
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := 0
+	for _, couples := range s.fingerprints {
+		for _, c := range couples {
+			if c.SongID == songID {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+func (db *MemoryClient) CountFingerprintsForSongs(songIDs []uint32) (map[uint32]int, error) {
+	s := db.store
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	wanted := make(map[uint32]bool, len(songIDs))
+	for _, id := range songIDs {
+		wanted[id] = true
+	}
+	counts := make(map[uint32]int, len(songIDs))
+	for _, couples := range s.fingerprints {
+		for _, c := range couples {
+			if wanted[c.SongID] {
+				counts[c.SongID]++
+			}
+		}
+	}
+	return counts, nil
+}
+
+func (db *MemoryClient) GetFingerprintsBySong(songID uint32) ([]models.Fingerprint, error) {
+	s := db.store
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var fingerprints []models.Fingerprint
+	for address, couples := range s.fingerprints {
+		for _, c := range couples {
+			if c.SongID == songID {
+				fingerprints = append(fingerprints, models.Fingerprint{Address: address, AnchorTimeMs: c.AnchorTimeMs})
+			}
+		}
+	}
+	sortFingerprints(fingerprints)
+	return fingerprints, nil
+}
+
+// DeleteSongByID removes the song record. like the other backends it
+// leaves fingerprints in place; matching skips songs that no longer exist.
+func (db *MemoryClient) DeleteSongByID(songID uint32) error {
+	s := db.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.songs, songID)
+	return nil
+}
+
+func (db *MemoryClient) DeleteFingerprintsForSong(songID uint32) error {
+	s := db.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deleteFingerprintsForSong(songID)
+	return nil
+}
+
+// deleteFingerprintsForSong drops every couple of songID. s.mu must be held.
+func (s *memoryStore) deleteFingerprintsForSong(songID uint32) {
+	for address, couples := range s.fingerprints {
+		kept := couples[:0]
+		for _, c := range couples {
+			if c.SongID != songID {
+				kept = append(kept, c)
+			}
+		}
+		if len(kept) == 0 {
+			delete(s.fingerprints, address)
+		} else {
+			s.fingerprints[address] = kept
+		}
+	}
+}
+
+func (db *MemoryClient) ReplaceFingerprintsForSong(songID uint32, fingerprints map[uint32]models.Couple) error {
+	s := db.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deleteFingerprintsForSong(songID)
+	s.storeFingerprints(fingerprints)
+	return nil
+}
+
+func (db *MemoryClient) AddressSongCounts() (map[uint32]int, error) {
+	s := db.store
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counts := make(map[uint32]int, len(s.fingerprints))
+	for address, couples := range s.fingerprints {
+		songs := make(map[uint32]bool)
+		for _, c := range couples {
+			songs[c.SongID] = true
+		}
+		counts[address] = len(songs)
+	}
+	return counts, nil
+}
+
+func (db *MemoryClient) LibraryComposition() ([]AuthorCount, error) {
+	songs, err := db.GetAllSongs()
+	if err != nil {
+		return nil, err
+	}
+	return countAuthors(songs), nil
+}
+
+func (db *MemoryClient) DeleteAddresses(addresses []uint32) error {
+	s := db.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, address := range addresses {
+		delete(s.fingerprints, address)
+	}
+	return nil
+}
+
+func (db *MemoryClient) DeleteCollection(collectionName string) error {
+	s := db.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch collectionName {
+	case "songs":
+		s.songs = make(map[uint32]memorySong)
+	case "fingerprints":
+		s.fingerprints = make(map[uint32][]models.Couple)
+	default:
+		return fmt.Errorf("error deleting collection: unknown collection %q", collectionName)
+	}
+	return nil
+}
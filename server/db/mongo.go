@@ -7,6 +7,7 @@ import (
 	"song-recognition/models"
 	"song-recognition/utils"
 	"strings"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -35,29 +36,74 @@ func (db *MongoClient) Close() error {
 }
 
 func (db *MongoClient) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
+	return db.storeCouples(fingerprints, bson.M{})
+}
+
+// storeCouples adds each couple, with extra fields alongside its own, to
+// its address document.
+func (db *MongoClient) storeCouples(fingerprints map[uint32]models.Couple, extra bson.M) error {
 	collection := db.client.Database("song-recognition").Collection("fingerprints")
 
+	added := make(map[uint32]int)
+	defer func() {
+		// count what made it in even if a later couple failed
+		if err := db.addFingerprintCounts(added); err != nil {
+			utils.Warnf("[db] failed to update fingerprint counts: %v", err)
+		}
+	}()
+
 	for address, couple := range fingerprints {
-		filter := bson.M{"_id": address}
-		update := bson.M{
-			"$push": bson.M{
-				"couples": bson.M{
-					"anchorTimeMs": couple.AnchorTimeMs,
-					"songID":       couple.SongID,
-				},
-			},
+		doc := bson.M{
+			"anchorTimeMs": couple.AnchorTimeMs,
+			"songID":       couple.SongID,
 		}
+		for k, v := range extra {
+			doc[k] = v
+		}
+
+		filter := bson.M{"_id": address}
+		// $addToSet rather than $push keeps a retried store from
+		// duplicating couples that made it in on the failed attempt
+		update := bson.M{"$addToSet": bson.M{"couples": doc}}
 		opts := options.Update().SetUpsert(true)
 
-		_, err := collection.UpdateOne(context.Background(), filter, update, opts)
+		res, err := collection.UpdateOne(context.Background(), filter, update, opts)
 		if err != nil {
-			return fmt.Errorf("error upserting document: %s", err)
+			return fmt.Errorf("error upserting document: %w", err)
+		}
+		if res.ModifiedCount > 0 || res.UpsertedCount > 0 {
+			added[couple.SongID]++
 		}
 	}
 
 	return nil
 }
 
+// addFingerprintCounts adjusts the fingerprintCount of song documents by
+// delta. songs registered before counts were kept have none and are left
+// alone; CountFingerprintsForSongs fills theirs in when first asked.
+func (db *MongoClient) addFingerprintCounts(delta map[uint32]int) error {
+	songs := db.client.Database("song-recognition").Collection("songs")
+	for songID, n := range delta {
+		if n == 0 {
+			continue
+		}
+		filter := bson.M{"_id": songID, "fingerprintCount": bson.M{"$exists": true}}
+		_, err := songs.UpdateOne(context.Background(), filter, bson.M{"$inc": bson.M{"fingerprintCount": n}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setFingerprintCount records songID's fingerprint count outright.
+func (db *MongoClient) setFingerprintCount(songID uint32, count int) error {
+	songs := db.client.Database("song-recognition").Collection("songs")
+	_, err := songs.UpdateOne(context.Background(), bson.M{"_id": songID}, bson.M{"$set": bson.M{"fingerprintCount": count}})
+	return err
+}
+
 func (db *MongoClient) GetCouples(addresses []uint32) (map[uint32][]models.Couple, error) {
 	collection := db.client.Database("song-recognition").Collection("fingerprints")
 
@@ -99,6 +145,17 @@ func (db *MongoClient) GetCouples(addresses []uint32) (map[uint32][]models.Coupl
 	return couples, nil
 }
 
+// GetCouplesForSongs is GetCouples restricted to couples of the given
+// songs. an empty songIDs means no restriction. couples for one address
+// live in a single document, so the filter is applied after fetching it.
+func (db *MongoClient) GetCouplesForSongs(addresses []uint32, songIDs []uint32) (map[uint32][]models.Couple, error) {
+	couples, err := db.GetCouples(addresses)
+	if err != nil || len(songIDs) == 0 {
+		return couples, err
+	}
+	return filterCouplesBySong(couples, songIDs), nil
+}
+
 func (db *MongoClient) TotalSongs() (int, error) {
 	existingSongsCollection := db.client.Database("song-recognition").Collection("songs")
 	total, err := existingSongsCollection.CountDocuments(context.Background(), bson.D{})
@@ -109,12 +166,12 @@ func (db *MongoClient) TotalSongs() (int, error) {
 	return int(total), nil
 }
 
-func (db *MongoClient) RegisterSong(songTitle, songArtist, ytID string) (uint32, error) {
+func (db *MongoClient) RegisterSong(songTitle, songArtist, ytID, sourcePath string) (uint32, error) {
 	existingSongsCollection := db.client.Database("song-recognition").Collection("songs")
 
 	// Create a compound unique index on ytID and key, if it doesn't already exist
 	indexModel := mongo.IndexModel{
-		Keys:    bson.D{{"ytID", 1}, {"key", 1}},
+		Keys:    bson.D{{Key: "ytID", Value: 1}, {Key: "key", Value: 1}},
 		Options: options.Index().SetUnique(true),
 	}
 	_, err := existingSongsCollection.Indexes().CreateOne(context.Background(), indexModel)
@@ -125,7 +182,7 @@ func (db *MongoClient) RegisterSong(songTitle, songArtist, ytID string) (uint32,
 	// Attempt to insert the song with ytID and key
 	songID := utils.GenerateUniqueID()
 	key := utils.GenerateSongKey(songTitle, songArtist)
-	_, err = existingSongsCollection.InsertOne(context.Background(), bson.M{"_id": songID, "key": key, "ytID": ytID})
+	_, err = existingSongsCollection.InsertOne(context.Background(), bson.M{"_id": songID, "key": key, "title": songTitle, "artist": songArtist, "ytID": ytID, "sourcePath": sourcePath, "fingerprintCount": 0})
 	if err != nil {
 		if mongo.IsDuplicateKeyError(err) {
 			return 0, fmt.Errorf("song with ytID or key already exists: %v", err)
@@ -139,6 +196,51 @@ func (db *MongoClient) RegisterSong(songTitle, songArtist, ytID string) (uint32,
 
 var mongofilterKeys = "_id | ytID | key"
 
+// mongoSongNames returns the title and artist of a song document. keys may
+// be normalized, so they are stored separately; documents from before that
+// only have the key to split.
+func mongoSongNames(doc bson.M) (title, artist string) {
+	if title, ok := doc["title"].(string); ok {
+		artist, _ := doc["artist"].(string)
+		return title, artist
+	}
+	key, _ := doc["key"].(string)
+	title, artist, _ = strings.Cut(key, "---")
+	return title, artist
+}
+
+// rekeySongs implements songRekeyer.
+func (db *MongoClient) rekeySongs() (changed, kept int, err error) {
+	songs := db.client.Database("song-recognition").Collection("songs")
+	cursor, err := songs.Find(context.Background(), bson.D{})
+	if err != nil {
+		return 0, 0, err
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(context.Background()) {
+		var doc bson.M
+		if err := cursor.Decode(&doc); err != nil {
+			return changed, kept, err
+		}
+		key, _ := doc["key"].(string)
+		newKey := utils.GenerateSongKey(mongoSongNames(doc))
+		if newKey == key {
+			continue
+		}
+		_, err := songs.UpdateOne(context.Background(), bson.M{"_id": doc["_id"]}, bson.M{"$set": bson.M{"key": newKey}})
+		if mongo.IsDuplicateKeyError(err) {
+			kept++
+			continue
+		}
+		if err != nil {
+			return changed, kept, err
+		}
+		changed++
+	}
+	return changed, kept, cursor.Err()
+}
+
 func (db *MongoClient) GetSong(filterKey string, value interface{}) (s Song, songExists bool, e error) {
 	if !strings.Contains(mongofilterKeys, filterKey) {
 		return Song{}, false, errors.New("invalid filter key")
@@ -158,10 +260,12 @@ func (db *MongoClient) GetSong(filterKey string, value interface{}) (s Song, son
 	}
 
 	ytID := song["ytID"].(string)
-	title := strings.Split(song["key"].(string), "---")[0]
-	artist := strings.Split(song["key"].(string), "---")[1]
+	title, artist := mongoSongNames(song)
 
-	songInstance := Song{title, artist, ytID}
+	id, _ := song["_id"].(int64)
+	sourcePath, _ := song["sourcePath"].(string)
+	durationSec, _ := song["durationSec"].(float64)
+	songInstance := Song{ID: uint32(id), Title: title, Artist: artist, YouTubeID: ytID, SourcePath: sourcePath, DurationSec: durationSec}
 
 	return songInstance, true, nil
 }
@@ -191,6 +295,61 @@ func (db *MongoClient) DeleteSongByID(songID uint32) error {
 	return nil
 }
 
+func (db *MongoClient) SetSongDuration(songID uint32, durationSec float64) error {
+	songsCollection := db.client.Database("song-recognition").Collection("songs")
+
+	update := bson.M{"$set": bson.M{"durationSec": durationSec}}
+	_, err := songsCollection.UpdateOne(context.Background(), bson.M{"_id": songID}, update)
+	if err != nil {
+		return fmt.Errorf("failed to set song duration: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteFingerprintsForSong pulls the song's couples out of every address
+// document, e.g. before storing a fresh set when reindexing.
+func (db *MongoClient) DeleteFingerprintsForSong(songID uint32) error {
+	collection := db.client.Database("song-recognition").Collection("fingerprints")
+
+	update := bson.M{"$pull": bson.M{"couples": bson.M{"songID": songID}}}
+	_, err := collection.UpdateMany(context.Background(), bson.M{"couples.songID": songID}, update)
+	if err != nil {
+		return fmt.Errorf("failed to delete fingerprints: %w", err)
+	}
+	if err := db.setFingerprintCount(songID, 0); err != nil {
+		return fmt.Errorf("failed to reset fingerprint count: %w", err)
+	}
+	return nil
+}
+
+// ReplaceFingerprintsForSong stores the new couples tagged with a fresh
+// generation, then pulls the song's couples without that tag. without
+// multi-document transactions the swap isn't atomic, but a failure part
+// way leaves the song with both sets rather than neither, and repeating
+// the replace cleans that up.
+func (db *MongoClient) ReplaceFingerprintsForSong(songID uint32, fingerprints map[uint32]models.Couple) error {
+	generation := time.Now().UnixNano()
+	if err := db.storeCouples(fingerprints, bson.M{"generation": generation}); err != nil {
+		return err
+	}
+
+	collection := db.client.Database("song-recognition").Collection("fingerprints")
+	update := bson.M{"$pull": bson.M{"couples": bson.M{
+		"songID":     songID,
+		"generation": bson.M{"$ne": generation},
+	}}}
+	_, err := collection.UpdateMany(context.Background(), bson.M{"couples.songID": songID}, update)
+	if err != nil {
+		return fmt.Errorf("failed to delete old fingerprints: %w", err)
+	}
+	// every new couple is tagged, so none was deduplicated against the old
+	if err := db.setFingerprintCount(songID, len(fingerprints)); err != nil {
+		return fmt.Errorf("failed to update fingerprint count: %w", err)
+	}
+	return nil
+}
+
 func (db *MongoClient) GetAllSongs() ([]SongWithID, error) {
 	collection := db.client.Database("song-recognition").Collection("songs")
 	cursor, err := collection.Find(context.Background(), bson.D{})
@@ -205,17 +364,13 @@ func (db *MongoClient) GetAllSongs() ([]SongWithID, error) {
 		if err := cursor.Decode(&doc); err != nil {
 			return nil, fmt.Errorf("error decoding song: %v", err)
 		}
-		key, _ := doc["key"].(string)
-		parts := strings.Split(key, "---")
-		title := parts[0]
-		artist := ""
-		if len(parts) > 1 {
-			artist = parts[1]
-		}
+		title, artist := mongoSongNames(doc)
+		sourcePath, _ := doc["sourcePath"].(string)
 		songs = append(songs, SongWithID{
-			ID:     uint32(doc["_id"].(int64)),
-			Title:  title,
-			Artist: artist,
+			ID:         uint32(doc["_id"].(int64)),
+			Title:      title,
+			Artist:     artist,
+			SourcePath: sourcePath,
 		})
 	}
 	return songs, nil
@@ -230,8 +385,213 @@ func (db *MongoClient) TotalFingerprints() (int, error) {
 	return int(count), nil
 }
 
-func (db *MongoClient) CountFingerprintsForSong(_ uint32) (int, error) {
-	return 0, nil
+func (db *MongoClient) CountFingerprintsForSong(songID uint32) (int, error) {
+	counts, err := db.CountFingerprintsForSongs([]uint32{songID})
+	if err != nil {
+		return 0, err
+	}
+	return counts[songID], nil
+}
+
+// CountFingerprintsForSongs reads the counts kept on the song documents.
+// songs without one are counted in a single aggregation over the
+// fingerprints, and the result is stored for next time.
+func (db *MongoClient) CountFingerprintsForSongs(songIDs []uint32) (map[uint32]int, error) {
+	songs := db.client.Database("song-recognition").Collection("songs")
+
+	counts := make(map[uint32]int, len(songIDs))
+	missing := make(map[uint32]bool)
+	for start := 0; start < len(songIDs); start += mongoDeleteBatch {
+		batch := songIDs[start:min(start+mongoDeleteBatch, len(songIDs))]
+		opts := options.Find().SetProjection(bson.M{"fingerprintCount": 1})
+		cursor, err := songs.Find(context.Background(), bson.M{"_id": bson.M{"$in": batch}}, opts)
+		if err != nil {
+			return nil, fmt.Errorf("error counting fingerprints: %v", err)
+		}
+		for cursor.Next(context.Background()) {
+			var doc struct {
+				ID    int64  `bson:"_id"`
+				Count *int64 `bson:"fingerprintCount"`
+			}
+			if err := cursor.Decode(&doc); err != nil {
+				cursor.Close(context.Background())
+				return nil, fmt.Errorf("error decoding fingerprint count: %v", err)
+			}
+			if doc.Count == nil {
+				missing[uint32(doc.ID)] = true
+			} else if *doc.Count > 0 {
+				counts[uint32(doc.ID)] = int(*doc.Count)
+			}
+		}
+		err = cursor.Err()
+		cursor.Close(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("error counting fingerprints: %v", err)
+		}
+	}
+	if len(missing) == 0 {
+		return counts, nil
+	}
+
+	ids := make([]uint32, 0, len(missing))
+	for id := range missing {
+		ids = append(ids, id)
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"couples.songID": bson.M{"$in": ids}}}},
+		{{Key: "$unwind", Value: "$couples"}},
+		{{Key: "$match", Value: bson.M{"couples.songID": bson.M{"$in": ids}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$couples.songID", "count": bson.M{"$sum": 1}}}},
+	}
+	collection := db.client.Database("song-recognition").Collection("fingerprints")
+	cursor, err := collection.Aggregate(context.Background(), pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("error counting fingerprints for songs: %v", err)
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(context.Background()) {
+		var result struct {
+			SongID int64 `bson:"_id"`
+			Count  int   `bson:"count"`
+		}
+		if err := cursor.Decode(&result); err != nil {
+			return nil, fmt.Errorf("error decoding fingerprint count: %v", err)
+		}
+		counts[uint32(result.SongID)] = result.Count
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, fmt.Errorf("error counting fingerprints for songs: %v", err)
+	}
+
+	for _, id := range ids {
+		if err := db.setFingerprintCount(id, counts[id]); err != nil {
+			utils.Warnf("[db] failed to store fingerprint count of song %d: %v", id, err)
+		}
+	}
+	return counts, nil
+}
+
+func (db *MongoClient) GetFingerprintsBySong(songID uint32) ([]models.Fingerprint, error) {
+	collection := db.client.Database("song-recognition").Collection("fingerprints")
+
+	cursor, err := collection.Find(context.Background(), bson.M{"couples.songID": songID})
+	if err != nil {
+		return nil, fmt.Errorf("error querying fingerprints: %v", err)
+	}
+	defer cursor.Close(context.Background())
+
+	var fingerprints []models.Fingerprint
+	for cursor.Next(context.Background()) {
+		var doc struct {
+			Address int64 `bson:"_id"`
+			Couples []struct {
+				AnchorTimeMs int64 `bson:"anchorTimeMs"`
+				SongID       int64 `bson:"songID"`
+			} `bson:"couples"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("error decoding fingerprint document: %v", err)
+		}
+		for _, c := range doc.Couples {
+			if uint32(c.SongID) == songID {
+				fingerprints = append(fingerprints, models.Fingerprint{
+					Address:      uint32(doc.Address),
+					AnchorTimeMs: uint32(c.AnchorTimeMs),
+				})
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, fmt.Errorf("error reading fingerprints: %v", err)
+	}
+
+	sortFingerprints(fingerprints)
+	return fingerprints, nil
+}
+
+func (db *MongoClient) AddressSongCounts() (map[uint32]int, error) {
+	collection := db.client.Database("song-recognition").Collection("fingerprints")
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$project", Value: bson.M{
+			"songs": bson.M{"$size": bson.M{"$setUnion": bson.A{"$couples.songID", bson.A{}}}},
+		}}},
+	}
+	cursor, err := collection.Aggregate(context.Background(), pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("error counting songs per address: %v", err)
+	}
+	defer cursor.Close(context.Background())
+
+	counts := make(map[uint32]int)
+	for cursor.Next(context.Background()) {
+		var doc struct {
+			Address int64 `bson:"_id"`
+			Songs   int   `bson:"songs"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("error decoding address count: %v", err)
+		}
+		counts[uint32(doc.Address)] = doc.Songs
+	}
+	return counts, cursor.Err()
+}
+
+// mongoDeleteBatch keeps each $in filter well under the document size limit.
+const mongoDeleteBatch = 10000
+
+// LibraryComposition counts in memory: songs indexed before the artist
+// field was stored only have it in their key, which GetAllSongs splits.
+func (db *MongoClient) LibraryComposition() ([]AuthorCount, error) {
+	songs, err := db.GetAllSongs()
+	if err != nil {
+		return nil, err
+	}
+	return countAuthors(songs), nil
+}
+
+func (db *MongoClient) DeleteAddresses(addresses []uint32) error {
+	collection := db.client.Database("song-recognition").Collection("fingerprints")
+
+	for start := 0; start < len(addresses); start += mongoDeleteBatch {
+		batch := addresses[start:min(start+mongoDeleteBatch, len(addresses))]
+		filter := bson.M{"_id": bson.M{"$in": batch}}
+
+		// the songs losing couples need their counts lowered
+		removed := make(map[uint32]int)
+		cursor, err := collection.Find(context.Background(), filter)
+		if err != nil {
+			return fmt.Errorf("error reading addresses: %w", err)
+		}
+		for cursor.Next(context.Background()) {
+			var doc struct {
+				Couples []struct {
+					SongID int64 `bson:"songID"`
+				} `bson:"couples"`
+			}
+			if err := cursor.Decode(&doc); err != nil {
+				cursor.Close(context.Background())
+				return fmt.Errorf("error decoding address: %w", err)
+			}
+			for _, c := range doc.Couples {
+				removed[uint32(c.SongID)]--
+			}
+		}
+		err = cursor.Err()
+		cursor.Close(context.Background())
+		if err != nil {
+			return fmt.Errorf("error reading addresses: %w", err)
+		}
+
+		if _, err := collection.DeleteMany(context.Background(), filter); err != nil {
+			return fmt.Errorf("error deleting addresses: %w", err)
+		}
+		if err := db.addFingerprintCounts(removed); err != nil {
+			return fmt.Errorf("error updating fingerprint counts: %w", err)
+		}
+	}
+	return nil
 }
 
 func (db *MongoClient) DeleteCollection(collectionName string) error {
@@ -240,5 +600,12 @@ func (db *MongoClient) DeleteCollection(collectionName string) error {
 	if err != nil {
 		return fmt.Errorf("error deleting collection: %v", err)
 	}
+	if collectionName == "fingerprints" {
+		songs := db.client.Database("song-recognition").Collection("songs")
+		_, err := songs.UpdateMany(context.Background(), bson.M{}, bson.M{"$set": bson.M{"fingerprintCount": 0}})
+		if err != nil {
+			return fmt.Errorf("error resetting fingerprint counts: %v", err)
+		}
+	}
 	return nil
 }
@@ -15,6 +15,42 @@ type SQLiteClient struct {
 }
 
 func NewSQLiteClient(dataSourceName string) (*SQLiteClient, error) {
+	db, err := openSQLite(dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	hadPostings, err := tableExists(db, "postings")
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error reading schema: %s", err)
+	}
+	counted, err := tableExists(db, "fingerprint_counts")
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error reading schema: %s", err)
+	}
+
+	// a database last used with the posting-list layout is moved back
+	err = migratePostingsToRows(db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error migrating fingerprints: %s", err)
+	}
+
+	// counts are (re)built whenever rows were written without them
+	err = createCountTable(db, !counted || hadPostings)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error counting fingerprints: %s", err)
+	}
+
+	return &SQLiteClient{db: db}, nil
+}
+
+// openSQLite opens the database and creates the tables shared by both
+// fingerprint layouts.
+func openSQLite(dataSourceName string) (*sql.DB, error) {
 	// Add busy timeout param to DSN (milliseconds)
 	if !strings.Contains(dataSourceName, "_busy_timeout") {
 		if strings.Contains(dataSourceName, "?") {
@@ -31,10 +67,11 @@ func NewSQLiteClient(dataSourceName string) (*SQLiteClient, error) {
 
 	err = createTables(db)
 	if err != nil {
+		db.Close()
 		return nil, fmt.Errorf("error creating tables: %s", err)
 	}
 
-	return &SQLiteClient{db: db}, nil
+	return db, nil
 }
 
 
@@ -46,7 +83,9 @@ func createTables(db *sql.DB) error {
         title TEXT NOT NULL,
         artist TEXT NOT NULL,
         ytID TEXT,
-        key TEXT NOT NULL UNIQUE
+        key TEXT NOT NULL UNIQUE,
+        sourcePath TEXT,
+        durationSec REAL
     );
     `
 
@@ -69,9 +108,110 @@ func createTables(db *sql.DB) error {
 		return fmt.Errorf("error creating fingerprints table: %s", err)
 	}
 
+	// per-song deletes and lookups (reindexing, GET .../fingerprints)
+	// would otherwise scan the whole table
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS fingerprints_songID ON fingerprints (songID)")
+	if err != nil {
+		return fmt.Errorf("error creating fingerprints index: %s", err)
+	}
+
+	// databases created before sourcePath existed need the column added
+	_, err = db.Exec("ALTER TABLE songs ADD COLUMN sourcePath TEXT")
+	if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+		return fmt.Errorf("error adding sourcePath column: %s", err)
+	}
+
+	_, err = db.Exec("ALTER TABLE songs ADD COLUMN durationSec REAL")
+	if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+		return fmt.Errorf("error adding durationSec column: %s", err)
+	}
+
 	return nil
 }
 
+// createCountTable creates fingerprint_counts, which holds each song's
+// number of fingerprint rows so that matching needn't count them per
+// candidate. with rebuild, it is refilled from the fingerprints table.
+func createCountTable(db *sql.DB, rebuild bool) error {
+	_, err := db.Exec(`
+    CREATE TABLE IF NOT EXISTS fingerprint_counts (
+        songID INTEGER PRIMARY KEY,
+        count INTEGER NOT NULL
+    );
+    `)
+	if err != nil || !rebuild {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM fingerprint_counts"); err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO fingerprint_counts (songID, count) SELECT songID, COUNT(*) FROM fingerprints GROUP BY songID")
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// addCounts adjusts the per-song counts in table (fingerprint_counts or
+// posting_counts) by delta, dropping counts that reach zero.
+func addCounts(tx *sql.Tx, table string, delta map[uint32]int) error {
+	for songID, n := range delta {
+		if n == 0 {
+			continue
+		}
+		_, err := tx.Exec(`INSERT INTO `+table+` (songID, count) VALUES (?, ?)
+            ON CONFLICT(songID) DO UPDATE SET count = count + excluded.count`, songID, n)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec("DELETE FROM " + table + " WHERE count <= 0")
+	return err
+}
+
+// countQueryBatch keeps IN lists well below SQLite's variable limit.
+const countQueryBatch = 500
+
+// queryCounts reads the counts of songIDs from table, in one query per
+// countQueryBatch songs. songs without a count are left out.
+func queryCounts(db *sql.DB, table string, songIDs []uint32) (map[uint32]int, error) {
+	counts := make(map[uint32]int, len(songIDs))
+	for start := 0; start < len(songIDs); start += countQueryBatch {
+		batch := songIDs[start:min(start+countQueryBatch, len(songIDs))]
+		args := make([]interface{}, len(batch))
+		for i, id := range batch {
+			args[i] = id
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(batch)), ",")
+
+		rows, err := db.Query("SELECT songID, count FROM "+table+" WHERE songID IN ("+placeholders+")", args...)
+		if err != nil {
+			return nil, fmt.Errorf("error counting fingerprints: %w", err)
+		}
+		for rows.Next() {
+			var songID uint32
+			var count int
+			if err := rows.Scan(&songID, &count); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("error scanning fingerprint count: %w", err)
+			}
+			counts[songID] = count
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("error counting fingerprints: %w", err)
+		}
+	}
+	return counts, nil
+}
+
 func (db *SQLiteClient) Close() error {
 	if db.db != nil {
 		return db.db.Close()
@@ -82,24 +222,40 @@ func (db *SQLiteClient) Close() error {
 func (db *SQLiteClient) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
 	tx, err := db.db.Begin()
 	if err != nil {
-		return fmt.Errorf("error starting transaction: %s", err)
+		return fmt.Errorf("error starting transaction: %w", err)
 	}
+	defer tx.Rollback()
 
-	stmt, err := tx.Prepare("INSERT OR REPLACE INTO fingerprints (address, anchorTimeMs, songID) VALUES (?, ?, ?)")
+	if err := insertFingerprints(tx, fingerprints); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertFingerprints adds one row per couple within tx, counting the
+// rows that weren't there already.
+func insertFingerprints(tx *sql.Tx, fingerprints map[uint32]models.Couple) error {
+	stmt, err := tx.Prepare("INSERT OR IGNORE INTO fingerprints (address, anchorTimeMs, songID) VALUES (?, ?, ?)")
 	if err != nil {
-		tx.Rollback()
-		return fmt.Errorf("error preparing statement: %s", err)
+		return fmt.Errorf("error preparing statement: %w", err)
 	}
 	defer stmt.Close()
 
+	added := make(map[uint32]int)
 	for address, couple := range fingerprints {
-		if _, err := stmt.Exec(address, couple.AnchorTimeMs, couple.SongID); err != nil {
-			tx.Rollback()
-			return fmt.Errorf("error executing statement: %s", err)
+		res, err := stmt.Exec(address, couple.AnchorTimeMs, couple.SongID)
+		if err != nil {
+			return fmt.Errorf("error executing statement: %w", err)
+		}
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			added[couple.SongID]++
 		}
 	}
 
-	return tx.Commit()
+	if err := addCounts(tx, "fingerprint_counts", added); err != nil {
+		return fmt.Errorf("error updating fingerprint counts: %w", err)
+	}
+	return nil
 }
 
 func (db *SQLiteClient) GetCouples(addresses []uint32) (map[uint32][]models.Couple, error) {
@@ -129,6 +285,54 @@ func (db *SQLiteClient) GetCouples(addresses []uint32) (map[uint32][]models.Coup
 	return couples, nil
 }
 
+// GetCouplesForSongs is GetCouples restricted to couples of the given
+// songs. an empty songIDs means no restriction.
+func (db *SQLiteClient) GetCouplesForSongs(addresses []uint32, songIDs []uint32) (map[uint32][]models.Couple, error) {
+	if len(songIDs) == 0 {
+		return db.GetCouples(addresses)
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(songIDs)), ",")
+	query := "SELECT anchorTimeMs, songID FROM fingerprints WHERE address = ? AND songID IN (" + placeholders + ")"
+
+	stmt, err := db.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("error preparing statement: %s", err)
+	}
+	defer stmt.Close()
+
+	args := make([]interface{}, 1, len(songIDs)+1)
+	for _, id := range songIDs {
+		args = append(args, id)
+	}
+
+	couples := make(map[uint32][]models.Couple)
+	for _, address := range addresses {
+		args[0] = address
+		rows, err := stmt.Query(args...)
+		if err != nil {
+			return nil, fmt.Errorf("error querying database: %s", err)
+		}
+
+		var docCouples []models.Couple
+		for rows.Next() {
+			var couple models.Couple
+			if err := rows.Scan(&couple.AnchorTimeMs, &couple.SongID); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("error scanning row: %s", err)
+			}
+			docCouples = append(docCouples, couple)
+		}
+		rows.Close()
+
+		if len(docCouples) > 0 {
+			couples[address] = docCouples
+		}
+	}
+
+	return couples, nil
+}
+
 
 func (db *SQLiteClient) TotalSongs() (int, error) {
 	var count int
@@ -139,13 +343,13 @@ func (db *SQLiteClient) TotalSongs() (int, error) {
 	return count, nil
 }
 
-func (db *SQLiteClient) RegisterSong(songTitle, songArtist, ytID string) (uint32, error) {
+func (db *SQLiteClient) RegisterSong(songTitle, songArtist, ytID, sourcePath string) (uint32, error) {
 	tx, err := db.db.Begin()
 	if err != nil {
 		return 0, fmt.Errorf("error starting transaction: %s", err)
 	}
 
-	stmt, err := tx.Prepare("INSERT INTO songs (id, title, artist, ytID, key) VALUES (?, ?, ?, ?, ?)")
+	stmt, err := tx.Prepare("INSERT INTO songs (id, title, artist, ytID, key, sourcePath) VALUES (?, ?, ?, ?, ?, ?)")
 	if err != nil {
 		tx.Rollback()
 		return 0, fmt.Errorf("error preparing statement: %s", err)
@@ -154,7 +358,7 @@ func (db *SQLiteClient) RegisterSong(songTitle, songArtist, ytID string) (uint32
 
 	songID := utils.GenerateUniqueID()
 	songKey := utils.GenerateSongKey(songTitle, songArtist)
-	if _, err := stmt.Exec(songID, songTitle, songArtist, ytID, songKey); err != nil {
+	if _, err := stmt.Exec(songID, songTitle, songArtist, ytID, songKey, sourcePath); err != nil {
 		tx.Rollback()
 		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.Code == sqlite3.ErrConstraint {
 			return 0, fmt.Errorf("song with ytID or key already exists: %v", err)
@@ -174,12 +378,12 @@ func (s *SQLiteClient) GetSong(filterKey string, value interface{}) (Song, bool,
 		return Song{}, false, fmt.Errorf("invalid filter key")
 	}
 
-	query := fmt.Sprintf("SELECT title, artist, ytID FROM songs WHERE %s = ?", filterKey)
+	query := fmt.Sprintf("SELECT id, title, artist, ytID, COALESCE(sourcePath, ''), COALESCE(durationSec, 0) FROM songs WHERE %s = ?", filterKey)
 
 	row := s.db.QueryRow(query, value)
 
 	var song Song
-	err := row.Scan(&song.Title, &song.Artist, &song.YouTubeID)
+	err := row.Scan(&song.ID, &song.Title, &song.Artist, &song.YouTubeID, &song.SourcePath, &song.DurationSec)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return Song{}, false, nil
@@ -202,6 +406,53 @@ func (db *SQLiteClient) GetSongByKey(key string) (Song, bool, error) {
 	return db.GetSong("key", key)
 }
 
+// rekeySongs implements songRekeyer.
+func (db *SQLiteClient) rekeySongs() (changed, kept int, err error) {
+	rows, err := db.db.Query("SELECT id, title, artist, key FROM songs")
+	if err != nil {
+		return 0, 0, err
+	}
+	type rekey struct {
+		id  uint32
+		key string
+	}
+	var updates []rekey
+	for rows.Next() {
+		var id uint32
+		var title, artist, key string
+		if err := rows.Scan(&id, &title, &artist, &key); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		if newKey := utils.GenerateSongKey(title, artist); newKey != key {
+			updates = append(updates, rekey{id, newKey})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(updates) == 0 {
+		return 0, 0, err
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	for _, u := range updates {
+		_, err := tx.Exec("UPDATE songs SET key = ? WHERE id = ?", u.key, u.id)
+		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.Code == sqlite3.ErrConstraint {
+			kept++
+			continue
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		changed++
+	}
+	return changed, kept, tx.Commit()
+}
+
 // DeleteSongByID deletes a song by ID
 func (db *SQLiteClient) DeleteSongByID(songID uint32) error {
 	_, err := db.db.Exec("DELETE FROM songs WHERE id = ?", songID)
@@ -211,8 +462,57 @@ func (db *SQLiteClient) DeleteSongByID(songID uint32) error {
 	return nil
 }
 
+// SetSongDuration records the length of the audio fingerprinted for a song
+func (db *SQLiteClient) SetSongDuration(songID uint32, durationSec float64) error {
+	_, err := db.db.Exec("UPDATE songs SET durationSec = ? WHERE id = ?", durationSec, songID)
+	if err != nil {
+		return fmt.Errorf("failed to set song duration: %w", err)
+	}
+	return nil
+}
+
+// DeleteFingerprintsForSong removes every fingerprint of a song.
+func (db *SQLiteClient) DeleteFingerprintsForSong(songID uint32) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to delete fingerprints: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := deleteSongRows(tx, songID); err != nil {
+		return fmt.Errorf("failed to delete fingerprints: %w", err)
+	}
+	return tx.Commit()
+}
+
+func deleteSongRows(tx *sql.Tx, songID uint32) error {
+	if _, err := tx.Exec("DELETE FROM fingerprints WHERE songID = ?", songID); err != nil {
+		return err
+	}
+	_, err := tx.Exec("DELETE FROM fingerprint_counts WHERE songID = ?", songID)
+	return err
+}
+
+// ReplaceFingerprintsForSong deletes the song's fingerprints and stores
+// the new ones in a single transaction.
+func (db *SQLiteClient) ReplaceFingerprintsForSong(songID uint32, fingerprints map[uint32]models.Couple) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := deleteSongRows(tx, songID); err != nil {
+		return fmt.Errorf("failed to delete fingerprints: %w", err)
+	}
+	if err := insertFingerprints(tx, fingerprints); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func (db *SQLiteClient) GetAllSongs() ([]SongWithID, error) {
-	rows, err := db.db.Query("SELECT id, title, artist FROM songs ORDER BY id")
+	rows, err := db.db.Query("SELECT id, title, artist, COALESCE(sourcePath, '') FROM songs ORDER BY id")
 	if err != nil {
 		return nil, fmt.Errorf("error querying songs: %s", err)
 	}
@@ -221,7 +521,7 @@ func (db *SQLiteClient) GetAllSongs() ([]SongWithID, error) {
 	var songs []SongWithID
 	for rows.Next() {
 		var s SongWithID
-		if err := rows.Scan(&s.ID, &s.Title, &s.Artist); err != nil {
+		if err := rows.Scan(&s.ID, &s.Title, &s.Artist, &s.SourcePath); err != nil {
 			return nil, fmt.Errorf("error scanning song row: %s", err)
 		}
 		songs = append(songs, s)
@@ -240,16 +540,129 @@ func (db *SQLiteClient) TotalFingerprints() (int, error) {
 
 func (db *SQLiteClient) CountFingerprintsForSong(songID uint32) (int, error) {
 	var count int
-	err := db.db.QueryRow("SELECT COUNT(*) FROM fingerprints WHERE songID = ?", songID).Scan(&count)
+	err := db.db.QueryRow("SELECT count FROM fingerprint_counts WHERE songID = ?", songID).Scan(&count)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
 	if err != nil {
 		return 0, fmt.Errorf("error counting fingerprints for song: %s", err)
 	}
 	return count, nil
 }
 
+func (db *SQLiteClient) CountFingerprintsForSongs(songIDs []uint32) (map[uint32]int, error) {
+	return queryCounts(db.db, "fingerprint_counts", songIDs)
+}
+
+func (db *SQLiteClient) GetFingerprintsBySong(songID uint32) ([]models.Fingerprint, error) {
+	rows, err := db.db.Query("SELECT address, anchorTimeMs FROM fingerprints WHERE songID = ? ORDER BY anchorTimeMs, address", songID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying fingerprints: %s", err)
+	}
+	defer rows.Close()
+
+	var fingerprints []models.Fingerprint
+	for rows.Next() {
+		var fp models.Fingerprint
+		if err := rows.Scan(&fp.Address, &fp.AnchorTimeMs); err != nil {
+			return nil, fmt.Errorf("error scanning fingerprint row: %s", err)
+		}
+		fingerprints = append(fingerprints, fp)
+	}
+	return fingerprints, rows.Err()
+}
+
+func (db *SQLiteClient) AddressSongCounts() (map[uint32]int, error) {
+	rows, err := db.db.Query("SELECT address, COUNT(DISTINCT songID) FROM fingerprints GROUP BY address")
+	if err != nil {
+		return nil, fmt.Errorf("error counting songs per address: %s", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[uint32]int)
+	for rows.Next() {
+		var address uint32
+		var count int
+		if err := rows.Scan(&address, &count); err != nil {
+			return nil, fmt.Errorf("error scanning address count: %s", err)
+		}
+		counts[address] = count
+	}
+	return counts, rows.Err()
+}
+
+func (db *SQLiteClient) LibraryComposition() ([]AuthorCount, error) {
+	rows, err := db.db.Query("SELECT artist, COUNT(*) FROM songs GROUP BY artist ORDER BY COUNT(*) DESC, artist")
+	if err != nil {
+		return nil, fmt.Errorf("error counting songs per author: %s", err)
+	}
+	defer rows.Close()
+
+	var authors []AuthorCount
+	for rows.Next() {
+		var a AuthorCount
+		if err := rows.Scan(&a.Artist, &a.Songs); err != nil {
+			return nil, fmt.Errorf("error scanning author count: %s", err)
+		}
+		authors = append(authors, a)
+	}
+	return authors, rows.Err()
+}
+
+func (db *SQLiteClient) DeleteAddresses(addresses []uint32) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	count, err := tx.Prepare("SELECT songID, COUNT(*) FROM fingerprints WHERE address = ? GROUP BY songID")
+	if err != nil {
+		return fmt.Errorf("error preparing statement: %w", err)
+	}
+	defer count.Close()
+
+	stmt, err := tx.Prepare("DELETE FROM fingerprints WHERE address = ?")
+	if err != nil {
+		return fmt.Errorf("error preparing statement: %w", err)
+	}
+	defer stmt.Close()
+
+	removed := make(map[uint32]int)
+	for _, address := range addresses {
+		rows, err := count.Query(address)
+		if err != nil {
+			return fmt.Errorf("error counting address: %w", err)
+		}
+		for rows.Next() {
+			var songID uint32
+			var n int
+			if err := rows.Scan(&songID, &n); err != nil {
+				rows.Close()
+				return fmt.Errorf("error counting address: %w", err)
+			}
+			removed[songID] -= n
+		}
+		rows.Close()
+
+		if _, err := stmt.Exec(address); err != nil {
+			return fmt.Errorf("error deleting address: %w", err)
+		}
+	}
+
+	if err := addCounts(tx, "fingerprint_counts", removed); err != nil {
+		return fmt.Errorf("error updating fingerprint counts: %w", err)
+	}
+	return tx.Commit()
+}
+
 // DeleteCollection deletes a collection (table) from the database
 func (db *SQLiteClient) DeleteCollection(collectionName string) error {
-	_, err := db.db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", collectionName))
+	query := fmt.Sprintf("DROP TABLE IF EXISTS %s", collectionName)
+	if collectionName == "fingerprints" {
+		query += "; DROP TABLE IF EXISTS fingerprint_counts"
+	}
+	_, err := db.db.Exec(query)
 	if err != nil {
 		return fmt.Errorf("error deleting collection: %v", err)
 	}
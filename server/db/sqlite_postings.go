@@ -0,0 +1,692 @@
+package db
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"song-recognition/models"
+	"song-recognition/utils"
+)
+
+// SQLitePostingsClient stores fingerprints as posting lists: one row per
+// address whose blob holds every (songID, anchorTimeMs) couple for it,
+// instead of one row per couple. the address is then stored once rather
+// than once per occurrence, and a lookup reads a single row. songs are
+// stored exactly as in SQLiteClient.
+//
+// the trade is on the write side. adding a couple reads its address's
+// whole list, scans it for a duplicate and writes it back, so storing
+// gets slower as the common addresses' lists grow. with 200 songs of 2000
+// fingerprints each (BenchmarkPostingsGetCouples), lookups take about a
+// third of the row layout's time, while a store already takes about 1.7x
+// as long (BenchmarkPostingsStore).
+//
+// per-song operations (reindexing, GET /api/entries/{id}/fingerprints)
+// find the song's posting lists through posting_songs, which records the
+// addresses each store added couples to, so they don't scan every list.
+// per-song counts are kept in their own table so they stay cheap.
+//
+// opening a row-layout database with this client moves its fingerprints
+// into posting lists, and NewSQLiteClient moves them back.
+type SQLitePostingsClient struct {
+	*SQLiteClient
+}
+
+// coupleSize is the encoded size of one couple in a posting list:
+// little-endian songID then anchorTimeMs.
+const coupleSize = 8
+
+func NewSQLitePostingsClient(dataSourceName string) (*SQLitePostingsClient, error) {
+	db, err := openSQLite(dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	indexed, err := tableExists(db, "posting_songs")
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error reading schema: %v", err)
+	}
+	if err := createPostingTables(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating posting tables: %v", err)
+	}
+	// posting lists written before posting_songs existed aren't in it
+	if !indexed {
+		if err := indexPostingSongs(db); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("error indexing posting lists: %v", err)
+		}
+	}
+	if err := migrateRowsToPostings(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error migrating fingerprints: %v", err)
+	}
+
+	return &SQLitePostingsClient{SQLiteClient: &SQLiteClient{db: db}}, nil
+}
+
+func createPostingTables(db *sql.DB) error {
+	_, err := db.Exec(`
+    CREATE TABLE IF NOT EXISTS postings (
+        address INTEGER PRIMARY KEY,
+        couples BLOB NOT NULL
+    );
+    CREATE TABLE IF NOT EXISTS posting_counts (
+        songID INTEGER PRIMARY KEY,
+        count INTEGER NOT NULL
+    );
+    CREATE TABLE IF NOT EXISTS posting_songs (
+        songID INTEGER NOT NULL,
+        addresses BLOB NOT NULL
+    );
+    CREATE INDEX IF NOT EXISTS posting_songs_songID ON posting_songs (songID);
+    `)
+	return err
+}
+
+func tableExists(db *sql.DB, name string) (bool, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", name).Scan(&n)
+	return n > 0, err
+}
+
+// songAddressLog collects the addresses songs gained couples at and
+// writes them to posting_songs, one row per song per flush. a song's
+// rows together list every address holding one of its couples; they may
+// also list addresses it has since lost, which readers skip.
+type songAddressLog struct {
+	pending map[uint32][]byte
+	size    int
+}
+
+// songAddressFlushSize bounds how many addresses a log holds before
+// maybeFlush writes them out, for scans over a whole database.
+const songAddressFlushSize = 1 << 20
+
+func newSongAddressLog() *songAddressLog {
+	return &songAddressLog{pending: make(map[uint32][]byte)}
+}
+
+func (l *songAddressLog) add(songID, address uint32) {
+	l.pending[songID] = binary.LittleEndian.AppendUint32(l.pending[songID], address)
+	l.size++
+}
+
+func (l *songAddressLog) flush(tx *sql.Tx) error {
+	for songID, addresses := range l.pending {
+		if _, err := tx.Exec("INSERT INTO posting_songs (songID, addresses) VALUES (?, ?)", songID, addresses); err != nil {
+			return err
+		}
+	}
+	l.pending = make(map[uint32][]byte)
+	l.size = 0
+	return nil
+}
+
+func (l *songAddressLog) maybeFlush(tx *sql.Tx) error {
+	if l.size < songAddressFlushSize {
+		return nil
+	}
+	return l.flush(tx)
+}
+
+// indexPostingSongs fills posting_songs from every posting list.
+func indexPostingSongs(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT address, couples FROM postings")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	log := newSongAddressLog()
+	for rows.Next() {
+		var address uint32
+		var blob []byte
+		if err := rows.Scan(&address, &blob); err != nil {
+			return err
+		}
+		seen := make(map[uint32]bool)
+		for _, c := range decodeCouples(blob) {
+			if !seen[c.SongID] {
+				seen[c.SongID] = true
+				log.add(c.SongID, address)
+			}
+		}
+		if err := log.maybeFlush(tx); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	if err := log.flush(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type queryer interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// songPostingAddresses returns, in ascending order, every address
+// posting_songs lists for songID.
+func songPostingAddresses(q queryer, songID uint32) ([]uint32, error) {
+	rows, err := q.Query("SELECT addresses FROM posting_songs WHERE songID = ?", songID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seen := make(map[uint32]bool)
+	for rows.Next() {
+		var blob []byte
+		if err := rows.Scan(&blob); err != nil {
+			return nil, err
+		}
+		for i := 0; i+4 <= len(blob); i += 4 {
+			seen[binary.LittleEndian.Uint32(blob[i:])] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	addresses := make([]uint32, 0, len(seen))
+	for address := range seen {
+		addresses = append(addresses, address)
+	}
+	slices.Sort(addresses)
+	return addresses, nil
+}
+
+func encodeCouples(couples []models.Couple) []byte {
+	buf := make([]byte, 0, len(couples)*coupleSize)
+	for _, c := range couples {
+		buf = binary.LittleEndian.AppendUint32(buf, c.SongID)
+		buf = binary.LittleEndian.AppendUint32(buf, c.AnchorTimeMs)
+	}
+	return buf
+}
+
+func decodeCouples(blob []byte) []models.Couple {
+	couples := make([]models.Couple, len(blob)/coupleSize)
+	for i := range couples {
+		b := blob[i*coupleSize:]
+		couples[i] = models.Couple{
+			SongID:       binary.LittleEndian.Uint32(b[0:4]),
+			AnchorTimeMs: binary.LittleEndian.Uint32(b[4:8]),
+		}
+	}
+	return couples
+}
+
+// StoreFingerprints appends each couple to its address's posting list,
+// skipping couples already there so a retried store is harmless.
+func (db *SQLitePostingsClient) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := storePostings(tx, fingerprints); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// storePostings adds each couple to its address's posting list with one
+// read and one write per address. each write replaces the whole list and
+// hasCouple scans it linearly, so the cost grows with the list. addresses are visited in order, which
+// keeps the B-tree pages a batch touches together.
+func storePostings(tx *sql.Tx, fingerprints map[uint32]models.Couple) error {
+	sel, err := tx.Prepare("SELECT couples FROM postings WHERE address = ?")
+	if err != nil {
+		return fmt.Errorf("error preparing statement: %w", err)
+	}
+	defer sel.Close()
+
+	upsert, err := tx.Prepare("INSERT OR REPLACE INTO postings (address, couples) VALUES (?, ?)")
+	if err != nil {
+		return fmt.Errorf("error preparing statement: %w", err)
+	}
+	defer upsert.Close()
+
+	addresses := make([]uint32, 0, len(fingerprints))
+	for address := range fingerprints {
+		addresses = append(addresses, address)
+	}
+	slices.Sort(addresses)
+
+	added := make(map[uint32]int)
+	log := newSongAddressLog()
+	for _, address := range addresses {
+		couple := fingerprints[address]
+		encoded := encodeCouples([]models.Couple{couple})
+
+		var blob []byte
+		err := sel.QueryRow(address).Scan(&blob)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("error reading posting list: %w", err)
+		}
+		if hasCouple(blob, encoded) {
+			continue
+		}
+
+		blob = append(blob, encoded...)
+		if _, err := upsert.Exec(address, blob); err != nil {
+			return fmt.Errorf("error writing posting list: %w", err)
+		}
+		added[couple.SongID]++
+		log.add(couple.SongID, address)
+	}
+
+	if err := addCounts(tx, "posting_counts", added); err != nil {
+		return fmt.Errorf("error updating fingerprint counts: %w", err)
+	}
+	if err := log.flush(tx); err != nil {
+		return fmt.Errorf("error recording song addresses: %w", err)
+	}
+	return nil
+}
+
+// hasCouple reports whether blob holds the encoded couple, comparing
+// bytes in place rather than decoding the list.
+func hasCouple(blob, encoded []byte) bool {
+	for i := 0; i+coupleSize <= len(blob); i += coupleSize {
+		if bytes.Equal(blob[i:i+coupleSize], encoded) {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *SQLitePostingsClient) GetCouples(addresses []uint32) (map[uint32][]models.Couple, error) {
+	stmt, err := db.db.Prepare("SELECT couples FROM postings WHERE address = ?")
+	if err != nil {
+		return nil, fmt.Errorf("error preparing statement: %v", err)
+	}
+	defer stmt.Close()
+
+	couples := make(map[uint32][]models.Couple)
+	for _, address := range addresses {
+		var blob []byte
+		err := stmt.QueryRow(address).Scan(&blob)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error querying database: %v", err)
+		}
+		couples[address] = decodeCouples(blob)
+	}
+	return couples, nil
+}
+
+func (db *SQLitePostingsClient) GetCouplesForSongs(addresses []uint32, songIDs []uint32) (map[uint32][]models.Couple, error) {
+	couples, err := db.GetCouples(addresses)
+	if err != nil || len(songIDs) == 0 {
+		return couples, err
+	}
+	return filterCouplesBySong(couples, songIDs), nil
+}
+
+func (db *SQLitePostingsClient) TotalFingerprints() (int, error) {
+	var count int
+	err := db.db.QueryRow("SELECT COALESCE(SUM(length(couples)), 0) FROM postings").Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("error counting fingerprints: %v", err)
+	}
+	return count / coupleSize, nil
+}
+
+func (db *SQLitePostingsClient) CountFingerprintsForSongs(songIDs []uint32) (map[uint32]int, error) {
+	return queryCounts(db.db, "posting_counts", songIDs)
+}
+
+func (db *SQLitePostingsClient) CountFingerprintsForSong(songID uint32) (int, error) {
+	var count int
+	err := db.db.QueryRow("SELECT count FROM posting_counts WHERE songID = ?", songID).Scan(&count)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error counting fingerprints for song: %v", err)
+	}
+	return count, nil
+}
+
+// scanPostings calls fn for every posting list.
+func (db *SQLitePostingsClient) scanPostings(fn func(address uint32, couples []models.Couple) error) error {
+	rows, err := db.db.Query("SELECT address, couples FROM postings")
+	if err != nil {
+		return fmt.Errorf("error querying posting lists: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var address uint32
+		var blob []byte
+		if err := rows.Scan(&address, &blob); err != nil {
+			return fmt.Errorf("error scanning posting list: %v", err)
+		}
+		if err := fn(address, decodeCouples(blob)); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (db *SQLitePostingsClient) GetFingerprintsBySong(songID uint32) ([]models.Fingerprint, error) {
+	addresses, err := songPostingAddresses(db.db, songID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying fingerprints: %v", err)
+	}
+	postings, err := db.GetCouples(addresses)
+	if err != nil {
+		return nil, err
+	}
+
+	var fingerprints []models.Fingerprint
+	for address, couples := range postings {
+		for _, c := range couples {
+			if c.SongID == songID {
+				fingerprints = append(fingerprints, models.Fingerprint{Address: address, AnchorTimeMs: c.AnchorTimeMs})
+			}
+		}
+	}
+	sortFingerprints(fingerprints)
+	return fingerprints, nil
+}
+
+func (db *SQLitePostingsClient) AddressSongCounts() (map[uint32]int, error) {
+	counts := make(map[uint32]int)
+	err := db.scanPostings(func(address uint32, couples []models.Couple) error {
+		songs := make(map[uint32]bool)
+		for _, c := range couples {
+			songs[c.SongID] = true
+		}
+		counts[address] = len(songs)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// DeleteFingerprintsForSong rewrites every posting list that holds one
+// of the song's couples.
+func (db *SQLitePostingsClient) DeleteFingerprintsForSong(songID uint32) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to delete fingerprints: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := removeSongPostings(tx, songID); err != nil {
+		return fmt.Errorf("failed to delete fingerprints: %w", err)
+	}
+	return tx.Commit()
+}
+
+// ReplaceFingerprintsForSong removes the song's couples and stores the
+// new ones in a single transaction.
+func (db *SQLitePostingsClient) ReplaceFingerprintsForSong(songID uint32, fingerprints map[uint32]models.Couple) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := removeSongPostings(tx, songID); err != nil {
+		return fmt.Errorf("failed to delete fingerprints: %w", err)
+	}
+	if err := storePostings(tx, fingerprints); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// removeSongPostings drops songID's couples from the posting lists
+// posting_songs lists for it, along with its posting_songs rows and count.
+func removeSongPostings(tx *sql.Tx, songID uint32) error {
+	addresses, err := songPostingAddresses(tx, songID)
+	if err != nil {
+		return err
+	}
+
+	for _, address := range addresses {
+		var blob []byte
+		err := tx.QueryRow("SELECT couples FROM postings WHERE address = ?", address).Scan(&blob)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		couples := decodeCouples(blob)
+		kept := couples[:0]
+		for _, c := range couples {
+			if c.SongID != songID {
+				kept = append(kept, c)
+			}
+		}
+		if len(kept) == len(couples) {
+			continue
+		}
+		if len(kept) == 0 {
+			_, err = tx.Exec("DELETE FROM postings WHERE address = ?", address)
+		} else {
+			_, err = tx.Exec("UPDATE postings SET couples = ? WHERE address = ?", encodeCouples(kept), address)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM posting_songs WHERE songID = ?", songID); err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM posting_counts WHERE songID = ?", songID)
+	return err
+}
+
+func (db *SQLitePostingsClient) DeleteAddresses(addresses []uint32) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	removed := make(map[uint32]int)
+	for _, address := range addresses {
+		var blob []byte
+		err := tx.QueryRow("SELECT couples FROM postings WHERE address = ?", address).Scan(&blob)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error reading posting list: %w", err)
+		}
+		for _, c := range decodeCouples(blob) {
+			removed[c.SongID]--
+		}
+		if _, err := tx.Exec("DELETE FROM postings WHERE address = ?", address); err != nil {
+			return fmt.Errorf("error deleting address: %w", err)
+		}
+	}
+
+	if err := addCounts(tx, "posting_counts", removed); err != nil {
+		return fmt.Errorf("error updating fingerprint counts: %w", err)
+	}
+	return tx.Commit()
+}
+
+// DeleteCollection drops the posting tables for "fingerprints"; they are
+// recreated the next time a client is opened.
+func (db *SQLitePostingsClient) DeleteCollection(collectionName string) error {
+	if collectionName != "fingerprints" {
+		return db.SQLiteClient.DeleteCollection(collectionName)
+	}
+	_, err := db.db.Exec("DROP TABLE IF EXISTS postings; DROP TABLE IF EXISTS posting_counts; DROP TABLE IF EXISTS posting_songs")
+	if err != nil {
+		return fmt.Errorf("error deleting collection: %v", err)
+	}
+	return nil
+}
+
+// migrateRowsToPostings moves fingerprints stored one per row into
+// posting lists, in one transaction. rows are read in address order and
+// each list is written as soon as its address is done, so memory holds
+// one posting list (plus a bounded songAddressLog) rather than the table.
+func migrateRowsToPostings(db *sql.DB) error {
+	var rowCount int
+	if err := db.QueryRow("SELECT COUNT(*) FROM fingerprints").Scan(&rowCount); err != nil {
+		return err
+	}
+	if rowCount == 0 {
+		return nil
+	}
+	utils.Infof("[db] moving %d fingerprints into posting lists...", rowCount)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT address, songID, anchorTimeMs FROM fingerprints ORDER BY address")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	counts := make(map[uint32]int)
+	log := newSongAddressLog()
+	var current uint32
+	var couples []models.Couple
+	writeCurrent := func() error {
+		if len(couples) == 0 {
+			return nil
+		}
+		var existing []byte
+		err := tx.QueryRow("SELECT couples FROM postings WHERE address = ?", current).Scan(&existing)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		blob := append(existing, encodeCouples(couples)...)
+		if _, err := tx.Exec("INSERT OR REPLACE INTO postings (address, couples) VALUES (?, ?)", current, blob); err != nil {
+			return err
+		}
+
+		seen := make(map[uint32]bool)
+		for _, c := range couples {
+			counts[c.SongID]++
+			if !seen[c.SongID] {
+				seen[c.SongID] = true
+				log.add(c.SongID, current)
+			}
+		}
+		couples = couples[:0]
+		return log.maybeFlush(tx)
+	}
+
+	for rows.Next() {
+		var address uint32
+		var c models.Couple
+		if err := rows.Scan(&address, &c.SongID, &c.AnchorTimeMs); err != nil {
+			return err
+		}
+		if address != current {
+			if err := writeCurrent(); err != nil {
+				return err
+			}
+			current = address
+		}
+		couples = append(couples, c)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if err := writeCurrent(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	if err := addCounts(tx, "posting_counts", counts); err != nil {
+		return err
+	}
+	if err := log.flush(tx); err != nil {
+		return err
+	}
+	// the row layout rebuilds its counts when it next opens the database
+	if _, err := tx.Exec("DELETE FROM fingerprints; DROP TABLE IF EXISTS fingerprint_counts"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migratePostingsToRows is the inverse of migrateRowsToPostings, for a
+// database reopened with the row layout. lists are streamed one at a time
+// and the posting tables are dropped.
+func migratePostingsToRows(db *sql.DB) error {
+	exists, err := tableExists(db, "postings")
+	if err != nil || !exists {
+		return err
+	}
+	utils.Infof("[db] moving fingerprints out of posting lists...")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("INSERT OR REPLACE INTO fingerprints (address, anchorTimeMs, songID) VALUES (?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	rows, err := tx.Query("SELECT address, couples FROM postings")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var address uint32
+		var blob []byte
+		if err := rows.Scan(&address, &blob); err != nil {
+			return err
+		}
+		for _, c := range decodeCouples(blob) {
+			if _, err := stmt.Exec(address, c.AnchorTimeMs, c.SongID); err != nil {
+				return err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	if _, err := tx.Exec("DROP TABLE postings; DROP TABLE IF EXISTS posting_counts; DROP TABLE IF EXISTS posting_songs"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
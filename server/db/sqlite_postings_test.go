@@ -0,0 +1,156 @@
+package db
+
+import (
+	"path/filepath"
+	"reflect"
+	"song-recognition/models"
+	"testing"
+)
+
+func TestPostingsMigrationRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.sqlite3")
+	rows, err := NewSQLiteClient(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []uint32
+	for i, title := range []string{"a", "b", "c"} {
+		id := mustRegister(t, rows, title)
+		ids = append(ids, id)
+		// overlapping ranges put several songs on one address
+		mustStore(t, rows, songFingerprints(id, uint32(i*15), 40))
+	}
+	want := make(map[uint32][]models.Fingerprint)
+	for _, id := range ids {
+		want[id], err = rows.GetFingerprintsBySong(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	rows.Close()
+
+	check := func(layout string, client DBClient) {
+		t.Helper()
+		if total, _ := client.TotalFingerprints(); total != 120 {
+			t.Errorf("%s: %d fingerprints, want 120", layout, total)
+		}
+		for _, id := range ids {
+			got, err := client.GetFingerprintsBySong(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want[id]) {
+				t.Errorf("%s: fingerprints of song %d changed", layout, id)
+			}
+			if n, _ := client.CountFingerprintsForSong(id); n != 40 {
+				t.Errorf("%s: song %d counts %d fingerprints, want 40", layout, id, n)
+			}
+		}
+	}
+
+	postings, err := NewSQLitePostingsClient(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("postings", postings)
+	postings.Close()
+
+	rows, err = NewSQLiteClient(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	check("rows", rows)
+}
+
+func TestPostingsStoreSkipsDuplicates(t *testing.T) {
+	client, err := NewSQLitePostingsClient(filepath.Join(t.TempDir(), "db.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	id := mustRegister(t, client, "a")
+	fps := songFingerprints(id, 0, 10)
+	mustStore(t, client, fps)
+	// a retried store, and a second anchor on an address already used
+	mustStore(t, client, fps)
+	mustStore(t, client, map[uint32]models.Couple{3: {SongID: id, AnchorTimeMs: 999}})
+
+	couples, err := client.GetCouples([]uint32{3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []models.Couple{{SongID: id, AnchorTimeMs: 30}, {SongID: id, AnchorTimeMs: 999}}
+	if !reflect.DeepEqual(couples[3], want) {
+		t.Errorf("address 3 holds %v, want %v", couples[3], want)
+	}
+	if n, _ := client.CountFingerprintsForSong(id); n != 11 {
+		t.Errorf("CountFingerprintsForSong = %d, want 11", n)
+	}
+}
+
+// benchmarkStore stores b.N songs whose fingerprints all fall on the
+// same 2000 addresses, so posting lists grow with every song as on hot
+// addresses in a large library.
+func benchmarkStore(b *testing.B, open func(path string) (DBClient, error)) {
+	client, err := open(filepath.Join(b.TempDir(), "db.sqlite3"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := client.StoreFingerprints(songFingerprints(uint32(i+1), 0, 2000)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSQLiteStore(b *testing.B) {
+	benchmarkStore(b, func(path string) (DBClient, error) { return NewSQLiteClient(path) })
+}
+
+func BenchmarkPostingsStore(b *testing.B) {
+	benchmarkStore(b, func(path string) (DBClient, error) { return NewSQLitePostingsClient(path) })
+}
+
+// benchmarkGetCouples looks up a clip's worth of addresses in a library
+// of 200 songs with 2000 fingerprints each, where every address is shared
+// by about ten songs.
+func benchmarkGetCouples(b *testing.B, open func(path string) (DBClient, error)) {
+	client, err := open(filepath.Join(b.TempDir(), "db.sqlite3"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+	for i := 0; i < 200; i++ {
+		if err := client.StoreFingerprints(songFingerprints(uint32(i+1), uint32(i*200), 2000)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	addresses := make([]uint32, 300)
+	for i := range addresses {
+		addresses[i] = uint32(i * 137)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		couples, err := client.GetCouples(addresses)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(couples) != len(addresses) {
+			b.Fatalf("%d of %d addresses found", len(couples), len(addresses))
+		}
+	}
+}
+
+func BenchmarkSQLiteGetCouples(b *testing.B) {
+	benchmarkGetCouples(b, func(path string) (DBClient, error) { return NewSQLiteClient(path) })
+}
+
+func BenchmarkPostingsGetCouples(b *testing.B) {
+	benchmarkGetCouples(b, func(path string) (DBClient, error) { return NewSQLitePostingsClient(path) })
+}
@@ -0,0 +1,68 @@
+package db
+
+import (
+	"song-recognition/models"
+	"sync/atomic"
+)
+
+// VersionedClient wraps a DBClient and counts writes made through it.
+// caches derived from the database remember the Generation they were
+// built at and rebuild once it moves on. writes by other processes (e.g.
+// `save` against the same SQLite file) are not seen.
+type VersionedClient struct {
+	DBClient
+	generation atomic.Uint64
+}
+
+// NewVersionedClient wraps client. the generation starts at zero.
+func NewVersionedClient(client DBClient) *VersionedClient {
+	return &VersionedClient{DBClient: client}
+}
+
+// Generation returns a counter that increases after every write.
+func (v *VersionedClient) Generation() uint64 {
+	return v.generation.Load()
+}
+
+// every write bumps the generation even when it fails, since a failed
+// write may still have been partially applied
+
+func (v *VersionedClient) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
+	defer v.generation.Add(1)
+	return v.DBClient.StoreFingerprints(fingerprints)
+}
+
+func (v *VersionedClient) RegisterSong(songTitle, songArtist, ytID, sourcePath string) (uint32, error) {
+	defer v.generation.Add(1)
+	return v.DBClient.RegisterSong(songTitle, songArtist, ytID, sourcePath)
+}
+
+func (v *VersionedClient) DeleteSongByID(songID uint32) error {
+	defer v.generation.Add(1)
+	return v.DBClient.DeleteSongByID(songID)
+}
+
+func (v *VersionedClient) SetSongDuration(songID uint32, durationSec float64) error {
+	defer v.generation.Add(1)
+	return v.DBClient.SetSongDuration(songID, durationSec)
+}
+
+func (v *VersionedClient) DeleteFingerprintsForSong(songID uint32) error {
+	defer v.generation.Add(1)
+	return v.DBClient.DeleteFingerprintsForSong(songID)
+}
+
+func (v *VersionedClient) ReplaceFingerprintsForSong(songID uint32, fingerprints map[uint32]models.Couple) error {
+	defer v.generation.Add(1)
+	return v.DBClient.ReplaceFingerprintsForSong(songID, fingerprints)
+}
+
+func (v *VersionedClient) DeleteAddresses(addresses []uint32) error {
+	defer v.generation.Add(1)
+	return v.DBClient.DeleteAddresses(addresses)
+}
+
+func (v *VersionedClient) DeleteCollection(collectionName string) error {
+	defer v.generation.Add(1)
+	return v.DBClient.DeleteCollection(collectionName)
+}
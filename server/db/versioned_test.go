@@ -0,0 +1,38 @@
+package db
+
+import "testing"
+
+func TestVersionedClientCountsWrites(t *testing.T) {
+	client := NewVersionedClient(NewMemoryClient())
+	gen := client.Generation()
+	wrote := func(what string, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("%s: %v", what, err)
+		}
+		if next := client.Generation(); next <= gen {
+			t.Errorf("generation still %d after %s", next, what)
+		} else {
+			gen = next
+		}
+	}
+
+	id, err := client.RegisterSong("a", "artist", "", "")
+	wrote("RegisterSong", err)
+	wrote("StoreFingerprints", client.StoreFingerprints(songFingerprints(id, 0, 10)))
+	wrote("SetSongDuration", client.SetSongDuration(id, 3))
+	wrote("ReplaceFingerprintsForSong", client.ReplaceFingerprintsForSong(id, songFingerprints(id, 5, 10)))
+	wrote("DeleteAddresses", client.DeleteAddresses([]uint32{5}))
+	wrote("DeleteFingerprintsForSong", client.DeleteFingerprintsForSong(id))
+	wrote("DeleteSongByID", client.DeleteSongByID(id))
+	wrote("DeleteCollection", client.DeleteCollection("songs"))
+
+	// reads leave it alone
+	client.TotalSongs()
+	client.TotalFingerprints()
+	client.GetCouples([]uint32{1})
+	client.GetAllSongs()
+	if client.Generation() != gen {
+		t.Errorf("reads moved the generation from %d to %d", gen, client.Generation())
+	}
+}
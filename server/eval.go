@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"song-recognition/db"
+	"song-recognition/shazam"
+	"sort"
+	"strings"
+	"time"
+)
+
+// evalLabelsFile is the optional sidecar in the clips directory mapping
+// clip file names to the song they were cut from, as "clip,expected"
+// rows. clips it doesn't list fall back to their file name.
+const evalLabelsFile = "labels.csv"
+
+// evalTopK is the rank within which a clip counts as found for top-k.
+const evalTopK = 5
+
+// evalClip is one query clip and the song it should match.
+type evalClip struct {
+	path     string
+	expected string
+}
+
+// evalReport accumulates match quality over a labeled corpus.
+type evalReport struct {
+	clips      int
+	failed     int // clips that couldn't be fingerprinted or searched
+	top1, topK int
+	rrSum      float64 // sum of reciprocal ranks, 0 for clips never found
+	searchTime time.Duration
+
+	// confusions counts top-1 misattributions as expected -> predicted
+	confusions map[[2]string]int
+}
+
+// add records the ranked matches for a clip expecting the given song.
+func (r *evalReport) add(expected string, matches []shazam.Match, searchTime time.Duration) {
+	r.clips++
+	r.searchTime += searchTime
+
+	rank := 0
+	for i, match := range matches {
+		if matchesLabel(match, expected) {
+			rank = i + 1
+			break
+		}
+	}
+	if rank == 1 {
+		r.top1++
+	}
+	if rank >= 1 && rank <= evalTopK {
+		r.topK++
+	}
+	if rank > 0 {
+		r.rrSum += 1 / float64(rank)
+	}
+
+	if rank != 1 {
+		predicted := "(no match)"
+		if len(matches) > 0 {
+			predicted = matches[0].SongTitle
+		}
+		if r.confusions == nil {
+			r.confusions = make(map[[2]string]int)
+		}
+		r.confusions[[2]string{expected, predicted}]++
+	}
+}
+
+// fail records a clip that produced an error; it counts as not found.
+func (r *evalReport) fail() {
+	r.clips++
+	r.failed++
+}
+
+func (r *evalReport) print(w io.Writer, confusion bool) {
+	if r.clips == 0 {
+		fmt.Fprintln(w, "no clips evaluated")
+		return
+	}
+	pct := func(n int) float64 { return 100 * float64(n) / float64(r.clips) }
+
+	fmt.Fprintf(w, "clips:        %d (%d failed)\n", r.clips, r.failed)
+	fmt.Fprintf(w, "top-1:        %.1f%% (%d)\n", pct(r.top1), r.top1)
+	fmt.Fprintf(w, "top-%d:        %.1f%% (%d)\n", evalTopK, pct(r.topK), r.topK)
+	fmt.Fprintf(w, "MRR:          %.3f\n", r.rrSum/float64(r.clips))
+	if searched := r.clips - r.failed; searched > 0 {
+		fmt.Fprintf(w, "avg search:   %s\n", (r.searchTime / time.Duration(searched)).Round(time.Microsecond))
+	}
+
+	if !confusion || len(r.confusions) == 0 {
+		return
+	}
+
+	type confusionRow struct {
+		expected, predicted string
+		count               int
+	}
+	rows := make([]confusionRow, 0, len(r.confusions))
+	for pair, count := range r.confusions {
+		rows = append(rows, confusionRow{pair[0], pair[1], count})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].count != rows[j].count {
+			return rows[i].count > rows[j].count
+		}
+		if rows[i].expected != rows[j].expected {
+			return rows[i].expected < rows[j].expected
+		}
+		return rows[i].predicted < rows[j].predicted
+	})
+
+	fmt.Fprintln(w, "\nmisattributions (expected -> top-1):")
+	for _, row := range rows {
+		fmt.Fprintf(w, "\t%3d  %s -> %s\n", row.count, row.expected, row.predicted)
+	}
+}
+
+// matchesLabel reports whether a match is the song a label names. labels
+// are compared case-insensitively against the title or "title - artist".
+func matchesLabel(match shazam.Match, label string) bool {
+	label = strings.TrimSpace(label)
+	return strings.EqualFold(label, match.SongTitle) ||
+		strings.EqualFold(label, match.SongTitle+" - "+match.SongArtist)
+}
+
+// labelFromFilename derives the expected song from a clip's name: the part
+// before the first "__", or the whole name without its extension, so
+// "Voilà__noisy-01.wav" and "Voilà.mp3" both expect "Voilà".
+func labelFromFilename(path string) string {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	if before, _, found := strings.Cut(name, "__"); found {
+		return before
+	}
+	return name
+}
+
+// readEvalLabels parses a "clip,expected" CSV into a map keyed by clip file
+// name. a missing file yields an empty map.
+func readEvalLabels(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", path, err)
+	}
+
+	labels := make(map[string]string, len(records))
+	for _, record := range records {
+		labels[record[0]] = record[1]
+	}
+	return labels, nil
+}
+
+// collectEvalClips lists the audio files in dir with their expected songs.
+func collectEvalClips(dir, labelsPath string) ([]evalClip, error) {
+	labels, err := readEvalLabels(labelsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var clips []evalClip
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || path == labelsPath || strings.HasPrefix(info.Name(), ".") || !isAudioFile(path) {
+			return nil
+		}
+		expected, ok := labels[info.Name()]
+		if !ok {
+			expected = labelFromFilename(path)
+		}
+		clips = append(clips, evalClip{path: path, expected: expected})
+		return nil
+	})
+	return clips, err
+}
+
+// eval matches every clip in clipsDir against the database and prints
+// top-1/top-k accuracy, mean reciprocal rank and the average search time.
+func eval(clipsDir, labelsPath string, confusion bool) {
+	if labelsPath == "" {
+		labelsPath = filepath.Join(clipsDir, evalLabelsFile)
+	}
+	clips, err := collectEvalClips(clipsDir, labelsPath)
+	if err != nil {
+		fmt.Println("error listing clips:", err)
+		return
+	}
+	if len(clips) == 0 {
+		fmt.Println("no clips found in", clipsDir)
+		return
+	}
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		fmt.Println("error creating DB client:", err)
+		return
+	}
+	defer dbClient.Close()
+
+	if err := checkLibrary(dbClient); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	report := &evalReport{}
+	for _, clip := range clips {
+		matches, searchTime, err := matchFile(dbClient, clip.path, fpConfig, matchOpts, maxMatchLimit)
+		if err != nil {
+			fmt.Printf("error evaluating (%v): %v\n", clip.path, err)
+			report.fail()
+			continue
+		}
+		report.add(clip.expected, matches, searchTime)
+	}
+
+	fmt.Println()
+	report.print(os.Stdout, confusion)
+}
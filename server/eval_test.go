@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestCollectEvalClipsSkipsNonAudio(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"Voilà__noisy-01.wav": "",
+		"Other.MP3":           "",
+		"notes.txt":           "not a clip",
+		"cover.jpg":           "",
+		".hidden.wav":         "",
+		evalLabelsFile:        "Other.MP3,Something Else\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clips, err := collectEvalClips(dir, filepath.Join(dir, evalLabelsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(clips, func(i, j int) bool { return clips[i].path < clips[j].path })
+
+	want := []evalClip{
+		{path: filepath.Join(dir, "Other.MP3"), expected: "Something Else"},
+		{path: filepath.Join(dir, "Voilà__noisy-01.wav"), expected: "Voilà"},
+	}
+	if len(clips) != len(want) {
+		t.Fatalf("collected %+v, want %+v", clips, want)
+	}
+	for i := range want {
+		if clips[i] != want[i] {
+			t.Errorf("clip %d = %+v, want %+v", i, clips[i], want[i])
+		}
+	}
+}
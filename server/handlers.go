@@ -1,38 +1,150 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
 	"song-recognition/db"
+	"song-recognition/metrics"
+	"song-recognition/models"
 	"song-recognition/shazam"
 	"song-recognition/utils"
 	"song-recognition/wav"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const maxUploadSize = 5000 << 20 // 5 GB
+const (
+	// upload limits when -max-index-upload/-max-match-upload are unset;
+	// match clips are short, index files can be whole audiobooks
+	defaultMaxIndexUpload = "5000MB"
+	defaultMaxMatchUpload = "100MB"
+
+	// multipartMemory is how much of an upload is held in memory before
+	// the rest spills to a temp file
+	multipartMemory = 32 << 20
+)
+
+const (
+	defaultMatchLimit = 20
+	maxMatchLimit     = 200
+	maxMatchPeaks     = 500 // peaks returned with ?includePeaks=1
+)
+
+const (
+	storeRetryAttempts  = 4
+	storeRetryBaseDelay = 250 * time.Millisecond
+)
 
 var fpConfig = shazam.DefaultAudiobookConfig()
 
+// matchOpts holds the match flags, for the CLI and for serve to copy.
+var matchOpts = shazam.DefaultMatchOptions()
+
+// apiServer holds state shared by every HTTP handler for the lifetime of
+// `serve`. db is opened once and reused; both backends are safe for
+// concurrent use (database/sql and the mongo driver pool connections).
+type apiServer struct {
+	db *db.VersionedClient
+
+	adminToken  string      // bearer token for admin routes; empty disables them
+	reindexing  atomic.Bool // set while a reindex-all run is in progress
+	exposePaths bool        // show full source paths in responses, not just file names
+	indexRoots  []string    // resolved directories /api/index/path may read; empty disables it
+
+	matchCache *shazam.MatchCache  // recent /api/match results; nil when disabled
+	matchOpts  shazam.MatchOptions // how every match path searches the library
+
+	// cfg is the fingerprint config requests are served with. handlers
+	// take a copy with config() when they start, so POST /api/config
+	// doesn't change it under a request that is already running.
+	configMu sync.RWMutex
+	cfg      shazam.FingerprintConfig
+
+	maxIndexUpload int64 // request body limit for /api/index, in bytes
+	maxMatchUpload int64 // request body limit for /api/match, in bytes
+
+	statsMu    sync.Mutex
+	stats      statsResponse // last /api/stats answer...
+	statsGen   uint64        // ...and the db generation it was computed at
+	statsValid bool
+}
+
+// sourceForClient redacts a stored source path to its file name unless
+// EXPOSE_SOURCE_PATHS is set, so the server's directory layout isn't
+// published to every API client.
+func (s *apiServer) sourceForClient(sourcePath string) string {
+	if s.exposePaths || sourcePath == "" {
+		return sourcePath
+	}
+	return filepath.Base(sourcePath)
+}
+
 type indexResponse struct {
 	Title           string `json:"title"`
 	Author          string `json:"author"`
 	Fingerprints    int    `json:"fingerprints"`
 	StorageEstimate string `json:"storageEstimate"`
 	DurationSec     int    `json:"durationSec"`
+
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// conflictResponse is returned with 409 when an upload duplicates an
+// existing entry, so clients can link to it or offer a reindex.
+type conflictResponse struct {
+	Error        string `json:"error"`
+	ExistingID   uint32 `json:"existingId"`
+	Title        string `json:"title"`
+	Author       string `json:"author"`
+	Fingerprints int    `json:"fingerprints"`
 }
 
 type matchResult struct {
+	SongID uint32  `json:"songId"`
 	Title  string  `json:"title"`
 	Author string  `json:"author"`
 	Score  float64 `json:"score"`
+
+	// OffsetMs is where in the song the sample starts, as aligned; it can
+	// be negative. SeekTimeSec is the same position clamped to the song
+	// and in seconds, ready for an <audio> element's currentTime.
+	OffsetMs    int32   `json:"offsetMs"`
+	SeekTimeSec float64 `json:"seekTimeSec"`
+	DurationSec float64 `json:"durationSec,omitempty"` // 0 (omitted) if unknown
+}
+
+func newMatchResult(m shazam.Match) matchResult {
+	return matchResult{
+		SongID:      m.SongID,
+		Title:       m.SongTitle,
+		Author:      m.SongArtist,
+		Score:       m.Score,
+		OffsetMs:    m.OffsetMs,
+		SeekTimeSec: seekTime(m.OffsetMs, m.DurationSec),
+		DurationSec: m.DurationSec,
+	}
+}
+
+// seekTime turns an alignment offset into a playback position: seconds,
+// not before the start and, when the duration is known, not past the end.
+func seekTime(offsetMs int32, durationSec float64) float64 {
+	sec := math.Max(float64(offsetMs)/1000, 0)
+	if durationSec > 0 {
+		sec = math.Min(sec, durationSec)
+	}
+	return sec
 }
 
 type statsResponse struct {
@@ -41,10 +153,16 @@ type statsResponse struct {
 	StorageEstimate   string `json:"storageEstimate"`
 }
 
+type authorCountResponse struct {
+	Artist string `json:"artist"`
+	Songs  int    `json:"songs"`
+}
+
 type entryResponse struct {
 	ID     uint32 `json:"id"`
 	Title  string `json:"title"`
 	Author string `json:"author"`
+	Source string `json:"source,omitempty"` // see apiServer.sourceForClient
 }
 
 func writeJSON(w http.ResponseWriter, status int, v any) {
@@ -53,15 +171,178 @@ func writeJSON(w http.ResponseWriter, status int, v any) {
 	json.NewEncoder(w).Encode(v)
 }
 
+// wantsNDJSON reports whether the client asked for newline-delimited
+// JSON in its Accept header.
+func wantsNDJSON(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(accept, ",") {
+			mediaType, _, _ = strings.Cut(mediaType, ";")
+			if strings.EqualFold(strings.TrimSpace(mediaType), "application/x-ndjson") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeNDJSON writes meta, the response's fields other than its matches,
+// as the first line and then each result as a line of its own, so even a
+// response without matches has a line. the results are all known by
+// then: NDJSON changes the format of a response, not when it is sent.
+func writeNDJSON(w http.ResponseWriter, meta map[string]any, results []matchResult) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(meta); err != nil {
+		return
+	}
+	for _, result := range results {
+		if err := enc.Encode(result); err != nil {
+			return
+		}
+	}
+}
+
 func writeError(w http.ResponseWriter, status int, msg string) {
-	log.Printf("[error] %d: %s", status, msg)
+	utils.WarnfCtx(requestContext(w), "[error] %d: %s", status, msg)
 	writeJSON(w, status, map[string]string{"error": msg})
 }
 
+// writeFingerprintError reports a failure to fingerprint an upload. files
+// ffmpeg can't decode are the client's problem and get a 422 with the
+// reason; anything else is an internal fault and stays a 500.
+func writeFingerprintError(w http.ResponseWriter, err error) {
+	if errors.Is(err, context.Canceled) {
+		// the client went away; there is nobody to send a response to
+		utils.InfofCtx(requestContext(w), "[http] request cancelled: %v", err)
+		return
+	}
+
+	var invalid *wav.InvalidAudioError
+	if errors.As(err, &invalid) {
+		utils.WarnfCtx(requestContext(w), "[error] %d: %v", http.StatusUnprocessableEntity, err)
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{
+			"error":   "file is not valid audio",
+			"details": invalid.Reason,
+		})
+		return
+	}
+
+	if errors.Is(err, shazam.ErrClipTooShort) {
+		utils.WarnfCtx(requestContext(w), "[error] %d: %v", http.StatusUnprocessableEntity, err)
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{
+			"error":   "clip too short to match",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	if errors.Is(err, shazam.ErrSparseFingerprints) {
+		utils.WarnfCtx(requestContext(w), "[error] %d: %v", http.StatusUnprocessableEntity, err)
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{
+			"error":   "too few fingerprints to match reliably",
+			"details": err.Error(),
+		})
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err.Error())
+}
+
+// appendChunkPeaks appends the peaks of a chunk to those of the chunks
+// before it, skipping the ones in the overlap with the previous chunk:
+// those no later than the last peak already kept. that time is taken
+// once, up front, since a frame holds peaks of several bands and the
+// ones after the first would otherwise be dropped.
+func appendChunkPeaks(peaks, chunkPeaks []shazam.Peak) []shazam.Peak {
+	if len(peaks) == 0 {
+		return append(peaks, chunkPeaks...)
+	}
+	last := peaks[len(peaks)-1].Time
+	for _, p := range chunkPeaks {
+		if p.Time > last {
+			peaks = append(peaks, p)
+		}
+	}
+	return peaks
+}
+
+// parseMatchLimit reads a user-supplied result limit. empty means the
+// default; values outside [1, maxMatchLimit] are clamped rather than rejected.
+func parseMatchLimit(raw string) (int, error) {
+	if raw == "" {
+		return defaultMatchLimit, nil
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(raw))
+	if err != nil {
+		return 0, fmt.Errorf("invalid limit %q: must be an integer", raw)
+	}
+	return clampMatchLimit(n), nil
+}
+
+// parseMinScore reads ?minScore=, the lowest score a returned match may
+// have; 0 (the default) keeps every match.
+func parseMinScore(raw string) (float64, error) {
+	if raw == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+	if err != nil || v < 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+		return 0, fmt.Errorf("invalid minScore %q: must be a non-negative number", raw)
+	}
+	return v, nil
+}
+
+// aboveMinScore returns the leading matches scoring at least minScore.
+// matches are sorted best first, so that is everything before the first
+// one below it.
+func aboveMinScore(matches []shazam.Match, minScore float64) []shazam.Match {
+	for i, m := range matches {
+		if m.Score < minScore {
+			return matches[:i]
+		}
+	}
+	return matches
+}
+
+// parseSongIDs reads ?songId= values, each of which may itself be a
+// comma-separated list, e.g. ?songId=1&songId=2,3.
+func parseSongIDs(raw []string) ([]uint32, error) {
+	var ids []uint32
+	for _, v := range raw {
+		for _, part := range strings.Split(v, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			id, err := strconv.ParseUint(part, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid songId %q", part)
+			}
+			ids = append(ids, uint32(id))
+		}
+	}
+	return ids, nil
+}
+
+func clampMatchLimit(n int) int {
+	if n < 1 {
+		return 1
+	}
+	if n > maxMatchLimit {
+		return maxMatchLimit
+	}
+	return n
+}
+
 func logMemUsage(label string) {
+	// ReadMemStats stops the world, so skip it entirely unless it will be printed
+	if !utils.LogEnabled(utils.LevelDebug) {
+		return
+	}
+
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
-	log.Printf("[mem] %s: alloc=%s, sys=%s, heap_in_use=%s",
+	utils.Debugf("[mem] %s: alloc=%s, sys=%s, heap_in_use=%s",
 		label, formatBytes(int64(m.Alloc)), formatBytes(int64(m.Sys)), formatBytes(int64(m.HeapInuse)))
 }
 
@@ -78,41 +359,229 @@ func formatBytes(b int64) string {
 	}
 }
 
-func processAndSave(filePath, title, author string) (uint32, int, error) {
-	log.Printf("[process] registering '%s' by '%s' in database", title, author)
+// parseByteSize parses a size such as "100MB", "5 GB" or a plain byte
+// count. units are powers of 1024, as in formatBytes.
+func parseByteSize(raw string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(raw))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
 
-	dbClient, err := db.NewDBClient()
-	if err != nil {
-		return 0, 0, fmt.Errorf("failed to create DB client: %v", err)
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", raw)
 	}
-	defer dbClient.Close()
+	return int64(n * float64(multiplier)), nil
+}
+
+// indexOptions tunes a single processAndSave run.
+type indexOptions struct {
+	durationSec float64 // audio length, used for the fingerprint density check
+	strict      bool    // reject sparse fingerprints instead of only warning
+	sourcePath  string  // stored with the song so it can be reindexed; "" for temp files
 
-	songID, err := dbClient.RegisterSong(title, author, "")
+	// appendTo, if not 0, is an existing entry to add the file to instead
+	// of registering a new one. its fingerprints are stored after the
+	// audio already indexed, so offsets run on across the parts.
+	appendTo uint32
+
+	// cfg is the fingerprint config to index with.
+	cfg shazam.FingerprintConfig
+}
+
+// indexResult is what processAndSave stored.
+type indexResult struct {
+	songID       uint32
+	fingerprints int
+	offsetSec    float64  // where the file starts in the entry; 0 unless appended
+	warnings     []string // non-fatal quality problems worth showing the user
+}
+
+// processAndSave registers an entry, fingerprints filePath and stores the
+// result using dbClient. a new entry's fingerprints are stored chunk by
+// chunk as they are produced, so memory stays bounded however long the
+// file is; the entry and whatever was stored are removed again if
+// anything fails. with opts.appendTo the file is added to that entry
+// instead, and is fingerprinted whole before anything is stored, so a
+// rejected part leaves nothing behind; a failed store may still leave
+// some of its fingerprints, but storing is idempotent, so running it
+// again is safe.
+func processAndSave(ctx context.Context, dbClient db.DBClient, filePath, title, author string, opts indexOptions) (indexResult, error) {
+	songID, offsetSec, err := entryForIndex(ctx, dbClient, title, author, opts)
 	if err != nil {
-		return 0, 0, fmt.Errorf("failed to register entry: %v", err)
+		return indexResult{}, err
 	}
-	log.Printf("[process] registered with songID=%d, starting chunked fingerprinting...", songID)
+	discard := func() {
+		if opts.appendTo == 0 {
+			dbClient.DeleteFingerprintsForSong(songID)
+			dbClient.DeleteSongByID(songID)
+		}
+	}
+	utils.DebugfCtx(ctx, "[process] songID=%d, starting chunked fingerprinting...", songID)
 
 	logMemUsage("before fingerprint")
 	fpStart := time.Now()
 
-	fingerprint, err := shazam.FingerprintAudioChunked(filePath, songID, fpConfig)
+	var count int
+	var report shazam.ChunkReport
+	var fingerprint map[uint32]models.Couple
+	if opts.appendTo == 0 {
+		count, report, err = shazam.FingerprintAudioStream(ctx, filePath, songID, opts.cfg, func(chunkFP map[uint32]models.Couple, _ []shazam.Peak) error {
+			if err := storeWithRetry(ctx, dbClient, chunkFP); err != nil {
+				return fmt.Errorf("failed to store fingerprints: %w", err)
+			}
+			return nil
+		})
+	} else {
+		fingerprint, report, err = shazam.FingerprintAudioChunked(ctx, filePath, songID, opts.cfg)
+		count = len(fingerprint)
+	}
 	if err != nil {
-		dbClient.DeleteSongByID(songID)
-		return 0, 0, fmt.Errorf("failed to fingerprint: %v", err)
+		discard()
+		return indexResult{}, fmt.Errorf("failed to fingerprint: %w", err)
 	}
-	log.Printf("[process] fingerprinting done: %d fingerprints in %s", len(fingerprint), time.Since(fpStart))
+	metrics.FingerprintDuration.Observe(time.Since(fpStart).Seconds())
+	utils.InfofCtx(ctx, "[process] fingerprinting done: %d fingerprints in %s", count, time.Since(fpStart))
 	logMemUsage("after fingerprint")
 
-	log.Printf("[process] storing %d fingerprints in database...", len(fingerprint))
-	storeStart := time.Now()
-	if err := dbClient.StoreFingerprints(fingerprint); err != nil {
-		dbClient.DeleteSongByID(songID)
-		return 0, 0, fmt.Errorf("failed to store fingerprints: %v", err)
+	result := indexResult{songID: songID, fingerprints: count, offsetSec: offsetSec}
+
+	if report.FailedChunks > 0 {
+		result.warnings = append(result.warnings, fmt.Sprintf(
+			"%d of %d chunks could not be decoded and were skipped", report.FailedChunks, report.Chunks))
+	}
+
+	if err := shazam.CheckDensity(count, opts.durationSec, opts.cfg); err != nil {
+		if opts.strict {
+			discard()
+			return indexResult{}, err
+		}
+		utils.WarnfCtx(ctx, "[process] '%s': %v", title, err)
+		result.warnings = append(result.warnings, err.Error())
+	}
+
+	if fingerprint != nil {
+		shazam.ShiftFingerprints(fingerprint, offsetSec, opts.cfg)
+		utils.DebugfCtx(ctx, "[process] storing %d fingerprints in database...", len(fingerprint))
+		storeStart := time.Now()
+		if err := storeWithRetry(ctx, dbClient, fingerprint); err != nil {
+			return indexResult{}, fmt.Errorf("failed to store fingerprints: %w", err)
+		}
+		utils.DebugfCtx(ctx, "[process] fingerprints stored in %s", time.Since(storeStart))
+	}
+
+	if err := dbClient.SetSongDuration(songID, offsetSec+opts.durationSec); err != nil {
+		discard()
+		return indexResult{}, err
+	}
+
+	return result, nil
+}
+
+// entryForIndex returns the song processAndSave stores fingerprints under
+// and how far into it the new audio starts: a newly registered entry at
+// 0, or the end of the audio already indexed for opts.appendTo.
+func entryForIndex(ctx context.Context, dbClient db.DBClient, title, author string, opts indexOptions) (uint32, float64, error) {
+	if opts.appendTo != 0 {
+		song, found, err := dbClient.GetSongByID(opts.appendTo)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to look up entry %d: %v", opts.appendTo, err)
+		}
+		if !found {
+			return 0, 0, fmt.Errorf("no entry with ID %d to append to", opts.appendTo)
+		}
+		if song.DurationSec <= 0 {
+			return 0, 0, fmt.Errorf("the length of entry %d ('%s') is unknown, since it was indexed before lengths were recorded; reindex it first", song.ID, song.Title)
+		}
+		utils.DebugfCtx(ctx, "[process] appending to '%s' by '%s' at %.1fs", song.Title, song.Artist, song.DurationSec)
+		return song.ID, song.DurationSec, nil
+	}
+
+	utils.DebugfCtx(ctx, "[process] registering '%s' by '%s' in database", title, author)
+	songID, err := dbClient.RegisterSong(title, author, "", opts.sourcePath)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to register entry: %v", err)
+	}
+	return songID, 0, nil
+}
+
+// storeWithRetry stores fingerprints, retrying transient failures (see
+// db.IsRetryable) with exponential backoff. all backends make the write
+// idempotent, so repeating a partially applied store is safe.
+func storeWithRetry(ctx context.Context, dbClient db.DBClient, fingerprint map[uint32]models.Couple) error {
+	return retryWrite(ctx, func() error { return dbClient.StoreFingerprints(fingerprint) })
+}
+
+// retryWrite runs write until it succeeds, fails permanently, runs out of
+// attempts or ctx is done. write must be safe to repeat.
+func retryWrite(ctx context.Context, write func() error) error {
+	delay := storeRetryBaseDelay
+	for attempt := 1; ; attempt++ {
+		err := write()
+		if err == nil {
+			return nil
+		}
+		if !db.IsRetryable(err) {
+			return err
+		}
+		if attempt >= storeRetryAttempts {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+
+		utils.WarnfCtx(ctx, "[process] transient error storing fingerprints (attempt %d/%d), retrying in %s: %v",
+			attempt, storeRetryAttempts, delay, err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w (last error: %v)", ctx.Err(), err)
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// parseUpload parses a multipart request of at most limit bytes. if it
+// fails, the error response (413 when the limit was hit) has been written
+// and false is returned.
+func parseUpload(w http.ResponseWriter, r *http.Request, limit int64) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	err := r.ParseMultipartForm(multipartMemory)
+	if err == nil {
+		return true
+	}
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("upload exceeds the %s limit", formatBytes(tooLarge.Limit)))
+		return false
 	}
-	log.Printf("[process] fingerprints stored in %s", time.Since(storeStart))
+	writeError(w, http.StatusBadRequest, "invalid form")
+	return false
+}
 
-	return songID, len(fingerprint), nil
+// checkAudioUpload turns away uploads before they are decoded: files
+// without an audio stream, and videos, whose audio alone should be
+// uploaded rather than the whole video. cover art doesn't count as video.
+func checkAudioUpload(ctx context.Context, path string) error {
+	format, err := wav.ProbeFormat(ctx, path)
+	if err != nil {
+		return err
+	}
+	if format.AudioStreams == 0 {
+		return &wav.InvalidAudioError{Reason: "no audio stream"}
+	}
+	if format.VideoStreams > 0 {
+		return &wav.InvalidAudioError{Reason: fmt.Sprintf("it is a video (%s); upload only its audio track", format.VideoCodec)}
+	}
+	return nil
 }
 
 func saveUploadedFile(r *http.Request) (string, string, int64, error) {
@@ -141,18 +610,43 @@ func saveUploadedFile(r *http.Request) (string, string, int64, error) {
 	return tmpPath, header.Filename, written, nil
 }
 
-func handleIndex(w http.ResponseWriter, r *http.Request) {
+// saveUploadPart writes one file part of a multipart upload to a unique
+// file under tmp, so parts sharing a name don't overwrite each other.
+func saveUploadPart(header *multipart.FileHeader) (string, error) {
+	file, err := header.Open()
+	if err != nil {
+		return "", fmt.Errorf("failed to open upload: %v", err)
+	}
+	defer file.Close()
+
+	if err := utils.CreateFolder("tmp"); err != nil {
+		return "", fmt.Errorf("failed to create tmp dir: %v", err)
+	}
+
+	dst, err := os.CreateTemp("tmp", "upload_*_"+filepath.Base(header.Filename))
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, file); err != nil {
+		os.Remove(dst.Name())
+		return "", fmt.Errorf("failed to write file: %v", err)
+	}
+	return dst.Name(), nil
+}
+
+func (s *apiServer) handleIndex(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 
 	reqStart := time.Now()
-	log.Printf("[index] received request from %s", r.RemoteAddr)
+	cfg := s.config()
+	utils.DebugfCtx(r.Context(), "[index] received request from %s", r.RemoteAddr)
 
-	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
-	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
-		writeError(w, http.StatusBadRequest, "file too large or invalid form")
+	if !parseUpload(w, r, s.maxIndexUpload) {
 		return
 	}
 
@@ -163,26 +657,27 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
 	}
 	defer os.Remove(tmpPath)
 
-	log.Printf("[index] file saved: %s (%s)", filename, formatBytes(fileSize))
+	utils.DebugfCtx(r.Context(), "[index] file saved: %s (%s)", filename, formatBytes(fileSize))
+
+	if err := checkAudioUpload(r.Context(), tmpPath); err != nil {
+		writeFingerprintError(w, err)
+		return
+	}
 
 	title := r.FormValue("title")
 	author := r.FormValue("author")
 
 	metadata, metaErr := wav.GetMetadata(tmpPath)
 	if metaErr != nil {
-		log.Printf("[index] warning: could not read metadata from %s: %v", filename, metaErr)
+		utils.WarnfCtx(r.Context(), "[index] warning: could not read metadata from %s: %v", filename, metaErr)
 	}
 
 	if metaErr == nil {
 		if author == "" {
-			if a := metadata.Format.Tags["artist"]; a != "" {
-				author = a
-			}
+			author = metadata.Artist()
 		}
 		if title == "" {
-			if t := metadata.Format.Tags["title"]; t != "" {
-				title = t
-			}
+			title = metadata.Title()
 		}
 	}
 
@@ -193,163 +688,619 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
 		author = "unknown"
 	}
 
-	log.Printf("[index] title=%q, author=%q", title, author)
+	utils.DebugfCtx(r.Context(), "[index] title=%q, author=%q", title, author)
 
-	dbClient, err := db.NewDBClient()
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, "db error")
+	key := utils.GenerateSongKey(title, author)
+	existing, exists, _ := s.db.GetSongByKey(key)
+	if exists {
+		msg := fmt.Sprintf("'%s' by '%s' already exists", title, author)
+		utils.WarnfCtx(r.Context(), "[error] %d: %s", http.StatusConflict, msg)
+
+		fpCount, _ := s.db.CountFingerprintsForSong(existing.ID)
+		writeJSON(w, http.StatusConflict, conflictResponse{
+			Error:        msg,
+			ExistingID:   existing.ID,
+			Title:        existing.Title,
+			Author:       existing.Artist,
+			Fingerprints: fpCount,
+		})
 		return
 	}
-	defer dbClient.Close()
 
-	key := utils.GenerateSongKey(title, author)
-	_, exists, _ := dbClient.GetSongByKey(key)
-	if exists {
-		writeError(w, http.StatusConflict, fmt.Sprintf("'%s' by '%s' already exists", title, author))
+	dur, err := wav.GetAudioDuration(r.Context(), tmpPath)
+	if err != nil {
+		writeFingerprintError(w, err)
 		return
 	}
+	utils.InfofCtx(r.Context(), "[index] audio duration: %.0f seconds (%.1f hours)", dur, dur/3600)
 
-	dur, _ := wav.GetAudioDuration(tmpPath)
-	log.Printf("[index] audio duration: %.0f seconds (%.1f hours)", dur, dur/3600)
+	strict, _ := strconv.ParseBool(r.FormValue("strict"))
 
 	logMemUsage("before processing")
-	songID, fpCount, err := processAndSave(tmpPath, title, author)
+	// the upload is deleted after indexing, so record the name the client
+	// sent rather than the temp path
+	result, err := processAndSave(r.Context(), s.db, tmpPath, title, author,
+		indexOptions{durationSec: dur, strict: strict, sourcePath: filename, cfg: cfg})
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err.Error())
+		writeFingerprintError(w, err)
 		return
 	}
 	logMemUsage("after processing")
+	metrics.IndexedFiles.Inc()
 
-	_ = songID
-
+	fpCount := result.fingerprints
 	resp := indexResponse{
 		Title:           title,
 		Author:          author,
 		Fingerprints:    fpCount,
 		StorageEstimate: formatBytes(int64(fpCount) * 20),
 		DurationSec:     int(dur),
+		Warnings:        result.warnings,
 	}
 
-	log.Printf("[index] completed %q: %d fingerprints, %s total time", title, fpCount, time.Since(reqStart))
+	utils.InfofCtx(r.Context(), "[index] completed %q: %d fingerprints, %s total time", title, fpCount, time.Since(reqStart))
 	writeJSON(w, http.StatusOK, resp)
 }
 
-func handleMatch(w http.ResponseWriter, r *http.Request) {
+// bulkIndexResult is the outcome for one file of POST /api/index/bulk.
+type bulkIndexResult struct {
+	File         string   `json:"file"`
+	Status       string   `json:"status"` // "indexed", "duplicate" or "error"
+	Title        string   `json:"title,omitempty"`
+	Author       string   `json:"author,omitempty"`
+	Fingerprints int      `json:"fingerprints,omitempty"`
+	ExistingID   uint32   `json:"existingId,omitempty"` // duplicates only
+	Error        string   `json:"error,omitempty"`
+	Warnings     []string `json:"warnings,omitempty"`
+}
+
+// handleIndexBulk indexes every "file" part of a multipart upload, using
+// the same worker pool as `save` on a directory, and returns one result
+// per file in upload order. titles and authors come from the files' tags
+// or names. a failing file doesn't fail the request.
+func (s *apiServer) handleIndexBulk(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 
 	reqStart := time.Now()
-	log.Printf("[match] received request from %s", r.RemoteAddr)
 
-	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
-	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
-		writeError(w, http.StatusBadRequest, "file too large or invalid form")
+	if !parseUpload(w, r, s.maxIndexUpload) {
+		return
+	}
+
+	parts := r.MultipartForm.File["file"]
+	if len(parts) == 0 {
+		writeError(w, http.StatusBadRequest, "no files provided")
+		return
+	}
+
+	strict, _ := strconv.ParseBool(r.FormValue("strict"))
+	cfg := s.config()
+	workers := indexWorkers(0, len(parts))
+	utils.InfofCtx(r.Context(), "[index] bulk request with %d files, %d workers", len(parts), workers)
+
+	results := make([]bulkIndexResult, len(parts))
+	indexConcurrently(len(parts), workers, func(i int) saveOutcome {
+		res, err := s.indexUploadPart(r.Context(), parts[i], strict, cfg, &results[i])
+		return saveOutcome{res, err}
+	}, func(i int, out saveOutcome) {
+		switch {
+		case results[i].Status == "duplicate":
+		case out.err != nil:
+			results[i].Status = "error"
+			results[i].Error = out.err.Error()
+			utils.WarnfCtx(r.Context(), "[index] %s: %v", results[i].File, out.err)
+		default:
+			results[i].Status = "indexed"
+			results[i].Fingerprints = out.fingerprints
+			results[i].Warnings = out.warnings
+			metrics.IndexedFiles.Inc()
+		}
+	})
+
+	utils.InfofCtx(r.Context(), "[index] bulk request done in %s", time.Since(reqStart))
+	writeJSON(w, http.StatusOK, results)
+}
+
+// indexUploadPart indexes one part of a bulk upload. a duplicate is not an
+// error: result is marked as one and an empty saveResult returned.
+func (s *apiServer) indexUploadPart(ctx context.Context, part *multipart.FileHeader, strict bool, cfg shazam.FingerprintConfig, result *bulkIndexResult) (saveResult, error) {
+	result.File = part.Filename
+
+	tmpPath, err := saveUploadPart(part)
+	if err != nil {
+		return saveResult{}, err
+	}
+	defer os.Remove(tmpPath)
+
+	if err := checkAudioUpload(ctx, tmpPath); err != nil {
+		return saveResult{}, err
+	}
+
+	title, author := entryTags(tmpPath, part.Filename)
+	result.Title, result.Author = title, author
+
+	if existing, exists, _ := s.db.GetSongByKey(utils.GenerateSongKey(title, author)); exists {
+		result.Status = "duplicate"
+		result.ExistingID = existing.ID
+		return saveResult{}, nil
+	}
+
+	dur, err := wav.GetAudioDuration(ctx, tmpPath)
+	if err != nil {
+		return saveResult{}, err
+	}
+
+	indexed, err := processAndSave(ctx, s.db, tmpPath, title, author,
+		indexOptions{durationSec: dur, strict: strict, sourcePath: part.Filename, cfg: cfg})
+	if err != nil {
+		return saveResult{}, err
+	}
+	return saveResult{title: title, author: author, fingerprints: indexed.fingerprints, durationSec: dur, warnings: indexed.warnings}, nil
+}
+
+// errEmptyLibrary is returned by the match paths when nothing has been
+// indexed, so "no songs to match against" isn't mistaken for "no match".
+// the API answers it with a 503: the request was fine, but the server
+// can't match anything until audio is indexed.
+var errEmptyLibrary = errors.New("no songs indexed yet; index some audio first")
+
+// libraryErrorStatus is the status for an error from checkLibrary.
+func libraryErrorStatus(err error) int {
+	if errors.Is(err, errEmptyLibrary) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// checkLibrary returns errEmptyLibrary if dbClient holds no songs.
+func checkLibrary(dbClient db.DBClient) error {
+	total, err := dbClient.TotalSongs()
+	if err != nil {
+		return fmt.Errorf("failed to count songs: %v", err)
+	}
+	if total == 0 {
+		return errEmptyLibrary
+	}
+	return nil
+}
+
+func (s *apiServer) handleMatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	// checked first so an empty library doesn't cost a fingerprint run
+	if err := checkLibrary(s.db); err != nil {
+		metrics.MatchRequests.WithLabelValues("error").Inc()
+		writeError(w, libraryErrorStatus(err), err.Error())
+		return
+	}
+
+	reqStart := time.Now()
+	cfg := s.config()
+	utils.DebugfCtx(r.Context(), "[match] received request from %s", r.RemoteAddr)
+
+	limit, err := parseMatchLimit(r.URL.Query().Get("limit"))
+	if err != nil {
+		metrics.MatchRequests.WithLabelValues("error").Inc()
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	songIDs, err := parseSongIDs(r.URL.Query()["songId"])
+	if err != nil {
+		metrics.MatchRequests.WithLabelValues("error").Inc()
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	minScore, err := parseMinScore(r.URL.Query().Get("minScore"))
+	if err != nil {
+		metrics.MatchRequests.WithLabelValues("error").Inc()
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if r.URL.Query().Get("progressive") == "1" {
+		minSec, err := parseProgressiveMinSec(r.URL.Query().Get("minSec"))
+		if err != nil {
+			metrics.MatchRequests.WithLabelValues("error").Inc()
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.matchProgressive(w, r, progressiveOptions{limit: limit, songIDs: songIDs, minScore: minScore, minSec: minSec, cfg: cfg})
+		return
+	}
+
+	includePeaks := false
+	if raw := r.URL.Query().Get("includePeaks"); raw != "" {
+		if includePeaks, err = strconv.ParseBool(raw); err != nil {
+			metrics.MatchRequests.WithLabelValues("error").Inc()
+			writeError(w, http.StatusBadRequest, "includePeaks must be a boolean")
+			return
+		}
+	}
+
+	if !parseUpload(w, r, s.maxMatchUpload) {
 		return
 	}
 
 	tmpPath, filename, fileSize, err := saveUploadedFile(r)
 	if err != nil {
+		metrics.MatchRequests.WithLabelValues("error").Inc()
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 	defer os.Remove(tmpPath)
 
-	log.Printf("[match] file saved: %s (%s)", filename, formatBytes(fileSize))
+	utils.DebugfCtx(r.Context(), "[match] file saved: %s (%s)", filename, formatBytes(fileSize))
+
+	if err := checkAudioUpload(r.Context(), tmpPath); err != nil {
+		metrics.MatchRequests.WithLabelValues("error").Inc()
+		writeFingerprintError(w, err)
+		return
+	}
+	// rejected rather than answered with a guess
+	clipSec, err := wav.GetAudioDuration(r.Context(), tmpPath)
+	if err == nil {
+		err = cfg.CheckClipLength(clipSec, wav.DecodeSampleRate)
+	}
+	if err != nil {
+		metrics.MatchRequests.WithLabelValues("error").Inc()
+		writeFingerprintError(w, err)
+		return
+	}
 	logMemUsage("before processing")
 
-	log.Printf("[match] fingerprinting sample with chunked processing...")
+	utils.DebugfCtx(r.Context(), "[match] fingerprinting sample with chunked processing...")
 	fpStart := time.Now()
-	fingerprint, err := shazam.FingerprintAudioChunked(tmpPath, utils.GenerateUniqueID(), fpConfig)
+	fingerprint := make(map[uint32]models.Couple)
+	var peaks []shazam.Peak
+	_, _, err = shazam.FingerprintAudioStream(r.Context(), tmpPath, utils.GenerateUniqueID(), cfg, func(chunkFP map[uint32]models.Couple, chunkPeaks []shazam.Peak) error {
+		utils.ExtendMap(fingerprint, chunkFP)
+		if includePeaks {
+			peaks = appendChunkPeaks(peaks, chunkPeaks)
+		}
+		return nil
+	})
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Sprintf("fingerprint error: %v", err))
+		metrics.MatchRequests.WithLabelValues("error").Inc()
+		writeFingerprintError(w, fmt.Errorf("fingerprint error: %w", err))
 		return
 	}
-	log.Printf("[match] fingerprinted: %d entries in %s", len(fingerprint), time.Since(fpStart))
+	metrics.FingerprintDuration.Observe(time.Since(fpStart).Seconds())
+	utils.DebugfCtx(r.Context(), "[match] fingerprinted: %d entries in %s", len(fingerprint), time.Since(fpStart))
 	logMemUsage("after fingerprint")
 
-	sampleFP := make(map[uint32]uint32, len(fingerprint))
-	for addr, couple := range fingerprint {
-		sampleFP[addr] = couple.AnchorTimeMs
+	sampleFP := shazam.SampleFingerprint(fingerprint, cfg)
+
+	cacheKey := shazam.MatchCacheKey(sampleFP, songIDs)
+	generation := s.db.Generation()
+	matches, cached := s.matchCache.Get(cacheKey, generation)
+	var searchDuration time.Duration
+	var truncated bool
+	if cached {
+		utils.InfofCtx(r.Context(), "[match] cache hit: %d matches", len(matches))
+	} else {
+		utils.DebugfCtx(r.Context(), "[match] searching database for matches...")
+		matches, searchDuration, truncated, err = shazam.FindMatchesContext(r.Context(), s.db, sampleFP, songIDs, limit, s.matchOpts)
+		if err != nil {
+			metrics.MatchRequests.WithLabelValues("error").Inc()
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("match error: %v", err))
+			return
+		}
+		// a truncated search may do better next time
+		if !truncated {
+			s.matchCache.Put(cacheKey, generation, matches)
+		}
+		utils.InfofCtx(r.Context(), "[match] search done: %d matches (db query: %s, truncated=%v)", len(matches), searchDuration, truncated)
 	}
 
-	log.Printf("[match] searching database for matches...")
-	matches, searchDuration, err := shazam.FindMatchesFGP(sampleFP)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, fmt.Sprintf("match error: %v", err))
-		return
+	// the cache holds every match, whatever the threshold
+	if kept := aboveMinScore(matches, minScore); len(kept) < len(matches) {
+		utils.DebugfCtx(r.Context(), "[match] %d of %d matches below minScore %g", len(matches)-len(kept), len(matches), minScore)
+		matches = kept
 	}
-	log.Printf("[match] search done: %d matches (db query: %s)", len(matches), searchDuration)
 
-	limit := 20
 	if len(matches) < limit {
 		limit = len(matches)
 	}
 
 	results := make([]matchResult, 0, limit)
 	for _, m := range matches[:limit] {
-		results = append(results, matchResult{
-			Title:  m.SongTitle,
-			Author: m.SongArtist,
-			Score:  m.Score,
-		})
+		results = append(results, newMatchResult(m))
 	}
 
-	log.Printf("[match] completed in %s, returning %d results", time.Since(reqStart), len(results))
-	writeJSON(w, http.StatusOK, map[string]any{
-		"matches":            results,
+	metrics.MatchRequests.WithLabelValues("ok").Inc()
+	metrics.MatchDuration.Observe(time.Since(reqStart).Seconds())
+
+	utils.InfofCtx(r.Context(), "[match] completed in %s, returning %d results", time.Since(reqStart), len(results))
+	resp := map[string]any{
 		"searchTimeMs":       searchDuration.Milliseconds(),
 		"sampleFingerprints": len(sampleFP),
-	})
+		"cached":             cached,
+		"truncated":          truncated,
+		"noMatch":            len(results) == 0,
+	}
+	if includePeaks {
+		resp["peakCount"] = len(peaks)
+		resp["peaks"] = spreadPeaks(peaks, maxMatchPeaks)
+	}
+	if wantsNDJSON(r) {
+		writeNDJSON(w, resp, results)
+		return
+	}
+	resp["matches"] = results
+	writeJSON(w, http.StatusOK, resp)
 }
 
-func handleStats(w http.ResponseWriter, r *http.Request) {
+// spreadPeaks converts up to n of peaks, evenly spaced through them, so a
+// long clip's subset still covers all of it.
+func spreadPeaks(peaks []shazam.Peak, n int) []peakJSON {
+	if len(peaks) < n {
+		n = len(peaks)
+	}
+	out := make([]peakJSON, n)
+	for i := range out {
+		p := peaks[i*len(peaks)/n]
+		out[i] = peakJSON{Time: p.Time, Freq: p.Freq, Mag: p.Mag}
+	}
+	return out
+}
+
+func (s *apiServer) handleStats(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 
-	dbClient, err := db.NewDBClient()
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, "db error")
-		return
-	}
-	defer dbClient.Close()
+	writeJSON(w, http.StatusOK, s.libraryStats())
+}
 
-	totalSongs, _ := dbClient.TotalSongs()
-	totalFP, _ := dbClient.TotalFingerprints()
+// libraryStats returns library totals, recounting only when the database
+// has been written to since the last call.
+func (s *apiServer) libraryStats() statsResponse {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
 
-	writeJSON(w, http.StatusOK, statsResponse{
+	generation := s.db.Generation()
+	if s.statsValid && s.statsGen == generation {
+		return s.stats
+	}
+
+	totalSongs, errSongs := s.db.TotalSongs()
+	totalFP, errFP := s.db.TotalFingerprints()
+	stats := statsResponse{
 		TotalEntries:      totalSongs,
 		TotalFingerprints: totalFP,
 		StorageEstimate:   formatBytes(int64(totalFP) * 20),
-	})
+	}
+
+	// don't pin a failed count until the next write
+	s.stats, s.statsGen, s.statsValid = stats, generation, errSongs == nil && errFP == nil
+	return stats
 }
 
-func handleEntries(w http.ResponseWriter, r *http.Request) {
+// handleComposition lists how many entries each author has, most first.
+func (s *apiServer) handleComposition(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 
-	dbClient, err := db.NewDBClient()
+	authors, err := s.db.LibraryComposition()
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "db error")
+		writeError(w, http.StatusInternalServerError, "failed to count entries per author")
+		return
+	}
+
+	resp := make([]authorCountResponse, 0, len(authors))
+	for _, a := range authors {
+		resp = append(resp, authorCountResponse{Artist: a.Artist, Songs: a.Songs})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *apiServer) handleEntries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	defer dbClient.Close()
 
-	songs, err := dbClient.GetAllSongs()
+	songs, err := s.db.GetAllSongs()
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "failed to list entries")
 		return
 	}
 
 	entries := make([]entryResponse, 0, len(songs))
-	for _, s := range songs {
-		entries = append(entries, entryResponse{ID: s.ID, Title: s.Title, Author: s.Artist})
+	for _, song := range songs {
+		entries = append(entries, entryResponse{
+			ID:     song.ID,
+			Title:  song.Title,
+			Author: song.Artist,
+			Source: s.sourceForClient(song.SourcePath),
+		})
 	}
 
 	writeJSON(w, http.StatusOK, entries)
 }
+
+const (
+	defaultFingerprintPage = 10000
+	maxFingerprintPage     = 100000
+)
+
+// fingerprintsResponse is one page of a song's stored fingerprints,
+// ordered by anchor time. each pair is [address, anchorTimeMs].
+type fingerprintsResponse struct {
+	SongID       uint32      `json:"songId"`
+	Total        int         `json:"total"`
+	Offset       int         `json:"offset"`
+	Fingerprints [][2]uint32 `json:"fingerprints"`
+}
+
+// handleEntryFingerprints serves GET /api/entries/{id}/fingerprints,
+// paginated with ?offset= and ?limit=.
+func (s *apiServer) handleEntryFingerprints(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 32)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid entry id")
+		return
+	}
+	songID := uint32(id)
+
+	offset, limit := 0, defaultFingerprintPage
+	if raw := r.URL.Query().Get("offset"); raw != "" {
+		if offset, err = strconv.Atoi(raw); err != nil || offset < 0 {
+			writeError(w, http.StatusBadRequest, "offset must be a non-negative integer")
+			return
+		}
+	}
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		if limit, err = strconv.Atoi(raw); err != nil || limit < 1 || limit > maxFingerprintPage {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxFingerprintPage))
+			return
+		}
+	}
+
+	if _, exists, err := s.db.GetSongByID(songID); err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to look up entry")
+		return
+	} else if !exists {
+		writeError(w, http.StatusNotFound, "entry not found")
+		return
+	}
+
+	fingerprints, err := s.db.GetFingerprintsBySong(songID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load fingerprints")
+		return
+	}
+
+	resp := fingerprintsResponse{SongID: songID, Total: len(fingerprints), Offset: offset, Fingerprints: [][2]uint32{}}
+	if offset < len(fingerprints) {
+		end := min(offset+limit, len(fingerprints))
+		for _, fp := range fingerprints[offset:end] {
+			resp.Fingerprints = append(resp.Fingerprints, [2]uint32{fp.Address, fp.AnchorTimeMs})
+		}
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// maxAnalyzeSec caps the clips /api/analyze accepts; a debug response
+// lists every peak, which grows with the duration.
+const maxAnalyzeSec = 30
+
+// analyzeResponse describes how a clip was analysed: the spectrogram's
+// shape, and with ?debug=1 every peak extracted from it.
+type analyzeResponse struct {
+	DurationSec      float64 `json:"durationSec"`
+	Frames           int     `json:"frames"`
+	Bins             int     `json:"bins"`
+	FrameDurationSec float64 `json:"frameDurationSec"`
+	FreqResolutionHz float64 `json:"freqResolutionHz"`
+	PeakCount        int     `json:"peakCount"`
+	Fingerprints     int     `json:"fingerprints"`
+
+	Peaks []peakJSON `json:"peaks,omitempty"`
+}
+
+type peakJSON struct {
+	Time float64 `json:"time"` // seconds
+	Freq float64 `json:"freq"` // Hz
+	Mag  float64 `json:"mag"`
+}
+
+// handleAnalyze serves POST /api/analyze: it runs a short upload through
+// the spectrogram and peak extraction instead of matching it, for
+// visualizers and for working out why a clip doesn't match.
+func (s *apiServer) handleAnalyze(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	cfg := s.config()
+	debug := false
+	if raw := r.URL.Query().Get("debug"); raw != "" {
+		var err error
+		if debug, err = strconv.ParseBool(raw); err != nil {
+			writeError(w, http.StatusBadRequest, "debug must be a boolean")
+			return
+		}
+	}
+
+	if !parseUpload(w, r, s.maxMatchUpload) {
+		return
+	}
+
+	tmpPath, filename, fileSize, err := saveUploadedFile(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer os.Remove(tmpPath)
+
+	utils.DebugfCtx(r.Context(), "[analyze] file saved: %s (%s)", filename, formatBytes(fileSize))
+
+	if err := checkAudioUpload(r.Context(), tmpPath); err != nil {
+		writeFingerprintError(w, err)
+		return
+	}
+
+	dur, err := wav.GetAudioDuration(r.Context(), tmpPath)
+	if err != nil {
+		writeFingerprintError(w, err)
+		return
+	}
+	if dur > maxAnalyzeSec {
+		writeError(w, http.StatusBadRequest,
+			fmt.Sprintf("clip is %.1fs long; /api/analyze accepts up to %ds", dur, maxAnalyzeSec))
+		return
+	}
+
+	wavPath, err := wav.ExtractChunkAsWAV(r.Context(), tmpPath, 0, dur)
+	if err != nil {
+		writeFingerprintError(w, err)
+		return
+	}
+	wavInfo, err := wav.ReadWavInfo(wavPath)
+	wav.RemoveTemp(wavPath)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to read decoded audio: %v", err))
+		return
+	}
+
+	// the same analysis a match runs, so the numbers agree with it
+	analysis, err := shazam.AnalyzeSamplesDetailed(wavInfo.MonoSamples(), wavInfo.SampleRate, cfg)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("analysis failed: %v", err))
+		return
+	}
+
+	effectiveRate := shazam.EffectiveSampleRate(wavInfo.SampleRate, cfg)
+	resp := analyzeResponse{
+		DurationSec:      wavInfo.Duration,
+		Frames:           analysis.Frames,
+		Bins:             analysis.Bins,
+		FrameDurationSec: shazam.FrameDuration(wavInfo.SampleRate, cfg),
+		FreqResolutionHz: effectiveRate / float64(cfg.WindowSize),
+		PeakCount:        len(analysis.Peaks),
+		Fingerprints:     len(analysis.Fingerprints),
+	}
+	if debug {
+		resp.Peaks = make([]peakJSON, len(analysis.Peaks))
+		for i, p := range analysis.Peaks {
+			resp.Peaks[i] = peakJSON{Time: p.Time, Freq: p.Freq, Mag: p.Mag}
+		}
+	}
+
+	utils.InfofCtx(r.Context(), "[analyze] %s: %d frames, %d peaks", filename, resp.Frames, resp.PeakCount)
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,896 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"song-recognition/db"
+	"song-recognition/models"
+	"song-recognition/shazam"
+	"song-recognition/utils"
+	"song-recognition/wav"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// ndjsonLines decodes every line of an NDJSON body.
+func ndjsonLines(t *testing.T, rec *httptest.ResponseRecorder) []map[string]any {
+	t.Helper()
+	if ct := rec.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	var lines []map[string]any
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		var line map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("bad NDJSON line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestWriteNDJSON(t *testing.T) {
+	meta := map[string]any{"noMatch": true, "truncated": false, "cached": false, "sampleFingerprints": 12, "searchTimeMs": 3}
+
+	rec := httptest.NewRecorder()
+	writeNDJSON(rec, meta, nil)
+	lines := ndjsonLines(t, rec)
+	if len(lines) != 1 || lines[0]["noMatch"] != true || lines[0]["sampleFingerprints"] != float64(12) {
+		t.Fatalf("response without matches = %v, want just the metadata line", lines)
+	}
+
+	meta["noMatch"] = false
+	results := []matchResult{{SongID: 1, Title: "a"}, {SongID: 2, Title: "b"}}
+	rec = httptest.NewRecorder()
+	writeNDJSON(rec, meta, results)
+	lines = ndjsonLines(t, rec)
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want metadata and 2 matches", len(lines))
+	}
+	if _, ok := lines[0]["truncated"]; !ok {
+		t.Errorf("first line %v lacks the metadata", lines[0])
+	}
+	if lines[1]["title"] != "a" || lines[2]["title"] != "b" {
+		t.Errorf("match lines = %v, %v", lines[1], lines[2])
+	}
+}
+
+func TestAppendChunkPeaks(t *testing.T) {
+	// two bands per frame; the second chunk repeats the frame at 0.2s
+	first := []shazam.Peak{{Time: 0.1, Freq: 300}, {Time: 0.1, Freq: 900}, {Time: 0.2, Freq: 300}, {Time: 0.2, Freq: 900}}
+	second := []shazam.Peak{{Time: 0.2, Freq: 300}, {Time: 0.2, Freq: 900}, {Time: 0.3, Freq: 300}, {Time: 0.3, Freq: 900}}
+
+	peaks := appendChunkPeaks(nil, first)
+	peaks = appendChunkPeaks(peaks, second)
+	want := append(first, second[2:]...)
+	if !reflect.DeepEqual(peaks, want) {
+		t.Errorf("got %v, want %v", peaks, want)
+	}
+}
+
+func TestWriteFingerprintError(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		status int
+		msg    string
+	}{
+		{fmt.Errorf("fingerprint error: %w", &wav.InvalidAudioError{Reason: "no audio stream"}), 422, "file is not valid audio"},
+		{fmt.Errorf("clip: %w", shazam.ErrClipTooShort), 422, "clip too short to match"},
+		{errors.New("disk full"), 500, "disk full"},
+	} {
+		rec := httptest.NewRecorder()
+		writeFingerprintError(rec, tc.err)
+		if rec.Code != tc.status || decodeJSON(t, rec)["error"] != tc.msg {
+			t.Errorf("%v: %d %s, want %d with error %q", tc.err, rec.Code, rec.Body, tc.status, tc.msg)
+		}
+	}
+}
+
+func TestMatchRejectsUndecodableUpload(t *testing.T) {
+	requireFFmpeg(t)
+	inTempDir(t)
+	s := newTestServer(t, shazam.DefaultAudiobookConfig(), 1)
+
+	rec := httptest.NewRecorder()
+	s.handleMatch(rec, uploadRequest(t, "/api/match", "notes.mp3", []byte("these are not the droids"), nil))
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status %d (%s), want 422", rec.Code, rec.Body)
+	}
+	if resp := decodeJSON(t, rec); resp["error"] != "file is not valid audio" || resp["details"] == "" {
+		t.Errorf("response %v", resp)
+	}
+}
+
+func TestParseMatchLimit(t *testing.T) {
+	for raw, want := range map[string]int{"": defaultMatchLimit, "5": 5, " 7 ": 7, "0": 1, "-3": 1, "100000": maxMatchLimit} {
+		if got, err := parseMatchLimit(raw); err != nil || got != want {
+			t.Errorf("parseMatchLimit(%q) = %d, %v; want %d", raw, got, err, want)
+		}
+	}
+	if _, err := parseMatchLimit("ten"); err == nil {
+		t.Error("parseMatchLimit(\"ten\") accepted")
+	}
+}
+
+func TestMatchLimit(t *testing.T) {
+	requireFFmpeg(t)
+	inTempDir(t)
+	s := newTestServer(t, shazam.DefaultMusicConfig(), 3)
+	clip := clipWav(t, 2, 20, 6)
+
+	if titles := matchTitles(t, postMatch(t, s, "?limit=1", clip)); len(titles) != 1 || titles[0] != "song 1" {
+		t.Errorf("limit=1 returned %v, want just song 1", titles)
+	}
+	if rec := postMatch(t, s, "?limit=ten", clip); rec.Code != http.StatusBadRequest {
+		t.Errorf("limit=ten returned %d, want 400", rec.Code)
+	}
+}
+
+func TestIndexConflictNamesExistingEntry(t *testing.T) {
+	requireFFmpeg(t)
+	inTempDir(t)
+	s := newTestServer(t, shazam.DefaultAudiobookConfig(), 1)
+	existing, _, err := s.db.GetSongByKey(utils.GenerateSongKey("song 0", "artist"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	s.handleIndex(rec, uploadRequest(t, "/api/index", "again.wav", clipWav(t, 1, 0, 5), map[string]string{"title": "song 0", "author": "artist"}))
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("status %d (%s), want 409", rec.Code, rec.Body)
+	}
+	resp := decodeJSON(t, rec)
+	if resp["existingId"] != float64(existing.ID) || resp["title"] != "song 0" || resp["fingerprints"].(float64) == 0 {
+		t.Errorf("conflict response %v doesn't describe entry %d", resp, existing.ID)
+	}
+}
+
+func TestRetryWrite(t *testing.T) {
+	busy := sqlite3.Error{Code: sqlite3.ErrBusy}
+
+	calls := 0
+	err := retryWrite(context.Background(), func() error {
+		if calls++; calls < 2 {
+			return busy
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Errorf("transient failure: %v after %d calls, want success on the 2nd", err, calls)
+	}
+
+	calls = 0
+	permanent := errors.New("no such table")
+	if err := retryWrite(context.Background(), func() error { calls++; return permanent }); err != permanent || calls != 1 {
+		t.Errorf("permanent failure: %v after %d calls, want it returned at once", err, calls)
+	}
+
+	calls = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := retryWrite(ctx, func() error { calls++; return busy }); !errors.Is(err, context.Canceled) || calls != 1 {
+		t.Errorf("cancelled: %v after %d calls, want context.Canceled after 1", err, calls)
+	}
+
+	calls = 0
+	if err := retryWrite(context.Background(), func() error { calls++; return busy }); !errors.Is(err, busy) || calls != storeRetryAttempts {
+		t.Errorf("always busy: %v after %d calls, want to give up after %d", err, calls, storeRetryAttempts)
+	}
+}
+
+// sparseWav is a WAV of 20s that is quiet but for half a second of a
+// faint tone, loud enough not to count as silence yet far too sparse to
+// match.
+func sparseWav(t *testing.T) []byte {
+	t.Helper()
+	samples := make([]float64, 20*wav.DecodeSampleRate)
+	for i := range wav.DecodeSampleRate / 2 {
+		samples[i] = 0.05 * math.Sin(2*math.Pi*440*float64(i)/wav.DecodeSampleRate)
+	}
+	path := filepath.Join(t.TempDir(), "sparse.wav")
+	if err := wav.WriteWav(path, samples, wav.DecodeSampleRate, 1); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestIndexWarnsOnSparseFingerprints(t *testing.T) {
+	requireFFmpeg(t)
+	inTempDir(t)
+	s := newTestServer(t, shazam.DefaultAudiobookConfig(), 0)
+
+	rec := httptest.NewRecorder()
+	s.handleIndex(rec, uploadRequest(t, "/api/index", "quiet.wav", sparseWav(t), map[string]string{"title": "quiet"}))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d (%s), want 200", rec.Code, rec.Body)
+	}
+	warnings, _ := decodeJSON(t, rec)["warnings"].([]any)
+	if len(warnings) != 1 || !strings.Contains(warnings[0].(string), "too few fingerprints") {
+		t.Errorf("warnings = %v, want the density warning", warnings)
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleIndex(rec, uploadRequest(t, "/api/index", "quiet.wav", sparseWav(t), map[string]string{"title": "quiet too", "strict": "true"}))
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("strict status %d (%s), want 422", rec.Code, rec.Body)
+	}
+	if _, found, _ := s.db.GetSongByKey(utils.GenerateSongKey("quiet too", "unknown")); found {
+		t.Error("strict rejection left the entry behind")
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleIndex(rec, uploadRequest(t, "/api/index", "loud.wav", clipWav(t, 1, 0, 20), map[string]string{"title": "loud"}))
+	if _, ok := decodeJSON(t, rec)["warnings"]; rec.Code != http.StatusOK || ok {
+		t.Errorf("ordinary audio: status %d, body %s; want 200 without warnings", rec.Code, rec.Body)
+	}
+}
+
+func TestParseSongIDs(t *testing.T) {
+	ids, err := parseSongIDs([]string{"1", "2, 3", ""})
+	if err != nil || !reflect.DeepEqual(ids, []uint32{1, 2, 3}) {
+		t.Errorf("parseSongIDs = %v, %v; want [1 2 3]", ids, err)
+	}
+	if ids, err := parseSongIDs(nil); err != nil || ids != nil {
+		t.Errorf("no songId gave %v, %v; want no restriction", ids, err)
+	}
+	if _, err := parseSongIDs([]string{"1,x"}); err == nil {
+		t.Error("non-numeric songId accepted")
+	}
+}
+
+func TestMatchRestrictedBySongID(t *testing.T) {
+	requireFFmpeg(t)
+	inTempDir(t)
+	s := newTestServer(t, shazam.DefaultAudiobookConfig(), 3)
+	other, _, err := s.db.GetSongByKey(utils.GenerateSongKey("song 2", "artist"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clip := clipWav(t, 1, 10, 8)
+	rec := postMatch(t, s, fmt.Sprintf("?songId=%d", other.ID), clip)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d (%s)", rec.Code, rec.Body)
+	}
+	for _, title := range matchTitles(t, rec) {
+		if title != "song 2" {
+			t.Errorf("?songId=%d matched %q", other.ID, title)
+		}
+	}
+	if rec := postMatch(t, s, "?songId=abc", clip); rec.Code != http.StatusBadRequest {
+		t.Errorf("songId=abc returned %d, want 400", rec.Code)
+	}
+}
+
+// entrySources returns the source GET /api/entries reports per title.
+func entrySources(t *testing.T, s *apiServer) map[string]string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.handleEntries(rec, httptest.NewRequest(http.MethodGet, "/api/entries", nil))
+	var entries []entryResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("bad entries response %q: %v", rec.Body, err)
+	}
+	sources := make(map[string]string, len(entries))
+	for _, e := range entries {
+		sources[e.Title] = e.Source
+	}
+	return sources
+}
+
+func TestSourcePathRoundTrips(t *testing.T) {
+	requireFFmpeg(t)
+	dir := cliTestDir(t)
+	path := filepath.Join(dir, "chapter one.wav")
+	writeTestWav(t, path, 1, 5)
+	captureStdout(t, func() { save(path, saveOptions{quiet: true}) })
+
+	s := newTestServerWith(t, openCLIDB(t), shazam.DefaultAudiobookConfig(), 0)
+	rec := httptest.NewRecorder()
+	s.handleIndex(rec, uploadRequest(t, "/api/index", "upload.wav", clipWav(t, 2, 0, 5), map[string]string{"title": "uploaded"}))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("index status %d (%s)", rec.Code, rec.Body)
+	}
+
+	stored := map[string]string{}
+	songs, err := s.db.GetAllSongs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, song := range songs {
+		stored[song.Title] = song.SourcePath
+	}
+	// uploads are indexed from a temp file; the client's name is kept
+	want := map[string]string{"chapter one": path, "uploaded": "upload.wav"}
+	if !reflect.DeepEqual(stored, want) {
+		t.Errorf("stored paths %v, want %v", stored, want)
+	}
+
+	if got := entrySources(t, s); got["chapter one"] != "chapter one.wav" || got["uploaded"] != "upload.wav" {
+		t.Errorf("entries list sources %v, want file names only", got)
+	}
+	s.exposePaths = true
+	if got := entrySources(t, s); got["chapter one"] != path {
+		t.Errorf("with exposed paths entries list %q, want %q", got["chapter one"], path)
+	}
+}
+
+func TestEntryFingerprints(t *testing.T) {
+	s := newTestServer(t, shazam.DefaultAudiobookConfig(), 0)
+	id, err := s.db.RegisterSong("known", "artist", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][2]uint32{{7, 0}, {3, 10}, {12, 20}, {5, 30}, {9, 40}}
+	fps := make(map[uint32]models.Couple, len(want))
+	for _, fp := range want {
+		fps[fp[0]] = models.Couple{SongID: id, AnchorTimeMs: fp[1]}
+	}
+	if err := s.db.StoreFingerprints(fps); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(id, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/entries/"+id+"/fingerprints"+query, nil)
+		req.SetPathValue("id", id)
+		rec := httptest.NewRecorder()
+		s.handleEntryFingerprints(rec, req)
+		return rec
+	}
+	page := func(rec *httptest.ResponseRecorder) fingerprintsResponse {
+		t.Helper()
+		var resp fingerprintsResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); rec.Code != http.StatusOK || err != nil {
+			t.Fatalf("status %d, body %s", rec.Code, rec.Body)
+		}
+		return resp
+	}
+
+	idStr := fmt.Sprint(id)
+	if resp := page(get(idStr, "")); resp.Total != 5 || !reflect.DeepEqual(resp.Fingerprints, want) {
+		t.Errorf("fingerprints = %+v, want %v in anchor order", resp, want)
+	}
+	if resp := page(get(idStr, "?offset=3&limit=10")); resp.Offset != 3 || !reflect.DeepEqual(resp.Fingerprints, want[3:]) {
+		t.Errorf("offset 3 page = %+v", resp)
+	}
+	if resp := page(get(idStr, "?offset=9")); len(resp.Fingerprints) != 0 || resp.Total != 5 {
+		t.Errorf("page past the end = %+v", resp)
+	}
+
+	for query, code := range map[string]int{"?limit=0": 400, "?offset=-1": 400} {
+		if rec := get(idStr, query); rec.Code != code {
+			t.Errorf("%s returned %d, want %d", query, rec.Code, code)
+		}
+	}
+	if rec := get("x", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("id x returned %d, want 400", rec.Code)
+	}
+	if rec := get(fmt.Sprint(id+1), ""); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown entry returned %d, want 404", rec.Code)
+	}
+}
+
+// countingClient counts the fingerprint lookups and song counts made
+// through it.
+type countingClient struct {
+	db.DBClient
+	lookups atomic.Int32
+	totals  atomic.Int32
+}
+
+func (c *countingClient) TotalSongs() (int, error) {
+	c.totals.Add(1)
+	return c.DBClient.TotalSongs()
+}
+
+func (c *countingClient) GetCouplesForSongs(addresses []uint32, songIDs []uint32) (map[uint32][]models.Couple, error) {
+	c.lookups.Add(1)
+	return c.DBClient.GetCouplesForSongs(addresses, songIDs)
+}
+
+func TestMatchCacheSkipsSearch(t *testing.T) {
+	requireFFmpeg(t)
+	inTempDir(t)
+	client := &countingClient{DBClient: db.NewMemoryClient()}
+	s := newTestServerWith(t, client, shazam.DefaultAudiobookConfig(), 2)
+	s.matchCache = shazam.NewMatchCache(8, time.Minute)
+
+	clip := clipWav(t, 2, 20, 8)
+	first := postMatch(t, s, "", clip)
+	searches := client.lookups.Load()
+	if first.Code != http.StatusOK || searches == 0 {
+		t.Fatalf("first match: status %d, %d lookups", first.Code, searches)
+	}
+	second := postMatch(t, s, "", clip)
+	if client.lookups.Load() != searches {
+		t.Error("repeating the query searched the database again")
+	}
+	if !reflect.DeepEqual(matchTitles(t, first), matchTitles(t, second)) {
+		t.Errorf("cached answer %v differs from %v", matchTitles(t, second), matchTitles(t, first))
+	}
+
+	// indexing something new invalidates it
+	if _, err := s.db.RegisterSong("new", "artist", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	postMatch(t, s, "", clip)
+	if client.lookups.Load() == searches {
+		t.Error("cached result served after a write")
+	}
+}
+
+func TestStatsFreshAfterIndexing(t *testing.T) {
+	requireFFmpeg(t)
+	inTempDir(t)
+	client := &countingClient{DBClient: db.NewMemoryClient()}
+	s := newTestServerWith(t, client, shazam.DefaultAudiobookConfig(), 1)
+
+	stats := func() statsResponse {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		s.handleStats(rec, httptest.NewRequest(http.MethodGet, "/api/stats", nil))
+		var resp statsResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("bad stats response %q: %v", rec.Body, err)
+		}
+		return resp
+	}
+
+	before := stats()
+	if stats() != before || client.totals.Load() != 1 {
+		t.Errorf("unchanged database recounted: %d counts", client.totals.Load())
+	}
+
+	rec := httptest.NewRecorder()
+	s.handleIndex(rec, uploadRequest(t, "/api/index", "new.wav", clipWav(t, 2, 0, 10), map[string]string{"title": "new"}))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("index status %d (%s)", rec.Code, rec.Body)
+	}
+	added := int(decodeJSON(t, rec)["fingerprints"].(float64))
+
+	after := stats()
+	if after.TotalEntries != before.TotalEntries+1 || after.TotalFingerprints != before.TotalFingerprints+added {
+		t.Errorf("stats after indexing %+v, want one more entry and %d more fingerprints than %+v", after, added, before)
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	for raw, want := range map[string]int64{"100MB": 100 << 20, "5 gb": 5 << 30, "1.5KB": 1536, "42": 42, " 7 B ": 7} {
+		if got, err := parseByteSize(raw); err != nil || got != want {
+			t.Errorf("parseByteSize(%q) = %d, %v; want %d", raw, got, err, want)
+		}
+	}
+	for _, raw := range []string{"", "MB", "-1MB", "0", "ten"} {
+		if _, err := parseByteSize(raw); err == nil {
+			t.Errorf("parseByteSize(%q) succeeded", raw)
+		}
+	}
+}
+
+func TestUploadLimits(t *testing.T) {
+	inTempDir(t)
+	s := newTestServer(t, shazam.DefaultAudiobookConfig(), 1)
+	s.maxIndexUpload, s.maxMatchUpload = 64<<10, 16<<10
+	big := make([]byte, 32<<10)
+
+	// a 32 KB file is over the match limit but within the index one
+	rec := postMatch(t, s, "", big)
+	if rec.Code != http.StatusRequestEntityTooLarge || !strings.Contains(decodeJSON(t, rec)["error"].(string), "16.0 KB") {
+		t.Errorf("match: status %d (%s), want 413 naming the 16 KB limit", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	s.handleIndex(rec, uploadRequest(t, "/api/index", "big.wav", big, nil))
+	if rec.Code == http.StatusRequestEntityTooLarge {
+		t.Errorf("index rejected 32 KB as too large with a 64 KB limit")
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleIndex(rec, uploadRequest(t, "/api/index", "huge.wav", make([]byte, 128<<10), nil))
+	if rec.Code != http.StatusRequestEntityTooLarge || !strings.Contains(decodeJSON(t, rec)["error"].(string), "64.0 KB") {
+		t.Errorf("index: status %d (%s), want 413 naming the 64 KB limit", rec.Code, rec.Body)
+	}
+}
+
+// bulkRequest builds a POST /api/index/bulk with a "file" part per entry
+// of files, in order.
+func bulkRequest(t *testing.T, files [][2]string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, f := range files {
+		part, err := mw.CreateFormFile("file", f[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(f[1]))
+	}
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/api/index/bulk", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestIndexBulk(t *testing.T) {
+	requireFFmpeg(t)
+	inTempDir(t)
+	s := newTestServer(t, shazam.DefaultAudiobookConfig(), 0)
+
+	first, second := string(clipWav(t, 5, 0, 10)), string(clipWav(t, 6, 0, 10))
+	results := func(files [][2]string) []map[string]any {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		s.handleIndexBulk(rec, bulkRequest(t, files))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d (%s), want 200", rec.Code, rec.Body)
+		}
+		var results []map[string]any
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != len(files) {
+			t.Fatalf("%d results for %d files: %s", len(results), len(files), rec.Body)
+		}
+		return results
+	}
+
+	got := results([][2]string{{"first.wav", first}, {"broken.wav", "not audio"}, {"second.wav", second}})
+	for i, want := range []struct{ file, status string }{{"first.wav", "indexed"}, {"broken.wav", "error"}, {"second.wav", "indexed"}} {
+		if got[i]["file"] != want.file || got[i]["status"] != want.status {
+			t.Errorf("result %d = %v, want %s %s", i, got[i], want.file, want.status)
+		}
+	}
+	if got[0]["title"] != "first" || got[0]["fingerprints"].(float64) == 0 {
+		t.Errorf("indexed result %v has no title or fingerprints", got[0])
+	}
+	if got[1]["error"] == "" {
+		t.Errorf("error result %v doesn't say what failed", got[1])
+	}
+	if total, _ := s.db.TotalSongs(); total != 2 {
+		t.Errorf("%d songs stored, want 2", total)
+	}
+
+	existing, _, err := s.db.GetSongByKey(utils.GenerateSongKey("second", "unknown"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = results([][2]string{{"second.wav", second}})
+	if got[0]["status"] != "duplicate" || got[0]["existingId"] != float64(existing.ID) {
+		t.Errorf("re-upload = %v, want a duplicate of %d", got[0], existing.ID)
+	}
+
+	rec := httptest.NewRecorder()
+	s.handleIndexBulk(rec, bulkRequest(t, nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("empty upload: status %d, want 400", rec.Code)
+	}
+	if left, _ := filepath.Glob(filepath.Join("tmp", "*")); len(left) > 0 {
+		t.Errorf("uploads left behind: %v", left)
+	}
+}
+
+func TestMatchUsesServerOptions(t *testing.T) {
+	requireFFmpeg(t)
+	inTempDir(t)
+	s := newTestServer(t, shazam.DefaultAudiobookConfig(), 2)
+	clip := clipWav(t, 2, 20, 8)
+
+	if resp := decodeJSON(t, postMatch(t, s, "", clip)); resp["truncated"] != false {
+		t.Fatalf("search without a time limit: truncated = %v", resp["truncated"])
+	}
+	s.matchOpts.MaxSearchDuration = time.Nanosecond
+	if resp := decodeJSON(t, postMatch(t, s, "?limit=1", clip)); resp["truncated"] != true {
+		t.Errorf("search limited to 1ns: truncated = %v", resp["truncated"])
+	}
+}
+
+func TestMatchEmptyLibrary(t *testing.T) {
+	requireFFmpeg(t)
+	inTempDir(t)
+	clip := clipWav(t, 9, 0, 5)
+
+	rec := postMatch(t, newTestServer(t, shazam.DefaultAudiobookConfig(), 0), "", clip)
+	if rec.Code != http.StatusServiceUnavailable || decodeJSON(t, rec)["error"] != errEmptyLibrary.Error() {
+		t.Errorf("empty library: status %d, body %s; want 503 saying nothing is indexed", rec.Code, rec.Body)
+	}
+
+	// audio that isn't in a populated library is an ordinary miss
+	rec = postMatch(t, newTestServer(t, shazam.DefaultAudiobookConfig(), 1), "", clip)
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), errEmptyLibrary.Error()) {
+		t.Errorf("populated library: status %d, body %s; want 200", rec.Code, rec.Body)
+	}
+}
+
+func TestRequestIDHeaderMatchesLogs(t *testing.T) {
+	var logs bytes.Buffer
+	flags, out := log.Flags(), log.Writer()
+	log.SetOutput(&logs)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(out)
+		log.SetFlags(flags)
+	}()
+
+	s := newTestServer(t, shazam.DefaultAudiobookConfig(), 0)
+	handler := requestLogger(http.HandlerFunc(s.handleMatch))
+	ids := map[string]bool{}
+	for range 2 {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/match", nil))
+		id := rec.Header().Get("X-Request-ID")
+		if id == "" || ids[id] {
+			t.Fatalf("X-Request-ID %q missing or reused", id)
+		}
+		ids[id] = true
+	}
+
+	// both the handler's error and the request summary carry the ID
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("logged %q, want an error and a summary per request", lines)
+	}
+	for i, line := range lines {
+		id := strings.TrimSuffix(strings.Fields(line)[1], "]")
+		if !strings.HasPrefix(line, "[req ") || !ids[id] {
+			t.Errorf("line %q doesn't carry a returned request ID", line)
+		}
+		if i%2 == 1 && (!strings.Contains(lines[i-1], "[req "+id+"]") || !strings.Contains(line, "-> 405")) {
+			t.Errorf("summary %q doesn't follow its request's error %q", line, lines[i-1])
+		}
+	}
+}
+
+func TestParseMinScore(t *testing.T) {
+	for raw, want := range map[string]float64{"": 0, "0": 0, " 2.5 ": 2.5} {
+		if got, err := parseMinScore(raw); err != nil || got != want {
+			t.Errorf("parseMinScore(%q) = %g, %v; want %g", raw, got, err, want)
+		}
+	}
+	for _, raw := range []string{"-1", "abc", "NaN", "Inf"} {
+		if _, err := parseMinScore(raw); err == nil {
+			t.Errorf("parseMinScore(%q) accepted", raw)
+		}
+	}
+}
+
+func TestMatchMinScore(t *testing.T) {
+	requireFFmpeg(t)
+	inTempDir(t)
+	s := newTestServer(t, shazam.DefaultMusicConfig(), 3)
+	clip := clipWav(t, 2, 10, 10)
+
+	scores := func(query string) (scores []float64, noMatch bool) {
+		t.Helper()
+		rec := postMatch(t, s, query, clip)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d (%s)", query, rec.Code, rec.Body)
+		}
+		resp := decodeJSON(t, rec)
+		for _, m := range resp["matches"].([]any) {
+			scores = append(scores, m.(map[string]any)["score"].(float64))
+		}
+		return scores, resp["noMatch"].(bool)
+	}
+
+	all, _ := scores("?limit=5")
+	if len(all) < 2 || all[0] <= all[1] {
+		t.Fatalf("scores %v, want a clear best match and weaker ones", all)
+	}
+	between := (all[0] + all[1]) / 2
+	for _, tc := range []struct {
+		minScore float64
+		want     []float64
+	}{
+		{0, all},
+		{between, all[:1]},
+		{all[0], all[:1]}, // the threshold itself is kept
+		{all[0] + 1, nil},
+	} {
+		got, noMatch := scores(fmt.Sprintf("?limit=5&minScore=%g", tc.minScore))
+		if !slices.Equal(got, tc.want) || noMatch != (len(tc.want) == 0) {
+			t.Errorf("minScore %g: scores %v (noMatch %v), want %v", tc.minScore, got, noMatch, tc.want)
+		}
+	}
+
+	// the threshold applies before the limit
+	if got, _ := scores(fmt.Sprintf("?limit=1&minScore=%g", between)); !slices.Equal(got, all[:1]) {
+		t.Errorf("limit 1 over minScore: %v", got)
+	}
+	if rec := postMatch(t, s, "?minScore=-2", clip); rec.Code != http.StatusBadRequest {
+		t.Errorf("negative minScore: status %d, want 400", rec.Code)
+	}
+}
+
+func TestSeekTime(t *testing.T) {
+	for _, tc := range []struct {
+		offsetMs    int32
+		durationSec float64
+		want        float64
+	}{
+		{12300, 60, 12.3},
+		{-1500, 60, 0},
+		{75000, 60, 60},
+		{75000, 0, 75}, // unknown duration
+	} {
+		if got := seekTime(tc.offsetMs, tc.durationSec); got != tc.want {
+			t.Errorf("seekTime(%d, %g) = %g, want %g", tc.offsetMs, tc.durationSec, got, tc.want)
+		}
+	}
+}
+
+func TestMatchReturnsSeekTime(t *testing.T) {
+	requireFFmpeg(t)
+	inTempDir(t)
+	s := newTestServer(t, shazam.DefaultAudiobookConfig(), 0)
+	rec := httptest.NewRecorder()
+	s.handleIndex(rec, uploadRequest(t, "/api/index", "book.wav", clipWav(t, 1, 0, 30), map[string]string{"title": "book"}))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("index: status %d (%s)", rec.Code, rec.Body)
+	}
+
+	rec = postMatch(t, s, "", clipWav(t, 1, 12, 8))
+	if titles := matchTitles(t, rec); len(titles) == 0 || titles[0] != "book" {
+		t.Fatalf("clip of book matched %v", titles)
+	}
+	best := decodeJSON(t, rec)["matches"].([]any)[0].(map[string]any)
+	offset, seek, duration := best["offsetMs"].(float64), best["seekTimeSec"].(float64), best["durationSec"].(float64)
+	// the clip starts 12s in; offsets are floored to 100ms buckets
+	if offset < 11800 || offset > 12000 || seek != offset/1000 || duration != 30 {
+		t.Errorf("offset %gms, seek %gs, duration %gs; want about 12000ms, the same in seconds, and 30s", offset, seek, duration)
+	}
+}
+
+// failingStoreClient fails every StoreFingerprints call after the first
+// ok ones, with an error that isn't retried.
+type failingStoreClient struct {
+	db.DBClient
+	ok, stores int
+}
+
+func (c *failingStoreClient) StoreFingerprints(fingerprints map[uint32]models.Couple) error {
+	if c.stores++; c.stores > c.ok {
+		return errors.New("disk full")
+	}
+	return c.DBClient.StoreFingerprints(fingerprints)
+}
+
+func TestProcessAndSaveStoresPerChunk(t *testing.T) {
+	requireFFmpeg(t)
+	path := filepath.Join(t.TempDir(), "long.wav")
+	writeTestWav(t, path, 3, 30)
+	cfg := shazam.DefaultAudiobookConfig()
+	cfg.ChunkDurationSec, cfg.ChunkOverlapSec = 10, 0
+	opts := indexOptions{durationSec: 30, cfg: cfg}
+
+	client := &failingStoreClient{DBClient: db.NewMemoryClient(), ok: 100}
+	result, err := processAndSave(context.Background(), client, path, "long", "author", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.stores != 3 {
+		t.Errorf("stored in %d writes, want one per chunk", client.stores)
+	}
+	if stored, _ := client.CountFingerprintsForSong(result.songID); stored != result.fingerprints {
+		t.Errorf("reported %d fingerprints, stored %d", result.fingerprints, stored)
+	}
+
+	// a store failing partway removes the entry and what was stored
+	client = &failingStoreClient{DBClient: db.NewMemoryClient(), ok: 1}
+	if _, err := processAndSave(context.Background(), client, path, "long", "author", opts); err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Fatalf("failed store returned %v", err)
+	}
+	if songs, _ := client.TotalSongs(); songs != 0 {
+		t.Errorf("%d songs left after a failed store", songs)
+	}
+	if fps, _ := client.TotalFingerprints(); fps != 0 {
+		t.Errorf("%d fingerprints left after a failed store", fps)
+	}
+}
+
+func TestComposition(t *testing.T) {
+	s := newTestServer(t, shazam.DefaultAudiobookConfig(), 2)
+	if _, err := s.db.RegisterSong("other", "someone else", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	s.handleComposition(rec, httptest.NewRequest(http.MethodGet, "/api/composition", nil))
+	var got []authorCountResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status %d, body %q: %v", rec.Code, rec.Body, err)
+	}
+	want := []authorCountResponse{{"artist", 2}, {"someone else", 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("composition = %+v, want %+v", got, want)
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleComposition(rec, httptest.NewRequest(http.MethodPost, "/api/composition", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST returned %d, want 405", rec.Code)
+	}
+}
+
+func TestVideoUploadsRejected(t *testing.T) {
+	inTempDir(t)
+	s := newTestServer(t, shazam.DefaultAudiobookConfig(), 1)
+
+	// an ffprobe that finds an H.264 video with an audio track
+	stub := filepath.Join(t.TempDir(), "ffprobe")
+	script := `#!/bin/sh
+echo '{"format":{"format_name":"mov,mp4"},"streams":[{"codec_type":"video","codec_name":"h264"},{"codec_type":"audio","codec_name":"aac"}]}'
+`
+	if err := os.WriteFile(stub, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(path string) { wav.FFprobePath = path }(wav.FFprobePath)
+	wav.FFprobePath = stub
+
+	rec := httptest.NewRecorder()
+	s.handleMatch(rec, uploadRequest(t, "/api/match", "clip.mp4", []byte("video"), nil))
+	if resp := decodeJSON(t, rec); rec.Code != http.StatusUnprocessableEntity || !strings.Contains(fmt.Sprint(resp["details"]), "video (h264)") {
+		t.Errorf("match: %d %v, want 422 naming the video", rec.Code, resp)
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleIndex(rec, uploadRequest(t, "/api/index", "film.mp4", []byte("video"), map[string]string{"title": "film"}))
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("index: %d (%s), want 422", rec.Code, rec.Body)
+	}
+	if songs, _ := s.db.TotalSongs(); songs != 1 {
+		t.Errorf("%d songs after indexing a video, want only the test song", songs)
+	}
+}
+
+func TestShortClipsRejected(t *testing.T) {
+	requireFFmpeg(t)
+	inTempDir(t)
+	cfg := shazam.DefaultAudiobookConfig()
+	s := newTestServer(t, cfg, 1)
+	short := clipWav(t, 1, 20, 1)
+
+	rec := postMatch(t, s, "", short)
+	if rec.Code != http.StatusUnprocessableEntity || decodeJSON(t, rec)["error"] != "clip too short to match" {
+		t.Errorf("1s clip: %d %s, want 422", rec.Code, rec.Body)
+	}
+	clipPath := filepath.Join(t.TempDir(), "short.wav")
+	if err := os.WriteFile(clipPath, short, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := runFind(s.db, clipPath, cfg, s.matchOpts, 1, 0); !errors.Is(err, shazam.ErrClipTooShort) {
+		t.Errorf("find on a 1s clip: err = %v, want ErrClipTooShort", err)
+	}
+
+	// a clip just long enough is searched
+	if rec := postMatch(t, s, "", clipWav(t, 1, 20, cfg.MinClipDuration(wav.DecodeSampleRate)+0.1)); rec.Code != http.StatusOK {
+		t.Errorf("clip of the minimum length: %d %s", rec.Code, rec.Body)
+	}
+	// and with the check disabled, so is the short one
+	cfg.MinClipFrames = 0
+	s = newTestServer(t, cfg, 1)
+	if rec := postMatch(t, s, "", short); rec.Code != http.StatusOK {
+		t.Errorf("1s clip with MinClipFrames 0: %d %s", rec.Code, rec.Body)
+	}
+}
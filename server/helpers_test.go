@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"song-recognition/db"
+	"song-recognition/shazam"
+	"song-recognition/wav"
+	"testing"
+)
+
+// testTones returns sec seconds of pseudo-music at sampleRate: three
+// tones that change pitch every 200ms, different for every seed.
+func testTones(seed int64, sampleRate int, sec float64) []float64 {
+	rng := rand.New(rand.NewSource(seed))
+	step := sampleRate / 5
+	samples := make([]float64, int(sec*float64(sampleRate)))
+	var freqs [3]float64
+	for i := range samples {
+		if i%step == 0 {
+			for j := range freqs {
+				freqs[j] = 100 + rng.Float64()*2400
+			}
+		}
+		t := float64(i) / float64(sampleRate)
+		var v float64
+		for j, f := range freqs {
+			v += math.Sin(2*math.Pi*f*t) / float64(j+2)
+		}
+		samples[i] = 0.5*v + 0.01*(rng.Float64()*2-1)
+	}
+	return samples
+}
+
+// f32PCM encodes samples as the little-endian float32 PCM a browser sends.
+func f32PCM(samples []float64) []byte {
+	out := make([]byte, 4*len(samples))
+	for i, v := range samples {
+		binary.LittleEndian.PutUint32(out[4*i:], math.Float32bits(float32(v)))
+	}
+	return out
+}
+
+// newTestServer returns a server over an in-memory database holding
+// songs "song 0", "song 1", ..., made of 60 seconds of testTones with
+// seeds 1, 2, ....
+func newTestServer(t testing.TB, cfg shazam.FingerprintConfig, songs int) *apiServer {
+	t.Helper()
+	return newTestServerWith(t, db.NewMemoryClient(), cfg, songs)
+}
+
+// newTestServerWith is newTestServer over the given client.
+func newTestServerWith(t testing.TB, client db.DBClient, cfg shazam.FingerprintConfig, songs int) *apiServer {
+	t.Helper()
+	for i := 0; i < songs; i++ {
+		id, err := client.RegisterSong(fmt.Sprintf("song %d", i), "artist", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fps, _, err := shazam.AnalyzeSamples(testTones(int64(i+1), 44100, 60), 44100, id, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.StoreFingerprints(fps); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &apiServer{db: db.NewVersionedClient(client), cfg: cfg, maxIndexUpload: 64 << 20, maxMatchUpload: 64 << 20}
+}
+
+// requireFFmpeg skips the test unless ffmpeg and ffprobe are installed.
+func requireFFmpeg(t testing.TB) {
+	t.Helper()
+	for _, bin := range []string{wav.FFmpegPath, wav.FFprobePath} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skipf("%s not found", bin)
+		}
+	}
+}
+
+// inTempDir runs the rest of the test in an empty temp dir, where the
+// handlers' tmp dir and the CLI's songs dir are created.
+func inTempDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+// writeTestWav writes sec seconds of testTones with the given seed as a
+// mono WAV file at the rate files are decoded at.
+func writeTestWav(t *testing.T, path string, seed int64, sec float64) {
+	t.Helper()
+	if err := wav.WriteWav(path, testTones(seed, wav.DecodeSampleRate, sec), wav.DecodeSampleRate, 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// uploadRequest builds a multipart POST with content as the "file" part,
+// plus the given form fields.
+func uploadRequest(t *testing.T, target, filename string, content []byte, fields map[string]string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	part, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(content)
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, target, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+// decodeJSON decodes a JSON object response.
+func decodeJSON(t *testing.T, rec *httptest.ResponseRecorder) map[string]any {
+	t.Helper()
+	var resp map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("bad JSON response %q: %v", rec.Body, err)
+	}
+	return resp
+}
+
+// clipWav returns sec seconds of song seed-1 (see newTestServer) from
+// startSec on, as the bytes of a WAV file.
+func clipWav(t *testing.T, seed int64, startSec, sec float64) []byte {
+	t.Helper()
+	audio := testTones(seed, wav.DecodeSampleRate, startSec+sec)[int(startSec*wav.DecodeSampleRate):]
+	path := filepath.Join(t.TempDir(), "clip.wav")
+	if err := wav.WriteWav(path, audio, wav.DecodeSampleRate, 1); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// postMatch uploads a clip to /api/match with the given query string.
+func postMatch(t *testing.T, s *apiServer, query string, clip []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.handleMatch(rec, uploadRequest(t, "/api/match"+query, "clip.wav", clip, nil))
+	return rec
+}
+
+// matchTitles returns the titles of a JSON /api/match response's matches.
+func matchTitles(t *testing.T, rec *httptest.ResponseRecorder) []string {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("match returned %d: %s", rec.Code, rec.Body)
+	}
+	var titles []string
+	for _, m := range decodeJSON(t, rec)["matches"].([]any) {
+		titles = append(titles, m.(map[string]any)["title"].(string))
+	}
+	return titles
+}
+
+// cliTestDir runs the rest of the test in an empty temp dir holding the
+// SQLite database the CLI commands open, and returns the dir.
+func cliTestDir(t *testing.T) string {
+	t.Helper()
+	dir := inTempDir(t)
+	if err := os.Mkdir("db", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	prev := db.DBtype
+	db.DBtype = "sqlite"
+	t.Cleanup(func() { db.DBtype = prev })
+	return dir
+}
+
+// openCLIDB opens the database the CLI commands use in a cliTestDir.
+func openCLIDB(t *testing.T) db.DBClient {
+	t.Helper()
+	client, err := db.NewDBClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// captureStdout returns what fn prints to stdout.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	out := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- string(data)
+	}()
+	defer func() { os.Stdout = stdout }()
+	fn()
+	w.Close()
+	return <-out
+}
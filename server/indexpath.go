@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"song-recognition/metrics"
+	"song-recognition/shazam"
+	"song-recognition/utils"
+	"strings"
+	"time"
+)
+
+// indexPathRequest is the body of POST /api/index/path.
+type indexPathRequest struct {
+	Path   string `json:"path"`
+	Strict bool   `json:"strict"`
+}
+
+// indexRootsFromEnv reads INDEX_PATH_ROOTS, the directories /api/index/path
+// may index from, separated like PATH. each is resolved to an absolute
+// path without symlinks so requests can be checked against it; entries
+// that don't exist are left out with a warning.
+func indexRootsFromEnv() []string {
+	var roots []string
+	for _, raw := range filepath.SplitList(utils.GetEnv("INDEX_PATH_ROOTS")) {
+		if raw == "" {
+			continue
+		}
+		root, err := resolvePath(raw)
+		if err != nil {
+			utils.Warnf("ignoring INDEX_PATH_ROOTS entry %q: %v", raw, err)
+			continue
+		}
+		roots = append(roots, root)
+	}
+	return roots
+}
+
+// resolvePath returns path made absolute, with symlinks evaluated.
+func resolvePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
+
+// withinRoots reports whether the resolved path is one of roots or lies
+// under one.
+func withinRoots(path string, roots []string) bool {
+	for _, root := range roots {
+		rel, err := filepath.Rel(root, path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleIndexPath indexes a file or directory the server can already
+// read, as `save` would, and returns one result per file in walk order.
+// the path has to be absolute and, symlinks resolved, under one of the
+// INDEX_PATH_ROOTS; so does every file found in it. titles and authors
+// come from the files' tags or names, or the directory's sidecar.
+func (s *apiServer) handleIndexPath(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if len(s.indexRoots) == 0 {
+		writeError(w, http.StatusForbidden, "indexing by path is disabled (set INDEX_PATH_ROOTS)")
+		return
+	}
+
+	var req indexPathRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	if !filepath.IsAbs(req.Path) {
+		writeError(w, http.StatusBadRequest, "path must be absolute")
+		return
+	}
+
+	// the same message whether or not the path exists, so requests can't
+	// probe the filesystem outside the allowed directories
+	notAllowed := fmt.Sprintf("%s is not under a directory that may be indexed", req.Path)
+	path, err := resolvePath(req.Path)
+	if err != nil || !withinRoots(path, s.indexRoots) {
+		writeError(w, http.StatusForbidden, notAllowed)
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	reqStart := time.Now()
+	cfg := s.config()
+	opts := saveOptions{strict: req.Strict}
+	filePaths := []string{path}
+	if info.IsDir() {
+		listing, err := listAudioFiles(path, nil)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		filePaths, opts.overrides = listing.files, listing.overrides
+		if listing.sidecarPath != "" {
+			utils.InfofCtx(r.Context(), "[index] using titles and authors from %s", listing.sidecarPath)
+		}
+		if len(listing.skipped) > 0 {
+			utils.InfofCtx(r.Context(), "[index] skipping %d files that aren't audio", len(listing.skipped))
+		}
+	}
+	if len(filePaths) == 0 {
+		writeError(w, http.StatusBadRequest, "no files found")
+		return
+	}
+
+	workers := indexWorkers(0, len(filePaths))
+	utils.InfofCtx(r.Context(), "[index] indexing %d files under %s, %d workers", len(filePaths), path, workers)
+
+	results := make([]bulkIndexResult, len(filePaths))
+	indexConcurrently(len(filePaths), workers, func(i int) saveOutcome {
+		res, err := s.indexServerFile(r, path, filePaths[i], opts, cfg, &results[i])
+		return saveOutcome{res, err}
+	}, func(i int, out saveOutcome) {
+		switch {
+		case results[i].Status == "duplicate":
+		case out.err != nil:
+			results[i].Status = "error"
+			results[i].Error = out.err.Error()
+			utils.WarnfCtx(r.Context(), "[index] %s: %v", results[i].File, out.err)
+		default:
+			results[i].Status = "indexed"
+			results[i].Fingerprints = out.fingerprints
+			results[i].Warnings = out.warnings
+			metrics.IndexedFiles.Inc()
+		}
+	})
+
+	utils.InfofCtx(r.Context(), "[index] path request done in %s", time.Since(reqStart))
+	writeJSON(w, http.StatusOK, results)
+}
+
+// indexServerFile indexes one file found by handleIndexPath. results name
+// it relative to the requested path. a duplicate is not an error: result
+// is marked as one and an empty saveResult returned.
+func (s *apiServer) indexServerFile(r *http.Request, requested, filePath string, opts saveOptions, cfg shazam.FingerprintConfig, result *bulkIndexResult) (saveResult, error) {
+	result.File = filepath.Base(filePath)
+	if rel, err := filepath.Rel(requested, filePath); err == nil && rel != "." {
+		result.File = filepath.ToSlash(rel)
+	}
+
+	// a symlink inside an allowed directory may still point out of it
+	if resolved, err := filepath.EvalSymlinks(filePath); err != nil || !withinRoots(resolved, s.indexRoots) {
+		return saveResult{}, fmt.Errorf("not under a directory that may be indexed")
+	}
+
+	title, author := entryNames(filePath, opts)
+	result.Title, result.Author = title, author
+	if existing, exists, _ := s.db.GetSongByKey(utils.GenerateSongKey(title, author)); exists {
+		result.Status = "duplicate"
+		result.ExistingID = existing.ID
+		return saveResult{}, nil
+	}
+
+	return saveEntryTo(r.Context(), s.db, filePath, opts, cfg)
+}
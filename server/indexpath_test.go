@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"song-recognition/shazam"
+	"strings"
+	"testing"
+)
+
+func TestWithinRoots(t *testing.T) {
+	roots := []string{"/srv/books", "/data"}
+	for path, want := range map[string]bool{
+		"/srv/books":            true,
+		"/srv/books/a/b.mp3":    true,
+		"/data/x.wav":           true,
+		"/srv/books-private/x":  false,
+		"/srv/x.mp3":            false,
+		"/srv/books/../x.mp3":   false,
+		"/srv/books/..hidden/x": true,
+	} {
+		if got := withinRoots(filepath.Clean(path), roots); got != want {
+			t.Errorf("withinRoots(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestIndexPath(t *testing.T) {
+	requireFFmpeg(t)
+	inTempDir(t)
+	base := t.TempDir()
+	root, outside := filepath.Join(base, "root"), filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(root, "books"), outside} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestWav(t, filepath.Join(root, "books", "first.wav"), 5, 10)
+	writeTestWav(t, filepath.Join(root, "books", "second.wav"), 6, 10)
+	writeTestWav(t, filepath.Join(outside, "secret.wav"), 7, 10)
+
+	s := newTestServer(t, shazam.DefaultAudiobookConfig(), 0)
+	post := func(body string) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		s.handleIndexPath(rec, httptest.NewRequest(http.MethodPost, "/api/index/path", strings.NewReader(body)))
+		return rec
+	}
+	pathBody := func(path string) string {
+		body, _ := json.Marshal(indexPathRequest{Path: path})
+		return string(body)
+	}
+
+	if rec := post(pathBody(root)); rec.Code != http.StatusForbidden {
+		t.Errorf("without INDEX_PATH_ROOTS: status %d, want 403", rec.Code)
+	}
+
+	resolved, err := resolvePath(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.indexRoots = []string{resolved}
+	if rec := post(pathBody("books/first.wav")); rec.Code != http.StatusBadRequest {
+		t.Errorf("relative path: status %d, want 400", rec.Code)
+	}
+	// a missing path outside the roots looks the same as an existing one
+	secret, missing := post(pathBody(filepath.Join(outside, "secret.wav"))), post(pathBody(filepath.Join(outside, "missing.wav")))
+	if secret.Code != http.StatusForbidden || missing.Code != http.StatusForbidden {
+		t.Errorf("outside the roots: status %d and %d, want 403", secret.Code, missing.Code)
+	}
+	if rec := post(pathBody(filepath.Join(root, "books", "..", "..", "outside", "secret.wav"))); rec.Code != http.StatusForbidden {
+		t.Errorf("escaping with ..: status %d, want 403", rec.Code)
+	}
+
+	// a link inside the root to a file outside it is listed, but refused
+	if err := os.Symlink(filepath.Join(outside, "secret.wav"), filepath.Join(root, "books", "link.wav")); err != nil {
+		t.Fatal(err)
+	}
+
+	results := func(path string) map[string]bulkIndexResult {
+		t.Helper()
+		rec := post(pathBody(path))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d (%s), want 200", rec.Code, rec.Body)
+		}
+		var list []bulkIndexResult
+		if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+			t.Fatal(err)
+		}
+		byFile := make(map[string]bulkIndexResult)
+		for _, res := range list {
+			byFile[res.File] = res
+		}
+		return byFile
+	}
+
+	got := results(root)
+	for file, status := range map[string]string{"books/first.wav": "indexed", "books/second.wav": "indexed", "books/link.wav": "error"} {
+		if got[file].Status != status {
+			t.Errorf("%s: %+v, want %s", file, got[file], status)
+		}
+	}
+	if got["books/first.wav"].Fingerprints == 0 {
+		t.Error("indexed file reported no fingerprints")
+	}
+	if songs, _ := s.db.TotalSongs(); songs != 2 {
+		t.Errorf("%d songs indexed, want 2", songs)
+	}
+
+	// indexing a file again reports the existing entry
+	again := results(filepath.Join(root, "books", "first.wav"))
+	if res := again["first.wav"]; res.Status != "duplicate" || res.ExistingID == 0 {
+		t.Errorf("second request: %+v, want a duplicate", res)
+	}
+}
@@ -1,10 +1,19 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"math"
 	"os"
+	"path/filepath"
+	"song-recognition/db"
+	"song-recognition/shazam"
 	"song-recognition/utils"
+	"song-recognition/wav"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -12,34 +21,156 @@ import (
 func main() {
 	_ = utils.CreateFolder("tmp")
 	_ = utils.CreateFolder(SONGS_DIR)
+	_ = godotenv.Load()
+
+	logLevel := flag.String("log-level", utils.GetEnv("LOG_LEVEL", "info"), "log verbosity (debug, info or warn)")
+	flag.StringVar(&db.DBtype, "db", db.DBtype, "database backend (sqlite, sqlite-postings, mongo or memory)")
+	keepTempDefault, _ := strconv.ParseBool(utils.GetEnv("KEEP_TEMP", "false"))
+	keepTemp := flag.Bool("keep-temp", keepTempDefault, "keep intermediate WAV files under tmp/kept for inspection")
+	idfDefault, _ := strconv.ParseBool(utils.GetEnv("MATCH_IDF", "false"))
+	idf := flag.Bool("idf", idfDefault, "weight matches by how rare each address is across the library")
+	minSongFP := flag.String("min-song-fingerprints", utils.GetEnv("MIN_SONG_FINGERPRINTS", "0"), "ignore songs with fewer stored fingerprints when matching (0 = off)")
+	maxSearch := flag.String("max-search", utils.GetEnv("MAX_SEARCH_DURATION", "0"), "stop a match search after this long and return the best matches so far, e.g. 2s (0 = no limit)")
+	profile := flag.String("profile", utils.GetEnv("FINGERPRINT_PROFILE", "audiobook"), "fingerprint config (audiobook, audiobook-overlap or music)")
+	multiResDefault, _ := strconv.ParseBool(utils.GetEnv("MULTI_RESOLUTION", "false"))
+	multiRes := flag.Bool("multi-res", multiResDefault, "also fingerprint at 1.25x and 1.5x speed so sped-up clips match")
+	centerPeaksDefault, _ := strconv.ParseBool(utils.GetEnv("CENTER_PEAK_TIMES", "false"))
+	centerPeaks := flag.Bool("center-peaks", centerPeaksDefault, "time peaks at the centre of their FFT window (reindex after changing)")
+	normalizeBandsDefault, _ := strconv.ParseBool(utils.GetEnv("NORMALIZE_BANDS", "false"))
+	normalizeBands := flag.Bool("normalize-bands", normalizeBandsDefault, "pick peaks relative to each band's own level (reindex after changing)")
+	flag.StringVar(&wav.FFmpegPath, "ffmpeg", wav.FFmpegPath, "ffmpeg binary to run (default from FFMPEG_PATH, else looked up on PATH)")
+	flag.StringVar(&wav.FFprobePath, "ffprobe", wav.FFprobePath, "ffprobe binary to run (default from FFPROBE_PATH, else looked up on PATH)")
+	chunkSec := flag.String("chunk-sec", utils.GetEnv("CHUNK_SEC", "0"), "seconds of audio decoded and fingerprinted at a time (0 = the profile's default)")
+	songKeys := flag.String("song-keys", utils.GetEnv("SONG_KEYS", "normalized"), "how titles and authors are compared for duplicates (strict, normalized or loose)")
+	flag.Usage = printUsage
+	flag.Parse()
+
+	level, err := utils.ParseLogLevel(*logLevel)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	utils.SetLogLevel(level)
+
+	if utils.SongKeys, err = utils.ParseSongKeyMode(*songKeys); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if *keepTemp {
+		wav.KeepTempDir = filepath.Join("tmp", "kept", time.Now().Format("20060102-150405"))
+		fmt.Printf("keeping intermediate WAV files in %s\n", wav.KeepTempDir)
+	}
 
-	if len(os.Args) < 2 {
+	matchOpts.IDFWeighting = *idf
+	matchOpts.MinSongFingerprints, err = strconv.Atoi(*minSongFP)
+	if err != nil || matchOpts.MinSongFingerprints < 0 {
+		fmt.Println("--min-song-fingerprints must be a non-negative number")
+		os.Exit(1)
+	}
+	matchOpts.MaxSearchDuration, err = time.ParseDuration(*maxSearch)
+	if err != nil || matchOpts.MaxSearchDuration < 0 {
+		fmt.Println("--max-search must be a non-negative duration, e.g. 2s or 500ms")
+		os.Exit(1)
+	}
+
+	fpConfig, err = shazam.ConfigByName(*profile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *multiRes {
+		fpConfig.SpeedScales = shazam.MultiResolutionSpeeds
+	}
+	fpConfig.CenterPeakTimes = *centerPeaks
+	fpConfig.NormalizeBands = *normalizeBands
+	fpConfig, err = withChunkSec(fpConfig, *chunkSec)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// the audiobook profile's 3 kHz cutoff is above its Nyquist frequency
+	// on purpose, so clamping is routine rather than worth a warning
+	if clamped, err := fpConfig.ClampToNyquist(wav.DecodeSampleRate); err != nil {
+		utils.Debugf("%v; clamping to %.0f Hz", err, clamped.MaxFreqHz)
+		fpConfig = clamped
+	}
+	if err := fpConfig.Validate(); err != nil {
+		fmt.Println("invalid fingerprint config:", err)
+		os.Exit(1)
+	}
+	if err := fpConfig.CheckResolution(wav.DecodeSampleRate); err != nil {
+		utils.Warnf("fingerprint config: %v", err)
+	}
+	if err := fpConfig.CheckBands(); err != nil {
+		utils.Warnf("fingerprint config: %v", err)
+	}
+
+	args := flag.Args()
+	if len(args) < 1 {
 		printUsage()
 		os.Exit(1)
 	}
-	_ = godotenv.Load()
 
-	switch os.Args[1] {
+	switch args[0] {
 	case "find":
-		if len(os.Args) < 3 {
-			fmt.Println("usage: seek-tune find <path_to_audio_file>")
+		findCmd := flag.NewFlagSet("find", flag.ExitOnError)
+		top := findCmd.Int("top", defaultMatchLimit, fmt.Sprintf("number of matches to show (1-%d)", maxMatchLimit))
+		minScore := findCmd.Float64("min-score", 0, "hide matches scoring below this")
+		findCmd.Parse(args[1:])
+		if findCmd.NArg() < 1 {
+			fmt.Println("usage: seek-tune find [--top N] [--min-score S] <path_to_audio_file | ->")
+			os.Exit(1)
+		}
+		if *top < 1 || *top > maxMatchLimit {
+			fmt.Printf("--top must be between 1 and %d, clamping\n", maxMatchLimit)
+		}
+		if *minScore < 0 {
+			fmt.Println("--min-score must not be negative")
 			os.Exit(1)
 		}
-		find(os.Args[2])
+		find(findCmd.Arg(0), *top, *minScore)
 
 	case "serve":
 		serveCmd := flag.NewFlagSet("serve", flag.ExitOnError)
 		protocol := serveCmd.String("proto", "http", "protocol to use (http or https)")
 		port := serveCmd.String("p", "5000", "port to use")
-		serveCmd.Parse(os.Args[2:])
-		serve(*protocol, *port)
+		maxIndexUpload := serveCmd.String("max-index-upload", utils.GetEnv("MAX_INDEX_UPLOAD", defaultMaxIndexUpload), "largest upload accepted by /api/index, e.g. 5GB")
+		maxMatchUpload := serveCmd.String("max-match-upload", utils.GetEnv("MAX_MATCH_UPLOAD", defaultMaxMatchUpload), "largest upload accepted by /api/match, e.g. 100MB")
+		certFile := serveCmd.String("cert", utils.GetEnv("TLS_CERT"), "TLS certificate file for -proto https")
+		keyFile := serveCmd.String("key", utils.GetEnv("TLS_KEY"), "TLS private key file for -proto https")
+		selfSigned := serveCmd.Bool("self-signed", false, "with -proto https and no -cert/-key, use a generated self-signed certificate (local testing only)")
+		serveCmd.Parse(args[1:])
+
+		opts := serveOptions{protocol: strings.ToLower(*protocol), port: *port,
+			certFile: *certFile, keyFile: *keyFile, selfSigned: *selfSigned}
+		switch {
+		case opts.protocol != "http" && opts.protocol != "https":
+			fmt.Printf("unknown protocol %q (expected http or https)\n", *protocol)
+			os.Exit(1)
+		case (opts.certFile == "") != (opts.keyFile == ""):
+			fmt.Println("-cert and -key must be given together")
+			os.Exit(1)
+		case opts.protocol == "https" && opts.certFile == "" && !opts.selfSigned:
+			fmt.Println("-proto https needs -cert and -key (or TLS_CERT and TLS_KEY), or -self-signed for local testing")
+			os.Exit(1)
+		}
+		if opts.maxIndexUpload, err = parseByteSize(*maxIndexUpload); err != nil {
+			fmt.Println("--max-index-upload:", err)
+			os.Exit(1)
+		}
+		if opts.maxMatchUpload, err = parseByteSize(*maxMatchUpload); err != nil {
+			fmt.Println("--max-match-upload:", err)
+			os.Exit(1)
+		}
+		serve(opts)
 
 	case "erase":
 		dbOnly := true
 		all := false
 
-		if len(os.Args) > 2 {
-			switch os.Args[2] {
+		if len(args) > 1 {
+			switch args[1] {
 			case "db":
 				dbOnly = true
 			case "all":
@@ -57,12 +188,95 @@ func main() {
 		indexCmd := flag.NewFlagSet("save", flag.ExitOnError)
 		force := indexCmd.Bool("force", false, "index file even without complete metadata")
 		indexCmd.BoolVar(force, "f", false, "index file even without complete metadata (shorthand)")
-		indexCmd.Parse(os.Args[2:])
+		workers := indexCmd.Int("workers", 0, "number of files to index in parallel (0 = auto, NumCPU/2)")
+		quiet := indexCmd.Bool("quiet", false, "don't show the progress bar")
+		strict := indexCmd.Bool("strict", false, "reject files that produce too few fingerprints per second")
+		appendTo := indexCmd.Uint64("append", 0, "add the file to the end of the entry with this ID instead of creating a new one")
+		resume := indexCmd.Bool("resume", false, "skip files whose title and author are already indexed, e.g. to continue an interrupted run")
+		var exclude globList
+		indexCmd.Var(&exclude, "exclude", "skip files and directories matching this glob when walking a directory (repeatable)")
+		indexCmd.Parse(args[1:])
 		if indexCmd.NArg() < 1 {
-			fmt.Println("usage: seek-tune save [-f|--force] <path_to_file_or_dir>")
+			fmt.Println("usage: seek-tune save [-f|--force] [--workers N] [--quiet] [--strict] [--append songID] [--exclude glob]... [--resume] <path_to_file_or_dir>")
+			os.Exit(1)
+		}
+		if *workers < 0 {
+			fmt.Println("--workers must be 0 (auto) or a positive number")
+			os.Exit(1)
+		}
+		if *appendTo > math.MaxUint32 {
+			fmt.Println("--append must be a song ID")
+			os.Exit(1)
+		}
+		if *resume && *appendTo != 0 {
+			fmt.Println("--resume can't be combined with --append")
+			os.Exit(1)
+		}
+		save(indexCmd.Arg(0), saveOptions{force: *force, workers: *workers, quiet: *quiet, strict: *strict, appendTo: uint32(*appendTo), exclude: exclude, resume: *resume})
+
+	case "verify":
+		verifyCmd := flag.NewFlagSet("verify", flag.ExitOnError)
+		artist := verifyCmd.String("artist", "", "artist of the song, if its title isn't unique")
+		verifyCmd.Parse(args[1:])
+		if verifyCmd.NArg() < 2 {
+			fmt.Println("usage: seek-tune verify [--artist name] <clip> <title>")
+			os.Exit(1)
+		}
+		verify(verifyCmd.Arg(0), verifyCmd.Arg(1), *artist)
+
+	case "eval":
+		evalCmd := flag.NewFlagSet("eval", flag.ExitOnError)
+		labels := evalCmd.String("labels", "", "CSV of clip,expected rows (default: <clips_dir>/"+evalLabelsFile+")")
+		confusion := evalCmd.Bool("confusion", false, "list misattributed clips by expected and predicted song")
+		evalCmd.Parse(args[1:])
+		if evalCmd.NArg() < 1 {
+			fmt.Println("usage: seek-tune eval [--labels file.csv] [--confusion] <clips_dir>")
+			os.Exit(1)
+		}
+		eval(evalCmd.Arg(0), *labels, *confusion)
+
+	case "compact":
+		compactCmd := flag.NewFlagSet("compact", flag.ExitOnError)
+		pruneCommon := compactCmd.Bool("prune-common", false, "delete addresses shared by many songs")
+		maxDF := compactCmd.Float64("max-df", 0.2, "with --prune-common, prune addresses found in more than this fraction of songs")
+		dryRun := compactCmd.Bool("dry-run", false, "only report what would be pruned")
+		compactCmd.Parse(args[1:])
+		if *maxDF <= 0 || *maxDF >= 1 {
+			fmt.Println("--max-df must be between 0 and 1")
+			os.Exit(1)
+		}
+		compact(compactOptions{pruneCommon: *pruneCommon, maxDF: *maxDF, dryRun: *dryRun})
+
+	case "merge":
+		mergeCmd := flag.NewFlagSet("merge", flag.ExitOnError)
+		sourceType := mergeCmd.String("source-type", "sqlite", "layout of the source database (sqlite or sqlite-postings)")
+		onConflict := mergeCmd.String("on-conflict", mergeSkip, "what to do with entries whose title and author are taken (skip or rename)")
+		mergeCmd.Parse(args[1:])
+		if mergeCmd.NArg() < 1 {
+			fmt.Println("usage: seek-tune merge [--source-type sqlite|sqlite-postings] [--on-conflict skip|rename] <source.sqlite3>")
+			os.Exit(1)
+		}
+		if *sourceType != "sqlite" && *sourceType != "sqlite-postings" {
+			fmt.Printf("unknown --source-type %q (expected sqlite or sqlite-postings)\n", *sourceType)
+			os.Exit(1)
+		}
+		if *onConflict != mergeSkip && *onConflict != mergeRename {
+			fmt.Printf("unknown --on-conflict %q (expected skip or rename)\n", *onConflict)
+			os.Exit(1)
+		}
+		merge(mergeCmd.Arg(0), mergeOptions{sourceType: *sourceType, onConflict: *onConflict})
+
+	case "selftest":
+		if !runSelftest() {
 			os.Exit(1)
 		}
-		save(indexCmd.Arg(0), *force)
+
+	case "spectrogram":
+		if len(args) < 3 {
+			fmt.Println("usage: seek-tune spectrogram <audio_file> <out.png>")
+			os.Exit(1)
+		}
+		spectrogram(args[1], args[2])
 
 	default:
 		printUsage()
@@ -70,12 +284,60 @@ func main() {
 	}
 }
 
+// withChunkSec returns cfg decoding the seconds of audio in raw (the
+// -chunk-sec flag or CHUNK_SEC) at a time, or cfg unchanged for 0.
+func withChunkSec(cfg shazam.FingerprintConfig, raw string) (shazam.FingerprintConfig, error) {
+	chunkSec, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+	if err != nil || math.IsNaN(chunkSec) || math.IsInf(chunkSec, 0) {
+		return cfg, fmt.Errorf("--chunk-sec must be a number of seconds, got %q", raw)
+	}
+	switch {
+	case chunkSec < 0:
+		return cfg, errors.New("--chunk-sec must be positive (or 0 for the profile's default)")
+	case chunkSec > 0 && chunkSec <= cfg.ChunkOverlapSec:
+		return cfg, fmt.Errorf("--chunk-sec must be longer than the %gs that chunks overlap by", cfg.ChunkOverlapSec)
+	case chunkSec > 0:
+		cfg.ChunkDurationSec = chunkSec
+	}
+	return cfg, nil
+}
+
 func printUsage() {
-	fmt.Println("usage: seek-tune <command>")
+	fmt.Println("usage: seek-tune [-log-level debug|info|warn] [-db sqlite|sqlite-postings|mongo|memory] [-profile name] [-multi-res] [-center-peaks] [-normalize-bands] [-song-keys strict|normalized|loose] [-ffmpeg path] [-ffprobe path] [-chunk-sec N] [-min-song-fingerprints N] [-max-search D] [-idf] [-keep-temp] <command>")
 	fmt.Println()
 	fmt.Println("commands:")
-	fmt.Println("  find  <audio_file>              match a file against the database")
-	fmt.Println("  save  [-f] <file_or_dir>        index audio file(s) into the database")
+	fmt.Println("  find  [--top N] [--min-score S] <audio_file|->")
+	fmt.Println("                                  match a file (or stdin) against the database")
+	fmt.Println("  save  [-f] [--workers N] [--quiet] [--strict] [--append songID] [--exclude glob]... [--resume] <file_or_dir>")
+	fmt.Println("                                  index audio file(s) into the database")
 	fmt.Println("  erase [db | all]                clear database (and optionally audio files)")
-	fmt.Println("  serve [-proto http] [-p 5000]    start the web server")
+	fmt.Println("  serve [-proto http|https] [-p 5000] [-cert file -key file | -self-signed]")
+	fmt.Println("        [-max-index-upload 5000MB] [-max-match-upload 100MB]")
+	fmt.Println("                                  start the web server")
+	fmt.Println("  spectrogram <audio_file> <png>  render the spectrogram and peaks for debugging")
+	fmt.Println("  compact --prune-common [--max-df 0.2] [--dry-run]")
+	fmt.Println("                                  drop addresses shared by many songs")
+	fmt.Println("  merge [--source-type sqlite|sqlite-postings] [--on-conflict skip|rename] <source.sqlite3>")
+	fmt.Println("                                  copy the entries of another database into this one")
+	fmt.Println("  verify [--artist name] <clip> <title>")
+	fmt.Println("                                  show how a clip aligns with one song")
+	fmt.Println("  eval  [--labels csv] [--confusion] <clips_dir>")
+	fmt.Println("                                  measure match accuracy over labeled clips")
+	fmt.Println("  selftest                        check the DSP pipeline on a synthetic signal")
+}
+
+// globList collects the values of a repeatable glob flag, rejecting
+// malformed patterns when they are parsed.
+type globList []string
+
+func (g *globList) String() string {
+	return strings.Join(*g, ",")
+}
+
+func (g *globList) Set(pattern string) error {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	*g = append(*g, pattern)
+	return nil
 }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"song-recognition/shazam"
+	"strings"
+	"testing"
+)
+
+func TestWithChunkSec(t *testing.T) {
+	base := shazam.DefaultMusicConfig()
+	if cfg, err := withChunkSec(base, "0"); err != nil || cfg.ChunkDurationSec != base.ChunkDurationSec {
+		t.Errorf("0 changed the config (%g s chunks, %v)", cfg.ChunkDurationSec, err)
+	}
+	if _, err := withChunkSec(base, "-1"); err == nil {
+		t.Error("negative --chunk-sec accepted")
+	}
+	if _, err := withChunkSec(base, fmt.Sprint(base.ChunkOverlapSec)); err == nil || !strings.Contains(err.Error(), "overlap") {
+		t.Errorf("chunks no longer than their overlap: %v", err)
+	}
+	for _, raw := range []string{"", "ten", "NaN", "Inf"} {
+		if _, err := withChunkSec(base, raw); err == nil || !strings.Contains(err.Error(), "number of seconds") {
+			t.Errorf("--chunk-sec %q: %v", raw, err)
+		}
+	}
+
+	requireFFmpeg(t)
+	path := filepath.Join(t.TempDir(), "song.wav")
+	writeTestWav(t, path, 1, 30)
+	chunks := func(cfg shazam.FingerprintConfig) int {
+		t.Helper()
+		_, report, err := shazam.FingerprintAudioChunked(context.Background(), path, 1, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report.Chunks
+	}
+	if n := chunks(base); n != 1 {
+		t.Errorf("default %gs chunks split 30s into %d", base.ChunkDurationSec, n)
+	}
+	cfg, err := withChunkSec(base, "10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 10s chunks overlapping by 5s step 5s at a time
+	if n := chunks(cfg); n < 5 {
+		t.Errorf("10s chunks split 30s into %d", n)
+	}
+}
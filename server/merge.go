@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"song-recognition/db"
+	"song-recognition/models"
+	"song-recognition/utils"
+	"time"
+)
+
+// what merge does with a source entry whose title and author (see
+// utils.GenerateSongKey) are already taken in the destination
+const (
+	mergeSkip   = "skip"   // leave it out
+	mergeRename = "rename" // add it as "Title (2)", "Title (3)", ...
+)
+
+// maxMergeRenames bounds the suffixes tried for one renamed entry.
+const maxMergeRenames = 100
+
+type mergeOptions struct {
+	sourceType string // "sqlite" or "sqlite-postings", the layout of the source file
+	onConflict string // mergeSkip or mergeRename
+}
+
+type mergeReport struct {
+	merged       int // entries copied, renamed ones included
+	renamed      int
+	skipped      int
+	fingerprints int
+}
+
+// merge copies every entry of the sqlite database at sourcePath, with its
+// fingerprints, into the current database.
+func merge(sourcePath string, opts mergeOptions) {
+	sourceInfo, err := os.Stat(sourcePath)
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		return
+	}
+	if sourceInfo.IsDir() {
+		fmt.Printf("error: %s is a directory, not a database file\n", sourcePath)
+		return
+	}
+	if currentInfo, err := os.Stat("db/db.sqlite3"); err == nil && os.SameFile(sourceInfo, currentInfo) &&
+		(db.DBtype == "sqlite" || db.DBtype == "sqlite-postings") {
+		fmt.Println("error: the source is the current database")
+		return
+	}
+
+	var source db.DBClient
+	switch opts.sourceType {
+	case "sqlite":
+		source, err = db.NewSQLiteClient(sourcePath)
+	case "sqlite-postings":
+		source, err = db.NewSQLitePostingsClient(sourcePath)
+	default:
+		err = fmt.Errorf("unsupported source type %q", opts.sourceType)
+	}
+	if err != nil {
+		fmt.Println("error opening source database:", err)
+		return
+	}
+	defer source.Close()
+
+	dbClient, err := db.NewDBClient()
+	if err != nil {
+		fmt.Println("error creating DB client:", err)
+		return
+	}
+	defer dbClient.Close()
+
+	start := time.Now()
+	report, err := mergeDB(dbClient, source, opts.onConflict)
+	fmt.Printf("merged %d entries (%d renamed, %d fingerprints), skipped %d in %s\n",
+		report.merged, report.renamed, report.fingerprints, report.skipped, time.Since(start).Round(time.Millisecond))
+	if err != nil {
+		fmt.Println("error merging:", err)
+	}
+}
+
+// mergeDB copies the entries of src, with their fingerprints and
+// durations, into dst under new IDs. an entry whose YouTube ID is already
+// in dst is always skipped; one whose key is taken is skipped or renamed
+// per onConflict. on error the report covers the entries merged so far,
+// and the entry being copied is removed again.
+func mergeDB(dst, src db.DBClient, onConflict string) (mergeReport, error) {
+	var report mergeReport
+
+	songs, err := src.GetAllSongs()
+	if err != nil {
+		return report, fmt.Errorf("error listing source entries: %v", err)
+	}
+
+	for _, listed := range songs {
+		song, found, err := src.GetSongByID(listed.ID)
+		if err != nil {
+			return report, fmt.Errorf("error reading source entry %d: %v", listed.ID, err)
+		}
+		if !found {
+			continue
+		}
+
+		title, reason, err := mergeTitle(dst, song, onConflict)
+		if err != nil {
+			return report, err
+		}
+		if reason != "" {
+			utils.Infof("[merge] skipping %q by %q: %s", song.Title, song.Artist, reason)
+			report.skipped++
+			continue
+		}
+
+		fingerprints, err := src.GetFingerprintsBySong(song.ID)
+		if err != nil {
+			return report, fmt.Errorf("error reading fingerprints of %q: %v", song.Title, err)
+		}
+
+		songID, err := dst.RegisterSong(title, song.Artist, song.YouTubeID, song.SourcePath)
+		if err != nil {
+			return report, fmt.Errorf("error registering %q: %v", title, err)
+		}
+		for _, batch := range fingerprintBatches(fingerprints, songID) {
+			if err := dst.StoreFingerprints(batch); err != nil {
+				dst.DeleteFingerprintsForSong(songID)
+				dst.DeleteSongByID(songID)
+				return report, fmt.Errorf("error storing fingerprints of %q: %v", title, err)
+			}
+		}
+		if song.DurationSec > 0 {
+			if err := dst.SetSongDuration(songID, song.DurationSec); err != nil {
+				utils.Warnf("[merge] could not record the duration of %q: %v", title, err)
+			}
+		}
+
+		if title != song.Title {
+			utils.Infof("[merge] added %q by %q as %q", song.Title, song.Artist, title)
+			report.renamed++
+		}
+		report.merged++
+		report.fingerprints += len(fingerprints)
+	}
+
+	return report, nil
+}
+
+// mergeTitle picks the title song is added to dst under, or says why it
+// is left out.
+func mergeTitle(dst db.DBClient, song db.Song, onConflict string) (title, skipReason string, err error) {
+	if song.YouTubeID != "" {
+		_, exists, err := dst.GetSongByYTID(song.YouTubeID)
+		if err != nil {
+			return "", "", fmt.Errorf("error looking up YouTube ID %s: %v", song.YouTubeID, err)
+		}
+		if exists {
+			return "", "YouTube ID " + song.YouTubeID + " is already indexed", nil
+		}
+	}
+
+	title = song.Title
+	for n := 1; n <= maxMergeRenames; n++ {
+		if n > 1 {
+			title = fmt.Sprintf("%s (%d)", song.Title, n)
+		}
+		existing, exists, err := dst.GetSongByKey(utils.GenerateSongKey(title, song.Artist))
+		if err != nil {
+			return "", "", fmt.Errorf("error looking up %q: %v", title, err)
+		}
+		if !exists {
+			return title, "", nil
+		}
+		if onConflict != mergeRename {
+			return "", fmt.Sprintf("already indexed as ID %d", existing.ID), nil
+		}
+	}
+	return "", fmt.Sprintf("%q to %q are all taken", song.Title+" (2)", fmt.Sprintf("%s (%d)", song.Title, maxMergeRenames)), nil
+}
+
+// fingerprintBatches groups fingerprints into the address-keyed maps
+// StoreFingerprints takes. an address can occur at several anchor times
+// (e.g. in appended parts), so each repeat starts the next batch.
+func fingerprintBatches(fingerprints []models.Fingerprint, songID uint32) []map[uint32]models.Couple {
+	var batches []map[uint32]models.Couple
+	for _, fp := range fingerprints {
+		placed := false
+		for _, batch := range batches {
+			if _, taken := batch[fp.Address]; !taken {
+				batch[fp.Address] = models.Couple{AnchorTimeMs: fp.AnchorTimeMs, SongID: songID}
+				placed = true
+				break
+			}
+		}
+		if !placed {
+			batches = append(batches, map[uint32]models.Couple{fp.Address: {AnchorTimeMs: fp.AnchorTimeMs, SongID: songID}})
+		}
+	}
+	return batches
+}
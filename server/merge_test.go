@@ -0,0 +1,102 @@
+package main
+
+import (
+	"slices"
+	"song-recognition/db"
+	"song-recognition/models"
+	"song-recognition/utils"
+	"testing"
+)
+
+// addEntry registers a song in client with n fingerprints at addresses
+// base, base+1, ...
+func addEntry(t *testing.T, client db.DBClient, title, ytID string, base uint32, n int) uint32 {
+	t.Helper()
+	id, err := client.RegisterSong(title, "artist", ytID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fps := make(map[uint32]models.Couple, n)
+	for i := 0; i < n; i++ {
+		fps[base+uint32(i)] = models.Couple{SongID: id, AnchorTimeMs: uint32(i * 100)}
+	}
+	if err := client.StoreFingerprints(fps); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// sortedTitles returns the sorted titles of client's songs.
+func sortedTitles(t *testing.T, client db.DBClient) []string {
+	t.Helper()
+	songs, err := client.GetAllSongs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var titles []string
+	for _, song := range songs {
+		titles = append(titles, song.Title)
+	}
+	slices.Sort(titles)
+	return titles
+}
+
+func TestMergeDB(t *testing.T) {
+	for _, tc := range []struct {
+		onConflict string
+		want       mergeReport
+		titles     []string
+	}{
+		{mergeSkip, mergeReport{merged: 1, skipped: 2, fingerprints: 20}, []string{"dst only", "shared", "src only", "video"}},
+		{mergeRename, mergeReport{merged: 2, renamed: 1, skipped: 1, fingerprints: 25}, []string{"dst only", "shared", "shared (2)", "src only", "video"}},
+	} {
+		dst, src := db.NewMemoryClient(), db.NewMemoryClient()
+		addEntry(t, dst, "dst only", "", 1000, 10)
+		addEntry(t, dst, "shared", "", 2000, 5)
+		addEntry(t, dst, "video", "yt1", 3000, 5)
+
+		srcOnly := addEntry(t, src, "src only", "", 4000, 20)
+		src.SetSongDuration(srcOnly, 42)
+		addEntry(t, src, "shared", "", 5000, 5)
+		addEntry(t, src, "same video", "yt1", 6000, 5) // skipped either way
+
+		report, err := mergeDB(dst, src, tc.onConflict)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report != tc.want {
+			t.Errorf("%s: report %+v, want %+v", tc.onConflict, report, tc.want)
+		}
+		if got := sortedTitles(t, dst); !slices.Equal(got, tc.titles) {
+			t.Errorf("%s: merged titles %v, want %v", tc.onConflict, got, tc.titles)
+		}
+
+		merged, _, err := dst.GetSongByKey(utils.GenerateSongKey("src only", "artist"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if merged.DurationSec != 42 {
+			t.Errorf("%s: merged duration %g, want 42", tc.onConflict, merged.DurationSec)
+		}
+		if fps, _ := dst.GetFingerprintsBySong(merged.ID); len(fps) != 20 {
+			t.Errorf("%s: %d fingerprints merged, want 20", tc.onConflict, len(fps))
+		}
+	}
+}
+
+func TestFingerprintBatches(t *testing.T) {
+	// address 1 occurs at three anchor times, e.g. in appended parts
+	fps := []models.Fingerprint{
+		{Address: 1, AnchorTimeMs: 0}, {Address: 2, AnchorTimeMs: 10},
+		{Address: 1, AnchorTimeMs: 20}, {Address: 1, AnchorTimeMs: 30},
+	}
+	batches := fingerprintBatches(fps, 7)
+	if len(batches) != 3 || len(batches[0]) != 2 || len(batches[1]) != 1 || len(batches[2]) != 1 {
+		t.Fatalf("batches %v, want address 1 spread over three", batches)
+	}
+	for i, want := range []uint32{0, 20, 30} {
+		if c := batches[i][1]; c.AnchorTimeMs != want || c.SongID != 7 {
+			t.Errorf("batch %d holds %+v for address 1, want anchor %d of song 7", i, c, want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "seektune"
+
+var (
+	// IndexedFiles counts files successfully fingerprinted and stored.
+	IndexedFiles = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "indexed_files_total",
+		Help:      "Number of audio files successfully indexed.",
+	})
+
+	// MatchRequests counts /api/match requests by outcome ("ok" or "error").
+	MatchRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "match_requests_total",
+		Help:      "Number of match requests handled, by outcome.",
+	}, []string{"outcome"})
+
+	// MatchDuration observes end-to-end /api/match latency.
+	MatchDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "match_duration_seconds",
+		Help:      "End-to-end latency of successful match requests.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 12),
+	})
+
+	// FingerprintDuration observes how long FingerprintAudioChunked takes per file.
+	FingerprintDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "fingerprint_duration_seconds",
+		Help:      "Time spent fingerprinting a single file.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 16),
+	})
+
+	// SearchDuration observes the database lookup and scoring in FindMatchesFGP.
+	SearchDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Time spent querying the database for matching fingerprints.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+	})
+)
+
+func init() {
+	prometheus.MustRegister(IndexedFiles, MatchRequests, MatchDuration, FingerprintDuration, SearchDuration)
+}
+
+// RegisterLibraryGauges exposes the current number of songs and
+// fingerprints. the counts are read on every scrape, so they always
+// reflect the database rather than what this process has indexed.
+func RegisterLibraryGauges(totalSongs, totalFingerprints func() float64) {
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "songs",
+			Help:      "Number of songs currently stored in the database.",
+		}, totalSongs),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "fingerprints",
+			Help:      "Number of fingerprints currently stored in the database.",
+		}, totalFingerprints),
+	)
+}
+
+// Handler returns the HTTP handler serving the /metrics endpoint.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrape(t *testing.T) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != 200 {
+		t.Fatalf("/metrics returned %d", rec.Code)
+	}
+	body, _ := io.ReadAll(rec.Body)
+	return string(body)
+}
+
+func TestScrape(t *testing.T) {
+	MatchRequests.WithLabelValues("ok").Inc()
+	MatchRequests.WithLabelValues("error").Inc()
+	MatchDuration.Observe(0.2)
+	RegisterLibraryGauges(func() float64 { return 3 }, func() float64 { return 1234 })
+
+	body := scrape(t)
+	for _, want := range []string{
+		`seektune_match_requests_total{outcome="ok"} 1`,
+		`seektune_match_requests_total{outcome="error"} 1`,
+		`seektune_match_duration_seconds_count 1`,
+		`seektune_indexed_files_total 0`,
+		`seektune_songs 3`,
+		`seektune_fingerprints 1234`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("scrape lacks %q", want)
+		}
+	}
+}
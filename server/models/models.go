@@ -5,6 +5,12 @@ type Couple struct {
 	SongID       uint32
 }
 
+// Fingerprint is one stored address of a known song.
+type Fingerprint struct {
+	Address      uint32
+	AnchorTimeMs uint32
+}
+
 type RecordData struct {
 	Audio      string  `json:"audio"`
 	Duration   float64 `json:"duration"`
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const progressBarWidth = 30
+
+// progressBar draws "[#####     ] 12/40  eta 3m20s" on a single,
+// continuously rewritten line. when disabled every method is a no-op, so
+// callers don't have to check.
+type progressBar struct {
+	out     io.Writer
+	enabled bool
+	total   int
+	done    int
+	start   time.Time
+}
+
+// newProgressBar returns a bar on stderr, enabled only when stderr is a
+// terminal and quiet is false; redirected output gets no control codes.
+func newProgressBar(total int, quiet bool) *progressBar {
+	return &progressBar{
+		out:     os.Stderr,
+		enabled: !quiet && isTerminal(os.Stderr),
+		total:   total,
+		start:   time.Now(),
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// advance records one more completed item and redraws.
+func (p *progressBar) advance() {
+	p.done++
+	p.draw()
+}
+
+func (p *progressBar) draw() {
+	if !p.enabled || p.total <= 0 {
+		return
+	}
+
+	filled := progressBarWidth * p.done / p.total
+	bar := strings.Repeat("#", filled) + strings.Repeat(" ", progressBarWidth-filled)
+
+	eta := "--"
+	if p.done > 0 && p.done < p.total {
+		perItem := time.Since(p.start) / time.Duration(p.done)
+		eta = (perItem * time.Duration(p.total-p.done)).Round(time.Second).String()
+	} else if p.done >= p.total {
+		eta = "0s"
+	}
+
+	fmt.Fprintf(p.out, "\r\033[K[%s] %d/%d  eta %s", bar, p.done, p.total, eta)
+}
+
+// clear erases the bar so regular output can be printed on a clean line;
+// call draw (or advance) afterwards to bring it back.
+func (p *progressBar) clear() {
+	if p.enabled {
+		fmt.Fprint(p.out, "\r\033[K")
+	}
+}
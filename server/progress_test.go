@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressBarSuppressedWithoutTerminal(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if isTerminal(f) {
+		t.Fatal("a regular file reported as a terminal")
+	}
+
+	stderr := os.Stderr
+	os.Stderr = f
+	bar := newProgressBar(3, false)
+	os.Stderr = stderr
+	if bar.enabled {
+		t.Fatal("bar enabled with stderr redirected to a file")
+	}
+	bar.advance()
+	bar.clear()
+	if info, _ := f.Stat(); info.Size() != 0 {
+		t.Errorf("disabled bar wrote %d bytes", info.Size())
+	}
+
+	if newProgressBar(3, true).enabled {
+		t.Error("bar enabled with quiet set")
+	}
+}
+
+func TestProgressBarDraw(t *testing.T) {
+	var out bytes.Buffer
+	bar := &progressBar{out: &out, enabled: true, total: 4, start: time.Now().Add(-2 * time.Second)}
+
+	bar.advance()
+	line := out.String()
+	if !strings.HasPrefix(line, "\r\033[K[#######") || !strings.Contains(line, "] 1/4  eta 6s") {
+		t.Errorf("after 1 of 4 in 2s drew %q, want 7 of 30 filled and eta 6s", line)
+	}
+
+	out.Reset()
+	bar.done = 3
+	bar.advance()
+	if want := "[" + strings.Repeat("#", progressBarWidth) + "] 4/4  eta 0s"; !strings.HasSuffix(out.String(), want) {
+		t.Errorf("finished bar drew %q, want suffix %q", out.String(), want)
+	}
+
+	out.Reset()
+	bar.clear()
+	if out.String() != "\r\033[K" {
+		t.Errorf("clear wrote %q", out.String())
+	}
+}
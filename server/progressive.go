@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"song-recognition/metrics"
+	"song-recognition/shazam"
+	"song-recognition/utils"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultProgressiveMinSec = 3.0      // audio needed before the first match attempt
+	maxProgressiveMinSec     = 60.0     // the most minSec may ask for
+	progressiveWindowSec     = 30.0     // most recent audio kept and matched
+	progressiveReadBytes     = 32 << 10 // read size for the upload body
+
+	// an early return also needs a leader this clear: at least
+	// progressiveEarlyMinAligned aligned hits, and a score
+	// progressiveEarlyMargin times the runner-up's
+	progressiveEarlyMinAligned = 20
+	progressiveEarlyMargin     = 1.5
+)
+
+// progressiveOptions are the /api/match query params a progressive
+// upload is matched with.
+type progressiveOptions struct {
+	limit    int
+	songIDs  []uint32
+	minScore float64
+	minSec   float64
+	cfg      shazam.FingerprintConfig
+}
+
+// parseProgressiveMinSec validates the minSec query param.
+func parseProgressiveMinSec(raw string) (float64, error) {
+	if raw == "" {
+		return defaultProgressiveMinSec, nil
+	}
+	sec, err := strconv.ParseFloat(raw, 64)
+	if err != nil || !(sec > 0 && sec <= maxProgressiveMinSec) {
+		return 0, fmt.Errorf("minSec must be a number of seconds above 0 and at most %g", maxProgressiveMinSec)
+	}
+	return sec, nil
+}
+
+// matchProgressive serves /api/match?progressive=1. the body is raw mono
+// PCM, described by the sampleRate and format params as for /api/stream,
+// and is usually sent with chunked transfer encoding while it is being
+// recorded. matching starts once minSec seconds have arrived and is
+// retried after every streamHopSec seconds of new audio, over the last
+// progressiveWindowSec seconds. as soon as the same song has led
+// streamStableAfter attempts in a row, and clearly (see confidentLead),
+// it is returned and the rest of the upload is left unread. otherwise the
+// audio is matched once more when the upload ends.
+func (s *apiServer) matchProgressive(w http.ResponseWriter, r *http.Request, opts progressiveOptions) {
+	reqStart := time.Now()
+	ctx := r.Context()
+
+	sampleRate, format, err := parsePCMParams(r.URL.Query())
+	if err != nil {
+		metrics.MatchRequests.WithLabelValues("error").Inc()
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	windowLen := int(progressiveWindowSec * float64(sampleRate))
+	hopLen := int(streamHopSec * float64(sampleRate))
+	sampleBytes := pcmSampleBytes(format)
+
+	body := http.MaxBytesReader(w, r.Body, s.maxMatchUpload)
+	buf := make([]byte, progressiveReadBytes)
+	var pending []byte                 // bytes of a sample split across reads
+	window := newSampleRing(windowLen) // the last windowLen samples
+	var attempt []float64              // window copied out in order for a match attempt
+	received := 0                      // samples so far
+
+	// attempts on less audio than a clip needs would only produce guesses
+	nextAttempt := int(max(opts.minSec, opts.cfg.MinClipDuration(sampleRate)) * float64(sampleRate))
+
+	var lastSongID uint32
+	agreeing := 0
+
+	for {
+		n, readErr := body.Read(buf)
+		pending = append(pending, buf[:n]...)
+		if whole := len(pending) - len(pending)%sampleBytes; whole > 0 {
+			samples, err := decodePCM(pending[:whole], format)
+			if err != nil {
+				metrics.MatchRequests.WithLabelValues("error").Inc()
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			pending = append(pending[:0], pending[whole:]...)
+			window.write(samples)
+			received += len(samples)
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			metrics.MatchRequests.WithLabelValues("error").Inc()
+			var tooLarge *http.MaxBytesError
+			if errors.As(readErr, &tooLarge) {
+				writeError(w, http.StatusRequestEntityTooLarge,
+					fmt.Sprintf("upload exceeds the %s limit", formatBytes(tooLarge.Limit)))
+			} else {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("upload interrupted: %v", readErr))
+			}
+			return
+		}
+		if received < nextAttempt {
+			continue
+		}
+		nextAttempt = received + hopLen
+
+		attempt = window.appendTo(attempt[:0])
+		matches, fingerprints, err := s.matchWindow(attempt, sampleRate, opts)
+		if err != nil {
+			metrics.MatchRequests.WithLabelValues("error").Inc()
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("match error: %v", err))
+			return
+		}
+		receivedSec := float64(received) / float64(sampleRate)
+		if len(matches) == 0 {
+			utils.DebugfCtx(ctx, "[match] progressive: no match after %.1fs", receivedSec)
+			lastSongID, agreeing = 0, 0
+			continue
+		}
+		if matches[0].SongID == lastSongID {
+			agreeing++
+		} else {
+			lastSongID, agreeing = matches[0].SongID, 1
+		}
+		utils.DebugfCtx(ctx, "[match] progressive: '%s' leads after %.1fs (%d in a row)", matches[0].SongTitle, receivedSec, agreeing)
+		if agreeing >= streamStableAfter && confidentLead(matches) {
+			// the client may still be sending; don't keep the connection
+			// around to drain the rest of the upload
+			w.Header().Set("Connection", "close")
+			s.writeProgressiveMatch(w, r, matches, opts.limit, fingerprints, receivedSec, true, reqStart)
+			return
+		}
+	}
+
+	if received == 0 {
+		metrics.MatchRequests.WithLabelValues("error").Inc()
+		writeError(w, http.StatusBadRequest, "no audio received")
+		return
+	}
+	if err := opts.cfg.CheckClipLength(float64(received)/float64(sampleRate), sampleRate); err != nil {
+		metrics.MatchRequests.WithLabelValues("error").Inc()
+		writeFingerprintError(w, err)
+		return
+	}
+	matches, fingerprints, err := s.matchWindow(window.appendTo(attempt[:0]), sampleRate, opts)
+	if err != nil {
+		metrics.MatchRequests.WithLabelValues("error").Inc()
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("match error: %v", err))
+		return
+	}
+	s.writeProgressiveMatch(w, r, matches, opts.limit, fingerprints, float64(received)/float64(sampleRate), false, reqStart)
+}
+
+// confidentLead reports whether the leading match is clear enough to end
+// a progressive upload early. a song that keeps leading by a hit or two
+// over near-silence or an unindexed recording is still a guess.
+func confidentLead(matches []shazam.Match) bool {
+	if matches[0].AlignedMatches < progressiveEarlyMinAligned {
+		return false
+	}
+	return len(matches) == 1 || matches[0].Score >= progressiveEarlyMargin*matches[1].Score
+}
+
+// sampleRing holds the last len(buf) samples written to it. writes wrap
+// around in place, so a long upload doesn't move the whole window on
+// every read; only a match attempt copies it out, with appendTo.
+type sampleRing struct {
+	buf  []float64
+	next int  // where the next sample goes
+	full bool // buf has wrapped at least once
+}
+
+func newSampleRing(size int) *sampleRing {
+	return &sampleRing{buf: make([]float64, size)}
+}
+
+func (r *sampleRing) write(samples []float64) {
+	if len(samples) >= len(r.buf) {
+		copy(r.buf, samples[len(samples)-len(r.buf):])
+		r.next, r.full = 0, true
+		return
+	}
+	end := r.next + len(samples)
+	n := copy(r.buf[r.next:], samples)
+	copy(r.buf, samples[n:])
+	if end >= len(r.buf) {
+		r.full = true
+	}
+	r.next = end % len(r.buf)
+}
+
+// appendTo appends the held samples to dst, oldest first.
+func (r *sampleRing) appendTo(dst []float64) []float64 {
+	if !r.full {
+		return append(dst, r.buf[:r.next]...)
+	}
+	dst = append(dst, r.buf[r.next:]...)
+	return append(dst, r.buf[:r.next]...)
+}
+
+// matchWindow fingerprints samples and matches them, dropping matches
+// below opts.minScore. it also returns the number of sample fingerprints.
+func (s *apiServer) matchWindow(samples []float64, sampleRate int, opts progressiveOptions) ([]shazam.Match, int, error) {
+	fingerprint, _, err := shazam.AnalyzeSamples(samples, sampleRate, utils.GenerateUniqueID(), opts.cfg)
+	if err != nil {
+		return nil, 0, err
+	}
+	sampleFP := shazam.SampleFingerprint(fingerprint, opts.cfg)
+	matches, _, err := shazam.FindMatchesFGP(s.db, sampleFP, opts.songIDs, opts.limit, s.matchOpts)
+	if err != nil {
+		return nil, 0, err
+	}
+	return aboveMinScore(matches, opts.minScore), len(sampleFP), nil
+}
+
+func (s *apiServer) writeProgressiveMatch(w http.ResponseWriter, r *http.Request, matches []shazam.Match, limit, fingerprints int, receivedSec float64, early bool, reqStart time.Time) {
+	if len(matches) < limit {
+		limit = len(matches)
+	}
+	results := make([]matchResult, 0, limit)
+	for _, m := range matches[:limit] {
+		results = append(results, newMatchResult(m))
+	}
+
+	metrics.MatchRequests.WithLabelValues("ok").Inc()
+	metrics.MatchDuration.Observe(time.Since(reqStart).Seconds())
+	utils.InfofCtx(r.Context(), "[match] progressive upload matched after %.1fs of audio in %s (early=%v), returning %d results",
+		receivedSec, time.Since(reqStart), early, len(results))
+
+	resp := map[string]any{
+		"sampleFingerprints": fingerprints,
+		"receivedSec":        receivedSec,
+		"early":              early,
+		"noMatch":            len(results) == 0,
+	}
+	if wantsNDJSON(r) {
+		writeNDJSON(w, resp, results)
+		return
+	}
+	resp["matches"] = results
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"song-recognition/shazam"
+	"testing"
+)
+
+func progressiveMatch(t *testing.T, s *apiServer, samples []float64) map[string]any {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/api/match?progressive=1&sampleRate=44100&format=f32", bytes.NewReader(f32PCM(samples)))
+	rec := httptest.NewRecorder()
+	s.handleMatch(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var resp map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestProgressiveMatchReturnsEarly(t *testing.T) {
+	s := newTestServer(t, shazam.DefaultAudiobookConfig(), 1)
+
+	resp := progressiveMatch(t, s, testTones(1, 44100, 60)[10*44100:])
+	if resp["early"] != true || resp["noMatch"] != false {
+		t.Fatalf("indexed audio: early=%v noMatch=%v, want an early match", resp["early"], resp["noMatch"])
+	}
+	if sec := resp["receivedSec"].(float64); sec >= 50 {
+		t.Errorf("early match read %.1fs, the whole upload", sec)
+	}
+
+	// audio that isn't indexed may produce stray leaders, but never
+	// clear enough ones to stop reading
+	resp = progressiveMatch(t, s, testTones(2, 44100, 30))
+	if resp["early"] != false {
+		t.Errorf("unindexed audio matched early: %v", resp)
+	}
+}
+
+func TestSampleRing(t *testing.T) {
+	ring := newSampleRing(5)
+	var all []float64
+	for i, n := range []int{2, 2, 3, 1, 7, 4} {
+		chunk := make([]float64, n)
+		for j := range chunk {
+			chunk[j] = float64(len(all) + j)
+		}
+		all = append(all, chunk...)
+		ring.write(chunk)
+
+		want := all[max(0, len(all)-5):]
+		if got := ring.appendTo(nil); !slices.Equal(got, want) {
+			t.Fatalf("after write %d: got %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestProgressiveMatchEmptyLibrary(t *testing.T) {
+	s := newTestServer(t, shazam.DefaultAudiobookConfig(), 0)
+	req := httptest.NewRequest("POST", "/api/match?progressive=1", bytes.NewReader(f32PCM(testTones(1, 44100, 5))))
+	rec := httptest.NewRecorder()
+	s.handleMatch(rec, req)
+	if rec.Code != http.StatusServiceUnavailable || decodeJSON(t, rec)["error"] != errEmptyLibrary.Error() {
+		t.Errorf("status %d, body %s; want 503 saying nothing is indexed", rec.Code, rec.Body)
+	}
+}
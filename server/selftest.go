@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"song-recognition/db"
+	"song-recognition/models"
+	"song-recognition/shazam"
+	"song-recognition/utils"
+	"song-recognition/wav"
+	"time"
+)
+
+const (
+	selftestSampleRate = 44100
+	selftestNoteSec    = 1.5 // long enough for whole frames inside every note
+	selftestClipStart  = 4.5 // seconds into the melody the query clip starts
+	selftestClipSec    = 9.0
+)
+
+// selftestMelody is the indexed signal: one pure tone per note. the decoy
+// uses unrelated pitches so it shares (almost) no addresses with it.
+var (
+	selftestMelody = []float64{220, 330, 523, 700, 880, 1046, 1318, 1568, 392, 987, 1760, 262}
+	selftestDecoy  = []float64{247, 415, 622, 784, 932, 1175, 1480, 1865, 466, 1109, 1976, 294}
+)
+
+// selftest tracks whether any stage failed.
+type selftest struct {
+	failed bool
+}
+
+// stage runs and times one step, printing ok/FAIL.
+func (t *selftest) stage(name string, run func() error) {
+	start := time.Now()
+	err := run()
+	elapsed := time.Since(start).Round(time.Microsecond)
+	if err != nil {
+		t.failed = true
+		fmt.Printf("  FAIL  %-28s %10s  %v\n", name, elapsed, err)
+		return
+	}
+	fmt.Printf("  ok    %-28s %10s\n", name, elapsed)
+}
+
+func (t *selftest) skip(name, reason string) {
+	fmt.Printf("  skip  %-28s %10s  %s\n", name, "", reason)
+}
+
+// synthesizeMelody renders each frequency as a noteSec long sine with
+// short fades so note boundaries don't click across the spectrum.
+func synthesizeMelody(freqs []float64, sampleRate int, noteSec float64) []float64 {
+	noteLen := int(noteSec * float64(sampleRate))
+	fade := sampleRate / 200 // 5 ms
+	samples := make([]float64, 0, noteLen*len(freqs))
+
+	for _, f := range freqs {
+		for i := 0; i < noteLen; i++ {
+			gain := 0.5
+			if i < fade {
+				gain *= float64(i) / float64(fade)
+			} else if i > noteLen-fade {
+				gain *= float64(noteLen-i) / float64(fade)
+			}
+			samples = append(samples, gain*math.Sin(2*math.Pi*f*float64(i)/float64(sampleRate)))
+		}
+	}
+	return samples
+}
+
+// runSelftest pushes a synthetic signal through the DSP pipeline and an
+// in-memory database and checks the results, printing timings per stage.
+// it returns false if any check failed.
+func runSelftest() bool {
+	cfg, opts := fpConfig, matchOpts
+	t := &selftest{}
+
+	fmt.Printf("selftest: %d-note melody, %.1fs notes, window %d, hop %d, DSP ratio %d\n",
+		len(selftestMelody), selftestNoteSec, cfg.WindowSize, cfg.HopSize, cfg.DSPRatio)
+
+	var melody, decoy []float64
+	t.stage("synthesize", func() error {
+		melody = synthesizeMelody(selftestMelody, selftestSampleRate, selftestNoteSec)
+		decoy = synthesizeMelody(selftestDecoy, selftestSampleRate, selftestNoteSec)
+		return nil
+	})
+
+	client := db.NewMemoryClient()
+	var songID, decoyID uint32
+	t.stage("register songs", func() error {
+		var err error
+		if songID, err = client.RegisterSong("melody", "selftest", "", ""); err != nil {
+			return err
+		}
+		decoyID, err = client.RegisterSong("decoy", "selftest", "", "")
+		return err
+	})
+
+	var songFP map[uint32]models.Couple
+	var peaks []shazam.Peak
+	t.stage("analyze samples", func() error {
+		var err error
+		songFP, peaks, err = shazam.AnalyzeSamples(melody, selftestSampleRate, songID, cfg)
+		if err != nil {
+			return err
+		}
+		if len(songFP) == 0 {
+			return fmt.Errorf("no fingerprints from %d peaks", len(peaks))
+		}
+		return nil
+	})
+
+	t.stage("peak frequencies", func() error {
+		return checkMelodyPeaks(peaks, cfg)
+	})
+
+	t.stage("store in memory db", func() error {
+		decoyFP, _, err := shazam.AnalyzeSamples(decoy, selftestSampleRate, decoyID, cfg)
+		if err != nil {
+			return err
+		}
+		if err := client.StoreFingerprints(songFP); err != nil {
+			return err
+		}
+		return client.StoreFingerprints(decoyFP)
+	})
+
+	t.stage("match clip", func() error {
+		return checkClipMatch(client, melody, songID, cfg, opts)
+	})
+
+	if _, err := exec.LookPath(wav.FFmpegPath); err != nil {
+		t.skip("ffmpeg round trip", wav.FFmpegPath+" not found (set FFMPEG_PATH)")
+	} else {
+		t.stage("ffmpeg round trip", func() error {
+			return checkFFmpegRoundTrip(melody, len(songFP), cfg)
+		})
+	}
+
+	if t.failed {
+		fmt.Println("selftest FAILED")
+		return false
+	}
+	fmt.Println("selftest passed")
+	return true
+}
+
+// checkMelodyPeaks asserts that peaks lying entirely inside a note are at
+// that note's frequency, within two FFT bins.
+func checkMelodyPeaks(peaks []shazam.Peak, cfg shazam.FingerprintConfig) error {
+	rate := shazam.EffectiveSampleRate(selftestSampleRate, cfg)
+	tolerance := 2 * rate / float64(cfg.WindowSize)
+	windowSec := float64(cfg.WindowSize) / rate
+
+	for i, want := range selftestMelody {
+		noteStart := float64(i) * selftestNoteSec
+		noteEnd := noteStart + selftestNoteSec
+
+		found, wrong := 0, 0
+		for _, p := range peaks {
+			if p.Time < noteStart || p.Time+windowSec > noteEnd {
+				continue
+			}
+			if math.Abs(p.Freq-want) <= tolerance {
+				found++
+			} else {
+				wrong++
+			}
+		}
+		if found == 0 {
+			return fmt.Errorf("note %d: no peak near %.0f Hz (%d elsewhere)", i, want, wrong)
+		}
+		if wrong > found {
+			return fmt.Errorf("note %d: %d peaks away from %.0f Hz vs %d on it", i, wrong, want, found)
+		}
+	}
+	return nil
+}
+
+// checkClipMatch fingerprints an excerpt of the melody and asserts the
+// search ranks the melody first, ahead of the decoy.
+func checkClipMatch(client db.DBClient, melody []float64, songID uint32, cfg shazam.FingerprintConfig, opts shazam.MatchOptions) error {
+	start := int(selftestClipStart * selftestSampleRate)
+	end := start + int(selftestClipSec*selftestSampleRate)
+	clipFP, _, err := shazam.AnalyzeSamples(melody[start:end], selftestSampleRate, utils.GenerateUniqueID(), cfg)
+	if err != nil {
+		return err
+	}
+
+	sample := shazam.SampleFingerprint(clipFP, cfg)
+
+	matches, _, err := shazam.FindMatchesFGP(client, sample, nil, 2, opts)
+	if err != nil {
+		return err
+	}
+	if len(matches) == 0 {
+		return fmt.Errorf("no matches for a %.0fs clip (%d fingerprints)", selftestClipSec, len(sample))
+	}
+	if matches[0].SongID != songID {
+		return fmt.Errorf("best match is %q (score %.0f), expected the melody", matches[0].SongTitle, matches[0].Score)
+	}
+	return nil
+}
+
+// checkFFmpegRoundTrip writes the melody to a WAV file and fingerprints
+// it through the chunked ffmpeg path, which should find about as many
+// fingerprints as the in-memory analysis did.
+func checkFFmpegRoundTrip(melody []float64, want int, cfg shazam.FingerprintConfig) error {
+	dir, err := os.MkdirTemp("", "seek-tune-selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "melody.wav")
+	if err := wav.WriteWav(path, melody, selftestSampleRate, 1); err != nil {
+		return err
+	}
+
+	fingerprints, _, err := shazam.FingerprintAudioChunked(context.Background(), path, utils.GenerateUniqueID(), cfg)
+	if err != nil {
+		return err
+	}
+	// chunk boundaries and 16-bit quantisation shift a few peaks
+	if got := len(fingerprints); float64(got) < 0.8*float64(want) {
+		return fmt.Errorf("got %d fingerprints via ffmpeg, expected about %d", got, want)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"song-recognition/db"
+	"song-recognition/shazam"
+	"strings"
+	"testing"
+)
+
+func TestSelftestPasses(t *testing.T) {
+	defer func(cfg shazam.FingerprintConfig) { fpConfig = cfg }(fpConfig)
+	for _, name := range []string{"audiobook", "audiobook-overlap", "music"} {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := shazam.ConfigByName(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fpConfig = cfg
+			var ok bool
+			out := captureStdout(t, func() { ok = runSelftest() })
+			if !ok || strings.Contains(out, "FAIL") {
+				t.Errorf("selftest failed:\n%s", out)
+			}
+			if !strings.Contains(out, "  ok    match clip") {
+				t.Errorf("no timing line for the match stage:\n%s", out)
+			}
+		})
+	}
+}
+
+func TestSelftestChecksFail(t *testing.T) {
+	cfg := shazam.DefaultMusicConfig()
+	melody := synthesizeMelody(selftestMelody, selftestSampleRate, selftestNoteSec)
+	decoy := synthesizeMelody(selftestDecoy, selftestSampleRate, selftestNoteSec)
+
+	// the decoy's peaks are at the wrong pitches for the melody
+	_, decoyPeaks, err := shazam.AnalyzeSamples(decoy, selftestSampleRate, 1, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMelodyPeaks(decoyPeaks, cfg); err == nil {
+		t.Error("checkMelodyPeaks accepted the decoy's peaks")
+	}
+
+	// with only the decoy indexed the melody clip can't rank first
+	client := db.NewMemoryClient()
+	decoyID, err := client.RegisterSong("decoy", "selftest", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoyFP, _, err := shazam.AnalyzeSamples(decoy, selftestSampleRate, decoyID, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.StoreFingerprints(decoyFP); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkClipMatch(client, melody, decoyID+1, cfg, shazam.MatchOptions{}); err == nil {
+		t.Error("checkClipMatch passed without the melody indexed")
+	}
+}
@@ -0,0 +1,128 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package shazam
+
+import (
+	"container/list"
+	"encoding/binary"
+	"hash/fnv"
+	"slices"
+	"sync"
+	"time"
+)
+
+// MatchCache is an LRU cache of FindMatchesFGP results keyed by the
+// sample fingerprint, for settings where the same clip is matched over
+// and over. entries expire after ttl, and are tagged with the database
+// generation (see db.VersionedClient) they were computed at so results
+// from before a write are never served. a nil *MatchCache is valid and
+// caches nothing.
+type MatchCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List // front = most recently used
+	entries map[uint64]*list.Element
+}
+
+type matchCacheEntry struct {
+	key        uint64
+	generation uint64
+	matches    []Match
+	expires    time.Time
+}
+
+// NewMatchCache returns a cache holding up to size results for ttl each
+// (0 = no expiry), or nil (caching disabled) when size is not positive.
+func NewMatchCache(size int, ttl time.Duration) *MatchCache {
+	if size <= 0 {
+		return nil
+	}
+	return &MatchCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[uint64]*list.Element),
+	}
+}
+
+// MatchCacheKey hashes a sample fingerprint and song filter. addresses
+// are visited in sorted order so equal maps always hash the same.
+func MatchCacheKey(sampleFingerprint map[uint32]uint32, songIDs []uint32) uint64 {
+	addresses := make([]uint32, 0, len(sampleFingerprint))
+	for address := range sampleFingerprint {
+		addresses = append(addresses, address)
+	}
+	slices.Sort(addresses)
+
+	h := fnv.New64a()
+	var buf [8]byte
+	for _, address := range addresses {
+		binary.LittleEndian.PutUint32(buf[:4], address)
+		binary.LittleEndian.PutUint32(buf[4:], sampleFingerprint[address])
+		h.Write(buf[:])
+	}
+
+	// separate the filter from the fingerprint so they can't run together
+	h.Write([]byte{0xff})
+	ids := slices.Clone(songIDs)
+	slices.Sort(ids)
+	for _, id := range ids {
+		binary.LittleEndian.PutUint32(buf[:4], id)
+		h.Write(buf[:4])
+	}
+	return h.Sum64()
+}
+
+// Get returns a copy of the cached matches for key, if present, unexpired
+// and computed at the given database generation.
+func (c *MatchCache) Get(key, generation uint64) ([]Match, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*matchCacheEntry)
+	if entry.generation != generation || (c.ttl > 0 && time.Now().After(entry.expires)) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return slices.Clone(entry.matches), true
+}
+
+// Put stores matches computed at generation under key, evicting the
+// least recently used entry when the cache is full.
+func (c *MatchCache) Put(key, generation uint64, matches []Match) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &matchCacheEntry{
+		key:        key,
+		generation: generation,
+		matches:    slices.Clone(matches),
+		expires:    time.Now().Add(c.ttl),
+	}
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*matchCacheEntry).key)
+	}
+}
@@ -0,0 +1,71 @@
+package shazam
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMatchCacheKey(t *testing.T) {
+	a := map[uint32]uint32{1: 10, 2: 20, 3: 30}
+	b := map[uint32]uint32{3: 30, 1: 10, 2: 20}
+	if MatchCacheKey(a, []uint32{5, 6}) != MatchCacheKey(b, []uint32{6, 5}) {
+		t.Error("equal fingerprints and filters hashed differently")
+	}
+	for name, other := range map[string]uint64{
+		"anchor time": MatchCacheKey(map[uint32]uint32{1: 10, 2: 20, 3: 31}, nil),
+		"filter":      MatchCacheKey(a, []uint32{5}),
+		"no filter":   MatchCacheKey(a, nil),
+	} {
+		if other == MatchCacheKey(a, []uint32{5, 6}) {
+			t.Errorf("a different %s hashed the same", name)
+		}
+	}
+}
+
+func TestMatchCache(t *testing.T) {
+	c := NewMatchCache(2, 0)
+	m := []Match{{SongTitle: "a", Score: 3}}
+	c.Put(1, 7, m)
+
+	got, ok := c.Get(1, 7)
+	if !ok || len(got) != 1 || got[0] != m[0] {
+		t.Fatalf("Get = %v, %v; want the stored matches", got, ok)
+	}
+	got[0].Score = 99
+	if again, _ := c.Get(1, 7); again[0].Score != 3 {
+		t.Error("changing a returned slice changed the cache")
+	}
+
+	// written to since: the entry is dropped
+	if _, ok := c.Get(1, 8); ok {
+		t.Error("hit at a later generation")
+	}
+	if _, ok := c.Get(1, 7); ok {
+		t.Error("stale entry kept after a generation miss")
+	}
+
+	// least recently used goes first
+	c.Put(1, 7, m)
+	c.Put(2, 7, m)
+	c.Get(1, 7)
+	c.Put(3, 7, m)
+	if _, ok := c.Get(2, 7); ok {
+		t.Error("least recently used entry not evicted")
+	}
+	if _, ok := c.Get(1, 7); !ok {
+		t.Error("recently used entry evicted")
+	}
+
+	c = NewMatchCache(2, 10*time.Millisecond)
+	c.Put(1, 0, m)
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := c.Get(1, 0); ok {
+		t.Error("hit after the TTL")
+	}
+
+	disabled := NewMatchCache(0, time.Minute)
+	disabled.Put(1, 0, m)
+	if _, ok := disabled.Get(1, 0); disabled != nil || ok {
+		t.Error("a cache of size 0 isn't disabled")
+	}
+}
@@ -1,15 +1,102 @@
 package shazam
 
+import (
+	"errors"
+	"fmt"
+	"song-recognition/wav"
+)
+
+// DownsampleMethod selects how Spectrogram reduces the sample rate by DSPRatio.
+type DownsampleMethod int
+
+const (
+	// DownsampleAverage averages each block of DSPRatio samples. it acts as
+	// an extra crude low-pass but smears transients. this is the default.
+	DownsampleAverage DownsampleMethod = iota
+	// DownsampleDecimate keeps every DSPRatio-th sample after the low-pass
+	// filter, preserving amplitude and transient timing.
+	DownsampleDecimate
+	// DownsampleLinear interpolates between samples at the exact rate ratio.
+	DownsampleLinear
+)
+
 // FingerprintConfig controls all tunable parameters in the
 // spectrogram, peak extraction, and fingerprint generation pipeline.
 type FingerprintConfig struct {
-	DSPRatio         int      // downsample factor applied to input audio
-	WindowSize       int      // FFT window size in samples (must be power of 2)
-	HopSize          int      // samples between successive FFT frames
-	MaxFreqHz        float64  // low-pass cutoff before downsampling
-	TargetZoneSize   int      // number of neighboring peaks to pair with each anchor
-	FreqBands        [][2]int // (minBin, maxBin) pairs for peak extraction
-	ChunkDurationSec float64  // seconds per processing chunk (0 = whole file)
+	DSPRatio         int              // downsample factor applied to input audio
+	WindowSize       int              // FFT window size in samples (must be power of 2)
+	HopSize          int              // samples between successive FFT frames
+	MaxFreqHz        float64          // low-pass cutoff before downsampling
+	FreqBinHz        float64          // width of the frequency bins in addresses (0 = 10 Hz)
+	TargetZoneSize   int              // number of neighboring peaks to pair with each anchor
+	TargetZoneSec    float64          // if > 0, pair with every peak this many seconds away instead of TargetZoneSize peaks
+	SymmetricTargets bool             // also pair anchors with the target zone before them
+	MinTargetDeltaMs float64          // targets closer than this to the anchor are not paired (0 = pair all)
+	AnchorStride     int              // only about 1 in this many peaks is an anchor (0 or 1 = all); see isAnchor
+	FreqBands        [][2]int         // (minBin, maxBin) pairs for peak extraction
+	ChunkDurationSec float64          // seconds per processing chunk (0 = whole file)
+	ChunkOverlapSec  float64          // seconds shared between consecutive chunks
+	PadFinalFrame    bool             // zero-pad and analyse the trailing partial window
+	DownsampleMethod DownsampleMethod // how audio is reduced by DSPRatio (default averaging)
+	SilenceRMS       float64          // chunks with RMS below this (full scale = 1) are skipped; 0 disables
+	TrimSilence      bool             // drop leading/trailing audio quieter than SilenceRMS before analysis
+	MaxPeaksPerChunk int              // keep only this many of the strongest peaks per chunk (0 = no cap)
+
+	// MergePeaksSec and MergePeaksHz, if either is > 0, collapse peaks
+	// that are at most this far apart in both time and frequency into the
+	// strongest of them (see mergePeaks). overlapping frames and fine hops
+	// can find the same feature in neighbouring frames or bins, and each
+	// copy only adds fingerprints that say the same thing. indexing and
+	// matching must agree on them.
+	MergePeaksSec float64
+	MergePeaksHz  float64
+
+	// CenterPeakTimes places each peak at the centre of its FFT window
+	// instead of at the window's start, half a window later, so reported
+	// match offsets and peak times point at where the sound is. it is off
+	// in every profile (opt in with -center-peaks) since it shifts every
+	// stored anchor time: indexing and matching must agree on it, and a
+	// library built without it needs /api/reindex-all after turning it on.
+	CenterPeakTimes bool
+
+	// NormalizeBands compares each band's maximum against that band's own
+	// running level (see normalizeBands) before picking peaks, instead of
+	// against the raw maxima of the other bands. without it, loud low
+	// bands win most frames and the high bands rarely contribute peaks.
+	// it is off in every profile (opt in with -normalize-bands) since it
+	// changes which peaks are picked: indexing and matching must agree on
+	// it, and a library built without it needs /api/reindex-all after
+	// turning it on.
+	NormalizeBands bool
+
+	// AnchorResolutionMs, if > 1, rounds stored anchor times to multiples
+	// of this many milliseconds. at audiobook frame rates (~371ms per
+	// frame) 10 or 50 ms loses nothing, and fewer distinct values make
+	// offsets line up more reliably. must divide offsetBucketMs so that
+	// quantized offsets still fall evenly into the alignment buckets.
+	AnchorResolutionMs int
+
+	// SpeedScales, if set, are playback speeds (above 1: sped up, with
+	// pitch kept) that clips should still match at. each one adds another
+	// fingerprint pass over every chunk, with about 1/speed times the
+	// fingerprints (see analyzeChunk). indexing and matching must use the
+	// same scales. see MultiResolutionSpeeds.
+	SpeedScales []float64
+
+	// ContinueOnChunkError skips chunks whose extraction or decoding fails
+	// (e.g. a corrupt region mid-file) instead of failing the whole file.
+	ContinueOnChunkError bool
+
+	// MinFingerprintsPerSec is the density below which an indexed file is
+	// unlikely to ever match reliably (0 disables the check). see CheckDensity.
+	MinFingerprintsPerSec float64
+
+	// MinClipFrames is how many frames a clip has to span to be matched
+	// at all (0 disables the check). a clip of a frame or two holds a
+	// handful of peaks, and whatever it "matches" is mostly chance. counted
+	// in frames so the minimum follows the config's frame rate; see
+	// MinClipDuration and CheckClipLength.
+	MinClipFrames int
 }
 
 // DefaultAudiobookConfig returns parameters optimised for long-form
@@ -20,15 +107,50 @@ func DefaultAudiobookConfig() FingerprintConfig {
 		DSPRatio:       8,    // effective rate 5512 Hz, covers speech fine
 		WindowSize:     2048, // ~371ms frames at 5512 Hz
 		HopSize:        2048, // no overlap, ~2.7 fps
-		MaxFreqHz:      3000, // speech doesn't need above 3 kHz
+		MaxFreqHz:      3000, // speech doesn't need above 3 kHz; clamped below the 2756 Hz Nyquist
+		FreqBinHz:      10,
 		TargetZoneSize: 3,
 		FreqBands: [][2]int{
-			{0, 100},     // 0-269 Hz: fundamental frequency
-			{100, 350},   // 269-942 Hz: first formant region
-			{350, 1024},  // 942-2756 Hz: higher formants
+			{0, 100},    // 0-269 Hz: fundamental frequency
+			{100, 350},  // 269-942 Hz: first formant region
+			{350, 1024}, // 942-2756 Hz: higher formants
 		},
 		ChunkDurationSec: 120,
+		ChunkOverlapSec:  5,
+		SilenceRMS:       0.001, // about -60 dBFS
+
+		MinFingerprintsPerSec: 2,
+		MinClipFrames:         defaultMinClipFrames, // ~3s, or ~1.7s with overlap
+	}
+}
+
+// AudiobookOverlapConfig is DefaultAudiobookConfig with frames that
+// overlap by half a window (~5.4 fps). speech onsets that straddle a
+// frame boundary in the default config land inside a frame here, which
+// helps short clips match, at the cost of about twice the fingerprints.
+// an index must be queried with the config it was built with.
+func AudiobookOverlapConfig() FingerprintConfig {
+	cfg := DefaultAudiobookConfig()
+	cfg.HopSize = cfg.WindowSize / 2
+	cfg.MinFingerprintsPerSec *= 2
+	return cfg
+}
+
+// configProfiles are the configs selectable by name with ConfigByName.
+var configProfiles = map[string]func() FingerprintConfig{
+	"audiobook":         DefaultAudiobookConfig,
+	"audiobook-overlap": AudiobookOverlapConfig,
+	"music":             DefaultMusicConfig,
+}
+
+// ConfigByName returns the config of a named profile: "audiobook",
+// "audiobook-overlap" or "music".
+func ConfigByName(name string) (FingerprintConfig, error) {
+	profile, ok := configProfiles[name]
+	if !ok {
+		return FingerprintConfig{}, fmt.Errorf("unknown fingerprint profile %q (expected audiobook, audiobook-overlap or music)", name)
 	}
+	return profile(), nil
 }
 
 // DefaultMusicConfig returns the original Shazam-style parameters
@@ -39,11 +161,262 @@ func DefaultMusicConfig() FingerprintConfig {
 		WindowSize:     1024,
 		HopSize:        512,
 		MaxFreqHz:      5000,
+		FreqBinHz:      10,
 		TargetZoneSize: 5,
 		FreqBands: [][2]int{
 			{0, 10}, {10, 20}, {20, 40},
-			{40, 80}, {80, 160}, {160, 512},
+			// the top band stops below 5 kHz (bin 464 of 10.8 Hz) so
+			// its peaks fit the 9-bit, 10 Hz address bins; the low-pass
+			// at MaxFreqHz leaves next to nothing above it anyway
+			{40, 80}, {80, 160}, {160, 464},
 		},
 		ChunkDurationSec: 300,
+		ChunkOverlapSec:  5,
+		SilenceRMS:       0.001,
+
+		MinFingerprintsPerSec: 20,
+		MinClipFrames:         defaultMinClipFrames, // ~0.4s
+	}
+}
+
+// MultiResolutionSpeeds are the SpeedScales set by the -multi-res flag:
+// the 1.25x and 1.5x that podcast players commonly offer.
+var MultiResolutionSpeeds = []float64{1.25, 1.5}
+
+// speed scales outside this range stretch frames too far to be useful
+const (
+	minSpeedScale = 0.5
+	maxSpeedScale = 2.0
+)
+
+// defaultMinClipFrames is the MinClipFrames of the built-in profiles.
+const defaultMinClipFrames = 8
+
+// defaultFreqBinHz is the address bin width used when FreqBinHz is unset.
+const defaultFreqBinHz = 10
+
+func (cfg FingerprintConfig) freqBinHz() float64 {
+	if cfg.FreqBinHz == 0 {
+		return defaultFreqBinHz
+	}
+	return cfg.FreqBinHz
+}
+
+// Validate reports the first parameter combination that would make the
+// pipeline misbehave, so bad configs fail before a long fingerprint run.
+func (cfg FingerprintConfig) Validate() error {
+	if cfg.DSPRatio < 1 {
+		return fmt.Errorf("DSPRatio must be at least 1, got %d", cfg.DSPRatio)
+	}
+	if cfg.WindowSize < 2 || cfg.WindowSize&(cfg.WindowSize-1) != 0 {
+		return fmt.Errorf("WindowSize must be a power of 2, got %d", cfg.WindowSize)
+	}
+	if cfg.HopSize < 1 {
+		return fmt.Errorf("HopSize must be positive, got %d", cfg.HopSize)
+	}
+	if cfg.MaxFreqHz <= 0 {
+		return fmt.Errorf("MaxFreqHz must be positive, got %g", cfg.MaxFreqHz)
+	}
+	if cfg.FreqBinHz < 0 {
+		return fmt.Errorf("FreqBinHz must not be negative, got %g", cfg.FreqBinHz)
+	}
+	if cfg.DownsampleMethod < DownsampleAverage || cfg.DownsampleMethod > DownsampleLinear {
+		return fmt.Errorf("unknown DownsampleMethod %d", cfg.DownsampleMethod)
+	}
+	if cfg.TargetZoneSec < 0 {
+		return fmt.Errorf("TargetZoneSec must not be negative, got %g", cfg.TargetZoneSec)
+	}
+	if maxDelta := maxPairDeltaSec(cfg); cfg.TargetZoneSec > maxDelta {
+		return fmt.Errorf("TargetZoneSec (%g) exceeds the %.3fs the address delta field can encode", cfg.TargetZoneSec, maxDelta)
+	}
+	if cfg.MinTargetDeltaMs < 0 {
+		return fmt.Errorf("MinTargetDeltaMs must not be negative, got %g", cfg.MinTargetDeltaMs)
+	}
+	if maxDelta := maxPairDeltaSec(cfg); cfg.MinTargetDeltaMs/1000 >= maxDelta {
+		return fmt.Errorf("MinTargetDeltaMs (%g) leaves nothing to pair below the %.3fs delta limit", cfg.MinTargetDeltaMs, maxDelta)
+	}
+	if cfg.TargetZoneSec > 0 && cfg.MinTargetDeltaMs/1000 >= cfg.TargetZoneSec {
+		return fmt.Errorf("MinTargetDeltaMs (%g) must be below TargetZoneSec (%g) in milliseconds", cfg.MinTargetDeltaMs, cfg.TargetZoneSec)
+	}
+	if cfg.AnchorStride < 0 {
+		return fmt.Errorf("AnchorStride must not be negative, got %d", cfg.AnchorStride)
+	}
+	if cfg.TargetZoneSec == 0 && cfg.TargetZoneSize < 1 {
+		return fmt.Errorf("TargetZoneSize must be at least 1, got %d", cfg.TargetZoneSize)
+	}
+	if len(cfg.FreqBands) == 0 {
+		return errors.New("FreqBands must not be empty")
+	}
+	if err := cfg.validateBands(); err != nil {
+		return err
+	}
+	if err := cfg.CheckFreqBits(wav.DecodeSampleRate); err != nil {
+		return err
+	}
+	if cfg.ChunkDurationSec < 0 {
+		return fmt.Errorf("ChunkDurationSec must not be negative, got %g", cfg.ChunkDurationSec)
+	}
+	if cfg.ChunkOverlapSec < 0 {
+		return fmt.Errorf("ChunkOverlapSec must not be negative, got %g", cfg.ChunkOverlapSec)
+	}
+	if cfg.ChunkDurationSec > 0 && cfg.ChunkOverlapSec >= cfg.ChunkDurationSec {
+		return fmt.Errorf("ChunkOverlapSec (%g) must be less than ChunkDurationSec (%g)",
+			cfg.ChunkOverlapSec, cfg.ChunkDurationSec)
+	}
+	if cfg.SilenceRMS < 0 || cfg.SilenceRMS >= 1 {
+		return fmt.Errorf("SilenceRMS must be in [0, 1), got %g", cfg.SilenceRMS)
+	}
+	for _, speed := range cfg.SpeedScales {
+		if speed < minSpeedScale || speed > maxSpeedScale || speed == 1 {
+			return fmt.Errorf("SpeedScales must be between %g and %g and not 1, got %g", minSpeedScale, maxSpeedScale, speed)
+		}
+	}
+	if cfg.MaxPeaksPerChunk < 0 {
+		return fmt.Errorf("MaxPeaksPerChunk must not be negative, got %d", cfg.MaxPeaksPerChunk)
+	}
+	if cfg.MergePeaksSec < 0 || cfg.MergePeaksHz < 0 {
+		return fmt.Errorf("MergePeaksSec and MergePeaksHz must not be negative, got %g and %g", cfg.MergePeaksSec, cfg.MergePeaksHz)
+	}
+	if cfg.TrimSilence && cfg.SilenceRMS == 0 {
+		return errors.New("TrimSilence needs a SilenceRMS threshold")
+	}
+	if cfg.AnchorResolutionMs < 0 || cfg.AnchorResolutionMs > 0 && offsetBucketMs%cfg.AnchorResolutionMs != 0 {
+		return fmt.Errorf("AnchorResolutionMs must be 0 or divide %d, got %d", offsetBucketMs, cfg.AnchorResolutionMs)
+	}
+	if cfg.MinFingerprintsPerSec < 0 {
+		return fmt.Errorf("MinFingerprintsPerSec must not be negative, got %g", cfg.MinFingerprintsPerSec)
+	}
+	if cfg.MinClipFrames < 0 {
+		return fmt.Errorf("MinClipFrames must not be negative, got %d", cfg.MinClipFrames)
+	}
+	// a MaxFreqHz at or above Nyquist isn't an error: analyzeSamples
+	// clamps it per call with ClampToNyquist, for whatever rate it gets
+	return nil
+}
+
+// validateBands checks that FreqBands are non-empty bin ranges in
+// ascending order without overlaps, and that at least one of them starts
+// within the WindowSize/2 bins ExtractPeaks looks at; otherwise no peaks
+// could ever be found.
+func (cfg FingerprintConfig) validateBands() error {
+	for i, band := range cfg.FreqBands {
+		if band[0] < 0 || band[1] <= band[0] {
+			return fmt.Errorf("FreqBands[%d] = %v must be a non-empty range of non-negative bins", i, band)
+		}
+		if i > 0 && band[0] < cfg.FreqBands[i-1][1] {
+			return fmt.Errorf("FreqBands[%d] = %v overlaps or comes before FreqBands[%d] = %v; bands must be sorted and disjoint",
+				i, band, i-1, cfg.FreqBands[i-1])
+		}
+	}
+	if bins := cfg.WindowSize / 2; cfg.FreqBands[0][0] >= bins {
+		return fmt.Errorf("every FreqBands range starts at or beyond the %d bins of a %d-sample window", bins, cfg.WindowSize)
+	}
+	return nil
+}
+
+// maxPeakFreqHz is the highest frequency ExtractPeaks can report for audio
+// at sampleRate: the last bin the highest band reaches, within the
+// WindowSize/2 bins of a frame, times the FFT's frequency resolution.
+// MaxFreqHz doesn't bound it; the low-pass only makes such peaks rare.
+func (cfg FingerprintConfig) maxPeakFreqHz(sampleRate int) float64 {
+	top := 0
+	for _, band := range cfg.FreqBands {
+		top = max(top, min(band[1], cfg.WindowSize/2)-1)
+	}
+	return float64(top) * EffectiveSampleRate(sampleRate, cfg) / float64(cfg.WindowSize)
+}
+
+// CheckFreqBits reports FreqBands whose peaks, for audio at sampleRate,
+// can land in a FreqBinHz bin beyond the maxFreqBits-bit frequency fields
+// of an address. createAddress would wrap them onto low bins, where they
+// collide with genuine low-frequency peaks.
+func (cfg FingerprintConfig) CheckFreqBits(sampleRate int) error {
+	maxHz := cfg.maxPeakFreqHz(sampleRate)
+	if bin := int(maxHz / cfg.freqBinHz()); bin >= 1<<maxFreqBits {
+		return fmt.Errorf("FreqBands reach %.0f Hz, address bin %d at %g Hz per bin, which does not fit the %d-bit address field (max %d); use wider bins or lower bands",
+			maxHz, bin, cfg.freqBinHz(), maxFreqBits, 1<<maxFreqBits-1)
+	}
+	return nil
+}
+
+// CheckBands reports FreqBands that reach past the WindowSize/2 bins of
+// a frame. ExtractPeaks cuts them short, or skips bands that lie wholly
+// beyond, which still works but usually means the bands were written for
+// a larger window.
+func (cfg FingerprintConfig) CheckBands() error {
+	bins := cfg.WindowSize / 2
+	var skipped, clamped [][2]int
+	for _, band := range cfg.FreqBands {
+		switch {
+		case band[0] >= bins:
+			skipped = append(skipped, band)
+		case band[1] > bins:
+			clamped = append(clamped, band)
+		}
+	}
+	switch {
+	case len(skipped) > 0:
+		return fmt.Errorf("FreqBands %v lie beyond the %d bins of a %d-sample window and are skipped", skipped, bins, cfg.WindowSize)
+	case len(clamped) > 0:
+		return fmt.Errorf("FreqBands %v reach past the %d bins of a %d-sample window and are cut short", clamped, bins, cfg.WindowSize)
+	}
+	return nil
+}
+
+// sane bounds on the time and frequency resolution that DSPRatio,
+// WindowSize and HopSize add up to. the defaults sit well inside them:
+// audiobook frames are ~371ms with 2.7 Hz bins, music ~93ms with 10.8 Hz.
+const (
+	minFrameSec         = 0.005 // shorter windows resolve next to no frequency detail
+	maxFrameSec         = 1.0   // longer windows blur syllables and notes together
+	maxFreqResolutionHz = 50    // coarser FFT bins can't tell formants or notes apart
+)
+
+// CheckResolution reports a DSPRatio/WindowSize/HopSize combination whose
+// frames are absurdly short or long, or whose FFT bins are too coarse, at
+// audio of sampleRate. e.g. DSPRatio 64 with a 2048-sample window gives
+// ~3s frames at 44.1 kHz. such configs still work, just badly, so this
+// is a warning rather than part of Validate.
+func (cfg FingerprintConfig) CheckResolution(sampleRate int) error {
+	effectiveRate := EffectiveSampleRate(sampleRate, cfg)
+	windowSec := float64(cfg.WindowSize) / effectiveRate
+	if windowSec < minFrameSec || windowSec > maxFrameSec {
+		return fmt.Errorf("WindowSize %d at DSPRatio %d gives %.3fs frames at %d Hz; expected %gs to %gs",
+			cfg.WindowSize, cfg.DSPRatio, windowSec, sampleRate, minFrameSec, maxFrameSec)
+	}
+	if hopSec := FrameDuration(sampleRate, cfg); hopSec > maxFrameSec {
+		return fmt.Errorf("HopSize %d at DSPRatio %d puts frames %.3fs apart at %d Hz; expected at most %gs",
+			cfg.HopSize, cfg.DSPRatio, hopSec, sampleRate, maxFrameSec)
+	}
+	if resolution := effectiveRate / float64(cfg.WindowSize); resolution > maxFreqResolutionHz {
+		return fmt.Errorf("WindowSize %d at DSPRatio %d gives %.1f Hz frequency bins at %d Hz; expected at most %d Hz",
+			cfg.WindowSize, cfg.DSPRatio, resolution, sampleRate, maxFreqResolutionHz)
+	}
+	return nil
+}
+
+// nyquistMargin keeps a clamped MaxFreqHz just below the Nyquist frequency.
+const nyquistMargin = 0.98
+
+// CheckNyquist reports an error if MaxFreqHz is not below the Nyquist
+// frequency of audio at sampleRate after downsampling by DSPRatio. the
+// low-pass filter is then pointless and everything above Nyquist aliases.
+func (cfg FingerprintConfig) CheckNyquist(sampleRate int) error {
+	nyquist := EffectiveSampleRate(sampleRate, cfg) / 2
+	if cfg.MaxFreqHz >= nyquist {
+		return fmt.Errorf("MaxFreqHz (%g) must be below the %.0f Hz Nyquist frequency of %d Hz audio downsampled by %d",
+			cfg.MaxFreqHz, nyquist, sampleRate, cfg.DSPRatio)
+	}
+	return nil
+}
+
+// ClampToNyquist returns cfg with MaxFreqHz lowered to just below the
+// Nyquist frequency for sampleRate if CheckNyquist fails, along with
+// that error (nil when cfg is returned unchanged).
+func (cfg FingerprintConfig) ClampToNyquist(sampleRate int) (FingerprintConfig, error) {
+	err := cfg.CheckNyquist(sampleRate)
+	if err != nil {
+		cfg.MaxFreqHz = nyquistMargin * EffectiveSampleRate(sampleRate, cfg) / 2
 	}
+	return cfg, err
 }
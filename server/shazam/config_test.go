@@ -0,0 +1,206 @@
+package shazam
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProfilesValidate(t *testing.T) {
+	for name := range configProfiles {
+		cfg, err := ConfigByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestValidateRejectsBandsBeyondAddressBits(t *testing.T) {
+	cfg := DefaultMusicConfig()
+	// 511 bins of 10.8 Hz reach 5.5 kHz, bin 550 of 10 Hz
+	cfg.FreqBands[len(cfg.FreqBands)-1] = [2]int{160, 512}
+	err := cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "address field") {
+		t.Fatalf("Validate() = %v, want an address field error", err)
+	}
+
+	cfg.FreqBinHz = 11
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("with 11 Hz bins: %v", err)
+	}
+}
+
+func TestPeaksFitAddressBits(t *testing.T) {
+	// 48 kHz audio has finer bins than the decode rate Validate checks
+	for _, rate := range []int{44100, 48000} {
+		cfg := DefaultMusicConfig()
+		_, peaks, err := AnalyzeSamples(testAudio(1, rate, 5, 20000), rate, 1, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(peaks) == 0 {
+			t.Fatalf("%d Hz: no peaks", rate)
+		}
+		for _, p := range peaks {
+			if bin := int(p.Freq / cfg.freqBinHz()); bin >= 1<<maxFreqBits {
+				t.Fatalf("%d Hz: peak at %.0f Hz is address bin %d", rate, p.Freq, bin)
+			}
+		}
+	}
+}
+
+func TestAudiobookCutoffClampedBelowNyquist(t *testing.T) {
+	cfg := DefaultAudiobookConfig()
+	if cfg.MaxFreqHz != 3000 {
+		t.Fatalf("audiobook MaxFreqHz = %g, want 3000", cfg.MaxFreqHz)
+	}
+	clamped, err := cfg.ClampToNyquist(44100)
+	if err == nil {
+		t.Fatal("ClampToNyquist(44100) reported nothing to clamp")
+	}
+	if nyquist := EffectiveSampleRate(44100, cfg) / 2; clamped.MaxFreqHz >= nyquist {
+		t.Errorf("clamped MaxFreqHz %g is not below the %g Hz Nyquist", clamped.MaxFreqHz, nyquist)
+	}
+	if err := clamped.Validate(); err != nil {
+		t.Errorf("clamped config: %v", err)
+	}
+}
+
+func TestValidateRejectsBadChunking(t *testing.T) {
+	for name, mutate := range map[string]func(*FingerprintConfig){
+		"negative overlap":  func(c *FingerprintConfig) { c.ChunkOverlapSec = -1 },
+		"overlap too long":  func(c *FingerprintConfig) { c.ChunkDurationSec, c.ChunkOverlapSec = 10, 10 },
+		"window not pow2":   func(c *FingerprintConfig) { c.WindowSize = 1000 },
+		"no bands":          func(c *FingerprintConfig) { c.FreqBands = nil },
+		"negative chunking": func(c *FingerprintConfig) { c.ChunkDurationSec = -5 },
+	} {
+		cfg := DefaultAudiobookConfig()
+		mutate(&cfg)
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%s: Validate() accepted it", name)
+		}
+	}
+}
+
+func TestPlanChunks(t *testing.T) {
+	cfg := DefaultAudiobookConfig()
+	cfg.ChunkDurationSec, cfg.ChunkOverlapSec = 100, 10
+
+	chunks := planChunks(250, cfg)
+	want := []chunkSpan{{0, 100}, {90, 100}, {180, 70}}
+	if !reflect.DeepEqual(chunks, want) {
+		t.Fatalf("planChunks(250) = %v, want %v", chunks, want)
+	}
+	// the last chunk's overlap already reaches the end
+	if chunks := planChunks(190, cfg); len(chunks) != 2 || chunks[1] != (chunkSpan{90, 100}) {
+		t.Errorf("planChunks(190) = %v, want 2 chunks ending at 190", chunks)
+	}
+	cfg.ChunkDurationSec = 0
+	if chunks := planChunks(250, cfg); len(chunks) != 1 || chunks[0] != (chunkSpan{0, 250}) {
+		t.Errorf("unchunked planChunks(250) = %v, want the whole file", chunks)
+	}
+}
+
+func TestCheckResolution(t *testing.T) {
+	for name := range configProfiles {
+		cfg, _ := ConfigByName(name)
+		if err := cfg.CheckResolution(testRate); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name                        string
+		dspRatio, window, hop, rate int
+		want                        string
+	}{
+		{"extreme DSPRatio", 64, 2048, 2048, testRate, "frames at"},
+		{"tiny window", 1, 128, 64, testRate, "0.003s frames"},
+		{"sparse hops", 8, 2048, 8192, testRate, "apart"},
+		{"coarse bins", 1, 512, 256, testRate, "Hz frequency bins"},
+		{"low sample rate", 8, 2048, 2048, 8000, "2.048s frames at 8000 Hz"},
+	} {
+		cfg := DefaultAudiobookConfig()
+		cfg.DSPRatio, cfg.WindowSize, cfg.HopSize = tc.dspRatio, tc.window, tc.hop
+		if err := cfg.CheckResolution(tc.rate); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: %v, want an error mentioning %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestValidateBands(t *testing.T) {
+	for name, bands := range map[string][][2]int{
+		"empty band":       {{0, 10}, {10, 10}},
+		"negative start":   {{-5, 10}},
+		"reversed":         {{20, 10}},
+		"overlapping":      {{0, 20}, {10, 40}},
+		"out of order":     {{40, 80}, {0, 40}},
+		"beyond the frame": {{512, 600}, {600, 700}},
+	} {
+		cfg := DefaultMusicConfig()
+		cfg.WindowSize, cfg.FreqBands = 1024, bands
+		if err := cfg.validateBands(); err == nil {
+			t.Errorf("%s: %v accepted", name, bands)
+		}
+	}
+
+	cfg := DefaultMusicConfig()
+	cfg.WindowSize, cfg.FreqBands = 1024, [][2]int{{0, 10}, {10, 40}, {60, 120}}
+	if err := cfg.validateBands(); err != nil {
+		t.Errorf("sorted bands with a gap rejected: %v", err)
+	}
+}
+
+func TestCheckBands(t *testing.T) {
+	for name := range configProfiles {
+		cfg, _ := ConfigByName(name)
+		if err := cfg.CheckBands(); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	cfg := DefaultMusicConfig()
+	cfg.WindowSize, cfg.FreqBands = 1024, [][2]int{{0, 100}, {400, 600}}
+	if err := cfg.CheckBands(); err == nil || !strings.Contains(err.Error(), "cut short") {
+		t.Errorf("band past bin 512: %v, want it reported as cut short", err)
+	}
+	cfg.FreqBands = append(cfg.FreqBands, [2]int{600, 700})
+	if err := cfg.CheckBands(); err == nil || !strings.Contains(err.Error(), "[[600 700]]") || !strings.Contains(err.Error(), "skipped") {
+		t.Errorf("band beyond bin 512: %v, want it reported as skipped", err)
+	}
+}
+
+func TestCheckClipLength(t *testing.T) {
+	// one 2048-sample window and 7 more hops at 44100/8 Hz
+	cfg := DefaultAudiobookConfig()
+	if got, want := cfg.MinClipDuration(44100), 8*2048/5512.5; math.Abs(got-want) > 1e-9 {
+		t.Errorf("audiobook minimum %gs, want %gs", got, want)
+	}
+	overlap := AudiobookOverlapConfig()
+	if got, want := overlap.MinClipDuration(44100), (2048+7*1024)/5512.5; math.Abs(got-want) > 1e-9 {
+		t.Errorf("overlapping minimum %gs, want %gs", got, want)
+	}
+
+	minSec := cfg.MinClipDuration(44100)
+	if err := cfg.CheckClipLength(minSec, 44100); err != nil {
+		t.Errorf("a clip of exactly the minimum rejected: %v", err)
+	}
+	err := cfg.CheckClipLength(1, 44100)
+	if !errors.Is(err, ErrClipTooShort) || !strings.Contains(err.Error(), "1.0s of audio, at least 3.0s (8 frames)") {
+		t.Errorf("1s clip: %v", err)
+	}
+
+	cfg.MinClipFrames = 0
+	if cfg.MinClipDuration(44100) != 0 || cfg.CheckClipLength(0.1, 44100) != nil {
+		t.Error("MinClipFrames 0 still checks the length")
+	}
+	cfg.MinClipFrames = -1
+	if cfg.Validate() == nil {
+		t.Error("negative MinClipFrames accepted")
+	}
+}
@@ -1,35 +1,104 @@
 package shazam
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"math"
 	"os"
 	"runtime"
 	"song-recognition/models"
 	"song-recognition/utils"
 	"song-recognition/wav"
+	"sort"
 	"time"
 )
 
 const (
 	maxFreqBits  = 9
 	maxDeltaBits = 14
+
+	// directionBit is set in the delta field for pairs whose target comes
+	// before the anchor (SymmetricTargets); the magnitude then uses the
+	// remaining maxDeltaBits-1 bits.
+	directionBit = 1 << (maxDeltaBits - 1)
 )
 
+// wavHeaderSize is the size of the canonical header ffmpeg writes; chunk
+// files no bigger than it hold no audio.
+const wavHeaderSize = 44
+
 // Fingerprint generates fingerprints from a list of peaks.
 // each fingerprint is an (address -> couple) entry where the address
 // encodes a frequency pair + time delta, and the couple holds the
-// anchor time and song ID.
+// anchor time and song ID. with cfg.SymmetricTargets each anchor is also
+// paired with the peaks before it, so a clip that only overlaps the tail
+// of a phrase still produces addresses for it.
+//
+// the target zone is the next cfg.TargetZoneSize peaks, or, when
+// cfg.TargetZoneSec is set, every peak within that many seconds. the
+// latter keeps the zone the same length in dense and sparse passages.
+// peaks less than cfg.MinTargetDeltaMs from the anchor are never paired.
+// with cfg.AnchorStride above 1, only some peaks are anchors (see
+// isAnchor); every peak can still be a target.
 func Fingerprint(peaks []Peak, songID uint32, cfg FingerprintConfig) map[uint32]models.Couple {
 	fingerprints := map[uint32]models.Couple{}
 
+	maxDelta := maxPairDeltaSec(cfg)
+	binHz := cfg.freqBinHz()
+
+	minDelta := cfg.MinTargetDeltaMs / 1000
+
+	// inZone reports whether the n-th pairable peak away from an anchor,
+	// dt seconds from it, is in its target zone
+	inZone := func(n int, dt float64) bool {
+		if dt > maxDelta {
+			return false
+		}
+		if cfg.TargetZoneSec > 0 {
+			return dt <= cfg.TargetZoneSec
+		}
+		return n <= cfg.TargetZoneSize
+	}
+
 	for i, anchor := range peaks {
-		for j := i + 1; j < len(peaks) && j <= i+cfg.TargetZoneSize; j++ {
-			target := peaks[j]
-			address := createAddress(anchor, target)
-			fingerprints[address] = models.Couple{
-				AnchorTimeMs: uint32(anchor.Time * 1000),
-				SongID:       songID,
+		if !isAnchor(peaks, i, binHz, cfg.AnchorStride) {
+			continue
+		}
+		couple := models.Couple{
+			AnchorTimeMs: quantizeAnchorMs(anchor.Time, cfg.AnchorResolutionMs),
+			SongID:       songID,
+		}
+
+		// peaks are in time order, so the first target out of range ends
+		// the zone; pairing it would wrap the delta field and alias.
+		// targets closer than minDelta are skipped without counting
+		// towards TargetZoneSize
+		n := 0
+		for j := i + 1; j < len(peaks); j++ {
+			dt := peaks[j].Time - anchor.Time
+			if dt < minDelta {
+				continue
+			}
+			n++
+			if !inZone(n, dt) {
+				break
+			}
+			fingerprints[createAddress(anchor, peaks[j], binHz)] = couple
+		}
+
+		if cfg.SymmetricTargets {
+			n = 0
+			for j := i - 1; j >= 0; j-- {
+				dt := anchor.Time - peaks[j].Time
+				if dt < minDelta {
+					continue
+				}
+				n++
+				if !inZone(n, dt) {
+					break
+				}
+				fingerprints[createAddress(anchor, peaks[j], binHz)] = couple
 			}
 		}
 	}
@@ -37,46 +106,390 @@ func Fingerprint(peaks []Peak, songID uint32, cfg FingerprintConfig) map[uint32]
 	return fingerprints
 }
 
-func createAddress(anchor, target Peak) uint32 {
-	anchorFreqBin := uint32(anchor.Freq / 10)
-	targetFreqBin := uint32(target.Freq / 10)
-	deltaMsRaw := uint32((target.Time - anchor.Time) * 1000)
+// isAnchor reports whether peaks[i] is one of the roughly 1 in stride
+// peaks Fingerprint pairs as an anchor. the choice hashes the peak's
+// frequency bin together with the time since the peak before it, not
+// its index or absolute time: a clip starting mid-song has its peaks at
+// other indices and times than the song does, but the same peaks at the
+// same frequencies and spacing, so both pick the same anchors. the bin
+// alone would leave most bins without a single anchor, however much of
+// the audio is in them.
+func isAnchor(peaks []Peak, i int, binHz float64, stride int) bool {
+	if stride <= 1 {
+		return true
+	}
+	var gapMs uint32
+	if i > 0 {
+		gapMs = uint32(math.Round((peaks[i].Time - peaks[i-1].Time) * 1000))
+	}
+	h := uint32(peaks[i].Freq/binHz)*0x9e3779b1 ^ gapMs*0x85ebca6b
+	h ^= h >> 15
+	h *= 0x2c1b3c6d
+	h ^= h >> 12
+	return h%uint32(stride) == 0
+}
+
+// quantizeAnchorMs converts an anchor time to milliseconds, rounded to
+// the nearest multiple of resolutionMs when that is above 1. the sample
+// and the song are both rounded, so their offset is off by at most one
+// resolution step.
+func quantizeAnchorMs(sec float64, resolutionMs int) uint32 {
+	if resolutionMs <= 1 {
+		return uint32(sec * 1000)
+	}
+	res := float64(resolutionMs)
+	return uint32(math.Round(sec*1000/res) * res)
+}
+
+// maxPairDeltaSec is the largest anchor-target gap createAddress can
+// encode without truncation: ~16.4s, or ~8.2s when SymmetricTargets
+// shares the delta field with the direction bit.
+func maxPairDeltaSec(cfg FingerprintConfig) float64 {
+	maxMs := (1 << maxDeltaBits) - 1
+	if cfg.SymmetricTargets {
+		maxMs = directionBit - 1
+	}
+	return float64(maxMs) / 1000
+}
+
+// createAddress packs a peak pair into 32 bits: anchor and target
+// frequency bins of binHz each (maxFreqBits apiece) and the time delta.
+func createAddress(anchor, target Peak, binHz float64) uint32 {
+	anchorFreqBin := uint32(anchor.Freq / binHz)
+	targetFreqBin := uint32(target.Freq / binHz)
 
 	anchorFreqBits := anchorFreqBin & ((1 << maxFreqBits) - 1)
 	targetFreqBits := targetFreqBin & ((1 << maxFreqBits) - 1)
-	deltaBits := deltaMsRaw & ((1 << maxDeltaBits) - 1)
+
+	var deltaBits uint32
+	if target.Time < anchor.Time {
+		deltaMsRaw := uint32((anchor.Time - target.Time) * 1000)
+		deltaBits = directionBit | deltaMsRaw&(directionBit-1)
+	} else {
+		// forward pairs keep the full-width layout so existing indexes
+		// stay valid
+		deltaMsRaw := uint32((target.Time - anchor.Time) * 1000)
+		deltaBits = deltaMsRaw & ((1 << maxDeltaBits) - 1)
+	}
 
 	return (anchorFreqBits << 23) | (targetFreqBits << 14) | deltaBits
 }
 
-// FingerprintAudioChunked processes an audio file in bounded-memory
-// chunks using ffmpeg for segment extraction. each chunk is independently
-// converted to WAV, fingerprinted, and merged into the result map.
-// memory usage is proportional to chunkDurationSec, not total file length.
-func FingerprintAudioChunked(inputPath string, songID uint32, cfg FingerprintConfig) (map[uint32]models.Couple, error) {
-	duration, err := wav.GetAudioDuration(inputPath)
+// AnalyzeSamples runs the full in-memory pipeline (Spectrogram ->
+// ExtractPeaks -> Fingerprint) over mono samples without touching disk
+// or ffmpeg. peak and anchor times are relative to the first sample.
+func AnalyzeSamples(samples []float64, sampleRate int, songID uint32, cfg FingerprintConfig) (map[uint32]models.Couple, []Peak, error) {
+	return analyzeSamples(samples, sampleRate, songID, cfg, 0)
+}
+
+// Analysis describes how AnalyzeSamplesDetailed saw a clip, for
+// diagnostics such as /api/analyze.
+type Analysis struct {
+	Frames       int // spectrogram frames, after any silence was trimmed
+	Bins         int // frequency bins per frame
+	Peaks        []Peak
+	Fingerprints map[uint32]models.Couple
+}
+
+// AnalyzeSamplesDetailed is AnalyzeSamples (with songID 0), also
+// reporting the shape of the spectrogram the peaks were picked from.
+func AnalyzeSamplesDetailed(samples []float64, sampleRate int, cfg FingerprintConfig) (Analysis, error) {
+	var analysis Analysis
+	peaks, err := samplePeaksInto(samples, sampleRate, cfg, 0, &analysis)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get audio duration: %v", err)
+		return Analysis{}, err
+	}
+	analysis.Peaks = peaks
+	analysis.Fingerprints = map[uint32]models.Couple{}
+	if len(peaks) > 0 {
+		analysis.Fingerprints = Fingerprint(peaks, 0, cfg)
 	}
+	return analysis, nil
+}
 
-	log.Printf("[fingerprint] file duration: %.0fs (%.1f hours), chunk size: %.0fs",
-		duration, duration/3600, cfg.ChunkDurationSec)
+// analyzeSamples is AnalyzeSamples with every peak shifted by offsetSec,
+// so chunks of a longer file produce file-relative anchor times.
+func analyzeSamples(samples []float64, sampleRate int, songID uint32, cfg FingerprintConfig, offsetSec float64) (map[uint32]models.Couple, []Peak, error) {
+	peaks, err := samplePeaks(samples, sampleRate, cfg, offsetSec)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(peaks) == 0 {
+		return map[uint32]models.Couple{}, nil, nil
+	}
+	return Fingerprint(peaks, songID, cfg), peaks, nil
+}
 
-	fingerprints := make(map[uint32]models.Couple)
+// analyzeChunk is analyzeSamples plus, for each speed in
+// cfg.SpeedScales, the fingerprints the samples would give if they were
+// played that much faster: frames are taken HopSize*speed samples apart
+// and peak times are divided by speed. the scaled addresses are XORed
+// with a per-speed tag, since most of them equal unscaled addresses and
+// would otherwise displace them; SampleFingerprint applies the same tags
+// to a clip's addresses when matching. the returned peaks are the
+// unscaled ones.
+func analyzeChunk(samples []float64, sampleRate int, songID uint32, cfg FingerprintConfig, offsetSec float64) (map[uint32]models.Couple, []Peak, error) {
+	fingerprints, peaks, err := analyzeSamples(samples, sampleRate, songID, cfg, offsetSec)
+	if err != nil || len(peaks) == 0 {
+		return fingerprints, peaks, err
+	}
+
+	for _, speed := range cfg.SpeedScales {
+		scaled := cfg
+		scaled.HopSize = max(1, int(math.Round(float64(cfg.HopSize)*speed)))
+		scaledPeaks, err := samplePeaks(samples, sampleRate, scaled, offsetSec)
+		if err != nil {
+			return nil, nil, fmt.Errorf("analysis at %gx speed failed: %v", speed, err)
+		}
+		for i := range scaledPeaks {
+			scaledPeaks[i].Time /= speed
+		}
+		tag := speedTag(speed)
+		for address, couple := range Fingerprint(scaledPeaks, songID, cfg) {
+			fingerprints[address^tag] = couple
+		}
+	}
+	return fingerprints, peaks, nil
+}
+
+// speedTag spreads a speed scale over the address bits; distinct speeds
+// (to 0.001) get distinct tags.
+func speedTag(speed float64) uint32 {
+	return uint32(math.Round(speed*1000)) * 0x9e3779b1
+}
+
+// SampleFingerprint turns a clip's fingerprints into the address -> anchor
+// time map FindMatchesFGP takes. with cfg.SpeedScales every address is
+// also added under each speed's tag, so a clip that was played faster
+// finds the song's fingerprints from analyzeChunk's scaled passes.
+func SampleFingerprint(fingerprint map[uint32]models.Couple, cfg FingerprintConfig) map[uint32]uint32 {
+	sample := make(map[uint32]uint32, len(fingerprint)*(1+len(cfg.SpeedScales)))
+	for address, couple := range fingerprint {
+		sample[address] = couple.AnchorTimeMs
+	}
+	for _, speed := range cfg.SpeedScales {
+		tag := speedTag(speed)
+		for address, couple := range fingerprint {
+			if _, taken := sample[address^tag]; !taken {
+				sample[address^tag] = couple.AnchorTimeMs
+			}
+		}
+	}
+	return sample
+}
+
+// samplePeaks runs Spectrogram and ExtractPeaks over samples and shifts
+// the peaks by offsetSec. silent input yields no peaks.
+func samplePeaks(samples []float64, sampleRate int, cfg FingerprintConfig, offsetSec float64) ([]Peak, error) {
+	return samplePeaksInto(samples, sampleRate, cfg, offsetSec, nil)
+}
+
+// samplePeaksInto is samplePeaks, recording the spectrogram's shape in
+// analysis unless it is nil.
+func samplePeaksInto(samples []float64, sampleRate int, cfg FingerprintConfig, offsetSec float64, analysis *Analysis) ([]Peak, error) {
+	if sampleRate <= 0 {
+		return nil, fmt.Errorf("invalid sample rate %d", sampleRate)
+	}
+
+	if silent, _ := IsSilent(samples, cfg); silent {
+		return nil, nil
+	}
+
+	if cfg.TrimSilence {
+		lead, trimmed := trimSilence(samples, cfg)
+		if len(trimmed) < len(samples) {
+			utils.Debugf("[analyze] trimmed %.2fs of leading and %.2fs of trailing silence",
+				float64(lead)/float64(sampleRate), float64(len(samples)-lead-len(trimmed))/float64(sampleRate))
+		}
+		samples = trimmed
+		offsetSec += float64(lead) / float64(sampleRate)
+	}
+
+	if clamped, err := cfg.ClampToNyquist(sampleRate); err != nil {
+		utils.Debugf("[analyze] %v; using %.0f Hz", err, clamped.MaxFreqHz)
+		cfg = clamped
+	}
+
+	spectro, err := Spectrogram(samples, sampleRate, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("spectrogram failed: %v", err)
+	}
+	if analysis != nil && len(spectro) > 0 {
+		analysis.Frames, analysis.Bins = len(spectro), len(spectro[0])
+	}
+
+	peaks := ExtractPeaks(spectro, sampleRate, cfg)
+	// Validate checks this at the decode rate; audio at other rates
+	// (e.g. live streams) gets finer bins that may reach further
+	if err := cfg.CheckFreqBits(sampleRate); err != nil {
+		n := len(peaks)
+		peaks = addressablePeaks(peaks, cfg)
+		utils.Debugf("[analyze] %v; dropped %d of %d peaks", err, n-len(peaks), n)
+	}
+	if cfg.MergePeaksSec > 0 || cfg.MergePeaksHz > 0 {
+		n := len(peaks)
+		peaks = mergePeaks(peaks, cfg.MergePeaksSec, cfg.MergePeaksHz)
+		utils.Debugf("[analyze] merged %d of %d peaks into stronger neighbours", n-len(peaks), n)
+	}
+	if cfg.MaxPeaksPerChunk > 0 && len(peaks) > cfg.MaxPeaksPerChunk {
+		utils.Debugf("[analyze] keeping the %d strongest of %d peaks", cfg.MaxPeaksPerChunk, len(peaks))
+		peaks = strongestPeaks(peaks, cfg.MaxPeaksPerChunk)
+	}
+
+	for i := range peaks {
+		peaks[i].Time += offsetSec
+	}
+
+	return peaks, nil
+}
+
+// addressablePeaks drops, in place, the peaks whose frequency bin doesn't
+// fit the address field.
+func addressablePeaks(peaks []Peak, cfg FingerprintConfig) []Peak {
+	kept := peaks[:0]
+	for _, p := range peaks {
+		if int(p.Freq/cfg.freqBinHz()) < 1<<maxFreqBits {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// strongestPeaks returns the n peaks with the highest magnitude, still in
+// time order. peaks is reordered in the process.
+func strongestPeaks(peaks []Peak, n int) []Peak {
+	if len(peaks) <= n {
+		return peaks
+	}
+
+	sort.SliceStable(peaks, func(i, j int) bool { return peaks[i].Mag > peaks[j].Mag })
+	kept := peaks[:n]
+	sort.SliceStable(kept, func(i, j int) bool {
+		if kept[i].Time != kept[j].Time {
+			return kept[i].Time < kept[j].Time
+		}
+		return kept[i].Freq < kept[j].Freq
+	})
+	return kept
+}
+
+// mergePeaks collapses peaks that lie within toleranceSec of each other
+// in time and toleranceHz in frequency, keeping the strongest. peaks must
+// be in time order, as ExtractPeaks returns them, and the result is too.
+// the strongest peak is kept first and absorbs its neighbours, then the
+// strongest of those left, and so on, so a chain of close peaks doesn't
+// collapse further than the tolerance reaches from each peak kept.
+func mergePeaks(peaks []Peak, toleranceSec, toleranceHz float64) []Peak {
+	order := make([]int, len(peaks))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return peaks[order[a]].Mag > peaks[order[b]].Mag })
+
+	const (
+		pending = iota
+		kept
+		merged
+	)
+	state := make([]int, len(peaks))
+	for _, i := range order {
+		if state[i] != pending {
+			continue
+		}
+		state[i] = kept
+		// peaks are in time order, so the candidates are the run of
+		// neighbours on either side within toleranceSec
+		lo, hi := i, i
+		for lo > 0 && peaks[i].Time-peaks[lo-1].Time <= toleranceSec {
+			lo--
+		}
+		for hi < len(peaks)-1 && peaks[hi+1].Time-peaks[i].Time <= toleranceSec {
+			hi++
+		}
+		for j := lo; j <= hi; j++ {
+			if state[j] == pending && math.Abs(peaks[j].Freq-peaks[i].Freq) <= toleranceHz {
+				state[j] = merged
+			}
+		}
+	}
 
+	result := peaks[:0]
+	for i, p := range peaks {
+		if state[i] == kept {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// IsSilent reports whether samples are quiet enough (RMS below
+// cfg.SilenceRMS) that fingerprinting them would yield nothing useful.
+// the measured RMS is returned for logging.
+func IsSilent(samples []float64, cfg FingerprintConfig) (bool, float64) {
+	if len(samples) == 0 {
+		return true, 0
+	}
+
+	var sumSquares float64
+	for _, s := range samples {
+		sumSquares += s * s
+	}
+	rms := math.Sqrt(sumSquares / float64(len(samples)))
+	return rms < cfg.SilenceRMS, rms
+}
+
+// trimSilence drops the leading and trailing blocks of samples whose RMS
+// is below cfg.SilenceRMS, returning how many samples were cut from the
+// front along with what is left. blocks are one hop at the input rate,
+// so the frames of the trimmed audio fall on the same grid as those of
+// the original and anchor times only need shifting by the cut.
+func trimSilence(samples []float64, cfg FingerprintConfig) (int, []float64) {
+	block := cfg.HopSize * cfg.DSPRatio
+	if block < 1 {
+		return 0, samples
+	}
+
+	quiet := func(from, to int) bool {
+		silent, _ := IsSilent(samples[max(from, 0):min(to, len(samples))], cfg)
+		return silent
+	}
+
+	start := 0
+	for start < len(samples) && quiet(start, start+block) {
+		start += block
+	}
+	if start >= len(samples) {
+		return 0, samples[:0]
+	}
+
+	end := len(samples)
+	for end-block > start && quiet(end-block, end) {
+		end -= block
+	}
+	return start, samples[start:end]
+}
+
+// chunkSpan is one [Start, Start+Duration) segment of a file, in seconds.
+type chunkSpan struct {
+	Start    float64
+	Duration float64
+}
+
+// planChunks splits a file of the given duration into chunks of
+// cfg.ChunkDurationSec that overlap by cfg.ChunkOverlapSec. the overlap
+// avoids losing peak pairs that straddle chunk boundaries.
+func planChunks(duration float64, cfg FingerprintConfig) []chunkSpan {
 	chunkDur := cfg.ChunkDurationSec
 	if chunkDur <= 0 {
 		chunkDur = duration
 	}
 
-	// small overlap avoids losing peak pairs that straddle chunk boundaries
-	overlap := 5.0
-	step := chunkDur - overlap
+	step := chunkDur - cfg.ChunkOverlapSec
 	if step <= 0 {
 		step = chunkDur
 	}
 
-	chunkIdx := 0
+	var chunks []chunkSpan
 	for start := 0.0; start < duration; start += step {
 		dur := chunkDur
 		if start+dur > duration {
@@ -85,53 +498,285 @@ func FingerprintAudioChunked(inputPath string, songID uint32, cfg FingerprintCon
 		if dur <= 0 {
 			break
 		}
+		chunks = append(chunks, chunkSpan{Start: start, Duration: dur})
+
+		// the remainder is already covered by this chunk's overlap
+		if start+dur >= duration {
+			break
+		}
+	}
+	return chunks
+}
+
+// ChunkReport summarises a FingerprintAudioChunked run.
+type ChunkReport struct {
+	DurationSec  float64 // length of the input file
+	Chunks       int     // chunks planned
+	SilentChunks int     // chunks skipped as silence
+	ShortChunks  int     // chunks skipped for holding less than one analysis window
+	FailedChunks int     // chunks skipped after an error (ContinueOnChunkError)
+}
+
+// ChunkSink receives the fingerprints of each chunk as
+// FingerprintAudioStream produces them, in file order, along with the
+// chunk's peaks at file-relative times. an address can come up again in
+// later chunks, and peaks in the overlap with the previous chunk are
+// repeated. returning an error stops the run.
+type ChunkSink func(fingerprints map[uint32]models.Couple, peaks []Peak) error
+
+// FingerprintAudioChunked fingerprints an audio file with
+// FingerprintAudioStream and merges the chunks into one map, keeping the
+// latest anchor of an address that occurs in several chunks.
+func FingerprintAudioChunked(ctx context.Context, inputPath string, songID uint32, cfg FingerprintConfig) (map[uint32]models.Couple, ChunkReport, error) {
+	fingerprints := make(map[uint32]models.Couple)
+	_, report, err := FingerprintAudioStream(ctx, inputPath, songID, cfg, func(chunkFP map[uint32]models.Couple, _ []Peak) error {
+		utils.ExtendMap(fingerprints, chunkFP)
+		return nil
+	})
+	if err != nil {
+		return nil, report, err
+	}
+	return fingerprints, report, nil
+}
+
+// FingerprintAudioStream processes an audio file in bounded-memory
+// chunks using ffmpeg for segment extraction. each chunk is independently
+// converted to WAV, fingerprinted, and handed to sink, so memory usage is
+// proportional to chunkDurationSec, not total file length. it returns how
+// many fingerprints sink was given.
+// ctx is checked between chunks and kills a running ffmpeg when cancelled.
+// with cfg.ContinueOnChunkError, failed chunks are counted in the report
+// and skipped; the run only fails if no chunk succeeds.
+func FingerprintAudioStream(ctx context.Context, inputPath string, songID uint32, cfg FingerprintConfig, sink ChunkSink) (int, ChunkReport, error) {
+	var report ChunkReport
+
+	if err := cfg.Validate(); err != nil {
+		return 0, report, fmt.Errorf("invalid fingerprint config: %v", err)
+	}
+
+	duration, err := wav.GetAudioDuration(ctx, inputPath)
+	if err != nil {
+		return 0, report, fmt.Errorf("failed to get audio duration: %w", err)
+	}
+	report.DurationSec = duration
+
+	utils.InfofCtx(ctx, "[fingerprint] file duration: %.0fs (%.1f hours), chunk size: %.0fs",
+		duration, duration/3600, cfg.ChunkDurationSec)
+	utils.DebugfCtx(ctx, "[fingerprint] expecting at most ~%d fingerprints", EstimateFingerprintCount(duration, cfg))
+
+	total := 0
+
+	chunks := planChunks(duration, cfg)
+	report.Chunks = len(chunks)
+
+	// chunkFailed applies ContinueOnChunkError: it returns err if the run
+	// should stop, or nil after recording the chunk as skipped
+	var lastChunkErr error
+	chunkFailed := func(idx int, err error) error {
+		if !cfg.ContinueOnChunkError {
+			return err
+		}
+		utils.WarnfCtx(ctx, "[chunk %d] skipped: %v", idx, err)
+		report.FailedChunks++
+		lastChunkErr = err
+		return nil
+	}
+
+	// chunk files are removed as soon as they are read; this catches the
+	// ones left behind by an early return or a panic
+	var temps wav.TempFiles
+	defer temps.Cleanup()
+
+	chunkIdx := 0
+	for _, chunk := range chunks {
+		if err := ctx.Err(); err != nil {
+			return 0, report, fmt.Errorf("fingerprinting cancelled after %d of %d chunks: %w", chunkIdx, len(chunks), err)
+		}
+
+		start, dur := chunk.Start, chunk.Duration
 
 		chunkStart := time.Now()
-		log.Printf("[chunk %d] extracting %.0fs - %.0fs", chunkIdx, start, start+dur)
+		utils.DebugfCtx(ctx, "[chunk %d] extracting %.0fs - %.0fs", chunkIdx, start, start+dur)
 
-		chunkPath, err := wav.ExtractChunkAsWAV(inputPath, start, dur)
+		chunkPath, err := wav.ExtractChunkAsWAV(ctx, inputPath, start, dur)
 		if err != nil {
-			return nil, fmt.Errorf("chunk extraction at %.0fs failed: %v", start, err)
+			if ctx.Err() != nil {
+				return 0, report, fmt.Errorf("fingerprinting cancelled during chunk %d: %w", chunkIdx, ctx.Err())
+			}
+			if err := chunkFailed(chunkIdx, fmt.Errorf("chunk extraction at %.0fs failed: %w", start, err)); err != nil {
+				return 0, report, err
+			}
+			chunkIdx++
+			continue
+		}
+		temps.Add(chunkPath)
+
+		// ffmpeg writes a bare header (or nothing) when asked for a
+		// chunk starting at or past the real end of the stream
+		if stat, err := os.Stat(chunkPath); err == nil && stat.Size() <= wavHeaderSize {
+			utils.DebugfCtx(ctx, "[chunk %d] empty chunk at %.0fs skipped", chunkIdx, start)
+			temps.Remove(chunkPath)
+			report.ShortChunks++
+			chunkIdx++
+			continue
 		}
 
 		wavInfo, err := wav.ReadWavInfo(chunkPath)
-		os.Remove(chunkPath)
+		temps.Remove(chunkPath)
 		if err != nil {
-			return nil, fmt.Errorf("reading chunk wav at %.0fs failed: %v", start, err)
+			if err := chunkFailed(chunkIdx, fmt.Errorf("reading chunk wav at %.0fs failed: %v", start, err)); err != nil {
+				return 0, report, err
+			}
+			chunkIdx++
+			continue
 		}
 
-		spectro, err := Spectrogram(wavInfo.LeftChannelSamples, wavInfo.SampleRate, cfg)
-		if err != nil {
-			return nil, fmt.Errorf("spectrogram at %.0fs failed: %v", start, err)
+		samples := wavInfo.MonoSamples()
+		if n := len(samples); n == 0 || (!cfg.PadFinalFrame && n < cfg.WindowSize*cfg.DSPRatio) {
+			utils.DebugfCtx(ctx, "[chunk %d] %d samples at %.0fs is less than one window, skipped", chunkIdx, n, start)
+			report.ShortChunks++
+			wavInfo = nil
+			chunkIdx++
+			continue
 		}
 
-		peaks := ExtractPeaks(spectro, wavInfo.Duration, wavInfo.SampleRate, cfg)
+		if silent, rms := IsSilent(samples, cfg); silent {
+			utils.DebugfCtx(ctx, "[chunk %d] silent chunk skipped (rms %.5f)", chunkIdx, rms)
+			report.SilentChunks++
+			wavInfo = nil
+			chunkIdx++
+			continue
+		}
 
 		// offset peak times so they reflect position in the full file
-		for i := range peaks {
-			peaks[i].Time += start
+		chunkFP, peaks, err := analyzeChunk(samples, wavInfo.SampleRate, songID, cfg, start)
+		if err != nil {
+			return 0, report, fmt.Errorf("analysis at %.0fs failed: %v", start, err)
 		}
+		if err := sink(chunkFP, peaks); err != nil {
+			return 0, report, fmt.Errorf("chunk at %.0fs: %w", start, err)
+		}
+		total += len(chunkFP)
 
-		chunkFP := Fingerprint(peaks, songID, cfg)
-		utils.ExtendMap(fingerprints, chunkFP)
-
-		log.Printf("[chunk %d] %d peaks, %d fingerprints, took %s",
+		utils.DebugfCtx(ctx, "[chunk %d] %d peaks, %d fingerprints, took %s",
 			chunkIdx, len(peaks), len(chunkFP), time.Since(chunkStart))
 
 		// release chunk memory before next iteration
 		wavInfo = nil
-		spectro = nil
 		runtime.GC()
 
 		chunkIdx++
 	}
 
-	log.Printf("[fingerprint] total: %d fingerprints from %d chunks", len(fingerprints), chunkIdx)
-	return fingerprints, nil
+	if report.FailedChunks > 0 && report.FailedChunks == report.Chunks {
+		return 0, report, fmt.Errorf("all %d chunks failed, last error: %w", report.Chunks, lastChunkErr)
+	}
+
+	utils.InfofCtx(ctx, "[fingerprint] total: %d fingerprints from %d chunks", total, chunkIdx)
+	return total, report, nil
+}
+
+// ShiftFingerprints moves every anchor in fingerprints offsetSec later,
+// e.g. to store a file after audio already indexed under the same song.
+// the offset is rounded like the anchors themselves, so shifted anchors
+// stay on the AnchorResolutionMs grid.
+func ShiftFingerprints(fingerprints map[uint32]models.Couple, offsetSec float64, cfg FingerprintConfig) {
+	offsetMs := quantizeAnchorMs(offsetSec, cfg.AnchorResolutionMs)
+	for address, couple := range fingerprints {
+		couple.AnchorTimeMs += offsetMs
+		fingerprints[address] = couple
+	}
+}
+
+// EstimateFingerprintCount predicts how many fingerprints durationSec of
+// audio decoded at wav.DecodeSampleRate yields under cfg, without touching
+// the audio. it assumes every frame has the most peaks ExtractPeaks allows
+// (one per band but the weakest) and that no two pairs share an address,
+// so real runs land at or somewhat below it; treat it as an upper-ish bound
+// for sizing, not a prediction.
+func EstimateFingerprintCount(durationSec float64, cfg FingerprintConfig) int {
+	if durationSec <= 0 || cfg.HopSize < 1 || cfg.DSPRatio < 1 {
+		return 0
+	}
+
+	framesPerSec := EffectiveSampleRate(wav.DecodeSampleRate, cfg) / float64(cfg.HopSize)
+	// a peak has to beat the frame's average band maximum, which at
+	// least one band can't
+	peaksPerFrame := float64(max(len(cfg.FreqBands)-1, 1))
+	peaksPerSec := framesPerSec * peaksPerFrame
+	if cfg.MaxPeaksPerChunk > 0 && cfg.ChunkDurationSec > 0 {
+		peaksPerSec = min(peaksPerSec, float64(cfg.MaxPeaksPerChunk)/cfg.ChunkDurationSec)
+	}
+
+	targetsPerPeak := float64(cfg.TargetZoneSize)
+	if cfg.TargetZoneSec > 0 {
+		targetsPerPeak = peaksPerSec * (cfg.TargetZoneSec - cfg.MinTargetDeltaMs/1000)
+	}
+	if cfg.SymmetricTargets {
+		targetsPerPeak *= 2
+	}
+
+	if cfg.AnchorStride > 1 {
+		targetsPerPeak /= float64(cfg.AnchorStride)
+	}
+
+	// each speed scale analyses frames HopSize*speed samples apart
+	passes := 1.0
+	for _, speed := range cfg.SpeedScales {
+		passes += 1 / speed
+	}
+
+	return int(durationSec * peaksPerSec * targetsPerPeak * passes)
+}
+
+// ErrSparseFingerprints is wrapped by CheckDensity's error.
+var ErrSparseFingerprints = errors.New("too few fingerprints")
+
+// CheckDensity returns an error wrapping ErrSparseFingerprints when count
+// fingerprints over durationSec of audio fall below
+// cfg.MinFingerprintsPerSec, which usually means a near-silent or heavily
+// degraded recording that will never match reliably.
+func CheckDensity(count int, durationSec float64, cfg FingerprintConfig) error {
+	if cfg.MinFingerprintsPerSec <= 0 || durationSec <= 0 {
+		return nil
+	}
+	perSec := float64(count) / durationSec
+	if perSec >= cfg.MinFingerprintsPerSec {
+		return nil
+	}
+	return fmt.Errorf("%w: %.1f per second (minimum %g); the recording may be too quiet or degraded to match",
+		ErrSparseFingerprints, perSec, cfg.MinFingerprintsPerSec)
+}
+
+// ErrClipTooShort is wrapped by CheckClipLength's error.
+var ErrClipTooShort = errors.New("clip too short")
+
+// MinClipDuration is the length in seconds of the shortest clip, decoded
+// at sampleRate, that spans cfg.MinClipFrames frames: one window plus a
+// hop for every further frame. it is 0 when the check is disabled.
+func (cfg FingerprintConfig) MinClipDuration(sampleRate int) float64 {
+	if cfg.MinClipFrames <= 0 {
+		return 0
+	}
+	samples := cfg.WindowSize + (cfg.MinClipFrames-1)*cfg.HopSize
+	return float64(samples) / EffectiveSampleRate(sampleRate, cfg)
+}
+
+// CheckClipLength returns an error wrapping ErrClipTooShort when
+// durationSec of audio at sampleRate is shorter than MinClipDuration,
+// i.e. too short to be worth matching.
+func (cfg FingerprintConfig) CheckClipLength(durationSec float64, sampleRate int) error {
+	minSec := cfg.MinClipDuration(sampleRate)
+	if durationSec >= minSec {
+		return nil
+	}
+	return fmt.Errorf("%w: %.1fs of audio, at least %.1fs (%d frames) is needed to match reliably",
+		ErrClipTooShort, durationSec, minSec, cfg.MinClipFrames)
 }
 
 // FingerprintAudio is a convenience wrapper that processes the entire
 // file using the default music config. kept for backward compatibility.
 func FingerprintAudio(songFilePath string, songID uint32) (map[uint32]models.Couple, error) {
-	return FingerprintAudioChunked(songFilePath, songID, DefaultMusicConfig())
+	fingerprints, _, err := FingerprintAudioChunked(context.Background(), songFilePath, songID, DefaultMusicConfig())
+	return fingerprints, err
 }
@@ -0,0 +1,885 @@
+package shazam
+
+import (
+	"context"
+	"errors"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"song-recognition/db"
+	"song-recognition/models"
+	"song-recognition/utils"
+	"song-recognition/wav"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnalyzeSamplesDetailedMatchesAnalyzeSamples(t *testing.T) {
+	cfg := DefaultMusicConfig()
+	cfg.TrimSilence = true
+	cfg.MaxPeaksPerChunk = 40
+	cfg.MergePeaksSec = 0.05
+
+	// a second of silence on either side, which TrimSilence drops
+	audio := testAudio(3, testRate, 4, 3000)
+	samples := make([]float64, testRate, 6*testRate)
+	samples = append(samples, audio...)
+	samples = append(samples, make([]float64, testRate)...)
+
+	fps, peaks, err := AnalyzeSamples(samples, testRate, 0, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	analysis, err := AnalyzeSamplesDetailed(samples, testRate, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(analysis.Peaks, peaks) {
+		t.Errorf("detailed analysis found %d peaks, AnalyzeSamples %d", len(analysis.Peaks), len(peaks))
+	}
+	if !reflect.DeepEqual(analysis.Fingerprints, fps) {
+		t.Errorf("detailed analysis made %d fingerprints, AnalyzeSamples %d", len(analysis.Fingerprints), len(fps))
+	}
+	if len(peaks) > cfg.MaxPeaksPerChunk {
+		t.Errorf("%d peaks kept, more than MaxPeaksPerChunk", len(peaks))
+	}
+
+	// frames only cover the audio between the silences
+	frameSec := FrameDuration(testRate, cfg)
+	if full := int(6 / frameSec); analysis.Frames >= full*3/4 {
+		t.Errorf("%d frames for 4s of sound in 6s of samples; silence wasn't trimmed", analysis.Frames)
+	}
+	if want := cfg.WindowSize / 2; analysis.Bins != want {
+		t.Errorf("Bins = %d, want %d", analysis.Bins, want)
+	}
+}
+
+// BenchmarkFingerprintAudioChunked goes through ffmpeg like indexing a
+// file does, so it is skipped where ffmpeg isn't installed.
+func BenchmarkFingerprintAudioChunked(b *testing.B) {
+	if _, err := exec.LookPath(wav.FFmpegPath); err != nil {
+		b.Skipf("%s not found (set FFMPEG_PATH)", wav.FFmpegPath)
+	}
+	path := writeTestWav(b, 1, benchAudioSec)
+	benchProfiles(b, func(b *testing.B, cfg FingerprintConfig) {
+		for i := 0; i < b.N; i++ {
+			if _, _, err := FingerprintAudioChunked(context.Background(), path, 1, cfg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestAnchorStrideSpreadsOverBins(t *testing.T) {
+	cfg := DefaultMusicConfig()
+	_, peaks, err := AnalyzeSamples(testAudio(1, testRate, testSongSec, 3000), testRate, 0, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const stride = 4
+	binHz := cfg.freqBinHz()
+	perBin := map[uint32]int{}
+	anchoredBins := map[uint32]bool{}
+	anchors := 0
+	for i, p := range peaks {
+		bin := uint32(p.Freq / binHz)
+		perBin[bin]++
+		if isAnchor(peaks, i, binHz, stride) {
+			anchors++
+			anchoredBins[bin] = true
+		}
+	}
+
+	if share := float64(anchors) / float64(len(peaks)); share < 0.15 || share > 0.35 {
+		t.Errorf("%d of %d peaks are anchors, want about 1 in %d", anchors, len(peaks), stride)
+	}
+	// a bin with this many peaks has almost no chance of missing out
+	// unless the choice ignores everything but the bin
+	busy, covered := 0, 0
+	for bin, n := range perBin {
+		if n >= 4*stride {
+			busy++
+			if anchoredBins[bin] {
+				covered++
+			}
+		}
+	}
+	if busy == 0 || float64(covered) < 0.9*float64(busy) {
+		t.Errorf("only %d of %d busy frequency bins have an anchor", covered, busy)
+	}
+}
+
+func TestAnchorStrideClipMatches(t *testing.T) {
+	cfg := DefaultMusicConfig()
+	cfg.AnchorStride = 4
+	client := db.NewMemoryClient()
+	indexTestSongs(t, client, cfg, 3)
+
+	matches, _, err := FindMatchesFGP(client, testClip(t, 1, 7.3, 5, cfg), nil, 1, MatchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) == 0 || matches[0].SongTitle != "song 1" {
+		t.Fatalf("clip of song 1 matched %+v", matches)
+	}
+	if off := matches[0].OffsetMs; off < 7200 || off > 7400 {
+		t.Errorf("offset %dms, want about 7300", off)
+	}
+}
+
+func TestAnalyzeSamples(t *testing.T) {
+	cfg := DefaultAudiobookConfig()
+	samples := testAudio(3, testRate, 10, 3000)
+	fps, peaks, err := AnalyzeSamples(samples, testRate, 42, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fps) == 0 || len(peaks) == 0 {
+		t.Fatalf("%d fingerprints and %d peaks from 10s of audio", len(fps), len(peaks))
+	}
+	for _, couple := range fps {
+		if couple.SongID != 42 || couple.AnchorTimeMs > 10000 {
+			t.Fatalf("couple %+v: want song 42 and an anchor within the 10s", couple)
+		}
+	}
+	for _, p := range peaks {
+		if p.Time < 0 || p.Time > 10 {
+			t.Fatalf("peak at %gs, outside the samples", p.Time)
+		}
+	}
+
+	again, _, err := AnalyzeSamples(samples, testRate, 42, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fps, again) {
+		t.Error("analyzing the same samples twice gave different fingerprints")
+	}
+}
+
+func TestFingerprintAudioChunkedStopsWhenCancelled(t *testing.T) {
+	// an ffprobe that would take far longer than the test
+	stub := filepath.Join(t.TempDir(), "ffprobe")
+	if err := os.WriteFile(stub, []byte("#!/bin/sh\nexec sleep 30\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(path string) { wav.FFprobePath = path }(wav.FFprobePath)
+	wav.FFprobePath = stub
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err := FingerprintAudioChunked(ctx, "song.mp3", 1, DefaultAudiobookConfig())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want the request's deadline", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("took %s to give up", elapsed)
+	}
+}
+
+func TestSilentSamplesSkipSpectrogram(t *testing.T) {
+	cfg := DefaultMusicConfig()
+	silence := make([]float64, 3*testRate)
+	for i := range silence {
+		silence[i] = 1e-5 * math.Sin(float64(i)) // hiss well under SilenceRMS
+	}
+	if silent, rms := IsSilent(silence, cfg); !silent {
+		t.Fatalf("rms %g not detected as silence under %g", rms, cfg.SilenceRMS)
+	}
+	analysis, err := AnalyzeSamplesDetailed(silence, testRate, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if analysis.Frames != 0 || len(analysis.Peaks) != 0 || len(analysis.Fingerprints) != 0 {
+		t.Errorf("silence analysed into %d frames, %d peaks and %d fingerprints; want the spectrogram skipped",
+			analysis.Frames, len(analysis.Peaks), len(analysis.Fingerprints))
+	}
+
+	// a threshold of 0 turns the check off
+	cfg.SilenceRMS = 0
+	if silent, _ := IsSilent(silence, cfg); silent {
+		t.Error("IsSilent with SilenceRMS 0 reported silence")
+	}
+	if analysis, _ := AnalyzeSamplesDetailed(silence, testRate, cfg); analysis.Frames == 0 {
+		t.Error("spectrogram skipped with the silence check disabled")
+	}
+}
+
+func TestFingerprintAudioChunkedSkipsSilentChunks(t *testing.T) {
+	if _, err := exec.LookPath(wav.FFmpegPath); err != nil {
+		t.Skipf("%s not found (set FFMPEG_PATH)", wav.FFmpegPath)
+	}
+	cfg := DefaultMusicConfig()
+	cfg.ChunkDurationSec, cfg.ChunkOverlapSec = 10, 0
+
+	// 10s of silence, then 10s of sound
+	samples := make([]float64, 10*testRate, 20*testRate)
+	samples = append(samples, testAudio(4, testRate, 10, 3000)...)
+	path := filepath.Join(t.TempDir(), "gap.wav")
+	if err := wav.WriteWav(path, samples, testRate, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	fps, report, err := FingerprintAudioChunked(context.Background(), path, 1, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Chunks != 2 || report.SilentChunks != 1 {
+		t.Errorf("report = %+v, want 2 chunks with 1 silent", report)
+	}
+	if len(fps) == 0 {
+		t.Fatal("no fingerprints from the chunk with sound")
+	}
+	for _, couple := range fps {
+		if couple.AnchorTimeMs < 10000 {
+			t.Fatalf("anchor at %dms, inside the silent chunk", couple.AnchorTimeMs)
+		}
+	}
+}
+
+func TestContinueOnChunkError(t *testing.T) {
+	ffmpeg, err := exec.LookPath(wav.FFmpegPath)
+	if err != nil {
+		t.Skipf("%s not found (set FFMPEG_PATH)", wav.FFmpegPath)
+	}
+	// an ffmpeg that can't extract the chunk starting at 10s
+	stub := filepath.Join(t.TempDir(), "ffmpeg")
+	script := "#!/bin/sh\ncase \" $* \" in *\" -ss 10.000 \"*) echo 'corrupt frame' >&2; exit 1;; esac\nexec " + ffmpeg + " \"$@\"\n"
+	if err := os.WriteFile(stub, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(path string) { wav.FFmpegPath = path }(wav.FFmpegPath)
+	wav.FFmpegPath = stub
+
+	path := writeTestWav(t, 5, 30)
+	cfg := DefaultMusicConfig()
+	cfg.ChunkDurationSec, cfg.ChunkOverlapSec = 10, 0
+
+	if _, _, err := FingerprintAudioChunked(context.Background(), path, 1, cfg); err == nil {
+		t.Fatal("a failed chunk didn't fail the file by default")
+	}
+
+	cfg.ContinueOnChunkError = true
+	fps, report, err := FingerprintAudioChunked(context.Background(), path, 1, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Chunks != 3 || report.FailedChunks != 1 {
+		t.Errorf("report = %+v, want 1 of 3 chunks failed", report)
+	}
+	var before, after bool
+	for _, couple := range fps {
+		switch {
+		case couple.AnchorTimeMs < 10000:
+			before = true
+		case couple.AnchorTimeMs >= 20000:
+			after = true
+		}
+	}
+	if !before || !after {
+		t.Errorf("fingerprints missing from the chunks either side of the failed one (before %v, after %v)", before, after)
+	}
+}
+
+func TestSymmetricTargets(t *testing.T) {
+	binHz := DefaultMusicConfig().freqBinHz()
+	a := Peak{Time: 2, Freq: 40 * binHz}
+	b := Peak{Time: 2.5, Freq: 90 * binHz}
+	forward, backward := createAddress(a, b, binHz), createAddress(b, a, binHz)
+	if forward&directionBit != 0 || backward&directionBit == 0 {
+		t.Errorf("direction bit wrong: forward %#x, backward %#x", forward, backward)
+	}
+	if forward&(directionBit-1) != 500 || backward&(directionBit-1) != 500 {
+		t.Errorf("deltas %d and %d, want 500ms both ways", forward&(directionBit-1), backward&(directionBit-1))
+	}
+
+	// a clip whose first half is unrelated audio and whose latter half is
+	// the start of song 1
+	song := testAudio(2, testRate, testSongSec, 3000)
+	clip := append(testAudio(99, testRate, 2, 3000), song[:2*testRate]...)
+	aligned := map[bool]int{}
+	for _, symmetric := range []bool{false, true} {
+		cfg := DefaultMusicConfig()
+		cfg.SymmetricTargets = symmetric
+		client := db.NewMemoryClient()
+		indexTestSongs(t, client, cfg, 3)
+		fps, _, err := AnalyzeSamples(clip, testRate, 0, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		matches, _, err := FindMatchesFGP(client, SampleFingerprint(fps, cfg), nil, 1, MatchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matches) == 0 || matches[0].SongTitle != "song 1" {
+			t.Fatalf("symmetric=%v: clip matched %+v, want song 1", symmetric, matches)
+		}
+		if off := matches[0].OffsetMs; off < -2200 || off > -1800 {
+			t.Errorf("symmetric=%v: offset %dms, want about -2000", symmetric, off)
+		}
+		aligned[symmetric] = matches[0].AlignedMatches
+	}
+	// pairing both ways about doubles the hits from the overlap
+	if aligned[true] < aligned[false]*3/2 {
+		t.Errorf("%d aligned hits with symmetric targets, %d without", aligned[true], aligned[false])
+	}
+}
+
+func TestLongDeltasNotAliased(t *testing.T) {
+	cfg := DefaultAudiobookConfig()
+	cfg.TargetZoneSize = 3
+	cfg.MinTargetDeltaMs = 0
+	binHz := cfg.freqBinHz()
+	// the third peak is 17s after the second, past the ~16.4s the delta
+	// field holds; wrapped, it would alias to a 616ms pair
+	peaks := []Peak{
+		{Time: 0, Freq: 20 * binHz},
+		{Time: 1, Freq: 30 * binHz},
+		{Time: 18, Freq: 40 * binHz},
+	}
+	fps := Fingerprint(peaks, 1, cfg)
+	if len(fps) != 1 {
+		t.Fatalf("%d fingerprints, want only the 1s pair", len(fps))
+	}
+	for address := range fps {
+		if delta := address & (1<<maxDeltaBits - 1); delta != 1000 {
+			t.Errorf("pair with delta %dms, want 1000", delta)
+		}
+	}
+
+	// symmetric pairs have a bit less room: 8.5s no longer fits
+	cfg.SymmetricTargets = true
+	peaks[2].Time = 9.5
+	fps = Fingerprint(peaks, 1, cfg)
+	if len(fps) != 2 {
+		t.Fatalf("%d symmetric fingerprints, want the 1s pair both ways", len(fps))
+	}
+	for address := range fps {
+		if delta := address & (directionBit - 1); delta != 1000 {
+			t.Errorf("symmetric pair with delta %dms, want 1000", delta)
+		}
+	}
+	if got := maxPairDeltaSec(cfg); got >= 8.2 || got < 8.1 {
+		t.Errorf("maxPairDeltaSec = %g with symmetric targets, want about 8.19", got)
+	}
+}
+
+func TestTargetZoneSec(t *testing.T) {
+	cfg := DefaultMusicConfig()
+	cfg.MinTargetDeltaMs = 0
+	cfg.TargetZoneSize = 5
+	binHz := cfg.freqBinHz()
+	// a dense second with a peak every 20ms, then a peak every 1.5s;
+	// every peak in its own bin so no two pairs share an address
+	var peaks []Peak
+	for i := 0; i < 50; i++ {
+		peaks = append(peaks, Peak{Time: float64(i) * 0.02, Freq: float64(10+i) * binHz})
+	}
+	for i := 0; i < 6; i++ {
+		peaks = append(peaks, Peak{Time: 2 + float64(i)*1.5, Freq: float64(100+i) * binHz})
+	}
+
+	// the longest delta and number of pairs of the anchors well inside
+	// the dense part, and of those in the sparse part
+	geometry := func(cfg FingerprintConfig) (dense, sparse [2]int) {
+		for address, couple := range Fingerprint(peaks, 1, cfg) {
+			delta := int(address & (1<<maxDeltaBits - 1))
+			var g *[2]int
+			switch {
+			case couple.AnchorTimeMs < 400:
+				g = &dense
+			case couple.AnchorTimeMs >= 2000:
+				g = &sparse
+			default:
+				continue
+			}
+			g[0] = max(g[0], delta)
+			g[1]++
+		}
+		return dense, sparse
+	}
+
+	dense, sparse := geometry(cfg)
+	// the same 5 targets span 100ms or 7.5s depending on where they are
+	if dense[0] != 100 || sparse[0] != 7500 {
+		t.Errorf("count-based zones reach %dms and %dms, want 100 and 7500", dense[0], sparse[0])
+	}
+
+	cfg.TargetZoneSec = 0.5
+	dense, sparse = geometry(cfg)
+	if dense[0] > 500 || sparse[0] > 500 {
+		t.Errorf("time-based zones reach %dms and %dms, want at most 500", dense[0], sparse[0])
+	}
+	// each of the 20 pairs with all 25 peaks in the next half second
+	if dense[1] != 20*25 {
+		t.Errorf("dense anchors made %d pairs, want 500", dense[1])
+	}
+	// sparse peaks have nothing within half a second
+	if sparse[1] != 0 {
+		t.Errorf("sparse anchors made %d pairs, want none", sparse[1])
+	}
+}
+
+func TestEstimateFingerprintCount(t *testing.T) {
+	for _, name := range []string{"audiobook", "audiobook-overlap", "music"} {
+		cfg, err := ConfigByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fps, _, err := AnalyzeSamples(testAudio(6, testRate, 30, 3000), testRate, 1, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// an upper-ish bound: at or somewhat above a real run
+		estimate := EstimateFingerprintCount(30, cfg)
+		if estimate < len(fps) || estimate > 6*len(fps) {
+			t.Errorf("%s: estimated %d fingerprints for a run that made %d", name, estimate, len(fps))
+		}
+		if double := EstimateFingerprintCount(60, cfg); double < 2*estimate-1 || double > 2*estimate+1 {
+			t.Errorf("%s: twice the audio estimated at %d, not about 2 × %d", name, double, estimate)
+		}
+	}
+	if n := EstimateFingerprintCount(0, DefaultMusicConfig()); n != 0 {
+		t.Errorf("no audio estimated at %d fingerprints", n)
+	}
+}
+
+func TestFingerprintAudioChunkedSkipsShortChunks(t *testing.T) {
+	if _, err := exec.LookPath(wav.FFmpegPath); err != nil {
+		t.Skipf("%s not found (set FFMPEG_PATH)", wav.FFmpegPath)
+	}
+	cfg := DefaultMusicConfig()
+	cfg.ChunkDurationSec, cfg.ChunkOverlapSec = 10, 0
+
+	// 20s and 200 samples: the last chunk is far shorter than a window
+	samples := testAudio(7, testRate, 21, 3000)[:20*testRate+200]
+	path := filepath.Join(t.TempDir(), "tail.wav")
+	if err := wav.WriteWav(path, samples, testRate, 1); err != nil {
+		t.Fatal(err)
+	}
+	fps, report, err := FingerprintAudioChunked(context.Background(), path, 1, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Chunks != 3 || report.ShortChunks != 1 || len(fps) == 0 {
+		t.Errorf("report = %+v with %d fingerprints, want the third of 3 chunks skipped", report, len(fps))
+	}
+
+	// a duration overstated by the container leaves a chunk past the end
+	// of the audio, which ffmpeg writes as a bare header
+	stub := filepath.Join(t.TempDir(), "ffprobe")
+	if err := os.WriteFile(stub, []byte("#!/bin/sh\necho 25.0\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(path string) { wav.FFprobePath = path }(wav.FFprobePath)
+	wav.FFprobePath = stub
+	samples = samples[:20*testRate]
+	if err := wav.WriteWav(path, samples, testRate, 1); err != nil {
+		t.Fatal(err)
+	}
+	_, report, err = FingerprintAudioChunked(context.Background(), path, 1, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Chunks != 3 || report.ShortChunks != 1 {
+		t.Errorf("report = %+v, want the empty third chunk skipped", report)
+	}
+}
+
+func TestChunkFilesRemovedOnPanic(t *testing.T) {
+	if _, err := exec.LookPath(wav.FFmpegPath); err != nil {
+		t.Skipf("%s not found (set FFMPEG_PATH)", wav.FFmpegPath)
+	}
+	path := writeTestWav(t, 8, 25)
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	cfg := DefaultMusicConfig()
+	cfg.ChunkDurationSec, cfg.ChunkOverlapSec = 10, 0
+	var recovered any
+	func() {
+		defer func() { recovered = recover() }()
+		FingerprintAudioStream(context.Background(), path, 1, cfg, func(map[uint32]models.Couple, []Peak) error {
+			panic("store exploded")
+		})
+	}()
+	if recovered == nil {
+		t.Fatal("the sink's panic didn't propagate")
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, "tmp", "*")); len(left) != 0 {
+		t.Errorf("chunk files left after a panic: %v", left)
+	}
+}
+
+func TestAnchorResolution(t *testing.T) {
+	for ms, want := range map[float64][2]uint32{1.2344: {1234, 1230}, 1.2351: {1235, 1240}, 0.004: {4, 0}} {
+		if got := quantizeAnchorMs(ms, 1); got != want[0] {
+			t.Errorf("quantizeAnchorMs(%g, 1) = %d, want %d", ms, got, want[0])
+		}
+		if got := quantizeAnchorMs(ms, 10); got != want[1] {
+			t.Errorf("quantizeAnchorMs(%g, 10) = %d, want %d", ms, got, want[1])
+		}
+	}
+
+	// a clip starting off the grid, matched at full resolution and at
+	// coarser ones
+	var base Match
+	for _, res := range []int{0, 10, 50} {
+		cfg := DefaultAudiobookConfig()
+		cfg.AnchorResolutionMs = res
+		if err := cfg.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		client := db.NewMemoryClient()
+		indexTestSongs(t, client, cfg, 3)
+		fps, _, err := AnalyzeSamples(testAudio(3, testRate, testSongSec, 3000), testRate, 1, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, couple := range fps {
+			if res > 0 && couple.AnchorTimeMs%uint32(res) != 0 {
+				t.Fatalf("%dms resolution: anchor at %dms", res, couple.AnchorTimeMs)
+			}
+		}
+
+		matches, _, err := FindMatchesFGP(client, testClip(t, 2, 6.013, 8, cfg), nil, 1, MatchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matches) == 0 || matches[0].SongTitle != "song 2" {
+			t.Fatalf("%dms resolution: clip of song 2 matched %+v", res, matches)
+		}
+		m := matches[0]
+		if res == 0 {
+			base = m
+			continue
+		}
+		// rounding moves an anchor by at most half a step, which can
+		// only tip the offset into the neighbouring bucket
+		if d := m.OffsetMs - base.OffsetMs; d < -offsetBucketMs || d > offsetBucketMs {
+			t.Errorf("%dms resolution: offset %dms, %dms at full resolution", res, m.OffsetMs, base.OffsetMs)
+		}
+		if m.AlignedMatches < base.AlignedMatches*4/5 {
+			t.Errorf("%dms resolution: %d aligned hits, %d at full resolution", res, m.AlignedMatches, base.AlignedMatches)
+		}
+	}
+
+	cfg := DefaultAudiobookConfig()
+	cfg.AnchorResolutionMs = 30
+	if err := cfg.Validate(); err == nil {
+		t.Error("a resolution that doesn't divide the offset buckets was accepted")
+	}
+}
+
+func TestMinTargetDelta(t *testing.T) {
+	cfg := DefaultMusicConfig()
+	cfg.TargetZoneSize = 5
+	cfg.SymmetricTargets = true
+	binHz := cfg.freqBinHz()
+	// a peak every 20ms for 1.2s, each in its own bin
+	var peaks []Peak
+	for i := 0; i < 60; i++ {
+		peaks = append(peaks, Peak{Time: float64(i) * 0.02, Freq: float64(10+i) * binHz})
+	}
+
+	// the shortest delta, and the number of targets of each anchor in
+	// the middle, which has 5 pairable peaks on either side
+	pairs := func(minDeltaMs float64) (shortest int, targets map[uint32]int) {
+		cfg.MinTargetDeltaMs = minDeltaMs
+		if err := cfg.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		shortest = 1 << maxDeltaBits
+		targets = map[uint32]int{}
+		for address, couple := range Fingerprint(peaks, 1, cfg) {
+			shortest = min(shortest, int(address&(directionBit-1)))
+			if couple.AnchorTimeMs >= 200 && couple.AnchorTimeMs < 1000 {
+				targets[couple.AnchorTimeMs]++
+			}
+		}
+		return shortest, targets
+	}
+
+	if shortest, _ := pairs(0); shortest > 20 {
+		t.Fatalf("without a minimum the shortest delta is %dms, want adjacent peaks paired", shortest)
+	}
+	shortest, targets := pairs(50)
+	if shortest < 50 {
+		t.Errorf("pair %dms apart made with MinTargetDeltaMs 50", shortest)
+	}
+	// skipped peaks don't count towards the zone
+	if len(targets) != 40 {
+		t.Errorf("%d anchors in the middle paired, want 40", len(targets))
+	}
+	for anchor, n := range targets {
+		if n != 10 {
+			t.Errorf("anchor at %dms has %d targets, want 5 each way", anchor, n)
+		}
+	}
+
+	cfg.MinTargetDeltaMs = -1
+	if err := cfg.Validate(); err == nil {
+		t.Error("negative MinTargetDeltaMs accepted")
+	}
+	cfg.MinTargetDeltaMs, cfg.TargetZoneSec = 500, 0.5
+	if err := cfg.Validate(); err == nil {
+		t.Error("MinTargetDeltaMs covering the whole target zone accepted")
+	}
+}
+
+func TestTrimSilence(t *testing.T) {
+	cfg := DefaultMusicConfig()
+	cfg.TrimSilence = true
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	block := cfg.HopSize * cfg.DSPRatio
+	audio := testAudio(1, testRate, 8, 3000)
+	audio = audio[:len(audio)/block*block]
+	// 40 blocks (a little under 2s at 44.1kHz) of silence before and 20
+	// after
+	lead := 40 * block
+	padded := append(append(make([]float64, lead), audio...), make([]float64, 20*block)...)
+
+	cut, trimmed := trimSilence(padded, cfg)
+	if cut != lead || len(trimmed) != len(audio) {
+		t.Fatalf("trimmed %d samples from the front leaving %d, want %d leaving %d", cut, len(trimmed), lead, len(audio))
+	}
+	if _, left := trimSilence(make([]float64, testRate), cfg); len(left) != 0 {
+		t.Errorf("%d samples left of pure silence", len(left))
+	}
+
+	// the padded audio is analysed as the bare audio, with anchors kept
+	// at their place in the padded input
+	want, _, err := AnalyzeSamples(audio, testRate, 1, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := AnalyzeSamples(padded, testRate, 1, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("%d fingerprints from the padded audio, %d from the bare audio", len(got), len(want))
+	}
+	leadMs := int(float64(lead) / testRate * 1000)
+	for address, couple := range want {
+		shift := int(got[address].AnchorTimeMs) - int(couple.AnchorTimeMs)
+		if shift < leadMs-1 || shift > leadMs+1 {
+			t.Fatalf("address %x anchored %dms later in the padded audio, want %dms", address, shift, leadMs)
+		}
+	}
+
+	cfg.SilenceRMS = 0
+	if err := cfg.Validate(); err == nil {
+		t.Error("TrimSilence without a SilenceRMS threshold accepted")
+	}
+}
+
+func TestMaxPeaksPerChunk(t *testing.T) {
+	cfg := DefaultMusicConfig()
+	audio := testAudio(1, testRate, 10, 3000)
+	all, err := AnalyzeSamplesDetailed(audio, testRate, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.MaxPeaksPerChunk = len(all.Peaks) / 4
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	capped, err := AnalyzeSamplesDetailed(audio, testRate, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(capped.Peaks) != cfg.MaxPeaksPerChunk {
+		t.Fatalf("%d peaks kept of %d, want %d", len(capped.Peaks), len(all.Peaks), cfg.MaxPeaksPerChunk)
+	}
+	if len(capped.Fingerprints) >= len(all.Fingerprints) {
+		t.Errorf("capping peaks left %d of %d fingerprints", len(capped.Fingerprints), len(all.Fingerprints))
+	}
+
+	// the kept peaks are the strongest ones, still in time order
+	kept := map[Peak]bool{}
+	weakestKept := math.Inf(1)
+	for i, p := range capped.Peaks {
+		if i > 0 && p.Time < capped.Peaks[i-1].Time {
+			t.Fatalf("peak %d at %gs comes after one at %gs", i, p.Time, capped.Peaks[i-1].Time)
+		}
+		kept[p] = true
+		weakestKept = min(weakestKept, p.Mag)
+	}
+	for _, p := range all.Peaks {
+		if !kept[p] && p.Mag > weakestKept {
+			t.Fatalf("dropped a peak of magnitude %g but kept one of %g", p.Mag, weakestKept)
+		}
+	}
+
+	cfg.MaxPeaksPerChunk = -1
+	if err := cfg.Validate(); err == nil {
+		t.Error("negative MaxPeaksPerChunk accepted")
+	}
+}
+
+func TestFingerprintAudioStream(t *testing.T) {
+	if _, err := exec.LookPath(wav.FFmpegPath); err != nil {
+		t.Skipf("%s not found (set FFMPEG_PATH)", wav.FFmpegPath)
+	}
+	path := writeTestWav(t, 6, 30)
+	cfg := DefaultMusicConfig()
+	cfg.ChunkDurationSec, cfg.ChunkOverlapSec = 10, 0
+
+	var chunks []map[uint32]models.Couple
+	count, report, err := FingerprintAudioStream(context.Background(), path, 1, cfg, func(fps map[uint32]models.Couple, _ []Peak) error {
+		chunks = append(chunks, fps)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Chunks != 3 || len(chunks) != 3 {
+		t.Fatalf("sink got %d chunks, report %+v; want 3", len(chunks), report)
+	}
+	total := 0
+	for i, fps := range chunks {
+		total += len(fps)
+		for _, couple := range fps {
+			if start := uint32(i * 10000); couple.AnchorTimeMs < start || couple.AnchorTimeMs >= start+10000 {
+				t.Fatalf("chunk %d has an anchor at %dms", i, couple.AnchorTimeMs)
+			}
+		}
+	}
+	if count != total {
+		t.Errorf("returned count %d, sink was given %d", count, total)
+	}
+
+	// the merged map is what the chunks add up to
+	merged, _, err := FingerprintAudioChunked(context.Background(), path, 1, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[uint32]models.Couple)
+	for _, fps := range chunks {
+		utils.ExtendMap(want, fps)
+	}
+	if !reflect.DeepEqual(merged, want) {
+		t.Errorf("FingerprintAudioChunked returned %d fingerprints, the streamed chunks merge to %d", len(merged), len(want))
+	}
+
+	// a sink error stops the run at that chunk
+	errFull := errors.New("disk full")
+	calls := 0
+	_, _, err = FingerprintAudioStream(context.Background(), path, 1, cfg, func(map[uint32]models.Couple, []Peak) error {
+		if calls++; calls == 2 {
+			return errFull
+		}
+		return nil
+	})
+	if !errors.Is(err, errFull) || !strings.Contains(err.Error(), "chunk at 10s") {
+		t.Errorf("sink failure returned %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("sink called %d times after failing on the 2nd chunk", calls)
+	}
+}
+
+func TestMergePeaks(t *testing.T) {
+	a := Peak{Time: 0, Freq: 100, Mag: 1}
+	b := Peak{Time: 0.01, Freq: 110, Mag: 5}
+	c := Peak{Time: 0.02, Freq: 200, Mag: 3} // close in time, far in frequency
+	d := Peak{Time: 0.03, Freq: 120, Mag: 2}
+	e := Peak{Time: 0.5, Freq: 100, Mag: 1} // far in time
+	got := mergePeaks([]Peak{a, b, c, d, e}, 0.05, 20)
+	if want := []Peak{b, c, e}; !reflect.DeepEqual(got, want) {
+		t.Errorf("merged to %v, want %v", got, want)
+	}
+
+	// each kept peak only absorbs what is within reach of it, so a chain
+	// of close peaks doesn't collapse into one
+	chain := []Peak{{Time: 0, Freq: 100, Mag: 3}, {Time: 0.04, Freq: 100, Mag: 2}, {Time: 0.08, Freq: 100, Mag: 1}}
+	if got := mergePeaks(append([]Peak(nil), chain...), 0.05, 0); !reflect.DeepEqual(got, []Peak{chain[0], chain[2]}) {
+		t.Errorf("chain merged to %v, want its ends", got)
+	}
+
+	cfg := DefaultMusicConfig()
+	cfg.MergePeaksHz = -1
+	if err := cfg.Validate(); err == nil {
+		t.Error("negative MergePeaksHz accepted")
+	}
+}
+
+func TestMergePeaksThinsFingerprints(t *testing.T) {
+	cfg := DefaultMusicConfig()
+	audio := testAudio(2, testRate, 10, 3000)
+	plain, err := AnalyzeSamplesDetailed(audio, testRate, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.MergePeaksSec, cfg.MergePeaksHz = 0.1, 50
+	merged, err := AnalyzeSamplesDetailed(audio, testRate, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merged.Peaks) >= len(plain.Peaks) || len(merged.Peaks) == 0 {
+		t.Fatalf("%d peaks merged to %d", len(plain.Peaks), len(merged.Peaks))
+	}
+	if len(merged.Fingerprints) >= len(plain.Fingerprints) {
+		t.Errorf("merging kept %d of %d fingerprints", len(merged.Fingerprints), len(plain.Fingerprints))
+	}
+	for i := 1; i < len(merged.Peaks); i++ {
+		if merged.Peaks[i].Time < merged.Peaks[i-1].Time {
+			t.Fatal("merged peaks out of time order")
+		}
+	}
+	for i, p := range merged.Peaks {
+		for _, q := range merged.Peaks[i+1:] {
+			if q.Time-p.Time > cfg.MergePeaksSec {
+				break
+			}
+			if math.Abs(q.Freq-p.Freq) <= cfg.MergePeaksHz {
+				t.Fatalf("kept peaks %+v and %+v are within the tolerance", p, q)
+			}
+		}
+	}
+}
+
+// minRealtime is the fewest seconds of audio per second the analysis of
+// any built-in profile may process. they run at around 100x or more (25x
+// under the race detector), so a busy machine doesn't trip it but a
+// regression in the DSP path on the order of a slower FFT does.
+const minRealtime = 10
+
+func TestThroughputFloor(t *testing.T) {
+	if testing.Short() {
+		t.Skip("timing test")
+	}
+	audio := testAudio(1, testRate, benchAudioSec, 3000)
+	for name := range configProfiles {
+		cfg, _ := ConfigByName(name)
+		// the best of a few runs, so one slow run doesn't fail it
+		best := time.Duration(math.MaxInt64)
+		for range 3 {
+			start := time.Now()
+			if _, _, err := AnalyzeSamples(audio, testRate, 1, cfg); err != nil {
+				t.Fatal(err)
+			}
+			best = min(best, time.Since(start))
+		}
+		if speed := benchAudioSec / best.Seconds(); speed < minRealtime {
+			t.Errorf("%s: analysis ran at %.1fx realtime, below the %dx floor", name, speed, minRealtime)
+		} else {
+			t.Logf("%s: %.1fx realtime", name, speed)
+		}
+	}
+}
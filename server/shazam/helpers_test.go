@@ -0,0 +1,114 @@
+package shazam
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"slices"
+	"song-recognition/db"
+	"song-recognition/wav"
+	"testing"
+)
+
+// testAudio returns sec seconds of deterministic pseudo-music at
+// sampleRate: three tones between 100 Hz and maxHz that change pitch
+// every 200ms, over a little noise. different seeds give unrelated audio.
+func testAudio(seed int64, sampleRate int, sec, maxHz float64) []float64 {
+	rng := rand.New(rand.NewSource(seed))
+	n := int(sec * float64(sampleRate))
+	step := sampleRate / 5
+	samples := make([]float64, n)
+	var freqs [3]float64
+	for i := range samples {
+		if i%step == 0 {
+			for j := range freqs {
+				freqs[j] = 100 + rng.Float64()*(maxHz-100)
+			}
+		}
+		t := float64(i) / float64(sampleRate)
+		var v float64
+		for j, f := range freqs {
+			v += math.Sin(2*math.Pi*f*t) / float64(j+2)
+		}
+		samples[i] = 0.5*v + 0.01*(rng.Float64()*2-1)
+	}
+	return samples
+}
+
+// testSongSec is the length of the songs indexTestSongs stores.
+const testSongSec = 20
+
+// indexTestSongs registers n songs named "song 0", "song 1", ... made
+// of testAudio with seeds 1 to n, stores their fingerprints under cfg and
+// returns their IDs in order.
+func indexTestSongs(t testing.TB, client db.DBClient, cfg FingerprintConfig, n int) []uint32 {
+	t.Helper()
+	ids := make([]uint32, n)
+	for i := range ids {
+		id, err := client.RegisterSong(fmt.Sprintf("song %d", i), "artist", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fps, _, err := AnalyzeSamples(testAudio(int64(i+1), testRate, testSongSec, 3000), testRate, id, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.StoreFingerprints(fps); err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = id
+	}
+	return ids
+}
+
+// testClip returns the sample fingerprint of sec seconds of song i (as
+// indexed by indexTestSongs) starting at startSec.
+func testClip(t testing.TB, i int, startSec, sec float64, cfg FingerprintConfig) map[uint32]uint32 {
+	t.Helper()
+	audio := testAudio(int64(i+1), testRate, testSongSec, 3000)
+	clip := audio[int(startSec*testRate):int((startSec+sec)*testRate)]
+	fps, _, err := AnalyzeSamples(clip, testRate, 0, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return SampleFingerprint(fps, cfg)
+}
+
+// testRate is the sample rate of test audio, as files are decoded at.
+const testRate = 44100
+
+// writeTestWav writes sec seconds of testAudio with the given seed as a
+// mono WAV file in a temp dir and returns its path.
+func writeTestWav(t testing.TB, seed int64, sec float64) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), fmt.Sprintf("test-%d.wav", seed))
+	if err := wav.WriteWav(path, testAudio(seed, testRate, sec, 3000), testRate, 1); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// benchAudioSec is the length of the audio the pipeline benchmarks
+// process.
+const benchAudioSec = 60
+
+// benchProfiles runs fn as a sub-benchmark for each built-in profile and
+// reports how many seconds of audio each run processed per second.
+func benchProfiles(b *testing.B, fn func(b *testing.B, cfg FingerprintConfig)) {
+	names := make([]string, 0, len(configProfiles))
+	for name := range configProfiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		b.Run(name, func(b *testing.B) {
+			cfg, err := ConfigByName(name)
+			if err != nil {
+				b.Fatal(err)
+			}
+			fn(b, cfg)
+			b.ReportMetric(benchAudioSec*float64(b.N)/b.Elapsed().Seconds(), "x-realtime")
+		})
+	}
+}
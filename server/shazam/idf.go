@@ -0,0 +1,64 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package shazam
+
+import (
+	"fmt"
+	"math"
+	"song-recognition/db"
+	"song-recognition/utils"
+	"sync"
+	"time"
+)
+
+// generational is implemented by db.VersionedClient.
+type generational interface {
+	Generation() uint64
+}
+
+// idfCache holds the library-wide address song counts. computing them
+// scans every fingerprint, so they are kept until the database changes,
+// which is only detectable for clients that report a generation; other
+// clients get a snapshot taken on first use.
+type idfCache struct {
+	mu         sync.Mutex
+	client     db.DBClient
+	generation uint64
+	counts     map[uint32]int
+	totalSongs int
+}
+
+var addressDF idfCache
+
+// weights returns the IDF weight of each address for dbClient's library.
+func (c *idfCache) weights(dbClient db.DBClient, addresses []uint32) (map[uint32]float64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var generation uint64
+	if g, ok := dbClient.(generational); ok {
+		generation = g.Generation()
+	}
+	if c.counts == nil || c.client != dbClient || c.generation != generation {
+		start := time.Now()
+		counts, err := dbClient.AddressSongCounts()
+		if err != nil {
+			return nil, fmt.Errorf("failed to count songs per address: %v", err)
+		}
+		totalSongs, err := dbClient.TotalSongs()
+		if err != nil {
+			return nil, fmt.Errorf("failed to count songs: %v", err)
+		}
+		c.client, c.generation, c.counts, c.totalSongs = dbClient, generation, counts, totalSongs
+		utils.Debugf("[match] loaded document frequencies of %d addresses in %s", len(counts), time.Since(start))
+	}
+
+	weights := make(map[uint32]float64, len(addresses))
+	for _, address := range addresses {
+		// addresses stored after the snapshot count as unique
+		df := max(c.counts[address], 1)
+		weights[address] = math.Log(1 + float64(max(c.totalSongs, df))/float64(df))
+	}
+	return weights, nil
+}
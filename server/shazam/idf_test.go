@@ -0,0 +1,98 @@
+package shazam
+
+import (
+	"fmt"
+	"math"
+	"song-recognition/db"
+	"song-recognition/models"
+	"testing"
+)
+
+func TestIDFWeightingFavoursRareAddresses(t *testing.T) {
+	client := db.NewMemoryClient()
+	register := func(title string) uint32 {
+		id, err := client.RegisterSong(title, "artist", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	store := func(id uint32, addresses []uint32) {
+		fps := make(map[uint32]models.Couple, len(addresses))
+		for i, address := range addresses {
+			fps[address] = models.Couple{SongID: id, AnchorTimeMs: 5000 + uint32(i)*10}
+		}
+		if err := client.StoreFingerprints(fps); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the clip shares 3 addresses no other song has with the true song,
+	// and 5 that most of the library has with the decoy and some fillers
+	rare := []uint32{11, 12, 13}
+	common := []uint32{21, 22, 23, 24, 25}
+	truth := register("true")
+	store(truth, rare)
+	store(register("decoy"), common)
+	for i := 0; i < 18; i++ {
+		store(register(fmt.Sprintf("filler %d", i)), common[:3+i%3])
+	}
+
+	sample := map[uint32]uint32{}
+	for i, address := range append(rare, common...) {
+		sample[address] = 1000 + uint32(i)*10
+	}
+
+	matches, _, err := FindMatchesFGP(client, sample, nil, 1, MatchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) == 0 || matches[0].Score != 5 {
+		t.Fatalf("without IDF the best match is %+v, want one with the 5 common hits", matches[:min(len(matches), 1)])
+	}
+
+	matches, _, err = FindMatchesFGP(client, sample, nil, 1, MatchOptions{IDFWeighting: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) == 0 || matches[0].SongTitle != "true" {
+		t.Fatalf("with IDF the best match is %+v, want the song sharing the rare addresses", matches)
+	}
+	if m := matches[0]; m.AlignedMatches != 3 || m.Score <= 3 {
+		t.Errorf("match %+v: want 3 aligned hits weighing more than 1 each", m)
+	}
+}
+
+func TestIDFWeightsRefreshAfterWrites(t *testing.T) {
+	client := db.NewVersionedClient(db.NewMemoryClient())
+	var ids []uint32
+	for i := 0; i < 4; i++ {
+		id, err := client.RegisterSong(fmt.Sprintf("song %d", i), "artist", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := client.StoreFingerprints(map[uint32]models.Couple{7: {SongID: ids[0]}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var cache idfCache
+	before, err := cache.weights(client, []uint32{7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids[1:] {
+		if err := client.StoreFingerprints(map[uint32]models.Couple{7: {SongID: id}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	after, err := cache.weights(client, []uint32{7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// log(1 + 4/1) while only one song had it, log(1 + 4/4) once all do
+	if math.Abs(before[7]-math.Log(5)) > 1e-9 || math.Abs(after[7]-math.Log(2)) > 1e-9 {
+		t.Errorf("weights %g then %g, want log 5 then log 2", before[7], after[7])
+	}
+}
@@ -49,3 +49,113 @@ func SpectrogramToImage(spectrogram [][]complex128, outputPath string) error {
 
 	return nil
 }
+
+// spectrogramDynamicRangeDb is the range below the loudest bin that is
+// still given colour; anything quieter renders black.
+const spectrogramDynamicRangeDb = 80.0
+
+// heatmapStops is a black -> purple -> orange -> yellow colour ramp.
+var heatmapStops = []color.RGBA{
+	{0, 0, 0, 255},
+	{80, 18, 123, 255},
+	{182, 54, 121, 255},
+	{251, 136, 97, 255},
+	{252, 253, 191, 255},
+}
+
+// MaxPoolFrames collapses several consecutive spectrogram frames into one
+// by keeping each bin's maximum, so short peaks survive time-binning.
+func MaxPoolFrames(frames [][]float64) []float64 {
+	if len(frames) == 0 {
+		return nil
+	}
+	pooled := make([]float64, len(frames[0]))
+	for _, frame := range frames {
+		for i := 0; i < len(pooled) && i < len(frame); i++ {
+			if frame[i] > pooled[i] {
+				pooled[i] = frame[i]
+			}
+		}
+	}
+	return pooled
+}
+
+// SpectrogramImage renders a magnitude spectrogram as a heatmap with time
+// on the x axis and frequency (low at the bottom) on the y axis, using a
+// log (dB) scale. each column spans columnDuration seconds and each row
+// freqResolution Hz; peaks are overlaid as red dots at those coordinates.
+func SpectrogramImage(columns [][]float64, peaks []Peak, columnDuration, freqResolution float64) *image.RGBA {
+	width := len(columns)
+	height := 0
+	if width > 0 {
+		height = len(columns[0])
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	if width == 0 || height == 0 {
+		return img
+	}
+
+	maxMagnitude := 0.0
+	for _, col := range columns {
+		for _, m := range col {
+			if m > maxMagnitude {
+				maxMagnitude = m
+			}
+		}
+	}
+	if maxMagnitude == 0 {
+		maxMagnitude = 1
+	}
+
+	for x, col := range columns {
+		for bin := 0; bin < height && bin < len(col); bin++ {
+			db := 20 * math.Log10(col[bin]/maxMagnitude+1e-12)
+			level := 1 + db/spectrogramDynamicRangeDb
+			img.SetRGBA(x, height-1-bin, heatmapColor(level))
+		}
+	}
+
+	red := color.RGBA{255, 0, 0, 255}
+	for _, p := range peaks {
+		x := int(p.Time / columnDuration)
+		y := height - 1 - int(math.Round(p.Freq/freqResolution))
+		for dx := -1; dx <= 1; dx++ {
+			for dy := -1; dy <= 1; dy++ {
+				if image.Pt(x+dx, y+dy).In(img.Rect) {
+					img.SetRGBA(x+dx, y+dy, red)
+				}
+			}
+		}
+	}
+
+	return img
+}
+
+func heatmapColor(level float64) color.RGBA {
+	if level <= 0 {
+		return heatmapStops[0]
+	}
+	if level >= 1 {
+		return heatmapStops[len(heatmapStops)-1]
+	}
+
+	pos := level * float64(len(heatmapStops)-1)
+	i := int(pos)
+	frac := pos - float64(i)
+	a, b := heatmapStops[i], heatmapStops[i+1]
+	lerp := func(x, y uint8) uint8 {
+		return uint8(float64(x) + (float64(y)-float64(x))*frac)
+	}
+	return color.RGBA{lerp(a.R, b.R), lerp(a.G, b.G), lerp(a.B, b.B), 255}
+}
+
+// SavePNG writes img to outputPath as a PNG file.
+func SavePNG(img image.Image, outputPath string) error {
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return png.Encode(file, img)
+}
@@ -0,0 +1,42 @@
+package shazam
+
+import (
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+func TestSpectrogramImage(t *testing.T) {
+	const frames, bins = 6, 10
+	columns := make([][]float64, frames)
+	for x := range columns {
+		columns[x] = make([]float64, bins)
+		columns[x][3] = 1 // one loud bin, the rest silent
+	}
+	peaks := []Peak{{Time: 0.2, Freq: 700}} // frame 2, bin 7 at 0.1s and 100 Hz per pixel
+	img := SpectrogramImage(columns, peaks, 0.1, 100)
+
+	if b := img.Bounds(); b.Dx() != frames || b.Dy() != bins {
+		t.Fatalf("image is %dx%d, want %dx%d", b.Dx(), b.Dy(), frames, bins)
+	}
+	red := color.RGBA{255, 0, 0, 255}
+	if got := img.RGBAAt(2, bins-1-7); got != red {
+		t.Errorf("peak pixel is %v, want red", got)
+	}
+	// low frequencies at the bottom, and loud brighter than silent
+	loud, quiet := img.RGBAAt(5, bins-1-3), img.RGBAAt(5, 0)
+	if int(loud.R)+int(loud.G)+int(loud.B) <= int(quiet.R)+int(quiet.G)+int(quiet.B) {
+		t.Errorf("loud bin %v is no brighter than a silent one %v", loud, quiet)
+	}
+
+	if b := SpectrogramImage(nil, nil, 0.1, 100).Bounds(); !b.Empty() {
+		t.Errorf("no columns gave a %v image", b)
+	}
+}
+
+func TestMaxPoolFrames(t *testing.T) {
+	got := MaxPoolFrames([][]float64{{1, 5, 0}, {3, 2, 0}, {2, 4, 1}})
+	if want := []float64{3, 5, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("MaxPoolFrames = %v, want %v", got, want)
+	}
+}
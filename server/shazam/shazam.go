@@ -4,13 +4,70 @@
 package shazam
 
 import (
+	"context"
 	"fmt"
+	"runtime"
 	"song-recognition/db"
+	"song-recognition/metrics"
+	"song-recognition/models"
 	"song-recognition/utils"
 	"sort"
+	"strconv"
+	"sync"
 	"time"
 )
 
+// searchBatchSize is how many sample addresses are looked up at once, and
+// so how often the search checks whether its time is up.
+const searchBatchSize = 512
+
+// DefaultMatchOptions returns the options the command line starts from:
+// Workers is taken from MATCH_WORKERS when it is set.
+func DefaultMatchOptions() MatchOptions {
+	return MatchOptions{Workers: matchWorkersFromEnv()}
+}
+
+func matchWorkersFromEnv() int {
+	fallback := runtime.NumCPU()
+	raw := utils.GetEnv("MATCH_WORKERS")
+	if raw == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 1 {
+		utils.Warnf("[match] ignoring invalid MATCH_WORKERS %q, using %d", raw, fallback)
+		return fallback
+	}
+	return n
+}
+
+// MatchOptions tunes how FindMatchesContext searches the library and
+// which candidates it keeps. the zero value counts hits unweighted,
+// scores on every CPU and applies no floor or time limit.
+type MatchOptions struct {
+	// Workers bounds how many goroutines score candidate songs; 1 scores
+	// serially, and 0 uses the CPU count.
+	Workers int
+
+	// IDFWeighting weights each matching address by its inverse document
+	// frequency, log(1 + songs/songsWithAddress), so a hit on an address
+	// few songs share counts for more than one on an address half the
+	// library has. scores are then sums of weights, not counts.
+	IDFWeighting bool
+
+	// MinSongFingerprints drops candidate songs with fewer stored
+	// fingerprints than this from the results. very short or sparse
+	// entries can otherwise outscore real matches on noisy clips. 0
+	// disables the floor.
+	MinSongFingerprints int
+
+	// MaxSearchDuration bounds how long a search spends looking up and
+	// scoring a sample. once it runs out the search stops and returns
+	// the best matches among what it has looked at so far. 0 disables
+	// the limit.
+	MaxSearchDuration time.Duration
+}
+
 type Match struct {
 	SongID     uint32
 	SongTitle  string
@@ -18,52 +75,122 @@ type Match struct {
 	YouTubeID  string
 	Timestamp  uint32
 	Score      float64
+
+	// AlignedMatches is the number of fingerprint hits in the best offset
+	// bucket. it equals Score unless MatchOptions.IDFWeighting is on.
+	AlignedMatches int
+
+	// OffsetMs is the best bucket's offset: where in the song the sample
+	// starts. it can be negative when the sample begins before the song.
+	OffsetMs int32
+
+	// DurationSec is the song's length, 0 if the entry predates durations
+	// being stored.
+	DurationSec float64
 }
 
 // FindMatches analyzes the audio sample to find matching songs in the database.
-func FindMatches(audioSample []float64, audioDuration float64, sampleRate int, cfg FingerprintConfig) ([]Match, time.Duration, error) {
+func FindMatches(dbClient db.DBClient, audioSample []float64, audioDuration float64, sampleRate int, limit int, cfg FingerprintConfig, opts MatchOptions) ([]Match, time.Duration, error) {
 	startTime := time.Now()
 
-	spectrogram, err := Spectrogram(audioSample, sampleRate, cfg)
+	sampleFingerprint, _, err := AnalyzeSamples(audioSample, sampleRate, utils.GenerateUniqueID(), cfg)
 	if err != nil {
-		return nil, time.Since(startTime), fmt.Errorf("failed to get spectrogram of samples: %v", err)
+		return nil, time.Since(startTime), fmt.Errorf("failed to analyze samples: %v", err)
 	}
 
-	peaks := ExtractPeaks(spectrogram, audioDuration, sampleRate, cfg)
-	sampleFingerprint := Fingerprint(peaks, utils.GenerateUniqueID(), cfg)
-
-	sampleFingerprintMap := make(map[uint32]uint32)
-	for address, couple := range sampleFingerprint {
-		sampleFingerprintMap[address] = couple.AnchorTimeMs
-	}
-
-	matches, _, _ := FindMatchesFGP(sampleFingerprintMap)
+	matches, _, _ := FindMatchesFGP(dbClient, SampleFingerprint(sampleFingerprint, cfg), nil, limit, opts)
 
 	return matches, time.Since(startTime), nil
 }
 
-// FindMatchesFGP uses the sample fingerprint to find matching songs in the database.
-func FindMatchesFGP(sampleFingerprint map[uint32]uint32) ([]Match, time.Duration, error) {
+// FindMatchesFGP uses the sample fingerprint to find matching songs in the
+// database behind dbClient. the caller owns the client and closes it.
+// a non-empty songIDs restricts the search to those songs. matches are
+// ordered best first, deterministically (see sortMatches). each song
+// appears at most once, at its best offset bucket; hits at other offsets
+// of the same song only show up in ExplainMatch. opts tunes the search
+// (see MatchOptions). a search cut short by opts.MaxSearchDuration is
+// logged and its partial matches returned; limit is how many results the
+// caller will use, so at least that many are resolved even then.
+func FindMatchesFGP(dbClient db.DBClient, sampleFingerprint map[uint32]uint32, songIDs []uint32, limit int, opts MatchOptions) ([]Match, time.Duration, error) {
+	matches, searchDuration, _, err := FindMatchesContext(context.Background(), dbClient, sampleFingerprint, songIDs, limit, opts)
+	return matches, searchDuration, err
+}
+
+// FindMatchesContext is FindMatchesFGP, also reporting whether the search
+// ran out of time. addresses are looked up in sample-time order, in
+// batches, and candidates are resolved best score first, so a truncated
+// search still returns the strongest matches among the fingerprints it
+// got to, resolving at least limit of them (or one, if limit is lower)
+// before it stops. cancelling ctx itself aborts the search with its
+// error.
+func FindMatchesContext(ctx context.Context, dbClient db.DBClient, sampleFingerprint map[uint32]uint32, songIDs []uint32, limit int, opts MatchOptions) (matchList []Match, searchDuration time.Duration, truncated bool, err error) {
 	startTime := time.Now()
 	logger := utils.GetLogger()
 
+	searchCtx := ctx
+	if opts.MaxSearchDuration > 0 {
+		var cancel context.CancelFunc
+		searchCtx, cancel = context.WithTimeout(ctx, opts.MaxSearchDuration)
+		defer cancel()
+	}
+	// outOfTime reports whether the search has to stop, failing it when
+	// it was the caller that gave up
+	outOfTime := func() (bool, error) {
+		if searchCtx.Err() == nil {
+			return false, nil
+		}
+		return true, ctx.Err()
+	}
+
 	addresses := make([]uint32, 0, len(sampleFingerprint))
 	for address := range sampleFingerprint {
 		addresses = append(addresses, address)
 	}
+	sort.Slice(addresses, func(i, j int) bool {
+		ti, tj := sampleFingerprint[addresses[i]], sampleFingerprint[addresses[j]]
+		if ti != tj {
+			return ti < tj
+		}
+		return addresses[i] < addresses[j]
+	})
 
-	db, err := db.NewDBClient()
+	// the first batch is always looked up, so there is something to score
+	m := make(map[uint32][]models.Couple)
+	looked := 0
+	for looked < len(addresses) {
+		if looked > 0 {
+			if truncated, err = outOfTime(); truncated {
+				break
+			}
+		}
+		end := min(looked+searchBatchSize, len(addresses))
+		batch, err := dbClient.GetCouplesForSongs(addresses[looked:end], songIDs)
+		if err != nil {
+			return nil, time.Since(startTime), false, err
+		}
+		for address, couples := range batch {
+			m[address] = couples
+		}
+		looked = end
+	}
 	if err != nil {
-		return nil, time.Since(startTime), err
+		return nil, time.Since(startTime), true, err
+	}
+	if truncated {
+		utils.Warnf("[match] search ran out of time after looking up %d of %d sample addresses", looked, len(addresses))
 	}
-	defer db.Close()
 
-	m, err := db.GetCouples(addresses)
-	if err != nil {
-		return nil, time.Since(startTime), err
+	var addressWeights map[uint32]float64
+	if opts.IDFWeighting {
+		addressWeights, err = addressDF.weights(dbClient, addresses[:looked])
+		if err != nil {
+			return nil, time.Since(startTime), truncated, err
+		}
 	}
 
 	matches := map[uint32][][2]uint32{}        // songID -> [(sampleTime, dbTime)]
+	weights := map[uint32][]float64{}          // songID -> weight of each match; empty without IDF
 	timestamps := map[uint32]uint32{}          // songID -> earliest timestamp
 	targetZones := map[uint32]map[uint32]int{} // songID -> timestamp -> count
 
@@ -73,6 +200,9 @@ func FindMatchesFGP(sampleFingerprint map[uint32]uint32) ([]Match, time.Duration
 				matches[couple.SongID],
 				[2]uint32{sampleFingerprint[address], couple.AnchorTimeMs},
 			)
+			if addressWeights != nil {
+				weights[couple.SongID] = append(weights[couple.SongID], addressWeights[address])
+			}
 
 			if existingTime, ok := timestamps[couple.SongID]; !ok || couple.AnchorTimeMs < existingTime {
 				timestamps[couple.SongID] = couple.AnchorTimeMs
@@ -85,12 +215,48 @@ func FindMatchesFGP(sampleFingerprint map[uint32]uint32) ([]Match, time.Duration
 		}
 	}
 
-	scores := analyzeRelativeTiming(matches)
+	workers := opts.Workers
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	scores := scoreCandidates(matches, weights, workers)
+
+	// resolve the best candidates first, in case time runs out
+	// (or has already)
+	candidates := make([]uint32, 0, len(scores))
+	for songID := range scores {
+		candidates = append(candidates, songID)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := scores[candidates[i]], scores[candidates[j]]
+		if a.score != b.score {
+			return a.score > b.score
+		}
+		return candidates[i] < candidates[j]
+	})
+
+	// one lookup for every candidate rather than a count per song
+	var fingerprintCounts map[uint32]int
+	if opts.MinSongFingerprints > 0 {
+		fingerprintCounts, err = dbClient.CountFingerprintsForSongs(candidates)
+		if err != nil {
+			return nil, time.Since(startTime), truncated, fmt.Errorf("failed to count fingerprints of candidate songs: %w", err)
+		}
+	}
 
-	var matchList []Match
+	for i, songID := range candidates {
+		stop, err := outOfTime()
+		if err != nil {
+			return nil, time.Since(startTime), true, err
+		}
+		if stop && len(matchList) >= max(limit, 1) {
+			utils.Warnf("[match] search ran out of time after resolving %d of %d candidate songs", i, len(candidates))
+			truncated = true
+			break
+		}
 
-	for songID, points := range scores {
-		song, songExists, err := db.GetSongByID(songID)
+		points := scores[songID]
+		song, songExists, err := dbClient.GetSongByID(songID)
 		if !songExists {
 			logger.Info(fmt.Sprintf("song with ID (%v) doesn't exist", songID))
 			continue
@@ -99,16 +265,40 @@ func FindMatchesFGP(sampleFingerprint map[uint32]uint32) ([]Match, time.Duration
 			logger.Info(fmt.Sprintf("failed to get song by ID (%v): %v", songID, err))
 			continue
 		}
+		if opts.MinSongFingerprints > 0 {
+			if count := fingerprintCounts[songID]; count < opts.MinSongFingerprints {
+				utils.Debugf("[match] skipping %q: %d fingerprints, below the floor of %d", song.Title, count, opts.MinSongFingerprints)
+				continue
+			}
+		}
 
-		match := Match{songID, song.Title, song.Artist, song.YouTubeID, timestamps[songID], points}
+		match := Match{songID, song.Title, song.Artist, song.YouTubeID, timestamps[songID], points.score, points.aligned, points.offsetMs, song.DurationSec}
 		matchList = append(matchList, match)
 	}
 
-	sort.Slice(matchList, func(i, j int) bool {
-		return matchList[i].Score > matchList[j].Score
-	})
+	sortMatches(matchList)
+
+	searchDuration = time.Since(startTime)
+	metrics.SearchDuration.Observe(searchDuration.Seconds())
 
-	return matchList, time.Since(startTime), nil
+	return matchList, searchDuration, truncated, nil
+}
+
+// sortMatches puts matches in the order FindMatchesFGP returns them:
+// Score descending, then AlignedMatches descending, then SongID
+// ascending. scores come out of a map, so the order has to be total for
+// results (and the top N of them) to be the same between runs.
+func sortMatches(matches []Match) {
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.AlignedMatches != b.AlignedMatches {
+			return a.AlignedMatches > b.AlignedMatches
+		}
+		return a.SongID < b.SongID
+	})
 }
 
 // filterMatches filters out matches that don't have enough
@@ -138,32 +328,189 @@ func filterMatches(
 }
 
 // analyzeRelativeTiming calculates a score for each song based on the
-// consistency of time offsets between the sample and database.
-func analyzeRelativeTiming(matches map[uint32][][2]uint32) map[uint32]float64 {
-	scores := make(map[uint32]float64)
+// consistency of time offsets between the sample and database. weights,
+// if it has an entry for a song, gives the weight of each of its matches.
+func analyzeRelativeTiming(matches map[uint32][][2]uint32, weights map[uint32][]float64) map[uint32]alignment {
+	scores := make(map[uint32]alignment)
 
 	for songID, times := range matches {
-		offsetCounts := make(map[int32]int)
+		scores[songID] = alignmentScore(times, weights[songID])
+	}
 
-		for _, timePair := range times {
-			sampleTime := int32(timePair[0])
-			dbTime := int32(timePair[1])
-			offset := dbTime - sampleTime
+	return scores
+}
 
-			// bin offsets in 100ms buckets to allow for small timing variations
-			offsetBucket := offset / 100
-			offsetCounts[offsetBucket]++
-		}
+// scoreCandidates is analyzeRelativeTiming spread over up to workers
+// goroutines. songs are scored independently, so the result is the same
+// as the serial version.
+func scoreCandidates(matches map[uint32][][2]uint32, weights map[uint32][]float64, workers int) map[uint32]alignment {
+	if workers > len(matches) {
+		workers = len(matches)
+	}
+	if workers <= 1 {
+		return analyzeRelativeTiming(matches, weights)
+	}
+
+	songIDs := make([]uint32, 0, len(matches))
+	for songID := range matches {
+		songIDs = append(songIDs, songID)
+	}
 
-		maxCount := 0
-		for _, count := range offsetCounts {
-			if count > maxCount {
-				maxCount = count
+	// each index is written by exactly one worker
+	results := make([]alignment, len(songIDs))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = alignmentScore(matches[songIDs[i]], weights[songIDs[i]])
 			}
+		}()
+	}
+	for i := range songIDs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	scores := make(map[uint32]alignment, len(songIDs))
+	for i, songID := range songIDs {
+		scores[songID] = results[i]
+	}
+	return scores
+}
+
+// offsetBucketMs is the width of the song-minus-sample offset buckets
+// alignmentScore counts matches in.
+const offsetBucketMs = 100
+
+// alignment is how well one song's hits line up with the sample.
+type alignment struct {
+	score    float64 // hits in the best offset bucket, or their total weight
+	aligned  int     // hits in that bucket
+	offsetMs int32   // that bucket's offset
+}
+
+// alignmentScore finds the largest group of (sampleTime, dbTime) pairs
+// sharing the same offset, by count, or by total weight when weights (one
+// per pair) is given.
+func alignmentScore(times [][2]uint32, weights []float64) alignment {
+	var best alignment
+	found := false
+	for _, bucket := range offsetHistogram(times, weights) {
+		// buckets tying on weight are told apart by hit count, then by
+		// the earlier offset, so the result doesn't depend on map order
+		if !found || bucket.Weight > best.score ||
+			bucket.Weight == best.score && (bucket.Hits > best.aligned ||
+				bucket.Hits == best.aligned && bucket.OffsetMs < best.offsetMs) {
+			best = alignment{bucket.Weight, bucket.Hits, bucket.OffsetMs}
+			found = true
 		}
+	}
+	return best
+}
+
+// OffsetBucket is one bar of the offset histogram: the hits whose song
+// time minus sample time, truncated towards zero to a multiple of
+// offsetBucketMs, is OffsetMs.
+type OffsetBucket struct {
+	OffsetMs int32
+	Hits     int
+	Weight   float64 // equals Hits unless IDF weights were given
+}
 
-		scores[songID] = float64(maxCount)
+// offsetHistogram buckets (sampleTime, dbTime) pairs by offset, weighting
+// each pair by weights[i] when weights is given.
+func offsetHistogram(times [][2]uint32, weights []float64) map[int32]*OffsetBucket {
+	buckets := make(map[int32]*OffsetBucket)
+
+	for i, timePair := range times {
+		sampleTime := int32(timePair[0])
+		dbTime := int32(timePair[1])
+		offset := dbTime - sampleTime
+
+		// bin offsets to allow for small timing variations
+		key := offset / offsetBucketMs
+		bucket, ok := buckets[key]
+		if !ok {
+			bucket = &OffsetBucket{OffsetMs: key * offsetBucketMs}
+			buckets[key] = bucket
+		}
+		bucket.Hits++
+		if weights != nil {
+			bucket.Weight += weights[i]
+		} else {
+			bucket.Weight++
+		}
 	}
 
-	return scores
+	return buckets
+}
+
+// AlignmentReport explains how one song scores against a sample.
+type AlignmentReport struct {
+	SampleFingerprints int     // fingerprints in the sample
+	Hits               int     // stored fingerprints of the song sharing an address with the sample
+	Score              float64 // what FindMatchesFGP would score the song
+	Buckets            []OffsetBucket
+}
+
+// ExplainMatch scores a single song against the sample like FindMatchesFGP
+// does under opts, but returns the whole offset histogram, best bucket
+// first. the best bucket's offset is where in the song the sample
+// starts.
+func ExplainMatch(dbClient db.DBClient, sampleFingerprint map[uint32]uint32, songID uint32, opts MatchOptions) (AlignmentReport, error) {
+	addresses := make([]uint32, 0, len(sampleFingerprint))
+	for address := range sampleFingerprint {
+		addresses = append(addresses, address)
+	}
+
+	couples, err := dbClient.GetCouplesForSongs(addresses, []uint32{songID})
+	if err != nil {
+		return AlignmentReport{}, err
+	}
+
+	var addressWeights map[uint32]float64
+	if opts.IDFWeighting {
+		addressWeights, err = addressDF.weights(dbClient, addresses)
+		if err != nil {
+			return AlignmentReport{}, err
+		}
+	}
+
+	var times [][2]uint32
+	var weights []float64
+	for address, found := range couples {
+		for _, couple := range found {
+			if couple.SongID != songID {
+				continue
+			}
+			times = append(times, [2]uint32{sampleFingerprint[address], couple.AnchorTimeMs})
+			if addressWeights != nil {
+				weights = append(weights, addressWeights[address])
+			}
+		}
+	}
+
+	report := AlignmentReport{
+		SampleFingerprints: len(sampleFingerprint),
+		Hits:               len(times),
+		Score:              alignmentScore(times, weights).score,
+	}
+	for _, bucket := range offsetHistogram(times, weights) {
+		report.Buckets = append(report.Buckets, *bucket)
+	}
+	sort.Slice(report.Buckets, func(i, j int) bool {
+		a, b := report.Buckets[i], report.Buckets[j]
+		if a.Weight != b.Weight {
+			return a.Weight > b.Weight
+		}
+		if a.Hits != b.Hits {
+			return a.Hits > b.Hits
+		}
+		return a.OffsetMs < b.OffsetMs
+	})
+	return report, nil
 }
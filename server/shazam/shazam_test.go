@@ -0,0 +1,459 @@
+package shazam
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"song-recognition/db"
+	"testing"
+	"time"
+)
+
+func TestMatchSameAcrossBackends(t *testing.T) {
+	cfg := DefaultMusicConfig()
+	dir := t.TempDir()
+	rows, err := db.NewSQLiteClient(filepath.Join(dir, "rows.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	postings, err := db.NewSQLitePostingsClient(filepath.Join(dir, "postings.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer postings.Close()
+
+	clients := map[string]db.DBClient{"memory": db.NewMemoryClient(), "sqlite": rows, "sqlite-postings": postings}
+	results := make(map[string][]Match)
+	for name, client := range clients {
+		indexTestSongs(t, client, cfg, 3)
+		matches, _, err := FindMatchesFGP(client, testClip(t, 1, 5, 5, cfg), nil, 3, MatchOptions{})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(matches) == 0 || matches[0].SongTitle != "song 1" {
+			t.Fatalf("%s: clip of song 1 matched %+v", name, matches)
+		}
+		results[name] = matches
+	}
+
+	// IDs differ per backend; everything else must not
+	want := results["memory"]
+	for name, got := range results {
+		if len(got) != len(want) {
+			t.Errorf("%s: %d matches, memory has %d", name, len(got), len(want))
+			continue
+		}
+		for i := range want {
+			g, w := got[i], want[i]
+			g.SongID, w.SongID = 0, 0
+			if g != w {
+				t.Errorf("%s: match %d = %+v, memory has %+v", name, i, g, w)
+			}
+		}
+	}
+}
+
+func TestTruncatedSearchResolvesLimit(t *testing.T) {
+	cfg := DefaultMusicConfig()
+	client := db.NewMemoryClient()
+	indexTestSongs(t, client, cfg, 6)
+	sample := testClip(t, 2, 4, 8, cfg)
+
+	all, _, err := FindMatchesFGP(client, sample, nil, 1, MatchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) < 4 {
+		t.Fatalf("clip only hits %d songs, the test needs 4", len(all))
+	}
+
+	// out of time before the first candidate is resolved
+	opts := MatchOptions{MaxSearchDuration: time.Nanosecond}
+	for _, limit := range []int{1, 3} {
+		matches, _, truncated, err := FindMatchesContext(context.Background(), client, sample, nil, limit, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !truncated || len(matches) != limit {
+			t.Errorf("limit %d: %d matches (truncated=%v), want %d truncated", limit, len(matches), truncated, limit)
+		}
+	}
+}
+
+func TestMinSongFingerprints(t *testing.T) {
+	cfg := DefaultMusicConfig()
+	client := db.NewMemoryClient()
+	ids := indexTestSongs(t, client, cfg, 3)
+	clip := testClip(t, 1, 5, 5, cfg)
+	counts, err := client.CountFingerprintsForSongs([]uint32{ids[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for floor, kept := range map[int]bool{0: true, counts[ids[1]]: true, counts[ids[1]] + 1: false} {
+		matches, _, err := FindMatchesFGP(client, clip, nil, 3, MatchOptions{MinSongFingerprints: floor})
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := slices.ContainsFunc(matches, func(m Match) bool { return m.SongID == ids[1] })
+		if found != kept {
+			t.Errorf("floor %d with %d fingerprints: song 1 returned = %v, want %v", floor, counts[ids[1]], found, kept)
+		}
+	}
+}
+
+func TestFindMatchesUsesGivenClient(t *testing.T) {
+	cfg := DefaultMusicConfig()
+	withSong, empty := db.NewMemoryClient(), db.NewMemoryClient()
+	indexTestSongs(t, withSong, cfg, 1)
+	sample := testClip(t, 0, 3, 5, cfg)
+
+	if matches, _, err := FindMatchesFGP(empty, sample, nil, 1, MatchOptions{}); err != nil || len(matches) != 0 {
+		t.Errorf("empty client: %v, %v; want no matches", matches, err)
+	}
+	// twice, as the caller still owns the client afterwards
+	for i := 0; i < 2; i++ {
+		matches, _, err := FindMatchesFGP(withSong, sample, nil, 1, MatchOptions{})
+		if err != nil || len(matches) == 0 || matches[0].SongTitle != "song 0" {
+			t.Fatalf("search %d: %v, %v; want song 0", i, matches, err)
+		}
+	}
+}
+
+func TestFindMatchesRestrictedToSongs(t *testing.T) {
+	cfg := DefaultMusicConfig()
+	client := db.NewMemoryClient()
+	ids := indexTestSongs(t, client, cfg, 3)
+	clip := testClip(t, 1, 5, 5, cfg)
+
+	// song 1 is by far the best match, but isn't among the candidates
+	others := []uint32{ids[0], ids[2]}
+	matches, _, err := FindMatchesFGP(client, clip, others, 3, MatchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range matches {
+		if !slices.Contains(others, m.SongID) {
+			t.Errorf("restricted search returned %q", m.SongTitle)
+		}
+	}
+
+	matches, _, err = FindMatchesFGP(client, clip, []uint32{ids[1], ids[2]}, 3, MatchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) == 0 || matches[0].SongID != ids[1] {
+		t.Errorf("search restricted to songs 1 and 2 matched %+v, want song 1 first", matches)
+	}
+}
+
+// candidateHits returns hits for n candidate songs, each with a run of
+// aligned hits at its own offset among scattered ones, and weights for
+// every other song.
+func candidateHits(n int) (map[uint32][][2]uint32, map[uint32][]float64) {
+	rng := rand.New(rand.NewSource(1))
+	matches := make(map[uint32][][2]uint32, n)
+	weights := make(map[uint32][]float64)
+	for song := uint32(1); song <= uint32(n); song++ {
+		offset := uint32(rng.Intn(600000))
+		var hits [][2]uint32
+		for i := 0; i < 20+rng.Intn(200); i++ {
+			sample := uint32(rng.Intn(10000))
+			if i%3 == 0 {
+				hits = append(hits, [2]uint32{sample, sample + offset})
+			} else {
+				hits = append(hits, [2]uint32{sample, uint32(rng.Intn(600000))})
+			}
+		}
+		matches[song] = hits
+		if song%2 == 0 {
+			w := make([]float64, len(hits))
+			for i := range w {
+				w[i] = rng.Float64()
+			}
+			weights[song] = w
+		}
+	}
+	return matches, weights
+}
+
+func TestScoreCandidatesMatchesSerial(t *testing.T) {
+	matches, weights := candidateHits(500)
+	serial := analyzeRelativeTiming(matches, weights)
+	for _, workers := range []int{2, 8, 1000} {
+		if got := scoreCandidates(matches, weights, workers); !reflect.DeepEqual(got, serial) {
+			t.Errorf("%d workers scored differently from the serial version", workers)
+		}
+	}
+}
+
+func TestFindMatchesParallelEqualsSerial(t *testing.T) {
+	cfg := DefaultMusicConfig()
+	client := db.NewMemoryClient()
+	indexTestSongs(t, client, cfg, 6)
+	clip := testClip(t, 3, 4, 6, cfg)
+
+	serial, _, err := FindMatchesFGP(client, clip, nil, 6, MatchOptions{Workers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serial) < 2 {
+		t.Fatalf("only %d matches; nothing to compare", len(serial))
+	}
+	for i := 0; i < 5; i++ {
+		parallel, _, err := FindMatchesFGP(client, clip, nil, 6, MatchOptions{Workers: 8})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(parallel, serial) {
+			t.Fatalf("parallel matches %+v, serial %+v", parallel, serial)
+		}
+	}
+}
+
+func BenchmarkScoreCandidates(b *testing.B) {
+	matches, weights := candidateHits(5000)
+	for _, run := range []struct {
+		name    string
+		workers int
+	}{{"serial", 1}, {"parallel", runtime.NumCPU()}} {
+		b.Run(run.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				scoreCandidates(matches, weights, run.workers)
+			}
+		})
+	}
+}
+
+func TestSortMatches(t *testing.T) {
+	want := []Match{
+		{SongID: 9, Score: 7.5, AlignedMatches: 3},
+		{SongID: 4, Score: 5, AlignedMatches: 6},
+		{SongID: 2, Score: 5, AlignedMatches: 5},
+		{SongID: 7, Score: 5, AlignedMatches: 5},
+		{SongID: 1, Score: 2, AlignedMatches: 9},
+	}
+	rng := rand.New(rand.NewSource(1))
+	for range 20 {
+		matches := slices.Clone(want)
+		rng.Shuffle(len(matches), func(i, j int) { matches[i], matches[j] = matches[j], matches[i] })
+		sortMatches(matches)
+		if !reflect.DeepEqual(matches, want) {
+			t.Fatalf("sorted to %+v, want %+v", matches, want)
+		}
+	}
+}
+
+func TestTiedMatchesOrderedBySongID(t *testing.T) {
+	cfg := DefaultMusicConfig()
+	client := db.NewMemoryClient()
+	fps, _, err := AnalyzeSamples(testAudio(1, testRate, testSongSec, 3000), testRate, 0, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// three copies of the same audio score exactly alike
+	var ids []uint32
+	for _, title := range []string{"copy a", "copy b", "copy c"} {
+		id, err := client.RegisterSong(title, "artist", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for address, couple := range fps {
+			couple.SongID = id
+			fps[address] = couple
+		}
+		if err := client.StoreFingerprints(fps); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	clip := testClip(t, 0, 4, 6, cfg)
+	for range 10 {
+		matches, _, err := FindMatchesFGP(client, clip, nil, 3, MatchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []uint32
+		for _, m := range matches {
+			if m.Score != matches[0].Score {
+				t.Fatalf("copies scored differently: %+v", matches)
+			}
+			got = append(got, m.SongID)
+		}
+		if !slices.Equal(got, ids) {
+			t.Fatalf("tied matches in order %v, want %v", got, ids)
+		}
+	}
+}
+
+func TestExplainMatch(t *testing.T) {
+	cfg := DefaultMusicConfig()
+	client := db.NewMemoryClient()
+	ids := indexTestSongs(t, client, cfg, 3)
+	clip := testClip(t, 1, 6, 5, cfg)
+
+	matches, _, err := FindMatchesFGP(client, clip, nil, 3, MatchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) == 0 || matches[0].SongID != ids[1] {
+		t.Fatalf("clip of song 1 matched %+v", matches)
+	}
+
+	report, err := ExplainMatch(client, clip, ids[1], MatchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.SampleFingerprints != len(clip) || report.Score != matches[0].Score {
+		t.Errorf("report of %d fingerprints scoring %g, want %d scoring %g as in the search",
+			report.SampleFingerprints, report.Score, len(clip), matches[0].Score)
+	}
+	if len(report.Buckets) == 0 || report.Buckets[0].OffsetMs != matches[0].OffsetMs {
+		t.Fatalf("best bucket %+v, want the search's offset %dms", report.Buckets, matches[0].OffsetMs)
+	}
+	hits := 0
+	for i, bucket := range report.Buckets {
+		if i > 0 && bucket.Weight > report.Buckets[i-1].Weight {
+			t.Errorf("bucket %d outweighs the one before it: %+v", i, report.Buckets[:i+1])
+		}
+		hits += bucket.Hits
+	}
+	if hits != report.Hits || report.Buckets[0].Hits != matches[0].AlignedMatches {
+		t.Errorf("buckets hold %d hits of %d, best %d; the search aligned %d",
+			hits, report.Hits, report.Buckets[0].Hits, matches[0].AlignedMatches)
+	}
+
+	// a song the clip isn't from has no strong bucket
+	other, err := ExplainMatch(client, clip, ids[0], MatchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Score >= report.Score/4 {
+		t.Errorf("unrelated song scores %g against %g", other.Score, report.Score)
+	}
+}
+
+// spedUpAudio is like testAudio, with its own tone sequence, as played
+// speed times faster with the pitch kept: every tone lasts 200ms/speed.
+func spedUpAudio(seed int64, sampleRate int, sec, speed float64) []float64 {
+	rng := rand.New(rand.NewSource(seed))
+	noise := rand.New(rand.NewSource(-seed))
+	step := int(float64(sampleRate) / 5 / speed)
+	samples := make([]float64, int(sec*float64(sampleRate)))
+	var freqs [3]float64
+	for i := range samples {
+		if i%step == 0 {
+			for j := range freqs {
+				freqs[j] = 100 + rng.Float64()*2900
+			}
+		}
+		t := float64(i) / float64(sampleRate)
+		var v float64
+		for j, f := range freqs {
+			v += math.Sin(2*math.Pi*f*t) / float64(j+2)
+		}
+		samples[i] = 0.5*v + 0.01*(noise.Float64()*2-1)
+	}
+	return samples
+}
+
+func TestSpeedScalesMatchSpedUpClip(t *testing.T) {
+	single := DefaultAudiobookConfig()
+	multi := single
+	multi.SpeedScales = MultiResolutionSpeeds
+	if err := multi.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		cfg  FingerprintConfig
+	}{{"single", single}, {"multi", multi}} {
+		client := db.NewMemoryClient()
+		for i := 0; i < 3; i++ {
+			id, err := client.RegisterSong(fmt.Sprintf("song %d", i), "artist", "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			fps, _, err := analyzeChunk(spedUpAudio(int64(i+1), testRate, 60, 1), testRate, id, tc.cfg, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := client.StoreFingerprints(fps); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// 12 seconds of song 1 at 1.5x
+		clipFP, _, err := analyzeChunk(spedUpAudio(2, testRate, 12, 1.5), testRate, 0, tc.cfg, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		matches, _, err := FindMatchesFGP(client, SampleFingerprint(clipFP, tc.cfg), nil, 3, MatchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a clear match stands well above the chance hits of other songs
+		clear := len(matches) > 1 && matches[0].SongTitle == "song 1" && matches[0].Score >= 10 && matches[0].Score >= 3*matches[1].Score
+		if clear != (tc.name == "multi") {
+			t.Errorf("%s resolution: sped-up clip of song 1 matched %+v", tc.name, matches)
+		}
+	}
+
+	for _, speed := range []float64{1, 0.25, 3} {
+		multi.SpeedScales = []float64{speed}
+		if err := multi.Validate(); err == nil {
+			t.Errorf("speed scale %g accepted", speed)
+		}
+	}
+}
+
+func TestMatchesHoldOneEntryPerSong(t *testing.T) {
+	cfg := DefaultMusicConfig()
+	client := db.NewMemoryClient()
+	ids := indexTestSongs(t, client, cfg, 3)
+
+	// a clip with two passages of song 1, which align at different offsets
+	audio := testAudio(2, testRate, testSongSec, 3000)
+	clip := append(slices.Clone(audio[2*testRate:6*testRate]), audio[12*testRate:16*testRate]...)
+	fps, _, err := AnalyzeSamples(clip, testRate, 0, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sample := SampleFingerprint(fps, cfg)
+
+	matches, _, err := FindMatchesFGP(client, sample, nil, 10, MatchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[uint32]bool{}
+	for _, m := range matches {
+		if seen[m.SongID] {
+			t.Errorf("%q listed more than once: %+v", m.SongTitle, matches)
+		}
+		seen[m.SongID] = true
+	}
+	if len(matches) == 0 || matches[0].SongID != ids[1] {
+		t.Fatalf("clip of song 1 matched %+v", matches)
+	}
+
+	// both passages are in the histogram, the weaker one only there
+	report, err := ExplainMatch(client, sample, ids[1], MatchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Buckets) < 2 || report.Buckets[1].Hits < report.Buckets[0].Hits/3 {
+		t.Errorf("second passage missing from the histogram: %+v", report.Buckets[:min(3, len(report.Buckets))])
+	}
+	// the passages start 2s and 12s into the song, 0s and 4s into the clip
+	if apart := math.Abs(float64(report.Buckets[1].OffsetMs - report.Buckets[0].OffsetMs)); math.Abs(apart-6000) > offsetBucketMs {
+		t.Errorf("the two passages' buckets are %gms apart, want about 6s", apart)
+	}
+}
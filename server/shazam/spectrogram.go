@@ -10,8 +10,9 @@ import (
 func Spectrogram(sample []float64, sampleRate int, cfg FingerprintConfig) ([][]float64, error) {
 	filteredSample := LowPassFilter(cfg.MaxFreqHz, float64(sampleRate), sample)
 
-	targetRate := sampleRate / cfg.DSPRatio
-	downsampledSample, err := Downsample(filteredSample, sampleRate, targetRate)
+	// downsample by exactly DSPRatio so the output rate is
+	// EffectiveSampleRate, which is what ExtractPeaks assumes
+	downsampledSample, err := downsampleByRatio(cfg.DownsampleMethod, filteredSample, float64(cfg.DSPRatio))
 	if err != nil {
 		return nil, fmt.Errorf("couldn't downsample audio sample: %v", err)
 	}
@@ -25,27 +26,41 @@ func Spectrogram(sample []float64, sampleRate int, cfg FingerprintConfig) ([][]f
 		window[i] = 0.5 - 0.5*math.Cos(theta) // hanning
 	}
 
-	spectrogram := make([][]float64, 0, len(downsampledSample)/cfg.HopSize)
+	spectrogram := make([][]float64, 0, len(downsampledSample)/cfg.HopSize+1)
 
-	for start := 0; start+cfg.WindowSize <= len(downsampledSample); start += cfg.HopSize {
-		frame := make([]float64, cfg.WindowSize)
-		copy(frame, downsampledSample[start:start+cfg.WindowSize])
+	start := 0
+	coveredEnd := 0
+	for ; start+cfg.WindowSize <= len(downsampledSample); start += cfg.HopSize {
+		spectrogram = append(spectrogram, frameMagnitude(downsampledSample[start:start+cfg.WindowSize], window))
+		coveredEnd = start + cfg.WindowSize
+	}
 
-		for j := range window {
-			frame[j] *= window[j]
-		}
+	// the loop above only takes full windows, so up to a window of audio at
+	// the end is never analysed. optionally zero-pad one more frame for it.
+	if cfg.PadFinalFrame && coveredEnd < len(downsampledSample) && start < len(downsampledSample) {
+		spectrogram = append(spectrogram, frameMagnitude(downsampledSample[start:], window))
+	}
 
-		fftResult := FFT(frame)
+	return spectrogram, nil
+}
 
-		magnitude := make([]float64, len(fftResult)/2)
-		for j := range magnitude {
-			magnitude[j] = cmplx.Abs(fftResult[j])
-		}
+// frameMagnitude windows samples (zero-padded to len(window) if short)
+// and returns the magnitude of the positive-frequency FFT bins.
+func frameMagnitude(samples []float64, window []float64) []float64 {
+	frame := make([]float64, len(window))
+	copy(frame, samples)
 
-		spectrogram = append(spectrogram, magnitude)
+	for j := range window {
+		frame[j] *= window[j]
 	}
 
-	return spectrogram, nil
+	fftResult := FFT(frame)
+
+	magnitude := make([]float64, len(fftResult)/2)
+	for j := range magnitude {
+		magnitude[j] = cmplx.Abs(fftResult[j])
+	}
+	return magnitude
 }
 
 // LowPassFilter is a first-order low-pass filter that attenuates high
@@ -71,7 +86,16 @@ func LowPassFilter(cutoffFrequency, sampleRate float64, input []float64) []float
 }
 
 // Downsample downsamples the input audio from originalSampleRate to targetSampleRate
+// by averaging blocks of samples (DownsampleAverage). the rate ratio need
+// not be an integer: block boundaries are placed at multiples of the exact
+// fractional ratio, so the output rate is exactly targetSampleRate.
 func Downsample(input []float64, originalSampleRate, targetSampleRate int) ([]float64, error) {
+	return DownsampleWith(DownsampleAverage, input, originalSampleRate, targetSampleRate)
+}
+
+// DownsampleWith resamples input from originalSampleRate to
+// targetSampleRate using the given method. see DownsampleMethod.
+func DownsampleWith(method DownsampleMethod, input []float64, originalSampleRate, targetSampleRate int) ([]float64, error) {
 	if targetSampleRate <= 0 || originalSampleRate <= 0 {
 		return nil, errors.New("sample rates must be positive")
 	}
@@ -79,23 +103,68 @@ func Downsample(input []float64, originalSampleRate, targetSampleRate int) ([]fl
 		return nil, errors.New("target sample rate must be less than or equal to original sample rate")
 	}
 
-	ratio := originalSampleRate / targetSampleRate
-	if ratio <= 0 {
-		return nil, errors.New("invalid ratio calculated from sample rates")
+	return downsampleByRatio(method, input, float64(originalSampleRate)/float64(targetSampleRate))
+}
+
+// EffectiveSampleRate is the sample rate Spectrogram actually analyses
+// after reducing sampleRate by cfg.DSPRatio. it is kept fractional
+// (e.g. 44100/8 = 5512.5 Hz) so frame times and bin frequencies derived
+// from it match the resampled signal exactly.
+func EffectiveSampleRate(sampleRate int, cfg FingerprintConfig) float64 {
+	return float64(sampleRate) / float64(cfg.DSPRatio)
+}
+
+// downsampleByRatio reduces the rate of input by ratio (>= 1), which may
+// be fractional. output sample k covers input positions [k*ratio, (k+1)*ratio).
+func downsampleByRatio(method DownsampleMethod, input []float64, ratio float64) ([]float64, error) {
+	if ratio < 1 || math.IsNaN(ratio) || math.IsInf(ratio, 0) {
+		return nil, fmt.Errorf("invalid downsample ratio %g", ratio)
 	}
 
-	resampled := make([]float64, 0, len(input)/ratio)
-	for i := 0; i < len(input); i += ratio {
-		end := i + ratio
-		if end > len(input) {
-			end = len(input)
+	outLen := int(math.Ceil(float64(len(input)) / ratio))
+	resampled := make([]float64, 0, outLen)
+
+	switch method {
+	case DownsampleAverage:
+		for k := 0; k < outLen; k++ {
+			start := int(float64(k) * ratio)
+			end := int(float64(k+1) * ratio)
+			if end > len(input) {
+				end = len(input)
+			}
+			if end <= start {
+				end = start + 1
+			}
+
+			sum := 0.0
+			for j := start; j < end; j++ {
+				sum += input[j]
+			}
+			resampled = append(resampled, sum/float64(end-start))
+		}
+
+	// decimation does no filtering of its own, so it relies on the
+	// LowPassFilter run beforehand to suppress aliasing, but unlike
+	// averaging it doesn't smear transients across the block
+	case DownsampleDecimate:
+		for k := 0; k < outLen; k++ {
+			resampled = append(resampled, input[int(float64(k)*ratio)])
 		}
 
-		sum := 0.0
-		for j := i; j < end; j++ {
-			sum += input[j]
+	case DownsampleLinear:
+		for k := 0; k < outLen; k++ {
+			pos := float64(k) * ratio
+			idx := int(pos)
+			frac := pos - float64(idx)
+			if idx+1 < len(input) {
+				resampled = append(resampled, input[idx]*(1-frac)+input[idx+1]*frac)
+			} else {
+				resampled = append(resampled, input[idx])
+			}
 		}
-		resampled = append(resampled, sum/float64(end-i))
+
+	default:
+		return nil, fmt.Errorf("unknown downsample method %d", method)
 	}
 
 	return resampled, nil
@@ -105,31 +174,102 @@ func Downsample(input []float64, originalSampleRate, targetSampleRate int) ([]fl
 type Peak struct {
 	Freq float64 // frequency in Hz
 	Time float64 // time in seconds
+	Mag  float64 // spectrogram magnitude of the bin; with NormalizeBands, relative to its band's level
+}
+
+// FrameDuration is the time between the starts of consecutive
+// spectrogram frames of audio at sampleRate: HopSize samples at the
+// downsampled rate. it holds with overlapping frames and doesn't depend
+// on how much of the tail was left out of the last frame.
+func FrameDuration(sampleRate int, cfg FingerprintConfig) float64 {
+	return float64(cfg.HopSize) / EffectiveSampleRate(sampleRate, cfg)
+}
+
+// peakTimeOffset is how far after the start of its frame a peak is
+// placed: half a window with CenterPeakTimes, otherwise nothing.
+func peakTimeOffset(sampleRate int, cfg FingerprintConfig) float64 {
+	if !cfg.CenterPeakTimes {
+		return 0
+	}
+	return float64(cfg.WindowSize) / 2 / EffectiveSampleRate(sampleRate, cfg)
+}
+
+// bandMax is the strongest bin of one frequency band in one frame.
+type bandMax struct {
+	mag     float64
+	freqIdx int
+}
+
+// bandLevelSec is the time constant of the running level each band is
+// divided by with NormalizeBands.
+const bandLevelSec = 5.0
+
+// bandLevelFloor keeps a band that has been silent from dividing by zero.
+const bandLevelFloor = 1e-9
+
+// bandLeakageRatio is how far (-60 dB in magnitude) a band may sit below
+// the frame's loudest one before NormalizeBands treats it as window
+// leakage from that band rather than content of its own, which dividing
+// by a near-silent band's level would otherwise turn into peaks.
+const bandLeakageRatio = 1e-3
+
+// normalizeBands divides every band maximum by the band's running level,
+// an exponential moving average of its maxima over about bandLevelSec,
+// so bands compete on how far they rise above their own level instead of
+// on raw energy. the level starts at the band's mean over the first
+// bandLevelSec, so the opening frames are compared against something.
+// bands below bandLeakageRatio of the frame's loudest are zeroed. every
+// frame must have the same bands.
+func normalizeBands(maxima [][]bandMax, frameDuration float64) {
+	if len(maxima) == 0 || len(maxima[0]) == 0 {
+		return
+	}
+	bands := len(maxima[0])
+	alpha := math.Min(frameDuration/bandLevelSec, 1)
+
+	warmup := maxima[:min(len(maxima), max(1, int(math.Ceil(bandLevelSec/frameDuration))))]
+	level := make([]float64, bands)
+	for _, frame := range warmup {
+		for b, m := range frame {
+			level[b] += m.mag / float64(len(warmup))
+		}
+	}
+
+	for _, frame := range maxima {
+		var loudest float64
+		for _, m := range frame {
+			loudest = math.Max(loudest, m.mag)
+		}
+		for b := range frame {
+			raw := frame[b].mag
+			if raw < loudest*bandLeakageRatio {
+				frame[b].mag = 0
+			} else {
+				frame[b].mag = raw / (level[b] + bandLevelFloor)
+			}
+			level[b] += alpha * (raw - level[b])
+		}
+	}
 }
 
 // ExtractPeaks analyzes a spectrogram and extracts significant peaks
-// in the frequency domain over time.
-func ExtractPeaks(spectrogram [][]float64, audioDuration float64, sampleRate int, cfg FingerprintConfig) []Peak {
+// in the frequency domain over time. sampleRate is the rate of the audio
+// before downsampling.
+func ExtractPeaks(spectrogram [][]float64, sampleRate int, cfg FingerprintConfig) []Peak {
 	if len(spectrogram) < 1 {
 		return []Peak{}
 	}
 
-	type bandMax struct {
-		mag     float64
-		freqIdx int
-	}
-
-	effectiveSampleRate := float64(sampleRate) / float64(cfg.DSPRatio)
+	effectiveSampleRate := EffectiveSampleRate(sampleRate, cfg)
 	freqResolution := effectiveSampleRate / float64(cfg.WindowSize)
-	frameDuration := audioDuration / float64(len(spectrogram))
+	frameDuration := FrameDuration(sampleRate, cfg)
+	timeOffset := peakTimeOffset(sampleRate, cfg)
 
 	halfWindow := cfg.WindowSize / 2
 
-	var peaks []Peak
+	// the strongest bin of every band in every frame, frame by frame
+	maxima := make([][]bandMax, len(spectrogram))
 	for frameIdx, frame := range spectrogram {
-		var maxMags []float64
-		var freqIndices []int
-
 		for _, band := range cfg.FreqBands {
 			hi := band[1]
 			if hi > halfWindow {
@@ -148,26 +288,32 @@ func ExtractPeaks(spectrogram [][]float64, audioDuration float64, sampleRate int
 					best = bandMax{frame[idx], idx}
 				}
 			}
-
-			maxMags = append(maxMags, best.mag)
-			freqIndices = append(freqIndices, best.freqIdx)
+			maxima[frameIdx] = append(maxima[frameIdx], best)
 		}
+	}
 
-		if len(maxMags) == 0 {
+	if cfg.NormalizeBands {
+		normalizeBands(maxima, frameDuration)
+	}
+
+	var peaks []Peak
+	for frameIdx, frameMaxima := range maxima {
+		if len(frameMaxima) == 0 {
 			continue
 		}
 
 		var sum float64
-		for _, m := range maxMags {
-			sum += m
+		for _, m := range frameMaxima {
+			sum += m.mag
 		}
-		avg := sum / float64(len(maxMags))
+		avg := sum / float64(len(frameMaxima))
 
-		for i, mag := range maxMags {
-			if mag > avg {
+		for _, m := range frameMaxima {
+			if m.mag > avg {
 				peaks = append(peaks, Peak{
-					Time: float64(frameIdx) * frameDuration,
-					Freq: float64(freqIndices[i]) * freqResolution,
+					Time: float64(frameIdx)*frameDuration + timeOffset,
+					Freq: float64(m.freqIdx) * freqResolution,
+					Mag:  m.mag,
 				})
 			}
 		}
@@ -0,0 +1,260 @@
+package shazam
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestCenterPeakTimesIsOptIn(t *testing.T) {
+	for name := range configProfiles {
+		if cfg, _ := ConfigByName(name); cfg.CenterPeakTimes {
+			t.Errorf("%s profile centres peak times by default", name)
+		}
+	}
+
+	cfg := DefaultMusicConfig()
+	samples := testAudio(5, testRate, 3, 3000)
+	_, plain, err := AnalyzeSamples(samples, testRate, 0, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.CenterPeakTimes = true
+	_, centred, err := AnalyzeSamples(samples, testRate, 0, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(plain) == 0 || len(plain) != len(centred) {
+		t.Fatalf("%d peaks without centring, %d with", len(plain), len(centred))
+	}
+	halfWindow := float64(cfg.WindowSize) / 2 / EffectiveSampleRate(testRate, cfg)
+	for i := range plain {
+		if d := centred[i].Time - plain[i].Time; math.Abs(d-halfWindow) > 1e-9 {
+			t.Fatalf("peak %d moved by %gs, want half a window (%gs)", i, d, halfWindow)
+		}
+	}
+}
+
+func TestNormalizeBandsIsOptIn(t *testing.T) {
+	for name := range configProfiles {
+		if cfg, _ := ConfigByName(name); cfg.NormalizeBands {
+			t.Errorf("%s profile normalizes bands by default", name)
+		}
+	}
+
+	// a loud bass line under quiet higher tones
+	samples := testAudio(7, testRate, 5, 3000)
+	for i := range samples {
+		tSec := float64(i) / testRate
+		samples[i] = 0.05*samples[i] + 0.8*math.Sin(2*math.Pi*70*tSec)
+	}
+	highPeaks := func(normalize bool) int {
+		cfg := DefaultMusicConfig()
+		cfg.NormalizeBands = normalize
+		_, peaks, err := AnalyzeSamples(samples, testRate, 0, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, p := range peaks {
+			if p.Freq > 500 {
+				n++
+			}
+		}
+		return n
+	}
+	plain, normalized := highPeaks(false), highPeaks(true)
+	if normalized <= plain {
+		t.Errorf("peaks above 500 Hz: %d normalized, %d without; normalizing should add some", normalized, plain)
+	}
+}
+
+func BenchmarkSpectrogram(b *testing.B) {
+	samples := testAudio(1, testRate, benchAudioSec, 3000)
+	benchProfiles(b, func(b *testing.B, cfg FingerprintConfig) {
+		for i := 0; i < b.N; i++ {
+			if _, err := Spectrogram(samples, testRate, cfg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkExtractPeaks(b *testing.B) {
+	samples := testAudio(1, testRate, benchAudioSec, 3000)
+	benchProfiles(b, func(b *testing.B, cfg FingerprintConfig) {
+		spectro, err := Spectrogram(samples, testRate, cfg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			ExtractPeaks(spectro, testRate, cfg)
+		}
+	})
+}
+
+func TestPadFinalFrame(t *testing.T) {
+	cfg := DefaultMusicConfig()
+	samples := testAudio(2, testRate, 2.013, 3000)
+	plain, err := Spectrogram(samples, testRate, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.PadFinalFrame = true
+	padded, err := Spectrogram(samples, testRate, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(padded) != len(plain)+1 {
+		t.Fatalf("%d frames with PadFinalFrame, %d without; want one more", len(padded), len(plain))
+	}
+	if !reflect.DeepEqual(padded[:len(plain)], plain) {
+		t.Error("padding changed the full frames")
+	}
+	energy := 0.0
+	for _, m := range padded[len(plain)] {
+		energy += m
+	}
+	if energy == 0 {
+		t.Error("the padded frame is empty, though the tail has audio")
+	}
+}
+
+func TestDownsampleMethods(t *testing.T) {
+	ramp := []float64{0, 1, 2, 3, 4, 5, 6, 7}
+	for method, want := range map[DownsampleMethod][]float64{
+		DownsampleAverage:  {0.5, 2.5, 4.5, 6.5},
+		DownsampleDecimate: {0, 2, 4, 6},
+		DownsampleLinear:   {0, 2, 4, 6},
+	} {
+		got, err := DownsampleWith(method, ramp, 2000, 1000)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("method %d: %v, %v; want %v", method, got, err, want)
+		}
+	}
+
+	// between samples, linear interpolation follows the ramp
+	got, err := DownsampleWith(DownsampleLinear, ramp, 3000, 2000)
+	if want := []float64{0, 1.5, 3, 4.5, 6, 7}; err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("linear at 1.5x: %v, %v; want %v", got, err, want)
+	}
+
+	if _, err := DownsampleWith(DownsampleMethod(9), ramp, 2000, 1000); err == nil {
+		t.Error("an unknown method was accepted")
+	}
+	cfg := DefaultMusicConfig()
+	cfg.DownsampleMethod = DownsampleMethod(9)
+	if cfg.Validate() == nil {
+		t.Error("Validate accepted an unknown DownsampleMethod")
+	}
+}
+
+func TestDownsampleFractionalRatio(t *testing.T) {
+	// 1s of a 1 kHz sine at 44.1 kHz, down to 16 kHz: a 2.75625 ratio
+	in := make([]float64, 44100)
+	for i := range in {
+		in[i] = math.Sin(2 * math.Pi * 1000 * float64(i) / 44100)
+	}
+	for _, method := range []DownsampleMethod{DownsampleAverage, DownsampleDecimate, DownsampleLinear} {
+		out, err := DownsampleWith(method, in, 44100, 16000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) != 16000 {
+			t.Errorf("method %d: %d samples, want exactly 16000", method, len(out))
+		}
+		// a rounded ratio would shift the pitch by several percent
+		crossings := 0
+		for i := 1; i < len(out); i++ {
+			if (out[i-1] < 0) != (out[i] < 0) {
+				crossings++
+			}
+		}
+		if crossings < 1990 || crossings > 2010 {
+			t.Errorf("method %d: %d zero crossings, want about 2000 for 1 kHz", method, crossings)
+		}
+	}
+
+	if got := EffectiveSampleRate(44100, FingerprintConfig{DSPRatio: 8}); got != 5512.5 {
+		t.Errorf("EffectiveSampleRate = %g, want 5512.5", got)
+	}
+}
+
+func TestOverlappingFrames(t *testing.T) {
+	base, overlap := DefaultAudiobookConfig(), AudiobookOverlapConfig()
+	if cfg, err := ConfigByName("audiobook-overlap"); err != nil || cfg.HopSize != cfg.WindowSize/2 {
+		t.Fatalf("audiobook-overlap profile hops %d of a %d window (err %v), want half", cfg.HopSize, cfg.WindowSize, err)
+	}
+	if _, err := ConfigByName("podcast"); err == nil {
+		t.Error("unknown profile name accepted")
+	}
+	if FrameDuration(testRate, overlap) != FrameDuration(testRate, base)/2 {
+		t.Errorf("overlapping frames %gs apart, %gs without overlap; want half",
+			FrameDuration(testRate, overlap), FrameDuration(testRate, base))
+	}
+
+	const sec = 10.0
+	samples := testAudio(3, testRate, sec, 3000)
+	plain, err := Spectrogram(samples, testRate, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spectro, err := Spectrogram(samples, testRate, overlap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(spectro); n < 2*len(plain)-1 || n > 2*len(plain)+1 {
+		t.Errorf("%d overlapping frames, %d without overlap; want about twice as many", n, len(plain))
+	}
+
+	// every peak lies where its frame does, so the last window ends
+	// within the audio rather than the frames being stretched over all of it
+	peaks := ExtractPeaks(spectro, testRate, overlap)
+	window := float64(overlap.WindowSize) / EffectiveSampleRate(testRate, overlap)
+	last := peaks[len(peaks)-1].Time
+	if want := float64(len(spectro)-1) * FrameDuration(testRate, overlap); math.Abs(last-want) > 1e-9 {
+		t.Errorf("last peak at %gs, want frame %d at %gs", last, len(spectro)-1, want)
+	}
+	if last+window > sec {
+		t.Errorf("last peak's window ends at %gs, past the %gs of audio", last+window, sec)
+	}
+}
+
+func TestPeakTimesMatchOnset(t *testing.T) {
+	// silence, then a tone from onset to the end
+	const sec, onset = 10.0, 6.5
+	samples := make([]float64, int(sec*testRate))
+	for i := int(onset * testRate); i < len(samples); i++ {
+		samples[i] = 0.5 * math.Sin(2*math.Pi*440*float64(i)/testRate)
+	}
+
+	for name, cfg := range map[string]FingerprintConfig{
+		"music": DefaultMusicConfig(), "audiobook": DefaultAudiobookConfig(), "audiobook-overlap": AudiobookOverlapConfig(),
+	} {
+		window := float64(cfg.WindowSize) / EffectiveSampleRate(testRate, cfg)
+		for _, centre := range []bool{false, true} {
+			cfg.CenterPeakTimes = centre
+			spectro, err := Spectrogram(samples, testRate, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			peaks := ExtractPeaks(spectro, testRate, cfg)
+			if len(peaks) == 0 {
+				t.Fatalf("%s: no peaks", name)
+			}
+			// the first frame to pick up the tone is the first whose
+			// window reaches the onset
+			start := peaks[0].Time - peakTimeOffset(testRate, cfg)
+			if start <= onset-window || start > onset {
+				t.Errorf("%s (centred %v): first peak's frame starts at %.3fs, want within a %.3fs window before the onset at %gs",
+					name, centre, start, window, onset)
+			}
+			if centre && math.Abs(peaks[0].Time-onset) > window/2 {
+				t.Errorf("%s: centred peak at %.3fs, more than half a window from the onset at %gs", name, peaks[0].Time, onset)
+			}
+		}
+	}
+}
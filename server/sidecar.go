@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sidecar files `save` looks for in a directory to override the title
+// and author of the files in it. the CSV has rows of
+// "filename,title,author" (an optional header row starts with
+// "filename"); the JSON is an object mapping filenames to
+// {"title": ..., "author": ...}. filenames are relative to the directory.
+var sidecarNames = []string{"metadata.csv", "metadata.json"}
+
+// entryOverride replaces the tags or filename of one file; empty fields
+// keep the usual value.
+type entryOverride struct {
+	Title  string `json:"title"`
+	Author string `json:"author"`
+}
+
+// readSidecar loads the sidecar in dir, if there is one. the returned map
+// is keyed by the cleaned path of each file (dir joined with the
+// filename), and path is the sidecar that was read, "" if none.
+func readSidecar(dir string) (overrides map[string]entryOverride, path string, err error) {
+	for _, name := range sidecarNames {
+		candidate := filepath.Join(dir, name)
+		if _, err := os.Stat(candidate); err == nil {
+			path = candidate
+			break
+		}
+	}
+	if path == "" {
+		return nil, "", nil
+	}
+
+	var byName map[string]entryOverride
+	if strings.HasSuffix(path, ".json") {
+		byName, err = readSidecarJSON(path)
+	} else {
+		byName, err = readSidecarCSV(path)
+	}
+	if err != nil {
+		return nil, path, fmt.Errorf("error reading %s: %v", path, err)
+	}
+
+	overrides = make(map[string]entryOverride, len(byName))
+	for name, override := range byName {
+		if strings.TrimSpace(name) == "" {
+			return nil, path, fmt.Errorf("error reading %s: entry with an empty filename", path)
+		}
+		if override.Title == "" && override.Author == "" {
+			return nil, path, fmt.Errorf("error reading %s: %q sets neither title nor author", path, name)
+		}
+		overrides[filepath.Join(dir, filepath.FromSlash(name))] = override
+	}
+	return overrides, path, nil
+}
+
+func readSidecarCSV(path string) (map[string]entryOverride, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = 3
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) > 0 && strings.EqualFold(records[0][0], "filename") {
+		records = records[1:]
+	}
+
+	overrides := make(map[string]entryOverride, len(records))
+	for _, record := range records {
+		if _, dup := overrides[record[0]]; dup {
+			return nil, fmt.Errorf("%q is listed more than once", record[0])
+		}
+		overrides[record[0]] = entryOverride{Title: strings.TrimSpace(record[1]), Author: strings.TrimSpace(record[2])}
+	}
+	return overrides, nil
+}
+
+func readSidecarJSON(path string) (map[string]entryOverride, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var overrides map[string]entryOverride
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return nil, err
+	}
+	if overrides == nil {
+		return nil, errors.New("expected an object mapping filenames to {title, author}")
+	}
+	for name, override := range overrides {
+		overrides[name] = entryOverride{Title: strings.TrimSpace(override.Title), Author: strings.TrimSpace(override.Author)}
+	}
+	return overrides, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"song-recognition/utils"
+	"strings"
+	"testing"
+)
+
+func TestReadSidecar(t *testing.T) {
+	for _, tc := range []struct {
+		name, content string
+		want          map[string]entryOverride
+		err           string
+	}{
+		{"metadata.csv", "filename,title,author\na.wav, First ,Someone\nsub/b.wav,Second,\n",
+			map[string]entryOverride{"a.wav": {"First", "Someone"}, filepath.Join("sub", "b.wav"): {"Second", ""}}, ""},
+		{"metadata.json", `{"a.wav": {"title": "First"}, "b.wav": {"author": " Someone "}}`,
+			map[string]entryOverride{"a.wav": {"First", ""}, "b.wav": {"", "Someone"}}, ""},
+		{"metadata.csv", "a.wav,First,x\na.wav,Again,x\n", nil, "listed more than once"},
+		{"metadata.csv", "a.wav,,\n", nil, "sets neither title nor author"},
+		{"metadata.csv", "a.wav,First\n", nil, "wrong number of fields"},
+		{"metadata.json", `["a.wav"]`, nil, "cannot unmarshal"},
+	} {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, tc.name), []byte(tc.content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		overrides, path, err := readSidecar(dir)
+		if path != filepath.Join(dir, tc.name) {
+			t.Errorf("%s: read %q", tc.name, path)
+		}
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s %q: err = %v, want %q", tc.name, tc.content, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]entryOverride{}
+		for name, override := range tc.want {
+			want[filepath.Join(dir, name)] = override
+		}
+		if !reflect.DeepEqual(overrides, want) {
+			t.Errorf("%s: overrides = %v, want %v", tc.name, overrides, want)
+		}
+	}
+
+	if overrides, path, err := readSidecar(t.TempDir()); overrides != nil || path != "" || err != nil {
+		t.Errorf("dir without a sidecar: %v, %q, %v", overrides, path, err)
+	}
+}
+
+func TestSaveUsesSidecar(t *testing.T) {
+	requireFFmpeg(t)
+	dir := cliTestDir(t)
+	songs := filepath.Join(dir, "in")
+	os.Mkdir(songs, 0o755)
+	for i, name := range []string{"a.wav", "b.wav", "c.wav"} {
+		writeTestWav(t, filepath.Join(songs, name), int64(i+1), 8)
+	}
+	sidecar := "filename,title,author\na.wav,Overture,Composer\nb.wav,Interlude,\nmissing.wav,Ghost,Nobody\n"
+	if err := os.WriteFile(filepath.Join(songs, "metadata.csv"), []byte(sidecar), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := captureStdout(t, func() { save(songs, saveOptions{workers: 1, quiet: true}) })
+	if !strings.Contains(out, "processed 3 files") {
+		t.Errorf("the sidecar was indexed, or files were missed:\n%s", out)
+	}
+	if !strings.Contains(out, "lists 1 file(s) that don't exist:\n  missing.wav") {
+		t.Errorf("unmatched row not reported:\n%s", out)
+	}
+
+	client := openCLIDB(t)
+	for _, key := range [][2]string{{"Overture", "Composer"}, {"Interlude", "unknown"}, {"c", "unknown"}} {
+		if _, found, err := client.GetSongByKey(utils.GenerateSongKey(key[0], key[1])); err != nil || !found {
+			t.Errorf("no entry titled %q by %q (err %v)", key[0], key[1], err)
+		}
+	}
+}
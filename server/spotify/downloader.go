@@ -11,6 +11,7 @@ import (
 	"song-recognition/db"
 	"song-recognition/shazam"
 	"song-recognition/utils"
+	"song-recognition/wav"
 	"strings"
 	"sync"
 	"time"
@@ -192,7 +193,7 @@ func addTags(file string, track Track) error {
 
 	// FFmpeg command to add metadata tags
 	cmd := exec.Command(
-		"ffmpeg",
+		wav.FFmpegPath,
 		"-i", file, // Input file path
 		"-c", "copy",
 		"-metadata", fmt.Sprintf("album_artist=%s", track.Artist),
@@ -226,7 +227,12 @@ func ProcessAndSaveSong(songFilePath, songTitle, songArtist, ytID string) error
 	}
 	defer dbclient.Close()
 
-	songID, err := dbclient.RegisterSong(songTitle, songArtist, ytID)
+	sourcePath, err := filepath.Abs(songFilePath)
+	if err != nil {
+		sourcePath = songFilePath
+	}
+
+	songID, err := dbclient.RegisterSong(songTitle, songArtist, ytID, sourcePath)
 	if err != nil {
 		logger.Error("Failed to register song", slog.Any("error", err))
 		return fmt.Errorf("error registering song '%s' by '%s': %v", songTitle, songArtist, err)
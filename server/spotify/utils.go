@@ -9,6 +9,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"song-recognition/db"
+	"song-recognition/wav"
 	"strings"
 )
 
@@ -91,7 +92,7 @@ func convertStereoToMono(stereoFilePath string) ([]byte, error) {
 	defer os.Remove(monoFilePath)
 
 	// Check the number of channels in the stereo audio
-	cmd := exec.Command("ffprobe", "-v", "error", "-show_entries", "stream=channels", "-of", "default=noprint_wrappers=1:nokey=1", stereoFilePath)
+	cmd := exec.Command(wav.FFprobePath, "-v", "error", "-show_entries", "stream=channels", "-of", "default=noprint_wrappers=1:nokey=1", stereoFilePath)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return nil, fmt.Errorf("error getting number of channels: %v, %v", err, string(output))
@@ -105,7 +106,7 @@ func convertStereoToMono(stereoFilePath string) ([]byte, error) {
 
 	if channels != "1" {
 		// Convert stereo to mono and downsample by 44100/2
-		cmd = exec.Command("ffmpeg", "-i", stereoFilePath, "-af", "pan=mono|c0=c0", monoFilePath)
+		cmd = exec.Command(wav.FFmpegPath, "-i", stereoFilePath, "-af", "pan=mono|c0=c0", monoFilePath)
 		// cmd = exec.Command("ffmpeg", "-i", stereoFilePath, "-af", "pan=mono|c0=c0", "-ar", "22050", monoFilePath)
 		if err := cmd.Run(); err != nil {
 			return nil, fmt.Errorf("error converting stereo to mono: %v", err)
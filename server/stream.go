@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"song-recognition/db"
+	"song-recognition/shazam"
+	"song-recognition/utils"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	streamWindowSec   = 10.0    // seconds of audio fingerprinted per match attempt
+	streamHopSec      = 2.0     // new audio needed before the next attempt
+	streamMaxPayload  = 1 << 20 // largest single binary message accepted
+	streamStableAfter = 2       // consecutive windows agreeing before a match is "stable"
+)
+
+// streamMessage is pushed to the client after each match attempt.
+type streamMessage struct {
+	Match        *matchResult `json:"match"`
+	Stable       bool         `json:"stable"`
+	WindowSec    float64      `json:"windowSec"`
+	Fingerprints int          `json:"fingerprints"`
+	Error        string       `json:"error,omitempty"`
+}
+
+// streamSession holds the rolling audio buffer for one /api/stream
+// connection. the reader appends samples; a single worker fingerprints
+// the latest window whenever enough new audio has arrived.
+type streamSession struct {
+	sampleRate int
+	cfg        shazam.FingerprintConfig // the server's config when the connection opened
+
+	mu       sync.Mutex
+	buffer   []float64
+	sinceHop int
+
+	// windows carries snapshots to the worker. it has capacity 1 and
+	// sends never block: if the worker is still busy, the newer window
+	// replaces the pending one so a slow DB can't back up the reader.
+	windows chan []float64
+}
+
+func newStreamSession(sampleRate int, cfg shazam.FingerprintConfig) *streamSession {
+	return &streamSession{
+		sampleRate: sampleRate,
+		cfg:        cfg,
+		windows:    make(chan []float64, 1),
+	}
+}
+
+// push appends samples, trims the buffer to the window length and queues
+// a snapshot once a hop's worth of new audio has accumulated.
+func (s *streamSession) push(samples []float64) {
+	windowLen := int(streamWindowSec * float64(s.sampleRate))
+	hopLen := int(streamHopSec * float64(s.sampleRate))
+
+	s.mu.Lock()
+	s.buffer = append(s.buffer, samples...)
+	if len(s.buffer) > windowLen {
+		s.buffer = append(s.buffer[:0:0], s.buffer[len(s.buffer)-windowLen:]...)
+	}
+	s.sinceHop += len(samples)
+	if s.sinceHop < hopLen {
+		s.mu.Unlock()
+		return
+	}
+	s.sinceHop = 0
+	snapshot := append([]float64(nil), s.buffer...)
+	s.mu.Unlock()
+
+	select {
+	case s.windows <- snapshot:
+	default:
+		// drop the stale pending window in favour of the newest one
+		select {
+		case <-s.windows:
+		default:
+		}
+		select {
+		case s.windows <- snapshot:
+		default:
+		}
+	}
+}
+
+// parsePCMParams reads the sampleRate (default 44100) and format (f32 or
+// s16, default f32) query params that describe raw PCM from a client.
+func parsePCMParams(query url.Values) (sampleRate int, format string, err error) {
+	sampleRate = 44100
+	if raw := query.Get("sampleRate"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 8000 || n > 192000 {
+			return 0, "", errors.New("sampleRate must be an integer between 8000 and 192000")
+		}
+		sampleRate = n
+	}
+
+	format = query.Get("format")
+	if format == "" {
+		format = "f32"
+	}
+	if format != "f32" && format != "s16" {
+		return 0, "", errors.New("format must be f32 or s16")
+	}
+	return sampleRate, format, nil
+}
+
+// pcmSampleBytes is the size of one sample in a format decodePCM accepts.
+func pcmSampleBytes(format string) int {
+	if format == "s16" {
+		return 2
+	}
+	return 4
+}
+
+// decodePCM converts a binary message into samples. "f32" is what the
+// Web Audio API hands out (Float32Array); "s16" is 16-bit PCM.
+func decodePCM(data []byte, format string) ([]float64, error) {
+	switch format {
+	case "f32":
+		if len(data)%4 != 0 {
+			return nil, fmt.Errorf("f32 payload length %d is not a multiple of 4", len(data))
+		}
+		samples := make([]float64, len(data)/4)
+		for i := range samples {
+			samples[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:])))
+		}
+		return samples, nil
+	case "s16":
+		if len(data)%2 != 0 {
+			return nil, fmt.Errorf("s16 payload length %d is not a multiple of 2", len(data))
+		}
+		samples := make([]float64, len(data)/2)
+		for i := range samples {
+			samples[i] = float64(int16(binary.LittleEndian.Uint16(data[2*i:]))) / 32768.0
+		}
+		return samples, nil
+	default:
+		return nil, fmt.Errorf("unsupported format %q (expected f32 or s16)", format)
+	}
+}
+
+// handleStream upgrades to a WebSocket that accepts mono PCM audio as
+// binary messages (query params: sampleRate, default 44100; format,
+// f32 or s16, default f32) and pushes back the best match for the most
+// recent streamWindowSec seconds every streamHopSec seconds. an empty
+// library is refused with a 503 before the upgrade, as /api/match does.
+func (s *apiServer) handleStream(w http.ResponseWriter, r *http.Request) {
+	sampleRate, format, err := parsePCMParams(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := checkLibrary(s.db); err != nil {
+		writeError(w, libraryErrorStatus(err), err.Error())
+		return
+	}
+
+	// websocket.Server (unlike websocket.Handler) skips the origin check,
+	// matching the permissive CORS policy of the rest of the API
+	cfg := s.config()
+	server := websocket.Server{Handler: func(ws *websocket.Conn) {
+		ws.MaxPayloadBytes = streamMaxPayload
+		serveStream(ws, s.db, sampleRate, format, cfg, s.matchOpts)
+	}}
+	server.ServeHTTP(w, r)
+}
+
+func serveStream(ws *websocket.Conn, dbClient db.DBClient, sampleRate int, format string, cfg shazam.FingerprintConfig, opts shazam.MatchOptions) {
+	defer ws.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	session := newStreamSession(sampleRate, cfg)
+	utils.Infof("[stream] connection opened (%d Hz, %s)", sampleRate, format)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		streamMatchWorker(ctx, ws, dbClient, session, opts)
+	}()
+
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			break
+		}
+
+		samples, err := decodePCM(data, format)
+		if err != nil {
+			websocket.JSON.Send(ws, streamMessage{Error: err.Error()})
+			continue
+		}
+		session.push(samples)
+	}
+
+	cancel()
+	wg.Wait()
+	utils.Infof("[stream] connection closed")
+}
+
+func streamMatchWorker(ctx context.Context, ws *websocket.Conn, dbClient db.DBClient, session *streamSession, opts shazam.MatchOptions) {
+	var lastSongID uint32
+	agreeing := 0
+
+	for {
+		var window []float64
+		select {
+		case <-ctx.Done():
+			return
+		case window = <-session.windows:
+		}
+
+		start := time.Now()
+		msg := streamMessage{WindowSec: float64(len(window)) / float64(session.sampleRate)}
+
+		fingerprint, _, err := shazam.AnalyzeSamples(window, session.sampleRate, utils.GenerateUniqueID(), session.cfg)
+		if err != nil {
+			msg.Error = err.Error()
+			websocket.JSON.Send(ws, msg)
+			continue
+		}
+
+		sampleFP := shazam.SampleFingerprint(fingerprint, session.cfg)
+		msg.Fingerprints = len(sampleFP)
+
+		// only the best match is reported
+		matches, _, err := shazam.FindMatchesFGP(dbClient, sampleFP, nil, 1, opts)
+		if err != nil {
+			msg.Error = err.Error()
+			websocket.JSON.Send(ws, msg)
+			continue
+		}
+
+		if len(matches) == 0 {
+			agreeing = 0
+			lastSongID = 0
+		} else {
+			best := matches[0]
+			if best.SongID == lastSongID {
+				agreeing++
+			} else {
+				lastSongID = best.SongID
+				agreeing = 1
+			}
+			result := newMatchResult(best)
+			msg.Match = &result
+			msg.Stable = agreeing >= streamStableAfter
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+		if err := websocket.JSON.Send(ws, msg); err != nil {
+			return
+		}
+		utils.Debugf("[stream] window of %.1fs matched in %s (stable=%v)", msg.WindowSec, time.Since(start), msg.Stable)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"song-recognition/shazam"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestStreamMatchesLiveAudio(t *testing.T) {
+	s := newTestServer(t, shazam.DefaultAudiobookConfig(), 2)
+	srv := httptest.NewServer(http.HandlerFunc(s.handleStream))
+	defer srv.Close()
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/stream?sampleRate=44100&format=f32", "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	// 20s of song 1 in half-second messages, as a recorder would send them
+	audio := testTones(2, 44100, 60)[15*44100 : 35*44100]
+	go func() {
+		for start := 0; start < len(audio); start += 22050 {
+			if err := websocket.Message.Send(ws, f32PCM(audio[start:min(start+22050, len(audio))])); err != nil {
+				return
+			}
+		}
+	}()
+
+	ws.SetReadDeadline(time.Now().Add(30 * time.Second))
+	for {
+		var msg streamMessage
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			t.Fatalf("no stable match before the stream ended: %v", err)
+		}
+		if msg.Error != "" {
+			t.Fatalf("stream error: %s", msg.Error)
+		}
+		if msg.WindowSec > streamWindowSec {
+			t.Errorf("matched a %.1fs window, more than %gs", msg.WindowSec, streamWindowSec)
+		}
+		if msg.Stable {
+			if msg.Match == nil || msg.Match.Title != "song 1" {
+				t.Fatalf("stable match %+v, want song 1", msg.Match)
+			}
+			return
+		}
+	}
+}
+
+func TestStreamRejectsBadParams(t *testing.T) {
+	s := newTestServer(t, shazam.DefaultAudiobookConfig(), 0)
+	for _, query := range []string{"?sampleRate=100", "?format=u8"} {
+		rec := httptest.NewRecorder()
+		s.handleStream(rec, httptest.NewRequest("GET", "/api/stream"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, rec.Code)
+		}
+	}
+}
+
+func TestStreamEmptyLibrary(t *testing.T) {
+	s := newTestServer(t, shazam.DefaultAudiobookConfig(), 0)
+	rec := httptest.NewRecorder()
+	s.handleStream(rec, httptest.NewRequest("GET", "/api/stream", nil))
+	if rec.Code != http.StatusServiceUnavailable || decodeJSON(t, rec)["error"] != errEmptyLibrary.Error() {
+		t.Errorf("status %d, body %s; want 503 saying nothing is indexed", rec.Code, rec.Body)
+	}
+}
+
+func TestDecodePCM(t *testing.T) {
+	s16 := make([]byte, 4)
+	binary.LittleEndian.PutUint16(s16, uint16(16384))
+	binary.LittleEndian.PutUint16(s16[2:], uint16(0x8000)) // -32768
+	samples, err := decodePCM(s16, "s16")
+	if err != nil || len(samples) != 2 || samples[0] != 0.5 || samples[1] != -1 {
+		t.Errorf("s16 decoded to %v, %v; want [0.5 -1]", samples, err)
+	}
+
+	samples, err = decodePCM(f32PCM([]float64{0.25, -0.75}), "f32")
+	if err != nil || len(samples) != 2 || samples[0] != 0.25 || samples[1] != -0.75 {
+		t.Errorf("f32 decoded to %v, %v; want [0.25 -0.75]", samples, err)
+	}
+
+	if _, err := decodePCM([]byte{1, 2, 3}, "f32"); err == nil {
+		t.Error("a partial f32 sample was accepted")
+	}
+}
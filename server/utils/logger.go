@@ -1,9 +1,16 @@
 package utils
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 
 	"github.com/mdobak/go-xerrors"
 )
@@ -81,3 +88,111 @@ func GetLogger() *slog.Logger {
 	logger := slog.New(h)
 	return logger
 }
+
+// LogLevel controls which of the bracket-tagged progress lines
+// (e.g. "[chunk 3] ...") are written to the standard logger.
+type LogLevel int32
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+)
+
+var currentLogLevel = int32(LevelInfo)
+
+// ParseLogLevel converts "debug", "info" or "warn" into a LogLevel.
+func ParseLogLevel(s string) (LogLevel, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	default:
+		return LevelInfo, fmt.Errorf("unknown log level %q (expected debug, info or warn)", s)
+	}
+}
+
+// SetLogLevel sets the minimum level that Debugf/Infof/Warnf will print.
+func SetLogLevel(level LogLevel) {
+	atomic.StoreInt32(&currentLogLevel, int32(level))
+}
+
+// LogEnabled reports whether messages at the given level are printed.
+func LogEnabled(level LogLevel) bool {
+	return int32(level) >= atomic.LoadInt32(&currentLogLevel)
+}
+
+func logf(level LogLevel, format string, args ...any) {
+	if !LogEnabled(level) {
+		return
+	}
+	log.Output(3, fmt.Sprintf(format, args...))
+}
+
+// Debugf logs per-chunk and memory diagnostics that are only useful
+// when investigating a single run.
+func Debugf(format string, args ...any) {
+	logf(LevelDebug, format, args...)
+}
+
+// Infof logs per-request and per-file summaries.
+func Infof(format string, args ...any) {
+	logf(LevelInfo, format, args...)
+}
+
+// Warnf logs recoverable problems and errors returned to clients.
+func Warnf(format string, args ...any) {
+	logf(LevelWarn, format, args...)
+}
+
+type requestIDKey struct{}
+
+// NewRequestID returns a short random ID for correlating the log lines of
+// one HTTP request.
+func NewRequestID() string {
+	var b [4]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// WithRequestID returns ctx carrying id, which the *Ctx log functions
+// prefix to every line logged with it.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the ID stored by WithRequestID, or "" if there is none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func logfCtx(ctx context.Context, level LogLevel, format string, args ...any) {
+	if !LogEnabled(level) {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if id := RequestID(ctx); id != "" {
+		msg = "[req " + id + "] " + msg
+	}
+	log.Output(3, msg)
+}
+
+// DebugfCtx is Debugf for code running on behalf of a request; the line
+// is prefixed with the request ID in ctx, if any.
+func DebugfCtx(ctx context.Context, format string, args ...any) {
+	logfCtx(ctx, LevelDebug, format, args...)
+}
+
+// InfofCtx is Infof with the request ID in ctx, if any.
+func InfofCtx(ctx context.Context, format string, args ...any) {
+	logfCtx(ctx, LevelInfo, format, args...)
+}
+
+// WarnfCtx is Warnf with the request ID in ctx, if any.
+func WarnfCtx(ctx context.Context, format string, args ...any) {
+	logfCtx(ctx, LevelWarn, format, args...)
+}
@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"testing"
+)
+
+// captureLog sends the standard logger's output to the returned buffer
+// until the test ends, at the given level.
+func captureLog(t *testing.T, level LogLevel) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	flags, out := log.Flags(), log.Writer()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	prev := LogLevel(currentLogLevel)
+	SetLogLevel(level)
+	t.Cleanup(func() {
+		log.SetOutput(out)
+		log.SetFlags(flags)
+		SetLogLevel(prev)
+	})
+	return &buf
+}
+
+func TestLogLevels(t *testing.T) {
+	for _, tc := range []struct {
+		level LogLevel
+		want  string
+	}{
+		{LevelDebug, "debug\ninfo\nwarn\n"},
+		{LevelInfo, "info\nwarn\n"},
+		{LevelWarn, "warn\n"},
+	} {
+		buf := captureLog(t, tc.level)
+		Debugf("debug")
+		Infof("info")
+		Warnf("warn")
+		if buf.String() != tc.want {
+			t.Errorf("level %d printed %q, want %q", tc.level, buf.String(), tc.want)
+		}
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for in, want := range map[string]LogLevel{"debug": LevelDebug, "": LevelInfo, " INFO ": LevelInfo, "warning": LevelWarn} {
+		if got, err := ParseLogLevel(in); err != nil || got != want {
+			t.Errorf("ParseLogLevel(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	if _, err := ParseLogLevel("verbose"); err == nil || !strings.Contains(err.Error(), "verbose") {
+		t.Errorf("ParseLogLevel(\"verbose\") error = %v", err)
+	}
+}
+
+func TestRequestIDPrefix(t *testing.T) {
+	id := NewRequestID()
+	if len(id) != 8 || strings.Trim(id, "0123456789abcdef") != "" {
+		t.Errorf("request ID %q isn't 8 hex digits", id)
+	}
+	if NewRequestID() == id {
+		t.Error("two requests got the same ID")
+	}
+
+	buf := captureLog(t, LevelDebug)
+	ctx := WithRequestID(context.Background(), id)
+	DebugfCtx(ctx, "debug %d", 1)
+	WarnfCtx(ctx, "warn")
+	InfofCtx(context.Background(), "no request")
+	want := "[req " + id + "] debug 1\n[req " + id + "] warn\nno request\n"
+	if buf.String() != want {
+		t.Errorf("logged %q, want %q", buf.String(), want)
+	}
+	if RequestID(ctx) != id || RequestID(context.Background()) != "" {
+		t.Errorf("RequestID = %q and %q, want %q and none", RequestID(ctx), RequestID(context.Background()), id)
+	}
+}
@@ -1,9 +1,12 @@
 package utils
 
 import (
+	"fmt"
 	"math/rand"
 	"os"
+	"strings"
 	"time"
+	"unicode"
 )
 
 func GenerateUniqueID() uint32 {
@@ -13,8 +16,57 @@ func GenerateUniqueID() uint32 {
 	return randomNumber
 }
 
+// SongKeyMode controls how much GenerateSongKey normalizes titles and
+// artists, and so which entries count as the same song.
+type SongKeyMode int
+
+const (
+	SongKeysStrict     SongKeyMode = iota // as given
+	SongKeysNormalized                    // case folded, whitespace trimmed and collapsed
+	SongKeysLoose                         // normalized, and punctuation dropped
+)
+
+// SongKeys is the mode GenerateSongKey uses. keys are stored with each
+// entry; db.NewDBClient re-keys entries saved under another mode.
+var SongKeys = SongKeysNormalized
+
+// ParseSongKeyMode converts "strict", "normalized" or "loose" into a
+// SongKeyMode.
+func ParseSongKeyMode(s string) (SongKeyMode, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "strict":
+		return SongKeysStrict, nil
+	case "normalized", "":
+		return SongKeysNormalized, nil
+	case "loose":
+		return SongKeysLoose, nil
+	default:
+		return SongKeysNormalized, fmt.Errorf("unknown song key mode %q (expected strict, normalized or loose)", s)
+	}
+}
+
 func GenerateSongKey(songTitle, songArtist string) string {
-	return songTitle + "---" + songArtist
+	return normalizeKeyPart(songTitle, SongKeys) + "---" + normalizeKeyPart(songArtist, SongKeys)
+}
+
+func normalizeKeyPart(s string, mode SongKeyMode) string {
+	switch mode {
+	case SongKeysStrict:
+		return s
+	case SongKeysLoose:
+		// apostrophes are dropped ("don't" is "dont"); other punctuation
+		// becomes a space so "Part-One" is "part one", not "partone"
+		s = strings.Map(func(r rune) rune {
+			switch {
+			case r == '\'' || r == '’':
+				return -1
+			case unicode.IsPunct(r):
+				return ' '
+			}
+			return r
+		}, s)
+	}
+	return strings.Join(strings.Fields(strings.ToLower(s)), " ")
 }
 
 func GetEnv(key string, fallback ...string) string {
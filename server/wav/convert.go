@@ -1,6 +1,9 @@
 package wav
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
@@ -11,13 +14,150 @@ import (
 	"time"
 )
 
-// ConvertToWAV converts an input audio file to WAV format with specified channels.
-func ConvertToWAV(inputFilePath string) (wavFilePath string, err error) {
-	_, err = os.Stat(inputFilePath)
+// DecodeSampleRate is the rate ffmpeg resamples every input to, and so
+// the rate the fingerprinting pipeline sees for files.
+const DecodeSampleRate = 44100
+
+// FFmpegPath and FFprobePath are the binaries run to decode and probe
+// audio. bare names are looked up on PATH; set FFMPEG_PATH and
+// FFPROBE_PATH (or the -ffmpeg and -ffprobe flags) to run others, e.g.
+// a static build outside PATH.
+var (
+	FFmpegPath  = binaryFromEnv("FFMPEG_PATH", "ffmpeg")
+	FFprobePath = binaryFromEnv("FFPROBE_PATH", "ffprobe")
+)
+
+func binaryFromEnv(key, fallback string) string {
+	if path := strings.TrimSpace(utils.GetEnv(key)); path != "" {
+		return path
+	}
+	return fallback
+}
+
+// FFmpegTimeout bounds every single ffmpeg/ffprobe invocation so a hung
+// process (e.g. on a malformed stream) can't block forever. override it
+// with FFMPEG_TIMEOUT, e.g. "30m".
+var FFmpegTimeout = ffmpegTimeoutFromEnv()
+
+// ErrFFmpegTimeout is returned (wrapped) when an ffmpeg or ffprobe run
+// exceeds FFmpegTimeout and is killed.
+var ErrFFmpegTimeout = errors.New("ffmpeg timed out")
+
+func ffmpegTimeoutFromEnv() time.Duration {
+	const fallback = 10 * time.Minute
+	raw := utils.GetEnv("FFMPEG_TIMEOUT")
+	if raw == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		utils.Warnf("[ffmpeg] ignoring invalid FFMPEG_TIMEOUT %q, using %s", raw, fallback)
+		return fallback
+	}
+	return d
+}
+
+// commandWithTimeout builds a command that is killed when ctx is cancelled
+// or FFmpegTimeout elapses, whichever comes first. call cancel once the
+// command has finished.
+func commandWithTimeout(ctx context.Context, name string, args ...string) (cmd *exec.Cmd, runCtx context.Context, cancel context.CancelFunc) {
+	runCtx, cancel = context.WithTimeout(ctx, FFmpegTimeout)
+	cmd = exec.CommandContext(runCtx, name, args...)
+	// don't wait forever on pipes held open by orphaned children
+	cmd.WaitDelay = 5 * time.Second
+	return cmd, runCtx, cancel
+}
+
+// interruptedError explains why a command bound to runCtx (derived from
+// parent) stopped early, or returns nil if neither context ended.
+func interruptedError(parent, runCtx context.Context, what string) error {
+	if parent.Err() != nil {
+		return fmt.Errorf("%s aborted: %w", what, parent.Err())
+	}
+	if errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s: %w after %s", what, ErrFFmpegTimeout, FFmpegTimeout)
+	}
+	return nil
+}
+
+// permissiveInputArgs make ffmpeg decode past damaged packets and look
+// further into the input for its stream parameters. they are input
+// options, so they go before -i.
+var permissiveInputArgs = []string{
+	"-err_detect", "ignore_err",
+	"-analyzeduration", "100M",
+	"-probesize", "100M",
+}
+
+// runDecode runs ffmpeg with argsFor(), the arguments of a decode of
+// inputPath. if ffmpeg itself fails, it is run once more with
+// argsFor(permissiveInputArgs...), which some malformed files need; if
+// that fails too, the first attempt's result is returned. interrupted
+// runs (see interruptedError) are not retried.
+func runDecode(ctx context.Context, what, inputPath string, argsFor func(inputArgs ...string) []string) (*stderrTail, error) {
+	stderr, err := runDecodeOnce(ctx, what, argsFor())
+	var exitErr *exec.ExitError
+	if err == nil || !errors.As(err, &exitErr) {
+		return stderr, err
+	}
+
+	utils.Debugf("[ffmpeg] %s of %s failed (%v), retrying with permissive decoding flags", what, inputPath, err)
+	if retryStderr, retryErr := runDecodeOnce(ctx, what, argsFor(permissiveInputArgs...)); retryErr == nil {
+		utils.Warnf("[ffmpeg] %s of %s only succeeded with permissive decoding flags; the file may be damaged", what, inputPath)
+		return retryStderr, nil
+	} else if !errors.As(retryErr, &exitErr) {
+		return retryStderr, retryErr
+	}
+	return stderr, err
+}
+
+// runDecodeOnce runs ffmpeg with args, reporting an interrupted run as
+// interruptedError does.
+func runDecodeOnce(ctx context.Context, what string, args []string) (*stderrTail, error) {
+	cmd, runCtx, cancel := commandWithTimeout(ctx, FFmpegPath, args...)
+	defer cancel()
+
+	stderr, err := runFFmpeg(cmd)
 	if err != nil {
-		return "", fmt.Errorf("input file does not exist: %v", err)
+		if stopped := interruptedError(ctx, runCtx, what); stopped != nil {
+			return stderr, stopped
+		}
+	}
+	return stderr, err
+}
+
+// ConvertOptions describes the WAV ffmpeg should produce. zero fields
+// take the defaults: mono, DecodeSampleRate and 16-bit PCM.
+type ConvertOptions struct {
+	Channels   int
+	SampleRate int
+	Codec      string // ffmpeg audio codec, e.g. "pcm_s16le" or "pcm_f32le"
+}
+
+// ffmpegArgs returns the output-format arguments for opts. -vn keeps
+// ffmpeg from touching the video stream of a video input, so only its
+// audio is decoded.
+func (opts ConvertOptions) ffmpegArgs() []string {
+	if opts.Channels == 0 {
+		opts.Channels = 1
+	}
+	if opts.SampleRate == 0 {
+		opts.SampleRate = DecodeSampleRate
+	}
+	if opts.Codec == "" {
+		opts.Codec = "pcm_s16le"
+	}
+	return []string{
+		"-vn",
+		"-c", opts.Codec,
+		"-ar", strconv.Itoa(opts.SampleRate),
+		"-ac", strconv.Itoa(opts.Channels),
 	}
+}
 
+// ConvertToWAV converts an input audio file to WAV format, in stereo if
+// FINGERPRINT_STEREO is set and mono otherwise. see ConvertToWAVWithOptions.
+func ConvertToWAV(ctx context.Context, inputFilePath string) (wavFilePath string, err error) {
 	to_stereoStr := utils.GetEnv("FINGERPRINT_STEREO", "false")
 	to_stereo, err := strconv.ParseBool(to_stereoStr)
 	if err != nil {
@@ -29,31 +169,58 @@ func ConvertToWAV(inputFilePath string) (wavFilePath string, err error) {
 		channels = 2
 	}
 
+	return ConvertToWAVWithOptions(ctx, inputFilePath, ConvertOptions{Channels: channels})
+}
+
+// ConvertDir, if set, is where ConvertToWAV and ConvertToWAVWithOptions
+// write their output, leaving the input untouched; it is created when
+// needed. inputs with the same name overwrite each other's output there.
+// it defaults to CONVERT_DIR. when it is empty the output is written next
+// to the input, which is then deleted (see ConvertToWAVWithOptions).
+var ConvertDir = strings.TrimSpace(utils.GetEnv("CONVERT_DIR"))
+
+// ConvertToWAVWithOptions converts an input audio file to a WAV file in
+// the format described by opts, named after the input. a failed
+// conversion is retried once with permissive decoding flags (see
+// runDecode). the output goes to ConvertDir if that is set. otherwise
+// it is written next to the input, and an input that isn't a .wav file
+// is deleted afterwards, even when the conversion failed: keep a copy of
+// anything converted that way, or set ConvertDir, which also works for
+// inputs in read-only directories.
+func ConvertToWAVWithOptions(ctx context.Context, inputFilePath string, opts ConvertOptions) (wavFilePath string, err error) {
+	_, err = os.Stat(inputFilePath)
+	if err != nil {
+		return "", fmt.Errorf("input file does not exist: %v", err)
+	}
+
 	fileExt := filepath.Ext(inputFilePath)
-	if fileExt != ".wav" {
+	outputDir := filepath.Dir(inputFilePath)
+	if ConvertDir != "" {
+		if err := utils.CreateFolder(ConvertDir); err != nil {
+			return "", fmt.Errorf("failed to create conversion directory: %v", err)
+		}
+		outputDir = ConvertDir
+	} else if fileExt != ".wav" {
 		defer os.Remove(inputFilePath)
 	}
 
-	outputFile := strings.TrimSuffix(inputFilePath, fileExt) + ".wav"
+	outputFile := filepath.Join(outputDir, strings.TrimSuffix(filepath.Base(inputFilePath), fileExt)+".wav")
 
 	// Output file may already exists. If it does FFmpeg will fail as
 	// it cannot edit existing files in-place. Use a temporary file.
 	tmpFile := filepath.Join(filepath.Dir(outputFile), "tmp_"+filepath.Base(outputFile))
-	defer os.Remove(tmpFile)
-
-	cmd := exec.Command(
-		"ffmpeg",
-		"-y",
-		"-i", inputFilePath,
-		"-c", "pcm_s16le",
-		"-ar", "44100",
-		"-ac", fmt.Sprint(channels),
-		tmpFile,
-	)
+	defer RemoveTemp(tmpFile)
 
-	output, err := cmd.CombinedOutput()
+	stderr, err := runDecode(ctx, "WAV conversion", inputFilePath, func(inputArgs ...string) []string {
+		args := append([]string{"-y"}, inputArgs...)
+		args = append(args, "-i", inputFilePath)
+		return append(append(args, opts.ffmpegArgs()...), tmpFile)
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to convert to WAV: %v, output %v", err, string(output))
+		if ctx.Err() != nil || errors.Is(err, ErrFFmpegTimeout) {
+			return "", err
+		}
+		return "", fmt.Errorf("failed to convert to WAV: %v, output %v", err, stderr)
 	}
 
 	// Rename the temporary file to the output file
@@ -75,19 +242,17 @@ func ReformatWAV(inputFilePath string, channels int) (reformatedFilePath string,
 	fileExt := filepath.Ext(inputFilePath)
 	outputFile := strings.TrimSuffix(inputFilePath, fileExt) + "rfm.wav"
 
-	cmd := exec.Command(
-		"ffmpeg",
-		"-y",
-		"-i", inputFilePath,
-		"-c", "pcm_s16le",
-		"-ar", "44100",
-		"-ac", fmt.Sprint(channels),
-		outputFile,
-	)
+	ctx := context.Background()
+	args := append([]string{"-y", "-i", inputFilePath}, ConvertOptions{Channels: channels}.ffmpegArgs()...)
+	cmd, runCtx, cancel := commandWithTimeout(ctx, FFmpegPath, append(args, outputFile)...)
+	defer cancel()
 
-	output, err := cmd.CombinedOutput()
+	stderr, err := runFFmpeg(cmd)
 	if err != nil {
-		return "", fmt.Errorf("failed to convert to WAV: %v, output %v", err, string(output))
+		if stopped := interruptedError(ctx, runCtx, "WAV reformat"); stopped != nil {
+			return "", stopped
+		}
+		return "", fmt.Errorf("failed to convert to WAV: %v, output %v", err, stderr)
 	}
 
 	return outputFile, nil
@@ -96,26 +261,33 @@ func ReformatWAV(inputFilePath string, channels int) (reformatedFilePath string,
 // ExtractChunkAsWAV uses ffmpeg to extract a time segment from any audio
 // file and write it as a 16-bit PCM mono WAV. the result is a small
 // temporary file bounded by durationSec regardless of original file size.
-func ExtractChunkAsWAV(inputPath string, startSec, durationSec float64) (string, error) {
+// the ffmpeg process is killed if ctx is cancelled or FFmpegTimeout elapses;
+// a failed extraction is retried once with permissive decoding flags.
+func ExtractChunkAsWAV(ctx context.Context, inputPath string, startSec, durationSec float64) (string, error) {
 	if err := utils.CreateFolder("tmp"); err != nil {
 		return "", err
 	}
 
 	outputFile := filepath.Join("tmp", fmt.Sprintf("chunk_%d_%.0f.wav", time.Now().UnixNano(), startSec))
 
-	cmd := exec.Command(
-		"ffmpeg", "-y",
-		"-ss", fmt.Sprintf("%.3f", startSec),
-		"-t", fmt.Sprintf("%.3f", durationSec),
-		"-i", inputPath,
-		"-c", "pcm_s16le",
-		"-ar", "44100",
-		"-ac", "1",
-		outputFile,
-	)
-
-	output, err := cmd.CombinedOutput()
+	stderr, err := runDecode(ctx, "ffmpeg chunk extraction", inputPath, func(inputArgs ...string) []string {
+		args := append([]string{"-y"}, inputArgs...)
+		args = append(args,
+			"-ss", fmt.Sprintf("%.3f", startSec),
+			"-t", fmt.Sprintf("%.3f", durationSec),
+			"-i", inputPath,
+		)
+		return append(append(args, ConvertOptions{}.ffmpegArgs()...), outputFile)
+	})
 	if err != nil {
+		RemoveTemp(outputFile)
+		if ctx.Err() != nil || errors.Is(err, ErrFFmpegTimeout) {
+			return "", err
+		}
+		output := stderr.String()
+		if invalid := classifyFFmpegFailure(err, output); invalid != nil {
+			return "", invalid
+		}
 		return "", fmt.Errorf("ffmpeg chunk extraction failed: %v, output: %s", err, output)
 	}
 
@@ -123,20 +295,149 @@ func ExtractChunkAsWAV(inputPath string, startSec, durationSec float64) (string,
 }
 
 // GetAudioDuration returns the duration in seconds of any audio file
-// by calling ffprobe.
-func GetAudioDuration(inputPath string) (float64, error) {
-	cmd := exec.Command(
-		"ffprobe",
-		"-v", "quiet",
-		"-show_entries", "format=duration",
+// by calling ffprobe. some containers only carry the duration on the
+// stream, so that is tried when the format has none, and as a last
+// resort the audio is decoded and its samples counted.
+func GetAudioDuration(ctx context.Context, inputPath string) (float64, error) {
+	var reported []string
+	for _, entry := range []string{"format=duration", "stream=duration"} {
+		durStr, err := probeDuration(ctx, inputPath, entry)
+		if err != nil {
+			return 0, err
+		}
+		if duration, err := strconv.ParseFloat(durStr, 64); err == nil && duration > 0 {
+			return duration, nil
+		}
+		reported = append(reported, fmt.Sprintf("%s %q", entry, durStr))
+	}
+
+	utils.Debugf("[ffmpeg] no duration metadata in %s (%s), decoding to measure it", inputPath, strings.Join(reported, ", "))
+	duration, err := decodedDuration(ctx, inputPath)
+	if err != nil {
+		return 0, err
+	}
+	if duration <= 0 {
+		return 0, &InvalidAudioError{Reason: fmt.Sprintf("could not determine duration (ffprobe reported %s, and no audio could be decoded)",
+			strings.Join(reported, ", "))}
+	}
+	return duration, nil
+}
+
+// probeDuration asks ffprobe for one duration entry ("format=duration" or
+// "stream=duration" of the first audio stream) and returns it as printed,
+// which is empty or "N/A" when the container doesn't record it.
+func probeDuration(ctx context.Context, inputPath, entry string) (string, error) {
+	cmd, runCtx, cancel := commandWithTimeout(ctx,
+		FFprobePath,
+		"-v", "error",
+		"-select_streams", "a:0",
+		"-show_entries", entry,
 		"-of", "default=noprint_wrappers=1:nokey=1",
 		inputPath,
 	)
+	defer cancel()
 
 	out, err := cmd.Output()
 	if err != nil {
-		return 0, fmt.Errorf("ffprobe duration query failed: %v", err)
+		if stopped := interruptedError(ctx, runCtx, "ffprobe duration query"); stopped != nil {
+			return "", stopped
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && !bytes.Contains(exitErr.Stderr, []byte("No such file")) {
+			return "", &InvalidAudioError{Reason: "unrecognized or corrupt media"}
+		}
+		return "", fmt.Errorf("ffprobe duration query failed: %v", err)
+	}
+
+	// a file with several audio streams prints one line per stream
+	lines := strings.Fields(string(out))
+	if len(lines) == 0 {
+		return "", nil
 	}
+	return lines[0], nil
+}
+
+// byteCounter is an io.Writer that only counts what is written to it.
+type byteCounter int64
 
-	return strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// decodedDuration decodes the first audio stream to raw 16-bit mono
+// samples at DecodeSampleRate and derives the duration from their count.
+// it reads the whole file, so it is only used when ffprobe has nothing.
+func decodedDuration(ctx context.Context, inputPath string) (float64, error) {
+	cmd, runCtx, cancel := commandWithTimeout(ctx,
+		FFmpegPath,
+		"-v", "error",
+		"-i", inputPath,
+		"-map", "0:a:0",
+		"-ac", "1",
+		"-ar", strconv.Itoa(DecodeSampleRate),
+		"-f", "s16le",
+		"pipe:1",
+	)
+	defer cancel()
+
+	var decoded byteCounter
+	cmd.Stdout = &decoded
+	stderr, err := runFFmpeg(cmd)
+	if err != nil {
+		if stopped := interruptedError(ctx, runCtx, "ffmpeg duration decode"); stopped != nil {
+			return 0, stopped
+		}
+		output := stderr.String()
+		if invalid := classifyFFmpegFailure(err, output); invalid != nil {
+			return 0, invalid
+		}
+		return 0, fmt.Errorf("ffmpeg duration decode failed: %v, output: %s", err, output)
+	}
+
+	const bytesPerSample = 2
+	return float64(decoded) / bytesPerSample / DecodeSampleRate, nil
+}
+
+// InvalidAudioError reports that ffmpeg/ffprobe ran fine but rejected
+// the input itself: the file is corrupt, in an unsupported container,
+// or has no audio stream. other failures (missing binary, disk errors)
+// are returned as plain errors so callers can tell the two apart.
+type InvalidAudioError struct {
+	Reason string
+}
+
+func (e *InvalidAudioError) Error() string {
+	return "file is not valid audio: " + e.Reason
+}
+
+// ffmpeg messages that mean the input, not the environment, is at fault.
+var invalidInputMarkers = []struct {
+	marker string
+	reason string
+}{
+	{"does not contain any stream", "no audio stream"},
+	{"matches no streams", "no audio stream"},
+	{"invalid data found when processing input", "unrecognized or corrupt media"},
+	{"could not find codec parameters", "unrecognized or corrupt media"},
+	{"moov atom not found", "truncated or corrupt container"},
+	{"error while decoding", "corrupt audio data"},
+	{"unknown format", "unsupported format"},
+}
+
+// classifyFFmpegFailure returns an *InvalidAudioError when a failed ffmpeg
+// run's output shows the input could not be decoded, or nil otherwise.
+func classifyFFmpegFailure(err error, output string) error {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return nil
+	}
+
+	lower := strings.ToLower(output)
+	for _, m := range invalidInputMarkers {
+		if strings.Contains(lower, m.marker) {
+			return &InvalidAudioError{Reason: m.reason}
+		}
+	}
+	return nil
 }
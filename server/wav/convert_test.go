@@ -0,0 +1,309 @@
+package wav
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClassifyFFmpegFailure(t *testing.T) {
+	exitErr := exec.Command("sh", "-c", "exit 1").Run()
+
+	var invalid *InvalidAudioError
+	err := classifyFFmpegFailure(exitErr, "[mov,mp4] moov atom not found\nx.m4a: Invalid data found when processing input")
+	if !errors.As(err, &invalid) || invalid.Reason != "unrecognized or corrupt media" {
+		t.Errorf("corrupt input classified as %v", err)
+	}
+	if err := classifyFFmpegFailure(exitErr, "x.wav: Permission denied"); err != nil {
+		t.Errorf("environment failure classified as %v", err)
+	}
+	// ffmpeg never ran, whatever the output says
+	if err := classifyFFmpegFailure(exec.ErrNotFound, "invalid data found when processing input"); err != nil {
+		t.Errorf("missing binary classified as %v", err)
+	}
+}
+
+// stubFFmpeg points FFmpegPath at a shell script with the given body for
+// the rest of the test.
+func stubFFmpeg(t *testing.T, body string) {
+	t.Helper()
+	stub := filepath.Join(t.TempDir(), "ffmpeg")
+	if err := os.WriteFile(stub, []byte("#!/bin/sh\n"+body+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	prev := FFmpegPath
+	FFmpegPath = stub
+	t.Cleanup(func() { FFmpegPath = prev })
+}
+
+func TestHungFFmpegIsKilled(t *testing.T) {
+	stubFFmpeg(t, "exec sleep 30")
+	input := filepath.Join(t.TempDir(), "in.wav")
+	if err := os.WriteFile(input, []byte("RIFF"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(d time.Duration) { FFmpegTimeout = d }(FFmpegTimeout)
+	FFmpegTimeout = 200 * time.Millisecond
+	start := time.Now()
+	if _, err := ConvertToWAV(context.Background(), input); !errors.Is(err, ErrFFmpegTimeout) {
+		t.Errorf("err = %v, want ErrFFmpegTimeout", err)
+	}
+
+	FFmpegTimeout = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	if _, err := ConvertToWAV(ctx, input); !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %s; ffmpeg wasn't killed", elapsed)
+	}
+}
+
+// recordingFFmpeg stubs ffmpeg with one that writes a dummy output file
+// and returns a func reading the arguments of its last run.
+func recordingFFmpeg(t *testing.T) func() string {
+	argsFile := filepath.Join(t.TempDir(), "args")
+	t.Setenv("STUB_ARGS", argsFile)
+	stubFFmpeg(t, `echo "$@" > "$STUB_ARGS"; for out; do :; done; printf 'RIFF....WAVE' > "$out"`)
+	return func() string {
+		t.Helper()
+		args, err := os.ReadFile(argsFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(args)
+	}
+}
+
+func TestConvertOptions(t *testing.T) {
+	lastArgs := recordingFFmpeg(t)
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.wav")
+	if err := os.WriteFile(input, []byte("RIFF"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(dir string) { ConvertDir = dir }(ConvertDir)
+	ConvertDir = filepath.Join(dir, "out")
+
+	out, err := ConvertToWAVWithOptions(context.Background(), input, ConvertOptions{Channels: 1, SampleRate: 22050})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != filepath.Join(ConvertDir, "in.wav") {
+		t.Errorf("converted to %s", out)
+	}
+	if args := lastArgs(); !strings.Contains(args, "-c pcm_s16le -ar 22050 -ac 1 ") {
+		t.Errorf("ffmpeg args %q, want 16-bit mono at 22050 Hz", args)
+	}
+
+	if _, err := ConvertToWAVWithOptions(context.Background(), input, ConvertOptions{Channels: 2, Codec: "pcm_f32le"}); err != nil {
+		t.Fatal(err)
+	}
+	if args := lastArgs(); !strings.Contains(args, fmt.Sprintf("-c pcm_f32le -ar %d -ac 2 ", DecodeSampleRate)) {
+		t.Errorf("ffmpeg args %q, want float stereo at the default rate", args)
+	}
+
+	// the env wrapper
+	for env, channels := range map[string]string{"false": "1", "true": "2"} {
+		t.Setenv("FINGERPRINT_STEREO", env)
+		if _, err := ConvertToWAV(context.Background(), input); err != nil {
+			t.Fatal(err)
+		}
+		if args := lastArgs(); !strings.Contains(args, "-ac "+channels+" ") {
+			t.Errorf("FINGERPRINT_STEREO=%s: ffmpeg args %q, want %s channel(s)", env, args, channels)
+		}
+	}
+	t.Setenv("FINGERPRINT_STEREO", "maybe")
+	if _, err := ConvertToWAV(context.Background(), input); err == nil {
+		t.Error("FINGERPRINT_STEREO=maybe accepted")
+	}
+}
+
+// stubFFprobe points FFprobePath at a shell script running body.
+func stubFFprobe(t *testing.T, body string) {
+	t.Helper()
+	stub := filepath.Join(t.TempDir(), "ffprobe")
+	if err := os.WriteFile(stub, []byte("#!/bin/sh\n"+body+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	prev := FFprobePath
+	FFprobePath = stub
+	t.Cleanup(func() { FFprobePath = prev })
+}
+
+func TestGetAudioDurationFallbacks(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "in.mka")
+	if err := os.WriteFile(input, []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// three seconds of 16-bit mono samples
+	decoded := fmt.Sprintf("head -c %d /dev/zero", 3*2*DecodeSampleRate)
+
+	for _, tc := range []struct {
+		name, probe, decode string
+		want                float64
+	}{
+		{"format", `echo 7.25`, "exit 1", 7.25},
+		{"stream", `case "$*" in *format=duration*) echo N/A;; *) printf '12.5\n9\n';; esac`, "exit 1", 12.5},
+		{"decoded", `case "$*" in *format=duration*) echo;; *) echo N/A;; esac`, decoded, 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stubFFprobe(t, tc.probe)
+			stubFFmpeg(t, tc.decode)
+			got, err := GetAudioDuration(context.Background(), input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("duration = %g, want %g", got, tc.want)
+			}
+		})
+	}
+
+	// nothing reported and nothing decoded
+	stubFFprobe(t, "echo N/A")
+	stubFFmpeg(t, "exit 0")
+	var invalid *InvalidAudioError
+	if _, err := GetAudioDuration(context.Background(), input); !errors.As(err, &invalid) {
+		t.Errorf("err = %v, want InvalidAudioError", err)
+	} else if !strings.Contains(err.Error(), `format=duration "N/A", stream=duration "N/A"`) {
+		t.Errorf("error doesn't say what ffprobe reported: %v", err)
+	}
+}
+
+func TestBinaryFromEnv(t *testing.T) {
+	t.Setenv("FFMPEG_PATH", " /opt/ffmpeg/bin/ffmpeg ")
+	if got := binaryFromEnv("FFMPEG_PATH", "ffmpeg"); got != "/opt/ffmpeg/bin/ffmpeg" {
+		t.Errorf("binaryFromEnv = %q, want the trimmed FFMPEG_PATH", got)
+	}
+	t.Setenv("FFMPEG_PATH", "")
+	if got := binaryFromEnv("FFMPEG_PATH", "ffmpeg"); got != "ffmpeg" {
+		t.Errorf("binaryFromEnv with FFMPEG_PATH empty = %q, want ffmpeg", got)
+	}
+}
+
+func TestConvertRunsFFmpegPath(t *testing.T) {
+	// a binary outside PATH is only found through FFmpegPath
+	t.Setenv("PATH", t.TempDir())
+	lastArgs := recordingFFmpeg(t)
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.wav")
+	if err := os.WriteFile(input, []byte("RIFF"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(dir string) { ConvertDir = dir }(ConvertDir)
+	ConvertDir = filepath.Join(dir, "out")
+
+	if _, err := ConvertToWAV(context.Background(), input); err != nil {
+		t.Fatal(err)
+	}
+	if args := lastArgs(); !strings.Contains(args, input) {
+		t.Errorf("stub ran with %q, want the input file", args)
+	}
+}
+
+func TestDecodeRetriesPermissively(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mp3")
+	runsFile := filepath.Join(dir, "runs")
+	t.Setenv("STUB_RUNS", runsFile)
+	defer func(dir string) { ConvertDir = dir }(ConvertDir)
+	ConvertDir = filepath.Join(dir, "out")
+
+	convert := func(stub string) ([]string, error) {
+		t.Helper()
+		stubFFmpeg(t, `echo "$@" >> "$STUB_RUNS"; `+stub)
+		os.Remove(runsFile)
+		if err := os.WriteFile(input, []byte("ID3"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := ConvertToWAV(context.Background(), input)
+		runs, readErr := os.ReadFile(runsFile)
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		return strings.Split(strings.TrimSpace(string(runs)), "\n"), err
+	}
+
+	// only decodes with the permissive flags
+	runs, err := convert(`case "$*" in *-err_detect*) for out; do :; done; printf 'RIFF....WAVE' > "$out";; *) echo 'plain failure' >&2; exit 1;; esac`)
+	if err != nil {
+		t.Fatalf("retry didn't recover: %v", err)
+	}
+	if len(runs) != 2 || !strings.Contains(runs[1], "-err_detect ignore_err -analyzeduration 100M -probesize 100M -i "+input) {
+		t.Errorf("ffmpeg runs %q, want a retry with the permissive flags before -i", runs)
+	}
+
+	// failing both times reports the first attempt
+	runs, err = convert(`case "$*" in *-err_detect*) echo 'permissive failure' >&2;; *) echo 'plain failure' >&2;; esac; exit 1`)
+	if err == nil || !strings.Contains(err.Error(), "plain failure") || strings.Contains(err.Error(), "permissive failure") {
+		t.Errorf("err = %v, want the first attempt's output", err)
+	}
+	if len(runs) != 2 {
+		t.Errorf("ffmpeg ran %d times, want 2", len(runs))
+	}
+
+	// a timed-out run isn't retried
+	defer func(d time.Duration) { FFmpegTimeout = d }(FFmpegTimeout)
+	FFmpegTimeout = 200 * time.Millisecond
+	runs, err = convert(`exec sleep 30`)
+	if !errors.Is(err, ErrFFmpegTimeout) || len(runs) != 1 {
+		t.Errorf("err = %v after %d runs, want ErrFFmpegTimeout after 1", err, len(runs))
+	}
+}
+
+func TestConvertDir(t *testing.T) {
+	recordingFFmpeg(t)
+	defer func(dir string) { ConvertDir = dir }(ConvertDir)
+	dir := t.TempDir()
+	input := filepath.Join(dir, "book.mp3")
+	writeInput := func() {
+		t.Helper()
+		if err := os.WriteFile(input, []byte("ID3"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// by default the WAV goes next to the input, which is removed
+	ConvertDir = ""
+	writeInput()
+	out, err := ConvertToWAV(context.Background(), input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != filepath.Join(dir, "book.wav") {
+		t.Errorf("converted to %s, want next to the input", out)
+	}
+	if _, err := os.Stat(input); !os.IsNotExist(err) {
+		t.Errorf("input left behind (%v)", err)
+	}
+
+	// with ConvertDir set, the directory is created and the input kept
+	ConvertDir = filepath.Join(dir, "converted", "wav")
+	writeInput()
+	out, err = ConvertToWAV(context.Background(), input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != filepath.Join(ConvertDir, "book.wav") {
+		t.Errorf("converted to %s, want in ConvertDir", out)
+	}
+	if _, err := os.Stat(out); err != nil {
+		t.Errorf("output missing: %v", err)
+	}
+	if _, err := os.Stat(input); err != nil {
+		t.Errorf("input removed with ConvertDir set: %v", err)
+	}
+	if entries, _ := os.ReadDir(ConvertDir); len(entries) != 1 {
+		t.Errorf("ConvertDir holds %d files, want only the output", len(entries))
+	}
+}
@@ -0,0 +1,121 @@
+package wav
+
+import (
+	"bytes"
+	"io"
+	"os/exec"
+	"song-recognition/utils"
+	"strings"
+)
+
+const (
+	stderrTailLines = 20  // lines of ffmpeg stderr kept for error messages
+	stderrLineBytes = 512 // longer lines are cut
+)
+
+// ffmpeg messages that are worth knowing about but don't stop it from
+// producing usable output.
+var recoverableMarkers = []string{
+	"non monotonic",
+	"non-monotonous",
+	"non monotonically increasing",
+	"invalid timestamps",
+	"estimating duration from bitrate",
+	"queue input is backward in time",
+	"header missing",
+}
+
+func isRecoverableWarning(line string) bool {
+	lower := strings.ToLower(line)
+	for _, m := range recoverableMarkers {
+		if strings.Contains(lower, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// stderrTail is an io.Writer that keeps only the last stderrTailLines
+// lines of ffmpeg's stderr, so a multi-hour run that logs a warning per
+// packet can't grow it without bound. recoverable warnings are counted
+// instead of kept.
+type stderrTail struct {
+	lines   []string // ring buffer
+	next    int
+	partial []byte
+
+	warnings     int
+	firstWarning string
+}
+
+func (t *stderrTail) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// ffmpeg ends progress lines with \r
+		i := bytes.IndexAny(p, "\r\n")
+		if i < 0 {
+			room := stderrLineBytes - len(t.partial)
+			if room > 0 {
+				t.partial = append(t.partial, p[:min(room, len(p))]...)
+			}
+			break
+		}
+		room := stderrLineBytes - len(t.partial)
+		if room > 0 {
+			t.partial = append(t.partial, p[:min(room, i)]...)
+		}
+		t.addLine(string(t.partial))
+		t.partial = t.partial[:0]
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+func (t *stderrTail) addLine(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	if isRecoverableWarning(line) {
+		if t.warnings == 0 {
+			t.firstWarning = line
+		}
+		t.warnings++
+		return
+	}
+
+	if len(t.lines) < stderrTailLines {
+		t.lines = append(t.lines, line)
+		return
+	}
+	t.lines[t.next] = line
+	t.next = (t.next + 1) % stderrTailLines
+}
+
+// String returns the kept lines, oldest first.
+func (t *stderrTail) String() string {
+	if len(t.partial) > 0 {
+		t.addLine(string(t.partial))
+		t.partial = t.partial[:0]
+	}
+	ordered := append(append([]string{}, t.lines[t.next:]...), t.lines[:t.next]...)
+	return strings.Join(ordered, "\n")
+}
+
+// runFFmpeg runs cmd, discarding stdout unless cmd.Stdout is set and
+// keeping the tail of stderr, which is returned for error messages.
+// recoverable warnings are logged at debug level whether or not the run
+// succeeds.
+func runFFmpeg(cmd *exec.Cmd) (*stderrTail, error) {
+	tail := &stderrTail{}
+	if cmd.Stdout == nil {
+		cmd.Stdout = io.Discard
+	}
+	cmd.Stderr = tail
+
+	err := cmd.Run()
+	if tail.warnings > 0 {
+		utils.Debugf("[ffmpeg] %d recoverable warning(s), first: %s", tail.warnings, tail.firstWarning)
+	}
+	return tail, err
+}
@@ -0,0 +1,65 @@
+package wav
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStderrTail(t *testing.T) {
+	tail := &stderrTail{}
+	fmt.Fprint(tail, "[mp3] Header missing\r")
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(tail, "line %d\n", i)
+	}
+	fmt.Fprint(tail, "[mux] Application provided invalid, non monotonically increasing dts\n")
+	// written in pieces, with the end of the line cut at stderrLineBytes
+	fmt.Fprint(tail, "last "+strings.Repeat("x", 300))
+	fmt.Fprint(tail, strings.Repeat("y", 300))
+
+	lines := strings.Split(tail.String(), "\n")
+	if len(lines) != stderrTailLines {
+		t.Fatalf("kept %d lines, want %d", len(lines), stderrTailLines)
+	}
+	if lines[0] != "line 81" {
+		t.Errorf("oldest kept line %q, want line 81", lines[0])
+	}
+	if last := lines[len(lines)-1]; !strings.HasPrefix(last, "last xxx") || len(last) != stderrLineBytes {
+		t.Errorf("last line %d bytes (%.20q...), want the partial line cut at %d", len(last), last, stderrLineBytes)
+	}
+	if tail.warnings != 2 || tail.firstWarning != "[mp3] Header missing" {
+		t.Errorf("%d warnings, first %q; want 2, the header one first", tail.warnings, tail.firstWarning)
+	}
+}
+
+func TestFFmpegWarningsDontFail(t *testing.T) {
+	// warnings on stderr, then a written file and a clean exit
+	stubFFmpeg(t, `for i in $(seq 200); do echo "[mp3 @ 0x1] Header missing" >&2; done
+echo "[aac] Queue input is backward in time" >&2
+for out; do :; done; printf 'RIFF....WAVE' > "$out"`)
+	dir := t.TempDir()
+	input := filepath.Join(dir, "noisy.wav")
+	if err := os.WriteFile(input, []byte("RIFF"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(dir string) { ConvertDir = dir }(ConvertDir)
+	ConvertDir = filepath.Join(dir, "out")
+	out, err := ConvertToWAV(context.Background(), input)
+	if err != nil {
+		t.Fatalf("warnings failed the conversion: %v", err)
+	}
+	if filepath.Dir(out) != ConvertDir {
+		t.Errorf("converted to %s", out)
+	}
+
+	// the same output on a failure is reported, with the warnings left out
+	stubFFmpeg(t, `echo "[mp3 @ 0x1] Header missing" >&2; echo "noisy.wav: Invalid data found when processing input" >&2; exit 1`)
+	_, err = ConvertToWAV(context.Background(), input)
+	if err == nil || strings.Contains(err.Error(), "Header missing") || !strings.Contains(err.Error(), "Invalid data found") {
+		t.Errorf("err = %v, want the invalid data error without the warnings", err)
+	}
+}
@@ -0,0 +1,77 @@
+package wav
+
+import (
+	"os"
+	"path/filepath"
+	"song-recognition/utils"
+	"sync"
+)
+
+// KeepTempDir, when set, makes RemoveTemp move intermediate WAV files
+// (converted files and extracted chunks) there instead of deleting them,
+// so what was actually fingerprinted can be listened to afterwards.
+var KeepTempDir string
+
+// RemoveTemp disposes of an intermediate file: it is deleted, or moved to
+// KeepTempDir when that is set. missing files are ignored.
+func RemoveTemp(path string) {
+	if KeepTempDir == "" {
+		os.Remove(path)
+		return
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		return
+	}
+	if err := utils.CreateFolder(KeepTempDir); err != nil {
+		utils.Warnf("[keep-temp] can't create %s: %v", KeepTempDir, err)
+		return
+	}
+
+	kept := filepath.Join(KeepTempDir, filepath.Base(path))
+	if err := utils.MoveFile(path, kept); err != nil {
+		utils.Warnf("[keep-temp] can't keep %s: %v", path, err)
+		return
+	}
+	utils.Infof("[keep-temp] kept %s", kept)
+}
+
+// TempFiles tracks the intermediate files of one operation so a deferred
+// Cleanup disposes of whatever is left, even if the operation panics
+// between creating a file and removing it. the zero value is ready to use.
+type TempFiles struct {
+	mu    sync.Mutex
+	paths map[string]struct{}
+}
+
+// Add registers path for cleanup.
+func (t *TempFiles) Add(path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.paths == nil {
+		t.paths = make(map[string]struct{})
+	}
+	t.paths[path] = struct{}{}
+}
+
+// Remove disposes of path now (see RemoveTemp) and forgets it.
+func (t *TempFiles) Remove(path string) {
+	t.mu.Lock()
+	delete(t.paths, path)
+	t.mu.Unlock()
+
+	RemoveTemp(path)
+}
+
+// Cleanup disposes of every file still registered.
+func (t *TempFiles) Cleanup() {
+	t.mu.Lock()
+	paths := t.paths
+	t.paths = nil
+	t.mu.Unlock()
+
+	for path := range paths {
+		RemoveTemp(path)
+	}
+}
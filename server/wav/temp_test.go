@@ -0,0 +1,85 @@
+package wav
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeepTemp(t *testing.T) {
+	// an ffmpeg that writes a dummy output file
+	stubFFmpeg(t, `for out; do :; done; printf 'RIFF....WAVE' > "$out"`)
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	defer func(dir string) { KeepTempDir = dir }(KeepTempDir)
+
+	extract := func() string {
+		t.Helper()
+		var temps TempFiles
+		defer temps.Cleanup()
+		path, err := ExtractChunkAsWAV(context.Background(), "in.mp3", 10, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		temps.Add(path)
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("chunk not written: %v", err)
+		}
+		return path
+	}
+	leftInTmp := func() []string {
+		names, _ := filepath.Glob(filepath.Join(dir, "tmp", "*"))
+		return names
+	}
+
+	KeepTempDir = ""
+	extract()
+	if left := leftInTmp(); len(left) != 0 {
+		t.Errorf("files left behind without keep-temp: %v", left)
+	}
+
+	KeepTempDir = filepath.Join(dir, "kept")
+	path := extract()
+	if left := leftInTmp(); len(left) != 0 {
+		t.Errorf("files left in tmp with keep-temp: %v", left)
+	}
+	if _, err := os.Stat(filepath.Join(KeepTempDir, filepath.Base(path))); err != nil {
+		t.Errorf("chunk not kept: %v", err)
+	}
+
+	// disposing of a file that is already gone is fine either way
+	RemoveTemp(filepath.Join(dir, "missing.wav"))
+	if names, _ := os.ReadDir(KeepTempDir); len(names) != 1 {
+		t.Errorf("%d files kept, want 1", len(names))
+	}
+}
+
+func TestTempFilesCleanedOnPanic(t *testing.T) {
+	dir := t.TempDir()
+	paths := []string{filepath.Join(dir, "a.wav"), filepath.Join(dir, "b.wav")}
+	func() {
+		defer func() { recover() }()
+		var temps TempFiles
+		defer temps.Cleanup()
+		for _, path := range paths {
+			if err := os.WriteFile(path, nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			temps.Add(path)
+		}
+		panic("mid-chunk")
+	}()
+	for _, path := range paths {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s left behind after a panic", path)
+		}
+	}
+}
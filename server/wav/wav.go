@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log/slog"
+	"math"
 	"os"
 	"os/exec"
 	"song-recognition/models"
@@ -94,86 +95,184 @@ func WriteWavFile(filename string, data []byte, sampleRate int, channels int, bi
 	return err
 }
 
+// WriteWav writes samples in [-1, 1] as a 16-bit PCM WAV file. with more
+// than one channel the samples are interleaved, left first. values out of
+// range are clipped.
+func WriteWav(path string, samples []float64, sampleRate, channels int) error {
+	if channels <= 0 || len(samples)%channels != 0 {
+		return fmt.Errorf("%d samples can't be split into %d channels", len(samples), channels)
+	}
+
+	data := make([]byte, 2*len(samples))
+	for i, sample := range samples {
+		sample = max(-1, min(1, sample))
+		binary.LittleEndian.PutUint16(data[2*i:], uint16(int16(math.Round(sample*math.MaxInt16))))
+	}
+	return WriteWavFile(path, data, sampleRate, channels, 16)
+}
+
+// WavInfo is a decoded WAV file. samples are split per channel: for a
+// mono file RightChannelSamples is nil, for a stereo one the interleaved
+// data is separated into left and right. use MonoSamples for analysis.
 type WavInfo struct {
 	Channels            int
 	SampleRate          int
+	BitsPerSample       int
 	Duration            float64
 	Data                []byte
 	LeftChannelSamples  []float64
 	RightChannelSamples []float64
 }
 
-// ReadWavInfo reads a 16-bit PCM WAV file and returns its metadata and audio samples.
-// Supports mono and stereo files. Note that it only supports 16-bit PCM format.
+// MonoSamples returns the audio as a single channel: the samples of a mono
+// file as they are, or the average of the two channels of a stereo one.
+// taking only LeftChannelSamples would drop anything panned right.
+func (info *WavInfo) MonoSamples() []float64 {
+	if info.RightChannelSamples == nil {
+		return info.LeftChannelSamples
+	}
+	mono := make([]float64, len(info.LeftChannelSamples))
+	for i, left := range info.LeftChannelSamples {
+		mono[i] = (left + info.RightChannelSamples[i]) / 2
+	}
+	return mono
+}
+
+// WAV format codes from the fmt chunk
+const (
+	formatPCM        = 1
+	formatIEEEFloat  = 3
+	formatExtensible = 0xFFFE // real format is in the sub-format GUID
+)
+
+// ReadWavInfo reads a WAV file and returns its metadata and audio samples,
+// normalised to [-1, 1]. it supports mono and stereo 16, 24 and 32-bit
+// integer PCM and 32-bit float.
 func ReadWavInfo(filename string) (*WavInfo, error) {
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	if len(data) < 44 {
-		return nil, errors.New("invalid WAV file size (too small)")
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, errors.New("invalid WAV header format")
 	}
 
-	// Parse PCM header to extract metadata
+	// walk the chunks rather than assuming the canonical 44-byte header:
+	// extensible fmt chunks are longer and LIST chunks may come first
 	// https://en.wikipedia.org/wiki/WAV#WAV_file_header
-	var header WavHeader
-	if err := binary.Read(bytes.NewReader(data[:44]), binary.LittleEndian, &header); err != nil {
-		return nil, err
+	var fmtChunk, dataChunk []byte
+	for pos := 12; pos+8 <= len(data); {
+		id := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		body := data[pos+8:]
+		if size > len(body) {
+			size = len(body) // truncated file (or a streamed header with a bogus size)
+		}
+		body = body[:size]
+
+		switch id {
+		case "fmt ":
+			fmtChunk = body
+		case "data":
+			dataChunk = body
+		}
+		if fmtChunk != nil && dataChunk != nil {
+			break
+		}
+		pos += 8 + size + size%2 // chunks are word aligned
 	}
-	if string(header.ChunkID[:]) != "RIFF" ||
-		string(header.Format[:]) != "WAVE" ||
-		header.AudioFormat != 1 {
-		return nil, errors.New("invalid WAV header format")
+	if len(fmtChunk) < 16 || dataChunk == nil {
+		return nil, errors.New("invalid WAV file (missing fmt or data chunk)")
 	}
 
-	info := &WavInfo{
-		Channels:   int(header.NumChannels),
-		SampleRate: int(header.SampleRate),
-		Data:       data[44:],
+	audioFormat := binary.LittleEndian.Uint16(fmtChunk[0:2])
+	if audioFormat == formatExtensible && len(fmtChunk) >= 26 {
+		audioFormat = binary.LittleEndian.Uint16(fmtChunk[24:26])
 	}
 
-	if header.BitsPerSample != 16 {
-		return nil, errors.New("unsupported bits‑per‑sample (expect 16‑bit PCM)")
+	info := &WavInfo{
+		Channels:      int(binary.LittleEndian.Uint16(fmtChunk[2:4])),
+		SampleRate:    int(binary.LittleEndian.Uint32(fmtChunk[4:8])),
+		BitsPerSample: int(binary.LittleEndian.Uint16(fmtChunk[14:16])),
+		Data:          dataChunk,
+	}
+	if info.Channels != 1 && info.Channels != 2 {
+		return nil, fmt.Errorf("unsupported channel count %d (only mono/stereo)", info.Channels)
+	}
+	if info.SampleRate <= 0 {
+		return nil, errors.New("invalid WAV sample rate")
+	}
+	// a frame is one sample for every channel. if the header says frames
+	// are some other size, the data isn't laid out the way it is decoded
+	// below and channels would come out shifted into one another
+	blockAlign := int(binary.LittleEndian.Uint16(fmtChunk[12:14]))
+	if blockAlign != info.Channels*info.BitsPerSample/8 {
+		return nil, fmt.Errorf("WAV block align %d doesn't match %d channels of %d bits", blockAlign, info.Channels, info.BitsPerSample)
 	}
 
-	sampleCount := len(info.Data) / 2
-	int16Buf := make([]int16, sampleCount)
-	if err := binary.Read(bytes.NewReader(info.Data), binary.LittleEndian, int16Buf); err != nil {
+	samples, err := decodeSamples(dataChunk, audioFormat, info.BitsPerSample)
+	if err != nil {
 		return nil, err
 	}
 
-	const scale = 1.0 / 32768.0 // 16‑bit normalisation factor
-
-	switch header.NumChannels {
-	case 1:
-		left := make([]float64, sampleCount)
-		for i, s := range int16Buf {
-			left[i] = float64(s) * scale
-		}
-		info.LeftChannelSamples = left
-
-	case 2:
-		frameCount := sampleCount / 2
+	// a trailing partial frame is dropped
+	frameCount := len(samples) / info.Channels
+	if info.Channels == 1 {
+		info.LeftChannelSamples = samples
+	} else {
 		left := make([]float64, frameCount)
 		right := make([]float64, frameCount)
 		for i := 0; i < frameCount; i++ {
-			left[i] = float64(int16Buf[2*i]) * scale
-			right[i] = float64(int16Buf[2*i+1]) * scale
+			left[i] = samples[2*i]
+			right[i] = samples[2*i+1]
 		}
 		info.LeftChannelSamples = left
 		info.RightChannelSamples = right
-
-	default:
-		return nil, errors.New("unsupported channel count (only mono/stereo)")
 	}
-
-	// Compute audio duration in seconds
-	info.Duration = float64(sampleCount) /
-		(float64(header.NumChannels) * float64(header.SampleRate))
+	info.Duration = float64(frameCount) / float64(info.SampleRate)
 
 	return info, nil
 }
 
+// decodeSamples converts interleaved little-endian sample data to floats in
+// [-1, 1]. a trailing partial sample is ignored.
+func decodeSamples(data []byte, audioFormat uint16, bitsPerSample int) ([]float64, error) {
+	switch {
+	case audioFormat == formatPCM && bitsPerSample == 16:
+		samples := make([]float64, len(data)/2)
+		for i := range samples {
+			samples[i] = float64(int16(binary.LittleEndian.Uint16(data[2*i:]))) / (1 << 15)
+		}
+		return samples, nil
+
+	case audioFormat == formatPCM && bitsPerSample == 24:
+		samples := make([]float64, len(data)/3)
+		for i := range samples {
+			b := data[3*i:]
+			// place the 3 bytes in the top of an int32 so the shift sign-extends
+			v := int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+			samples[i] = float64(v) / (1 << 23)
+		}
+		return samples, nil
+
+	case audioFormat == formatPCM && bitsPerSample == 32:
+		samples := make([]float64, len(data)/4)
+		for i := range samples {
+			samples[i] = float64(int32(binary.LittleEndian.Uint32(data[4*i:]))) / (1 << 31)
+		}
+		return samples, nil
+
+	case audioFormat == formatIEEEFloat && bitsPerSample == 32:
+		samples := make([]float64, len(data)/4)
+		for i := range samples {
+			samples[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:])))
+		}
+		return samples, nil
+	}
+
+	return nil, fmt.Errorf("unsupported WAV encoding (format %d, %d bits per sample)", audioFormat, bitsPerSample)
+}
+
 // WavBytesToFloat64 converts a slice of bytes from a .wav file to a slice of float64 samples
 func WavBytesToSamples(input []byte) ([]float64, error) {
 	if len(input)%2 != 0 {
@@ -224,11 +323,63 @@ type FFmpegMetadata struct {
 	} `json:"format"`
 }
 
+// MediaFormat summarises the streams of a media file, see ProbeFormat.
+type MediaFormat struct {
+	FormatName   string // ffprobe's format_name, e.g. "mov,mp4,m4a,3gp,3g2,mj2"
+	AudioStreams int
+	// VideoStreams counts video streams other than attached pictures, so
+	// the cover art of an MP3 or M4A doesn't count.
+	VideoStreams int
+	VideoCodec   string // codec of the first of those, e.g. "h264"
+}
+
+// ProbeFormat asks ffprobe which streams inputPath has, e.g. to turn away
+// videos and files without audio before decoding them. a file ffprobe
+// can't read at all gives an *InvalidAudioError.
+func ProbeFormat(ctx context.Context, inputPath string) (MediaFormat, error) {
+	var format MediaFormat
+
+	cmd, runCtx, cancel := commandWithTimeout(ctx, FFprobePath,
+		"-v", "error", "-print_format", "json", "-show_format", "-show_streams", inputPath)
+	defer cancel()
+
+	out, err := cmd.Output()
+	if err != nil {
+		if stopped := interruptedError(ctx, runCtx, "ffprobe format query"); stopped != nil {
+			return format, stopped
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && !bytes.Contains(exitErr.Stderr, []byte("No such file")) {
+			return format, &InvalidAudioError{Reason: "unrecognized or corrupt media"}
+		}
+		return format, fmt.Errorf("ffprobe format query failed: %v", err)
+	}
+
+	var metadata FFmpegMetadata
+	if err := json.Unmarshal(out, &metadata); err != nil {
+		return format, fmt.Errorf("failed to parse ffprobe output: %v", err)
+	}
+
+	format.FormatName = metadata.Format.NbatName
+	for _, stream := range metadata.Streams {
+		switch {
+		case stream.CodecType == "audio":
+			format.AudioStreams++
+		case stream.CodecType == "video" && stream.Disposition["attached_pic"] == 0:
+			if format.VideoStreams == 0 {
+				format.VideoCodec = stream.CodecName
+			}
+			format.VideoStreams++
+		}
+	}
+	return format, nil
+}
+
 // GetMetadata retrieves metadata from a file using ffprobe.
 func GetMetadata(filePath string) (FFmpegMetadata, error) {
 	var metadata FFmpegMetadata
 
-	cmd := exec.Command("ffprobe", "-v", "quiet", "-print_format", "json", "-show_format", "-show_streams", filePath)
+	cmd := exec.Command(FFprobePath, "-v", "quiet", "-print_format", "json", "-show_format", "-show_streams", filePath)
 	var out bytes.Buffer
 	cmd.Stdout = &out
 	err := cmd.Run()
@@ -241,17 +392,67 @@ func GetMetadata(filePath string) (FFmpegMetadata, error) {
 		return metadata, err
 	}
 
-	// convert all keys of the Tags map to lowercase
-	for k, v := range metadata.Format.Tags {
-		metadata.Format.Tags[strings.ToLower(k)] = v
-	}
-	for k, v := range metadata.Streams[0].Tags {
-		metadata.Streams[0].Tags[strings.ToLower(k)] = v
+	// normalize tag keys (ffprobe passes ID3 and Vorbis comment keys
+	// through as written, e.g. "ARTIST" or "Album Artist")
+	metadata.Format.Tags = normalizeTags(metadata.Format.Tags)
+	for i := range metadata.Streams {
+		metadata.Streams[i].Tags = normalizeTags(metadata.Streams[i].Tags)
 	}
 
 	return metadata, nil
 }
 
+// normalizeTags returns tags with lowercase keys whose spaces and dashes
+// are replaced by underscores. when two keys normalize alike, the one
+// already in normal form wins.
+func normalizeTags(tags map[string]string) map[string]string {
+	normalized := make(map[string]string, len(tags))
+	for k, v := range tags {
+		key := tagKeyReplacer.Replace(strings.ToLower(k))
+		if _, taken := normalized[key]; taken && key != k {
+			continue
+		}
+		normalized[key] = v
+	}
+	return normalized
+}
+
+var tagKeyReplacer = strings.NewReplacer(" ", "_", "-", "_")
+
+// tag keys tried in order by Title and Artist, after normalization
+var (
+	titleTagKeys  = []string{"title", "tit2"}
+	artistTagKeys = []string{"artist", "album_artist", "albumartist", "tpe1", "tpe2", "performer", "author"}
+)
+
+// Tag returns the first non-empty value among keys, looking in the
+// container's tags before each stream's (Ogg files keep their Vorbis
+// comments on the stream).
+func (m FFmpegMetadata) Tag(keys ...string) string {
+	for _, key := range keys {
+		if v := strings.TrimSpace(m.Format.Tags[key]); v != "" {
+			return v
+		}
+		for _, stream := range m.Streams {
+			if v := strings.TrimSpace(stream.Tags[key]); v != "" {
+				return v
+			}
+		}
+	}
+	return ""
+}
+
+// Title returns the title tag, or "" if the file has none.
+func (m FFmpegMetadata) Title() string {
+	return m.Tag(titleTagKeys...)
+}
+
+// Artist returns the artist tag, falling back to the album artist and
+// similar keys, or "" if the file has none.
+func (m FFmpegMetadata) Artist() string {
+	return m.Tag(artistTagKeys...)
+}
+
 func ProcessRecording(recData *models.RecordData, saveRecording bool) ([]float64, error) {
 	decodedAudioData, err := base64.StdEncoding.DecodeString(recData.Audio)
 	if err != nil {
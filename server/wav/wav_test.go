@@ -0,0 +1,271 @@
+package wav
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// rawWav writes a WAV file with the given fmt fields and sample data,
+// preceded by a LIST chunk, and returns its path. extensible stores
+// format in the sub-format GUID of a WAVE_FORMAT_EXTENSIBLE fmt chunk.
+func rawWav(t *testing.T, format uint16, channels, bits int, extensible bool, data []byte) string {
+	t.Helper()
+	fmtChunk := binary.LittleEndian.AppendUint16(nil, format)
+	if extensible {
+		fmtChunk = binary.LittleEndian.AppendUint16(nil, formatExtensible)
+	}
+	fmtChunk = binary.LittleEndian.AppendUint16(fmtChunk, uint16(channels))
+	fmtChunk = binary.LittleEndian.AppendUint32(fmtChunk, 8000)
+	fmtChunk = binary.LittleEndian.AppendUint32(fmtChunk, uint32(8000*channels*bits/8))
+	fmtChunk = binary.LittleEndian.AppendUint16(fmtChunk, uint16(channels*bits/8))
+	fmtChunk = binary.LittleEndian.AppendUint16(fmtChunk, uint16(bits))
+	if extensible {
+		fmtChunk = binary.LittleEndian.AppendUint16(fmtChunk, 22)
+		fmtChunk = binary.LittleEndian.AppendUint16(fmtChunk, uint16(bits))
+		fmtChunk = binary.LittleEndian.AppendUint32(fmtChunk, 0)
+		fmtChunk = binary.LittleEndian.AppendUint16(fmtChunk, format)
+		fmtChunk = append(fmtChunk, "\x00\x00\x00\x00\x10\x00\x80\x00\x00\xaa\x00\x38\x9b\x71"...)
+	}
+
+	chunk := func(id string, body []byte) []byte {
+		out := binary.LittleEndian.AppendUint32([]byte(id), uint32(len(body)))
+		out = append(out, body...)
+		if len(body)%2 == 1 {
+			out = append(out, 0)
+		}
+		return out
+	}
+	body := []byte("WAVE")
+	body = append(body, chunk("LIST", []byte("INFOISFT\x03\x00\x00\x00ab\x00"))...)
+	body = append(body, chunk("fmt ", fmtChunk)...)
+	body = append(body, chunk("data", data)...)
+	file := append(binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(len(body))), body...)
+
+	path := filepath.Join(t.TempDir(), "raw.wav")
+	if err := os.WriteFile(path, file, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func closeTo(got, want []float64) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if math.Abs(got[i]-want[i]) > 1e-6 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestReadWavInfoFormats(t *testing.T) {
+	var pcm24 []byte
+	for _, v := range []int32{0x7fffff, -0x800000, 0x400000, -1} {
+		pcm24 = append(pcm24, byte(v), byte(v>>8), byte(v>>16))
+	}
+	var float32le []byte
+	for _, v := range []float32{0.25, -0.75, 1, 0} {
+		float32le = binary.LittleEndian.AppendUint32(float32le, math.Float32bits(v))
+	}
+	var pcm32 []byte
+	for _, v := range []int32{math.MaxInt32, math.MinInt32, 1 << 30, 0} {
+		pcm32 = binary.LittleEndian.AppendUint32(pcm32, uint32(v))
+	}
+	var pcm16 []byte
+	for _, v := range []int16{math.MaxInt16, math.MinInt16, 1 << 14, 0} {
+		pcm16 = binary.LittleEndian.AppendUint16(pcm16, uint16(v))
+	}
+
+	for _, tc := range []struct {
+		name       string
+		format     uint16
+		bits       int
+		extensible bool
+		data       []byte
+		want       []float64
+	}{
+		{"16-bit", formatPCM, 16, false, pcm16, []float64{1 - 1.0/(1<<15), -1, 0.5, 0}},
+		{"24-bit", formatPCM, 24, false, pcm24, []float64{1 - 1.0/(1<<23), -1, 0.5, -1.0 / (1 << 23)}},
+		{"24-bit extensible", formatPCM, 24, true, pcm24, []float64{1 - 1.0/(1<<23), -1, 0.5, -1.0 / (1 << 23)}},
+		{"32-bit", formatPCM, 32, false, pcm32, []float64{1 - 1.0/(1<<31), -1, 0.5, 0}},
+		{"float", formatIEEEFloat, 32, false, float32le, []float64{0.25, -0.75, 1, 0}},
+		{"float extensible", formatIEEEFloat, 32, true, float32le, []float64{0.25, -0.75, 1, 0}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			info, err := ReadWavInfo(rawWav(t, tc.format, 1, tc.bits, tc.extensible, tc.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.BitsPerSample != tc.bits || info.SampleRate != 8000 || info.Duration != 4.0/8000 {
+				t.Errorf("info = %d bits at %d Hz for %gs", info.BitsPerSample, info.SampleRate, info.Duration)
+			}
+			if !closeTo(info.LeftChannelSamples, tc.want) {
+				t.Errorf("samples = %v, want %v", info.LeftChannelSamples, tc.want)
+			}
+		})
+	}
+
+	if _, err := ReadWavInfo(rawWav(t, formatPCM, 1, 8, false, []byte{1, 2})); err == nil {
+		t.Error("8-bit PCM accepted")
+	}
+	if _, err := ReadWavInfo(rawWav(t, formatIEEEFloat, 1, 64, false, make([]byte, 16))); err == nil {
+		t.Error("64-bit float accepted")
+	}
+}
+
+func TestMetadataTags(t *testing.T) {
+	for _, tc := range []struct {
+		name, probe   string
+		title, artist string
+	}{
+		{"uppercase", `{"streams": [{}], "format": {"tags": {"TITLE": "Loud", "ARTIST": "Shouty"}}}`, "Loud", "Shouty"},
+		{"vorbis on the stream", `{"streams": [{"tags": {"Title": "Ogg", "Album Artist": "Band"}}], "format": {}}`, "Ogg", "Band"},
+		{"id3 frames", `{"streams": [], "format": {"tags": {"TIT2": "Frame", "TPE1": " Singer "}}}`, "Frame", "Singer"},
+		{"normal form wins", `{"streams": [], "format": {"tags": {"title": "lower", "TITLE": "upper", "artist": ""}}}`, "lower", ""},
+		{"no tags", `{"streams": [{}], "format": {}}`, "", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stubFFprobe(t, "cat <<'EOF'\n"+tc.probe+"\nEOF")
+			metadata, err := GetMetadata("in.ogg")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if title, artist := metadata.Title(), metadata.Artist(); title != tc.title || artist != tc.artist {
+				t.Errorf("title %q, artist %q; want %q, %q", title, artist, tc.title, tc.artist)
+			}
+		})
+	}
+}
+
+func TestWriteWavRoundTrips(t *testing.T) {
+	samples := make([]float64, 4410)
+	for i := range samples {
+		samples[i] = 0.8 * math.Sin(2*math.Pi*440*float64(i)/44100)
+	}
+	samples[10], samples[20] = 1.5, -3 // clipped to full scale
+
+	path := filepath.Join(t.TempDir(), "out.wav")
+	if err := WriteWav(path, samples, 44100, 1); err != nil {
+		t.Fatal(err)
+	}
+	info, err := ReadWavInfo(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Channels != 1 || info.SampleRate != 44100 || info.BitsPerSample != 16 || !closeTo([]float64{info.Duration}, []float64{0.1}) {
+		t.Fatalf("read back %d channels at %d Hz, %d bits, %gs", info.Channels, info.SampleRate, info.BitsPerSample, info.Duration)
+	}
+
+	got := info.MonoSamples()
+	if len(got) != len(samples) {
+		t.Fatalf("read back %d samples, want %d", len(got), len(samples))
+	}
+	for i, want := range samples {
+		want = max(-1, min(1, want))
+		// half a step of rounding plus the 32767/32768 scale difference
+		if math.Abs(got[i]-want) > 1.0/16384 {
+			t.Fatalf("sample %d read back as %g, want %g", i, got[i], want)
+		}
+	}
+
+	if err := WriteWav(path, samples[:3], 44100, 2); err == nil {
+		t.Error("3 samples written as stereo")
+	}
+}
+
+func TestProbeFormat(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "in.m4a")
+	if err := os.WriteFile(input, []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name, streams string
+		want          MediaFormat
+	}{
+		{"audio with cover art",
+			`{"codec_type":"audio","codec_name":"aac"},{"codec_type":"video","codec_name":"mjpeg","disposition":{"attached_pic":1}}`,
+			MediaFormat{FormatName: "mov,mp4", AudioStreams: 1}},
+		{"video",
+			`{"codec_type":"video","codec_name":"h264","disposition":{"attached_pic":0}},{"codec_type":"audio","codec_name":"aac"},{"codec_type":"video","codec_name":"hevc"}`,
+			MediaFormat{FormatName: "mov,mp4", AudioStreams: 1, VideoStreams: 2, VideoCodec: "h264"}},
+		{"no audio", `{"codec_type":"subtitle","codec_name":"mov_text"}`, MediaFormat{FormatName: "mov,mp4"}},
+	} {
+		stubFFprobe(t, `echo '{"format":{"format_name":"mov,mp4"},"streams":[`+tc.streams+`]}'`)
+		got, err := ProbeFormat(context.Background(), input)
+		if err != nil || got != tc.want {
+			t.Errorf("%s: ProbeFormat = %+v, %v; want %+v", tc.name, got, err, tc.want)
+		}
+	}
+
+	var invalid *InvalidAudioError
+	stubFFprobe(t, `echo "in.m4a: Invalid data found when processing input" >&2; exit 1`)
+	if _, err := ProbeFormat(context.Background(), input); !errors.As(err, &invalid) {
+		t.Errorf("unreadable file: %v, want an InvalidAudioError", err)
+	}
+	stubFFprobe(t, `echo "in.m4a: No such file or directory" >&2; exit 1`)
+	if _, err := ProbeFormat(context.Background(), input); err == nil || errors.As(err, &invalid) {
+		t.Errorf("missing file: %v, want an error that isn't about the audio", err)
+	}
+}
+
+func TestReadWavInfoStereo(t *testing.T) {
+	var data []byte
+	for _, v := range []int16{1 << 14, -1 << 14, 1 << 13, 1 << 13, 0, 1 << 14} {
+		data = binary.LittleEndian.AppendUint16(data, uint16(v))
+	}
+	// half a frame at the end is dropped
+	data = binary.LittleEndian.AppendUint16(data, 1<<14)
+
+	path := rawWav(t, formatPCM, 2, 16, false, data)
+	info, err := ReadWavInfo(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Channels != 2 || info.Duration != 3.0/8000 {
+		t.Errorf("info = %d channels for %gs, want 2 for 3 frames", info.Channels, info.Duration)
+	}
+	if want := []float64{0.5, 0.25, 0}; !closeTo(info.LeftChannelSamples, want) {
+		t.Errorf("left = %v, want %v", info.LeftChannelSamples, want)
+	}
+	if want := []float64{-0.5, 0.25, 0.5}; !closeTo(info.RightChannelSamples, want) {
+		t.Errorf("right = %v, want %v", info.RightChannelSamples, want)
+	}
+	if want := []float64{0, 0.25, 0.25}; !closeTo(info.MonoSamples(), want) {
+		t.Errorf("mono = %v, want %v", info.MonoSamples(), want)
+	}
+
+	mono, err := ReadWavInfo(rawWav(t, formatPCM, 1, 16, false, data[:4]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mono.MonoSamples(); len(got) != 2 || &got[0] != &mono.LeftChannelSamples[0] {
+		t.Error("MonoSamples of a mono file isn't its samples as they are")
+	}
+
+	// a block align that doesn't fit the channels would shift them into
+	// one another; the fmt fields start 44 bytes in, after the LIST chunk
+	file, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.LittleEndian.PutUint16(file[44+12:], 2)
+	if err := os.WriteFile(path, file, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadWavInfo(path); err == nil || !strings.Contains(err.Error(), "block align 2") {
+		t.Errorf("stereo with 2-byte frames: %v", err)
+	}
+
+	if _, err := ReadWavInfo(rawWav(t, formatPCM, 3, 16, false, data[:12])); err == nil {
+		t.Error("3 channels accepted")
+	}
+}